@@ -3,18 +3,24 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/tlsconfig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io"
 	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 const (
-	address = "localhost:50051"
+	defaultAddress = "localhost:50051"
 )
 
-type commandFunc func(ctx context.Context, client api.CacheClient) error
+type commandFunc func(ctx context.Context, conn grpc.ClientConnInterface) error
 
 func main() {
 	var (
@@ -22,7 +28,15 @@ func main() {
 		err error
 	)
 
-	args := os.Args[1:]
+	address := flag.String("address", defaultAddress, "Address of the server, as host:port or unix:/path/to/socket")
+	useTLS := flag.Bool("tls", false, "Connect with TLS, verifying the server with the system roots unless -tls-ca is set")
+	tlsCA := flag.String("tls-ca", "", "Path of a PEM CA bundle to verify the server's certificate with, which implies -tls")
+	tlsCert := flag.String("tls-cert", "", "Path of a PEM client certificate for servers that require one, which implies -tls")
+	tlsKey := flag.String("tls-key", "", "Path of the PEM private key for -tls-cert")
+	tlsServerName := flag.String("tls-server-name", "", "Name to verify the server's certificate against, instead of the host in -address")
+	token := flag.String("token", os.Getenv("CACHE_TOKEN"), "Bearer token to authenticate with, which defaults to the CACHE_TOKEN environment variable")
+	flag.Parse()
+	args := flag.Args()
 
 	// Read the command argument
 	command, ok := readArgument(args, 0)
@@ -36,23 +50,50 @@ func main() {
 		log.Fatalf("Failed to parse command: %v", err)
 	}
 
+	creds := grpc.WithInsecure()
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		tlsConfig, err := tlsconfig.ClientConfig(tlsconfig.Files{
+			Cert: *tlsCert,
+			Key:  *tlsKey,
+			CA:   *tlsCA,
+		}, *tlsServerName)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+
+	dialOptions := []grpc.DialOption{creds, grpc.WithBlock()}
+	if *token != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(bearerToken(*token)))
+	}
+
 	// Set up a connection to the server.
-	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithBlock())
+	conn, err := grpc.Dial(*address, dialOptions...)
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
 	defer conn.Close()
 
-	// Create client
-	client := api.NewCacheClient(conn)
-
 	// Execute command handler
-	err = commandHandler(context.Background(), client)
+	err = commandHandler(context.Background(), conn)
 	if err != nil {
 		log.Fatalf("Failed to execute command: %v", err)
 	}
 }
 
+// bearerToken sends a token in the authorization header of each request. It
+// is allowed without TLS, for servers on a trusted network or Unix socket.
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
 func readArgument(args []string, index int) (string, bool) {
 	if index >= len(args) {
 		return "", false
@@ -70,6 +111,30 @@ func parseCommandHandler(command string, args []string) (commandFunc, error) {
 		return parsePutHandler(args)
 	case "delete":
 		return parseDeleteHandler(args)
+	case "mget":
+		return parseMultiGetHandler(args)
+	case "mput":
+		return parseMultiPutHandler(args)
+	case "mdelete":
+		return parseMultiDeleteHandler(args)
+	case "stats":
+		return parseStatsHandler(args)
+	case "cas":
+		return parseCompareAndSwapHandler(args)
+	case "incr":
+		return parseIncrementHandler(args)
+	case "decr":
+		return parseDecrementHandler(args)
+	case "scan":
+		return parseScanHandler(args)
+	case "watch":
+		return parseWatchHandler(args)
+	case "snapshot":
+		return parseSnapshotHandler(args)
+	case "replication":
+		return parseReplicationHandler(args)
+	case "cluster":
+		return parseClusterHandler(args)
 	default:
 		return nil, fmt.Errorf("Invalid command: %v", command)
 	}
@@ -83,7 +148,8 @@ func parseHasHandler(args []string) (commandFunc, error) {
 
 	log.Printf("Request: Has key:\"%v\"", key)
 
-	return func(ctx context.Context, client api.CacheClient) error {
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
 		response, err := client.Has(ctx, &api.HasRequest{
 			Key: key,
 		})
@@ -103,7 +169,8 @@ func parseGetHandler(args []string) (commandFunc, error) {
 
 	log.Printf("Command: Get key:\"%v\"", key)
 
-	return func(ctx context.Context, client api.CacheClient) error {
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
 		response, err := client.Get(ctx, &api.GetRequest{
 			Key: key,
 		})
@@ -125,12 +192,23 @@ func parsePutHandler(args []string) (commandFunc, error) {
 		return nil, errors.New("No value specified")
 	}
 
-	log.Printf("Request: Put key:\"%v\" value:\"%v\"", key, value)
+	var ttl time.Duration
+	if ttlArgument, ok := readArgument(args, 3); ok {
+		var err error
+		ttl, err = time.ParseDuration(ttlArgument)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ttl: %v", err)
+		}
+	}
+
+	log.Printf("Request: Put key:\"%v\" value:\"%v\" ttl:%v", key, value, ttl)
 
-	return func(ctx context.Context, client api.CacheClient) error {
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
 		response, err := client.Put(ctx, &api.PutRequest{
 			Key:   key,
 			Value: value,
+			TtlMs: ttl.Milliseconds(),
 		})
 		if err != nil {
 			return err
@@ -148,7 +226,8 @@ func parseDeleteHandler(args []string) (commandFunc, error) {
 
 	log.Printf("Request: Delete key:\"%v\"", key)
 
-	return func(ctx context.Context, client api.CacheClient) error {
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
 		response, err := client.Delete(ctx, &api.DeleteRequest{
 			Key: key,
 		})
@@ -159,3 +238,450 @@ func parseDeleteHandler(args []string) (commandFunc, error) {
 		return nil
 	}, nil
 }
+
+func parseMultiGetHandler(args []string) (commandFunc, error) {
+	keys := args[1:]
+	if len(keys) == 0 {
+		return nil, errors.New("No keys specified")
+	}
+
+	log.Printf("Request: MultiGet keys:%q", keys)
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
+		response, err := client.MultiGet(ctx, &api.MultiGetRequest{
+			Keys: keys,
+		})
+		if err != nil {
+			return err
+		}
+		for i, value := range response.Values {
+			log.Printf("Response: %v %v", keys[i], value)
+		}
+		return nil
+	}, nil
+}
+
+func parseMultiPutHandler(args []string) (commandFunc, error) {
+	pairs := args[1:]
+	if len(pairs) == 0 {
+		return nil, errors.New("No keys specified")
+	}
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("No value specified for key: %v", pairs[len(pairs)-1])
+	}
+	entries := make(map[string]string, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		entries[pairs[i]] = pairs[i+1]
+	}
+
+	log.Printf("Request: MultiPut entries:%q", entries)
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
+		response, err := client.MultiPut(ctx, &api.MultiPutRequest{
+			Entries: entries,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Response: %v", response)
+		return nil
+	}, nil
+}
+
+func parseMultiDeleteHandler(args []string) (commandFunc, error) {
+	keys := args[1:]
+	if len(keys) == 0 {
+		return nil, errors.New("No keys specified")
+	}
+
+	log.Printf("Request: MultiDelete keys:%q", keys)
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
+		response, err := client.MultiDelete(ctx, &api.MultiDeleteRequest{
+			Keys: keys,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Response: %v", response)
+		return nil
+	}, nil
+}
+
+func parseStatsHandler(args []string) (commandFunc, error) {
+	log.Print("Request: Stats")
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
+		response, err := client.Stats(ctx, &api.StatsRequest{})
+		if err != nil {
+			return err
+		}
+		log.Printf("Response: %v", response)
+		return nil
+	}, nil
+}
+
+func parseReplicationHandler(args []string) (commandFunc, error) {
+	log.Print("Request: ReplicationStatus")
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewReplicationClient(conn)
+		response, err := client.Status(ctx, &api.ReplicationStatusRequest{})
+		if err != nil {
+			return err
+		}
+		log.Printf("Response: %v", response)
+		return nil
+	}, nil
+}
+
+func parseClusterHandler(args []string) (commandFunc, error) {
+	subcommand, ok := readArgument(args, 1)
+	if !ok {
+		return nil, errors.New("No cluster command specified")
+	}
+
+	switch subcommand {
+	case "status":
+		log.Print("Request: ClusterStatus")
+		return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+			response, err := api.NewClusterClient(conn).Status(ctx, &api.ClusterStatusRequest{})
+			if err != nil {
+				return err
+			}
+			log.Printf("Response: %v", response)
+			return nil
+		}, nil
+	case "join":
+		id, ok := readArgument(args, 2)
+		if !ok {
+			return nil, errors.New("No node ID specified")
+		}
+		raftAddress, ok := readArgument(args, 3)
+		if !ok {
+			return nil, errors.New("No Raft address specified")
+		}
+		address, ok := readArgument(args, 4)
+		if !ok {
+			return nil, errors.New("No API address specified")
+		}
+		log.Printf("Request: Join id:\"%v\" raft_address:\"%v\" address:\"%v\"", id, raftAddress, address)
+		return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+			response, err := api.NewClusterClient(conn).Join(ctx, &api.JoinRequest{
+				Id:          id,
+				RaftAddress: raftAddress,
+				Address:     address,
+			})
+			if err != nil {
+				return err
+			}
+			log.Printf("Response: %v", response)
+			return nil
+		}, nil
+	case "remove":
+		id, ok := readArgument(args, 2)
+		if !ok {
+			return nil, errors.New("No node ID specified")
+		}
+		log.Printf("Request: Remove id:\"%v\"", id)
+		return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+			response, err := api.NewClusterClient(conn).Remove(ctx, &api.RemoveRequest{
+				Id: id,
+			})
+			if err != nil {
+				return err
+			}
+			log.Printf("Response: %v", response)
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("Invalid cluster command: %v", subcommand)
+	}
+}
+
+func parseCompareAndSwapHandler(args []string) (commandFunc, error) {
+	key, ok := readArgument(args, 1)
+	if !ok {
+		return nil, errors.New("No key specified")
+	}
+	expected, ok := readArgument(args, 2)
+	if !ok {
+		return nil, errors.New("No expected value specified")
+	}
+	value, ok := readArgument(args, 3)
+	if !ok {
+		return nil, errors.New("No value specified")
+	}
+
+	log.Printf("Request: CompareAndSwap key:\"%v\" expected:\"%v\" value:\"%v\"", key, expected, value)
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
+		response, err := client.CompareAndSwap(ctx, &api.CompareAndSwapRequest{
+			Key:      key,
+			Expected: expected,
+			Value:    value,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Response: %v", response)
+		return nil
+	}, nil
+}
+
+// readDelta reads an optional delta argument, which defaults to 1
+func readDelta(args []string, index int) (int64, error) {
+	deltaArgument, ok := readArgument(args, index)
+	if !ok {
+		return 1, nil
+	}
+	delta, err := strconv.ParseInt(deltaArgument, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid delta: %v", err)
+	}
+	return delta, nil
+}
+
+func parseIncrementHandler(args []string) (commandFunc, error) {
+	key, ok := readArgument(args, 1)
+	if !ok {
+		return nil, errors.New("No key specified")
+	}
+	delta, err := readDelta(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Request: Increment key:\"%v\" delta:%v", key, delta)
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
+		response, err := client.Increment(ctx, &api.IncrementRequest{
+			Key:   key,
+			Delta: delta,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Response: %v", response)
+		return nil
+	}, nil
+}
+
+func parseDecrementHandler(args []string) (commandFunc, error) {
+	key, ok := readArgument(args, 1)
+	if !ok {
+		return nil, errors.New("No key specified")
+	}
+	delta, err := readDelta(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Request: Decrement key:\"%v\" delta:%v", key, delta)
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
+		response, err := client.Decrement(ctx, &api.DecrementRequest{
+			Key:   key,
+			Delta: delta,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Response: %v", response)
+		return nil
+	}, nil
+}
+
+func parseScanHandler(args []string) (commandFunc, error) {
+	prefix, _ := readArgument(args, 1)
+	var limit int64
+	if limitArgument, ok := readArgument(args, 2); ok {
+		var err error
+		limit, err = strconv.ParseInt(limitArgument, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid limit: %v", err)
+		}
+	}
+	cursor, _ := readArgument(args, 3)
+
+	log.Printf("Request: Scan prefix:\"%v\" limit:%v cursor:\"%v\"", prefix, limit, cursor)
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
+		stream, err := client.Scan(ctx, &api.ScanRequest{
+			Prefix: prefix,
+			Cursor: cursor,
+			Limit:  limit,
+		})
+		if err != nil {
+			return err
+		}
+		next := ""
+		for {
+			response, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			for _, key := range response.Keys {
+				log.Printf("Response: %v", key)
+			}
+			next = response.Cursor
+		}
+		// The limit was reached before the end of the scan
+		if next != "" {
+			log.Printf("Cursor: %v", next)
+		}
+		return nil
+	}, nil
+}
+
+func parseWatchHandler(args []string) (commandFunc, error) {
+	mode, ok := readArgument(args, 1)
+	if !ok {
+		return nil, errors.New("No watch mode specified")
+	}
+	if mode != "key" && mode != "prefix" {
+		return nil, fmt.Errorf("Invalid watch mode: %v", mode)
+	}
+	key, ok := readArgument(args, 2)
+	if !ok {
+		return nil, errors.New("No key specified")
+	}
+	prefix := mode == "prefix"
+
+	log.Printf("Request: Watch key:\"%v\" prefix:%v", key, prefix)
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		client := api.NewCacheClient(conn)
+		stream, err := client.Watch(ctx, &api.WatchRequest{
+			Key:    key,
+			Prefix: prefix,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := stream.Header(); err != nil {
+			return err
+		}
+		log.Print("Watching")
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			log.Printf("Event: %v", event)
+		}
+	}, nil
+}
+
+func parseSnapshotHandler(args []string) (commandFunc, error) {
+	subcommand, ok := readArgument(args, 1)
+	if !ok {
+		return nil, errors.New("No snapshot command specified")
+	}
+	path, ok := readArgument(args, 2)
+	if !ok {
+		return nil, errors.New("No file specified")
+	}
+
+	switch subcommand {
+	case "save":
+		log.Printf("Request: SaveSnapshot file:\"%v\"", path)
+		return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+			return saveSnapshot(ctx, api.NewAdminClient(conn), path)
+		}, nil
+	case "load":
+		log.Printf("Request: LoadSnapshot file:\"%v\"", path)
+		return func(ctx context.Context, conn grpc.ClientConnInterface) error {
+			return loadSnapshot(ctx, api.NewAdminClient(conn), path)
+		}, nil
+	default:
+		return nil, fmt.Errorf("Invalid snapshot command: %v", subcommand)
+	}
+}
+
+func saveSnapshot(ctx context.Context, client api.AdminClient, path string) error {
+	stream, err := client.SaveSnapshot(ctx, &api.SaveSnapshotRequest{})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file, so that a failure doesn't leave a partial snapshot
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+	defer file.Close()
+
+	size := 0
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(chunk.Data); err != nil {
+			return err
+		}
+		size += len(chunk.Data)
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	log.Printf("Response: Saved %v bytes", size)
+	return nil
+}
+
+func loadSnapshot(ctx context.Context, client api.AdminClient, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stream, err := client.LoadSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buffer)
+		if n > 0 {
+			if err := stream.Send(&api.SnapshotChunk{Data: buffer[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	log.Printf("Response: %v", response)
+	return nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/cluster"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// envPrefix is prepended to the upper-cased flag name, with dashes replaced by
+// underscores, to get the environment variable for a setting
+const envPrefix = "CACHE_"
+
+// stringsFlag is a flag that can be repeated
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Config is the server configuration. Every setting has a flag, an environment
+// variable such as CACHE_MAX_BYTES for -max-bytes, and a key in the config
+// file named after the flag. Flags take precedence over environment variables,
+// which take precedence over the config file.
+type Config struct {
+	ConfigFile            string
+	Listen                string
+	RESPListen            string
+	MemcachedListen       string
+	HTTPListen            string
+	Store                 string
+	Lock                  string
+	Shards                int
+	MaxBytes              int64
+	MaxEntries            int
+	AOF                   string
+	AOFFsync              string
+	AOFCompactionInterval time.Duration
+	Snapshot              string
+	ShutdownSnapshot      string
+	ShutdownTimeout       time.Duration
+	WatchBuffer           int
+	MaxKeyLength          int
+	MaxValueSize          int
+	KeyCharset            string
+	TLSCert               string
+	TLSKey                string
+	TLSClientCA           string
+	TokenFile             string
+	ReplicateFrom         string
+	ReplicationToken      string
+	ReplicationTLS        bool
+	ReplicationTLSCA      string
+	ReplicationLogSize    int
+	ClusterID             string
+	ClusterListen         string
+	ClusterAdvertise      string
+	ClusterAPIAddress     string
+	ClusterDir            string
+	ClusterBootstrap      stringsFlag
+	ClusterTLSCA          string
+	LogRequests           bool
+	LogRedact             stringsFlag
+	MetricsListen         string
+	Reflection            bool
+
+	flags       *flag.FlagSet
+	keyPattern  *regexp.Regexp   // Compiled from KeyCharset, or nil
+	redactions  []*regexp.Regexp // Compiled from LogRedact
+	fsyncPolicy store.FsyncPolicy
+	bootstrap   []cluster.Server // Parsed from ClusterBootstrap
+}
+
+func newFlagSet(c *Config) *flag.FlagSet {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: server [flags]\n\n"+
+			"Every flag can also be set with a %v environment variable, such as %v for -max-bytes,\n"+
+			"or in the -config file. Flags take precedence over the environment, which takes\n"+
+			"precedence over the config file.\n\n", envPrefix, envName("max-bytes"))
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&c.ConfigFile, "config", "", "Path of a YAML (.yaml or .yml) or TOML (.toml) config file")
+	flags.StringVar(&c.Listen, "listen", ":50051", "Address to serve gRPC on, as host:port or unix:/path/to/socket")
+	flags.StringVar(&c.RESPListen, "resp-listen", "", "Address to serve the Redis protocol on, as host:port or unix:/path/to/socket, or empty to not serve it")
+	flags.StringVar(&c.HTTPListen, "http-listen", "", "Address to serve the HTTP/JSON API on, as host:port or unix:/path/to/socket, or empty to not serve it")
+	flags.StringVar(&c.MemcachedListen, "memcached-listen", "", "Address to serve the memcached text protocol on, as host:port or unix:/path/to/socket, or empty to not serve it")
+	flags.StringVar(&c.Store, "store", "map", "Store implementation: map, sharded, syncmap or cow")
+	flags.StringVar(&c.Lock, "lock", "auto", "Lock decorator protecting the store: none, mutex, rwmutex, or auto for rwmutex when the store isn't already safe")
+	flags.IntVar(&c.Shards, "shards", 16, "Number of shards used by the sharded store")
+	flags.Int64Var(&c.MaxBytes, "max-bytes", 0, "Approximate limit on the size of all keys and values, or 0 for no limit")
+	flags.IntVar(&c.MaxEntries, "max-entries", 0, "Limit on the number of entries, evicting the least recently used, or 0 for no limit")
+	flags.StringVar(&c.AOF, "aof", "", "Path of an append-only file to persist writes to, or empty for no persistence")
+	flags.StringVar(&c.AOFFsync, "aof-fsync", "everysec", "How often to flush the append-only file: always, everysec or never")
+	flags.DurationVar(&c.AOFCompactionInterval, "aof-compaction-interval", time.Hour, "How often to compact the append-only file, or 0 to never compact")
+	flags.StringVar(&c.Snapshot, "snapshot", "", "Path of a snapshot file to load at startup")
+	flags.StringVar(&c.ShutdownSnapshot, "shutdown-snapshot", "", "Path to save a snapshot to when shutting down, or empty to not save one")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "How long to wait for requests in progress to finish when shutting down")
+	flags.IntVar(&c.WatchBuffer, "watch-buffer", 1024, "Number of events buffered for each watcher before it is dropped, or 0 to disable watching")
+	flags.IntVar(&c.MaxKeyLength, "max-key-length", 1024, "Maximum length of a key in bytes, or 0 for no limit")
+	flags.IntVar(&c.MaxValueSize, "max-value-size", 1024*1024, "Maximum size of a value in bytes, or 0 for no limit")
+	flags.StringVar(&c.KeyCharset, "key-charset", "", "Characters allowed in keys, as a regular expression character class such as a-zA-Z0-9:_-, or empty to allow any")
+	flags.StringVar(&c.TLSCert, "tls-cert", "", "Path of a PEM certificate to serve TLS with, or empty to serve plaintext. It is reloaded when it changes.")
+	flags.StringVar(&c.TLSKey, "tls-key", "", "Path of the PEM private key for -tls-cert")
+	flags.StringVar(&c.TLSClientCA, "tls-client-ca", "", "Path of a PEM CA bundle that client certificates must be signed by, or empty to not require client certificates")
+	flags.StringVar(&c.TokenFile, "token-file", "", "Path of a YAML file of bearer tokens and the operations they allow on each key prefix, or empty to not require tokens")
+	flags.StringVar(&c.ReplicateFrom, "replicate-from", "", "Address of a primary to replicate, as host:port or unix:/path/to/socket, making this server a read-only replica")
+	flags.StringVar(&c.ReplicationToken, "replication-token", "", "Bearer token to authenticate with the primary, which needs access to every key")
+	flags.BoolVar(&c.ReplicationTLS, "replication-tls", false, "Connect to the primary with TLS, verifying it with the system roots unless -replication-tls-ca is set, and presenting -tls-cert if it is set")
+	flags.StringVar(&c.ReplicationTLSCA, "replication-tls-ca", "", "Path of a PEM CA bundle to verify the primary's certificate with, which implies -replication-tls")
+	flags.IntVar(&c.ReplicationLogSize, "replication-log-size", 0, "Number of recent changes kept for replicas to catch up from without a full sync, such as 10000, or 0 to not serve replicas. Every write is recorded under a single lock while it is set.")
+	flags.StringVar(&c.ClusterID, "cluster-id", "", "ID of this node in a Raft cluster, which commits writes to a majority of nodes before applying them, or empty to not cluster")
+	flags.StringVar(&c.ClusterListen, "cluster-listen", "", "Address to serve Raft traffic between cluster nodes on, as host:port, which is required in cluster mode. Anyone who can reach it can change the store unless -cluster-tls-ca is set.")
+	flags.StringVar(&c.ClusterAdvertise, "cluster-advertise", "", "Address other nodes reach -cluster-listen at, if it differs, such as when -cluster-listen has no host")
+	flags.StringVar(&c.ClusterAPIAddress, "cluster-api-address", "", "Address clients reach -listen at, which other nodes send clients to when this node is the leader, if it differs")
+	flags.StringVar(&c.ClusterDir, "cluster-dir", "", "Directory to keep the Raft log and snapshots in, which is required in cluster mode")
+	flags.Var(&c.ClusterBootstrap, "cluster-bootstrap", "Initial member of a new cluster, as id=host:port for its -cluster-advertise address, which can be repeated, or comma separated in the environment. It is ignored once the node has joined a cluster.")
+	flags.StringVar(&c.ClusterTLSCA, "cluster-tls-ca", "", "Path of a PEM CA bundle that other nodes' certificates must be signed by, which serves and connects to Raft traffic with mutual TLS, using -tls-cert as this node's certificate")
+	flags.BoolVar(&c.LogRequests, "log-requests", true, "Log a JSON line for each request")
+	flags.Var(&c.LogRedact, "log-redact", "Regular expression for keys to redact from request logs, which can be repeated, or comma separated in the environment")
+	flags.StringVar(&c.MetricsListen, "metrics-listen", "", "Address to serve Prometheus metrics on at /metrics, as host:port or unix:/path/to/socket, or empty to disable metrics. They are served without TLS or tokens.")
+	flags.BoolVar(&c.Reflection, "reflection", false, "Enable gRPC server reflection, for tools such as grpcurl")
+	return flags
+}
+
+// envName returns the environment variable for a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// legacyStores maps the store types that used to be given as the only
+// argument to the store and lock they mean now
+var legacyStores = map[string][2]string{
+	"default": {"map", "none"},
+	"mutex":   {"map", "mutex"},
+	"rwmutex": {"map", "rwmutex"},
+	"sharded": {"sharded", "none"},
+	"syncmap": {"syncmap", "none"},
+	"cow":     {"cow", "none"},
+}
+
+// loadConfig reads the configuration from the command line arguments, the
+// environment and the config file, and validates it
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := &Config{}
+	c.flags = newFlagSet(c)
+	if err := c.flags.Parse(args); err != nil {
+		return nil, err
+	}
+	explicit := make(map[string]bool)
+	c.flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	// The store type used to be the only argument
+	if c.flags.NArg() > 1 {
+		return nil, fmt.Errorf("unexpected arguments: %v", c.flags.Args()[1:])
+	}
+	if c.flags.NArg() == 1 {
+		legacy, ok := legacyStores[c.flags.Arg(0)]
+		if !ok {
+			return nil, fmt.Errorf("unknown store type: %v", c.flags.Arg(0))
+		}
+		if explicit["store"] || explicit["lock"] {
+			return nil, errors.New("the store type argument can't be combined with -store or -lock")
+		}
+		c.Store, c.Lock = legacy[0], legacy[1]
+		explicit["store"], explicit["lock"] = true, true
+	}
+
+	if !explicit["config"] {
+		if path, ok := lookupEnv(envName("config")); ok {
+			c.ConfigFile = path
+		}
+	}
+
+	// Each source replaces the values from the one before, so that repeated
+	// flags aren't merged across sources
+	settings := make(map[string][]string)
+	if c.ConfigFile != "" {
+		fileSettings, err := readConfigFile(c.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range fileSettings {
+			if name == "config" || c.flags.Lookup(name) == nil {
+				return nil, fmt.Errorf("%v: unknown setting %q", c.ConfigFile, name)
+			}
+			settings[name] = values
+		}
+	}
+	c.flags.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" {
+			return
+		}
+		if _, repeatable := f.Value.(*stringsFlag); repeatable {
+			settings[f.Name] = strings.Split(value, ",")
+		} else {
+			settings[f.Name] = []string{value}
+		}
+	})
+	for name, values := range settings {
+		if explicit[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := c.flags.Set(name, value); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %v: %v", value, name, err)
+			}
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readConfigFile reads the settings in a YAML or TOML file, depending on its
+// extension. Each setting is a value or a list of values.
+func readConfigFile(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	case ".toml":
+		err = toml.Unmarshal(data, &document)
+	default:
+		return nil, fmt.Errorf("%v: config file must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	settings := make(map[string][]string, len(document))
+	for name, value := range document {
+		switch value := value.(type) {
+		case []interface{}:
+			values := make([]string, 0, len(value))
+			for _, item := range value {
+				if !isScalar(item) {
+					return nil, fmt.Errorf("%v: %v must be a value or a list of values", path, name)
+				}
+				values = append(values, fmt.Sprint(item))
+			}
+			settings[name] = values
+		default:
+			if !isScalar(value) {
+				return nil, fmt.Errorf("%v: %v must be a value or a list of values", path, name)
+			}
+			settings[name] = []string{fmt.Sprint(value)}
+		}
+	}
+	return settings, nil
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, bool, int, int64, uint64, float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// validate checks every setting, and reports all of the problems at once
+func (c *Config) validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Listen == "" {
+		problem("listen must not be empty")
+	} else if network, address := listenAddress(c.Listen); network == "unix" && address == "" {
+		problem("listen must include a socket path")
+	}
+	if c.RESPListen != "" {
+		if network, address := listenAddress(c.RESPListen); network == "unix" && address == "" {
+			problem("resp-listen must include a socket path")
+		}
+	}
+	if c.HTTPListen != "" {
+		if network, address := listenAddress(c.HTTPListen); network == "unix" && address == "" {
+			problem("http-listen must include a socket path")
+		}
+	}
+	if c.MemcachedListen != "" {
+		if network, address := listenAddress(c.MemcachedListen); network == "unix" && address == "" {
+			problem("memcached-listen must include a socket path")
+		}
+	}
+	switch c.Store {
+	case "map", "sharded", "syncmap", "cow":
+	default:
+		problem("store must be map, sharded, syncmap or cow, not %q", c.Store)
+	}
+	switch c.Lock {
+	case "none", "mutex", "rwmutex":
+	case "auto":
+		if c.Store == "map" {
+			c.Lock = "rwmutex"
+		} else {
+			c.Lock = "none"
+		}
+	default:
+		problem("lock must be auto, none, mutex or rwmutex, not %q", c.Lock)
+	}
+	if c.Shards < 1 {
+		problem("shards must be at least 1")
+	}
+	if c.MaxBytes < 0 {
+		problem("max-bytes must not be negative")
+	}
+	if c.MaxEntries < 0 {
+		problem("max-entries must not be negative")
+	}
+	fsyncPolicy, err := store.ParseFsyncPolicy(c.AOFFsync)
+	if err != nil {
+		problem("aof-fsync: %v", err)
+	}
+	c.fsyncPolicy = fsyncPolicy
+	if c.AOFCompactionInterval < 0 {
+		problem("aof-compaction-interval must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		problem("shutdown-timeout must not be negative")
+	}
+	if c.WatchBuffer < 0 {
+		problem("watch-buffer must not be negative")
+	}
+	if c.KeyCharset != "" {
+		keyPattern, err := regexp.Compile("^[" + c.KeyCharset + "]*$")
+		if err != nil {
+			problem("key-charset: %v", err)
+		}
+		c.keyPattern = keyPattern
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		problem("tls-cert and tls-key must be set together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		problem("tls-client-ca requires tls-cert and tls-key")
+	}
+	if c.ReplicateFrom != "" {
+		if network, address := listenAddress(c.ReplicateFrom); network == "unix" && address == "" {
+			problem("replicate-from must include a socket path")
+		}
+		if c.Snapshot != "" {
+			problem("snapshot can't be loaded by a replica, which gets its data from the primary")
+		}
+	} else if c.ReplicationToken != "" || c.ReplicationTLS || c.ReplicationTLSCA != "" {
+		problem("replication-token, replication-tls and replication-tls-ca require replicate-from")
+	}
+	if c.ReplicationLogSize < 0 {
+		problem("replication-log-size must not be negative")
+	}
+	c.validateCluster(problem)
+	c.redactions = nil
+	for _, pattern := range c.LogRedact {
+		redaction, err := regexp.Compile(pattern)
+		if err != nil {
+			problem("log-redact: %v", err)
+			continue
+		}
+		c.redactions = append(c.redactions, redaction)
+	}
+	if c.MetricsListen != "" {
+		if network, address := listenAddress(c.MetricsListen); network == "unix" && address == "" {
+			problem("metrics-listen must include a socket path")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateCluster checks the cluster settings, filling in the advertised
+// addresses from the listen addresses if they aren't set
+func (c *Config) validateCluster(problem func(format string, args ...interface{})) {
+	c.bootstrap = nil
+	if c.ClusterID == "" {
+		if c.ClusterListen != "" || c.ClusterAdvertise != "" || c.ClusterAPIAddress != "" || c.ClusterDir != "" || len(c.ClusterBootstrap) > 0 || c.ClusterTLSCA != "" {
+			problem("cluster-listen, cluster-advertise, cluster-api-address, cluster-dir, cluster-bootstrap and cluster-tls-ca require cluster-id")
+		}
+		return
+	}
+
+	// Other writers, and evictions, would change the store outside the Raft
+	// log
+	var conflicts []string
+	for _, setting := range []struct {
+		name string
+		set  bool
+	}{
+		{"resp-listen", c.RESPListen != ""},
+		{"memcached-listen", c.MemcachedListen != ""},
+		{"aof", c.AOF != ""},
+		{"snapshot", c.Snapshot != ""},
+		{"replicate-from", c.ReplicateFrom != ""},
+		{"max-bytes", c.MaxBytes > 0},
+		{"max-entries", c.MaxEntries > 0},
+	} {
+		if setting.set {
+			conflicts = append(conflicts, setting.name)
+		}
+	}
+	if len(conflicts) == 1 {
+		problem("cluster-id can't be combined with %v, which would write to the store outside the Raft log", conflicts[0])
+	} else if len(conflicts) > 1 {
+		last := len(conflicts) - 1
+		problem("cluster-id can't be combined with %v or %v, which would write to the store outside the Raft log", strings.Join(conflicts[:last], ", "), conflicts[last])
+	}
+	if c.ClusterDir == "" {
+		problem("cluster-dir is required in cluster mode")
+	}
+	// Raft traffic can change the store, so it is only served on every
+	// interface when asked to
+	if host, _, err := net.SplitHostPort(c.ClusterListen); err != nil || host == "" {
+		problem("cluster-listen must be host:port in cluster mode")
+	}
+	if c.ClusterTLSCA != "" && c.TLSCert == "" {
+		problem("cluster-tls-ca requires tls-cert")
+	}
+	if c.ClusterAdvertise == "" {
+		if hasHost(c.ClusterListen) {
+			c.ClusterAdvertise = c.ClusterListen
+		} else {
+			problem("cluster-advertise is required when cluster-listen has no host")
+		}
+	}
+	if c.ClusterAPIAddress == "" {
+		if network, _ := listenAddress(c.Listen); network == "tcp" && hasHost(c.Listen) {
+			c.ClusterAPIAddress = c.Listen
+		} else {
+			problem("cluster-api-address is required when listen has no host")
+		}
+	}
+	for _, member := range c.ClusterBootstrap {
+		parts := strings.SplitN(member, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || !hasHost(parts[1]) {
+			problem("cluster-bootstrap must be id=host:port, not %q", member)
+			continue
+		}
+		c.bootstrap = append(c.bootstrap, cluster.Server{ID: parts[0], RaftAddress: parts[1]})
+	}
+}
+
+// hasHost returns whether a host:port address names a host that other
+// machines could reach it at
+func hasHost(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsUnspecified()
+}
+
+// listenAddress splits the listen setting into a network and an address for
+// net.Listen. Unix sockets are given as unix:/path or unix:///path.
+func listenAddress(listen string) (string, string) {
+	if strings.HasPrefix(listen, "unix:") {
+		return "unix", strings.TrimPrefix(strings.TrimPrefix(listen, "unix://"), "unix:")
+	}
+	return "tcp", listen
+}
+
+// secretFlags are the settings that String leaves out the values of
+var secretFlags = map[string]bool{
+	"replication-token": true,
+}
+
+// String describes the effective configuration, one setting per flag
+func (c *Config) String() string {
+	var settings []string
+	c.flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "redacted"
+		}
+		settings = append(settings, fmt.Sprintf("%v=%q", f.Name, value))
+	})
+	return strings.Join(settings, " ")
+}
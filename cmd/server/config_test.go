@@ -0,0 +1,253 @@
+package main
+
+import (
+	"github.com/Matt-Kelly-/go-memory-cache/internal/cluster"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// env returns a lookup function for a fixed environment
+func env(variables map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := variables[name]
+		return value, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config, err := loadConfig(nil, env(nil))
+	require.Nil(t, err)
+	require.Equal(t, ":50051", config.Listen)
+	require.Equal(t, "map", config.Store)
+	require.Equal(t, "rwmutex", config.Lock)
+	require.Equal(t, 16, config.Shards)
+	require.Equal(t, time.Hour, config.AOFCompactionInterval)
+	require.True(t, config.LogRequests)
+	require.Equal(t, "", config.MetricsListen)
+	require.Equal(t, 0, config.ReplicationLogSize)
+
+	// The LRU decorator has its own lock, so it doesn't need another around a
+	// store that is already safe
+	config, err = loadConfig([]string{"-store", "sharded", "-max-entries", "10"}, env(nil))
+	require.Nil(t, err)
+	require.Equal(t, "none", config.Lock)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "cache.yaml", `
+listen: unix:/tmp/cache.sock
+store: sharded
+shards: 4
+max-bytes: 1000
+aof-compaction-interval: 5m
+log-requests: false
+log-redact:
+  - ^secret
+  - ^token
+`)
+
+	// The config file alone
+	config, err := loadConfig([]string{"-config", path}, env(nil))
+	require.Nil(t, err)
+	require.Equal(t, "unix:/tmp/cache.sock", config.Listen)
+	require.Equal(t, "sharded", config.Store)
+	require.Equal(t, "none", config.Lock)
+	require.Equal(t, 4, config.Shards)
+	require.Equal(t, int64(1000), config.MaxBytes)
+	require.Equal(t, 5*time.Minute, config.AOFCompactionInterval)
+	require.False(t, config.LogRequests)
+	require.Equal(t, stringsFlag{"^secret", "^token"}, config.LogRedact)
+	require.Len(t, config.redactions, 2)
+
+	// The environment overrides the file, including the config file itself
+	config, err = loadConfig(nil, env(map[string]string{
+		"CACHE_CONFIG":     path,
+		"CACHE_SHARDS":     "8",
+		"CACHE_LOG_REDACT": "^password,^key",
+	}))
+	require.Nil(t, err)
+	require.Equal(t, "sharded", config.Store)
+	require.Equal(t, 8, config.Shards)
+	require.Equal(t, stringsFlag{"^password", "^key"}, config.LogRedact)
+
+	// Flags override both
+	config, err = loadConfig([]string{"-config", path, "-shards", "32", "-log-redact", "^x"}, env(map[string]string{
+		"CACHE_SHARDS":     "8",
+		"CACHE_LOG_REDACT": "^password",
+	}))
+	require.Nil(t, err)
+	require.Equal(t, 32, config.Shards)
+	require.Equal(t, stringsFlag{"^x"}, config.LogRedact)
+	require.Equal(t, int64(1000), config.MaxBytes)
+}
+
+func TestConfigTOML(t *testing.T) {
+	path := writeConfigFile(t, "cache.toml", `
+listen = "127.0.0.1:6000"
+lock = "mutex"
+max-entries = 100
+reflection = true
+log-redact = ["^secret"]
+`)
+	config, err := loadConfig([]string{"-config", path}, env(nil))
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1:6000", config.Listen)
+	require.Equal(t, "mutex", config.Lock)
+	require.Equal(t, 100, config.MaxEntries)
+	require.True(t, config.Reflection)
+	require.Equal(t, stringsFlag{"^secret"}, config.LogRedact)
+}
+
+func TestConfigReplica(t *testing.T) {
+	config, err := loadConfig([]string{"-replicate-from", "primary:50051"}, env(map[string]string{
+		"CACHE_REPLICATION_TOKEN": "secret",
+	}))
+	require.Nil(t, err)
+	require.Equal(t, "primary:50051", config.ReplicateFrom)
+	require.Equal(t, "secret", config.ReplicationToken)
+
+	// The token isn't logged
+	require.Contains(t, config.String(), `replication-token="redacted"`)
+	require.NotContains(t, config.String(), "secret")
+
+	_, err = loadConfig([]string{"-replicate-from", "primary:50051", "-snapshot", "cache.snapshot"}, env(nil))
+	require.EqualError(t, err, "invalid configuration: snapshot can't be loaded by a replica, which gets its data from the primary")
+}
+
+func TestConfigCluster(t *testing.T) {
+	config, err := loadConfig([]string{
+		"-listen", "10.0.0.1:50051",
+		"-cluster-id", "a",
+		"-cluster-listen", "10.0.0.1:50052",
+		"-cluster-dir", "/var/lib/cache",
+	}, env(map[string]string{
+		"CACHE_CLUSTER_BOOTSTRAP": "a=10.0.0.1:50052,b=10.0.0.2:50052",
+	}))
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.1:50052", config.ClusterAdvertise)
+	require.Equal(t, "10.0.0.1:50051", config.ClusterAPIAddress)
+	require.Equal(t, []cluster.Server{
+		{ID: "a", RaftAddress: "10.0.0.1:50052"},
+		{ID: "b", RaftAddress: "10.0.0.2:50052"},
+	}, config.bootstrap)
+
+	// Raft is only served on every interface when asked to, and addresses
+	// without hosts can't be advertised
+	_, err = loadConfig([]string{"-cluster-id", "a", "-cluster-dir", "/var/lib/cache", "-cluster-tls-ca", "ca.pem"}, env(nil))
+	require.EqualError(t, err, "invalid configuration: "+
+		"cluster-listen must be host:port in cluster mode; "+
+		"cluster-tls-ca requires tls-cert; "+
+		"cluster-advertise is required when cluster-listen has no host; "+
+		"cluster-api-address is required when listen has no host")
+	config, err = loadConfig([]string{
+		"-cluster-id", "a",
+		"-cluster-listen", "0.0.0.0:50052",
+		"-cluster-dir", "/var/lib/cache",
+		"-cluster-advertise", "cache-a:50052",
+		"-cluster-api-address", "cache-a:50051",
+	}, env(nil))
+	require.Nil(t, err)
+	require.Equal(t, "cache-a:50052", config.ClusterAdvertise)
+
+	_, err = loadConfig([]string{
+		"-cluster-id", "a",
+		"-cluster-listen", "10.0.0.1:50052",
+		"-cluster-advertise", "cache-a:50052",
+		"-cluster-api-address", "cache-a:50051",
+		"-cluster-bootstrap", "cache-a:50052",
+		"-cluster-bootstrap", "b=cache-b:50052,c=cache-c:50052",
+		"-aof", "cache.aof",
+		"-resp-listen", ":6379",
+		"-max-entries", "100",
+	}, env(nil))
+	require.EqualError(t, err, "invalid configuration: "+
+		"cluster-id can't be combined with resp-listen, aof or max-entries, which would write to the store outside the Raft log; "+
+		"cluster-dir is required in cluster mode; "+
+		`cluster-bootstrap must be id=host:port, not "cache-a:50052"; `+
+		`cluster-bootstrap must be id=host:port, not "b=cache-b:50052,c=cache-c:50052"`)
+}
+
+func TestConfigLegacyStoreArgument(t *testing.T) {
+	config, err := loadConfig([]string{"-shards", "2", "sharded"}, env(map[string]string{
+		"CACHE_LOCK": "mutex",
+	}))
+	require.Nil(t, err)
+	require.Equal(t, "sharded", config.Store)
+	require.Equal(t, "none", config.Lock)
+	require.Equal(t, 2, config.Shards)
+
+	_, err = loadConfig([]string{"-lock", "mutex", "sharded"}, env(nil))
+	require.NotNil(t, err)
+
+	_, err = loadConfig([]string{"btree"}, env(nil))
+	require.EqualError(t, err, "unknown store type: btree")
+}
+
+func TestConfigErrors(t *testing.T) {
+	_, err := loadConfig([]string{"-config", writeConfigFile(t, "cache.yaml", "shard: 4\n")}, env(nil))
+	require.Contains(t, err.Error(), `unknown setting "shard"`)
+
+	_, err = loadConfig([]string{"-config", writeConfigFile(t, "cache.yaml", "tls:\n  cert: a.pem\n")}, env(nil))
+	require.Contains(t, err.Error(), "tls must be a value or a list of values")
+
+	_, err = loadConfig([]string{"-config", writeConfigFile(t, "cache.json", "{}")}, env(nil))
+	require.Contains(t, err.Error(), "config file must be .yaml, .yml or .toml")
+
+	_, err = loadConfig(nil, env(map[string]string{"CACHE_SHARDS": "many"}))
+	require.Contains(t, err.Error(), `invalid value "many" for shards`)
+
+	// Every problem is reported
+	_, err = loadConfig([]string{
+		"-listen", "unix:",
+		"-store", "btree",
+		"-lock", "spin",
+		"-shards", "0",
+		"-max-entries", "-1",
+		"-aof-fsync", "sometimes",
+		"-key-charset", "z-a",
+		"-log-redact", "(",
+		"-tls-cert", "cert.pem",
+		"-tls-client-ca", "ca.pem",
+		"-replication-token", "secret",
+		"-replication-log-size", "-1",
+		"-cluster-dir", "/var/lib/cache",
+		"-cluster-tls-ca", "ca.pem",
+		"-metrics-listen", "unix:",
+	}, env(nil))
+	require.EqualError(t, err, "invalid configuration: "+
+		"listen must include a socket path; "+
+		`store must be map, sharded, syncmap or cow, not "btree"; `+
+		`lock must be auto, none, mutex or rwmutex, not "spin"; `+
+		"shards must be at least 1; "+
+		"max-entries must not be negative; "+
+		"aof-fsync: invalid fsync policy: sometimes; "+
+		"key-charset: error parsing regexp: invalid character class range: `z-a`; "+
+		"tls-cert and tls-key must be set together; "+
+		"replication-token, replication-tls and replication-tls-ca require replicate-from; "+
+		"replication-log-size must not be negative; "+
+		"cluster-listen, cluster-advertise, cluster-api-address, cluster-dir, cluster-bootstrap and cluster-tls-ca require cluster-id; "+
+		"log-redact: error parsing regexp: missing closing ): `(`; "+
+		"metrics-listen must include a socket path")
+}
+
+func TestListenAddress(t *testing.T) {
+	for listen, expected := range map[string][2]string{
+		":50051":              {"tcp", ":50051"},
+		"localhost:50051":     {"tcp", "localhost:50051"},
+		"unix:/tmp/cache":     {"unix", "/tmp/cache"},
+		"unix:///tmp/cache":   {"unix", "/tmp/cache"},
+		"unix:relative/cache": {"unix", "relative/cache"},
+	} {
+		network, address := listenAddress(listen)
+		require.Equal(t, expected, [2]string{network, address}, listen)
+	}
+}
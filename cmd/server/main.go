@@ -1,29 +1,74 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/cluster"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/metrics"
 	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
 	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/tlsconfig"
+	"github.com/hashicorp/raft"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-const (
-	port = ":50051"
-)
+const sweepInterval = time.Second
 
 func main() {
-	args := os.Args[1:]
-	storeType := ""
-	if len(args) > 0 {
-		storeType = args[0]
+	config, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Configuration: %v", config)
+
+	// Signals that arrive while the store loads shut the server down once it
+	// has started, rather than killing it part way through
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// A cluster node's store checks expiry at the times the leader stamps
+	// writes with
+	var (
+		clock        = store.SystemClock()
+		clusterClock *cluster.Clock
+	)
+	if config.ClusterID != "" {
+		clusterClock = cluster.NewClock(clock)
+		clock = clusterClock
 	}
 
-	cacheStore := store.NewStore()
+	var cacheStore store.Store
+	switch config.Store {
+	case "map":
+		cacheStore = store.NewStore(store.UseClock(clock))
+	case "sharded":
+		log.Printf("Sharding store into %v partitions", config.Shards)
+		cacheStore = store.NewShardedStore(config.Shards, store.UseClock(clock))
+	case "syncmap":
+		log.Print("Backing store with sync.Map")
+		cacheStore = store.NewSyncMapStore(store.UseClock(clock))
+	case "cow":
+		log.Print("Backing store with copy-on-write map")
+		cacheStore = store.NewCopyOnWriteStore(store.UseClock(clock))
+	}
 
-	switch storeType {
+	switch config.Lock {
 	case "mutex":
 		log.Print("Protecting store with mutex")
 		cacheStore = store.WithMutex(cacheStore)
@@ -34,18 +79,399 @@ func main() {
 		log.Print("Leaving store unprotected")
 	}
 
-	logger := log.New(os.Stdout, "Server ", log.LstdFlags)
+	var persistentStore store.PersistentStore
+	if config.AOF != "" {
+		log.Printf("Replaying append-only file %v", config.AOF)
+		persistentStore, err = store.WithAppendOnlyFile(cacheStore, config.AOF, store.AppendOnlyFileOptions{
+			Fsync:              config.fsyncPolicy,
+			CompactionInterval: config.AOFCompactionInterval,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open append-only file: %v", err)
+		}
+		cacheStore = persistentStore
+	}
+
+	// Replicas don't serve replicas of their own, and cluster nodes replicate
+	// through the Raft log instead
+	var changeLog store.ChangeLogStore
+	if config.ReplicateFrom == "" && config.ClusterID == "" && config.ReplicationLogSize > 0 {
+		changeLog = store.WithChangeLog(cacheStore, config.ReplicationLogSize)
+		cacheStore = changeLog
+	}
+
+	// Evictions are deletes from the store below, so the limits are enforced
+	// above the observer, the append-only file and the change log, which
+	// would otherwise not publish or record them. The server finds the
+	// observer through the decorators above it.
+	if config.WatchBuffer > 0 {
+		cacheStore = store.WithObserver(cacheStore, config.WatchBuffer)
+	}
+	if config.MaxEntries > 0 || config.MaxBytes > 0 {
+		log.Printf("Evicting least recently used entries beyond %v entries or %v bytes", config.MaxEntries, config.MaxBytes)
+		cacheStore = store.WithLRU(cacheStore, config.MaxEntries, store.MaxBytes(config.MaxBytes))
+	}
+
+	cacheMetrics := metrics.New()
+	if config.MetricsListen != "" {
+		cacheStore = cacheMetrics.WithStore(cacheStore)
+	}
+
+	// Cluster nodes delete expired keys through the Raft log instead
+	var sweeper *store.Sweeper
+	if config.ClusterID == "" {
+		sweeper = store.StartSweeper(cacheStore, store.SystemClock(), sweepInterval)
+	}
 
-	lis, err := net.Listen("tcp", port)
+	lis, err := listen(config.Listen)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	grpcServer := grpc.NewServer()
+	serverOptions := []server.Option{
+		server.MaxKeyLength(config.MaxKeyLength),
+		server.MaxValueSize(config.MaxValueSize),
+	}
+	if config.keyPattern != nil {
+		serverOptions = append(serverOptions, server.KeyPattern(config.keyPattern))
+	}
+	if config.ReplicateFrom != "" {
+		serverOptions = append(serverOptions, server.ReadOnly(config.ReplicateFrom))
+	}
+	if persistentStore != nil {
+		serverOptions = append(serverOptions, server.Persistence(persistentStore.Err))
+	}
+
+	// Writes are refused until the snapshot has loaded, as it would overwrite
+	// them
+	healthServer := health.NewServer()
+	readiness := server.NewReadiness(healthServer)
+	serverOptions = append(serverOptions, server.RequireReadiness(readiness))
+
+	// The node applies committed writes through the whole store, so that
+	// watchers and metrics see them
+	var node *cluster.Node
+	if config.ClusterID != "" {
+		node, err = startNode(config, cacheStore, clusterClock)
+		if err != nil {
+			log.Fatalf("Failed to start cluster node: %v", err)
+		}
+		log.Printf("Clustering as %v, with Raft on %v", config.ClusterID, config.ClusterAdvertise)
+		serverOptions = append(serverOptions, server.Clustered(node))
+	}
+
+	var (
+		unaryInterceptors  []grpc.UnaryServerInterceptor
+		streamInterceptors []grpc.StreamServerInterceptor
+	)
+	if config.LogRequests {
+		requestLogger := server.NewRequestLogger(log.New(os.Stdout, "", 0), config.redactions)
+		unaryInterceptors = append(unaryInterceptors, requestLogger.UnaryInterceptor())
+		streamInterceptors = append(streamInterceptors, requestLogger.StreamInterceptor())
+	}
+	var authorizer *server.Authorizer
+	if config.TokenFile != "" {
+		authorizer, err = server.LoadTokenFile(config.TokenFile)
+		if err != nil {
+			log.Fatalf("Failed to load token file: %v", err)
+		}
+		log.Print("Requiring bearer tokens")
+		unaryInterceptors = append(unaryInterceptors, authorizer.UnaryInterceptor())
+		streamInterceptors = append(streamInterceptors, authorizer.StreamInterceptor())
+	}
+	if config.MetricsListen != "" {
+		unaryInterceptors = append(unaryInterceptors, cacheMetrics.UnaryInterceptor())
+		streamInterceptors = append(streamInterceptors, cacheMetrics.StreamInterceptor())
+
+	}
+
+	grpcOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
+	var reloader *tlsconfig.Reloader
+	if config.TLSCert != "" {
+		reloader, err = tlsconfig.NewReloader(tlsconfig.Files{
+			Cert: config.TLSCert,
+			Key:  config.TLSKey,
+			CA:   config.TLSClientCA,
+		}, log.New(os.Stderr, "", log.LstdFlags))
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		if config.TLSClientCA != "" {
+			log.Print("Serving mutual TLS")
+		} else {
+			log.Print("Serving TLS")
+		}
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(reloader.ServerConfig())))
+	}
+	grpcServer := grpc.NewServer(grpcOptions...)
+
+	// Follow the primary through the whole store, so that watchers and metrics
+	// see replicated writes
+	var (
+		primaryConn *grpc.ClientConn
+		follower    *server.Follower
+	)
+	if config.ReplicateFrom != "" {
+		primaryConn, err = dialPrimary(config)
+		if err != nil {
+			log.Fatalf("Failed to connect to primary: %v", err)
+		}
+		log.Printf("Replicating from %v", config.ReplicateFrom)
+		follower = server.StartFollower(primaryConn, config.ReplicateFrom, cacheStore, store.SystemClock(), log.New(os.Stderr, "", log.LstdFlags))
+	}
+
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	cacheServer := server.NewServer(cacheStore, serverOptions...)
+	api.RegisterCacheServer(grpcServer, cacheServer)
+	api.RegisterAdminServer(grpcServer, server.NewAdminServer(cacheStore, store.SystemClock(), readiness, serverOptions...))
+	api.RegisterReplicationServer(grpcServer, server.NewReplicationServer(changeLog, follower, store.SystemClock()))
+	if node != nil {
+		api.RegisterClusterServer(grpcServer, server.NewClusterServer(node))
+	}
+	if config.Reflection {
+		reflection.Register(grpcServer)
+	}
 
-	api.RegisterCacheServer(grpcServer, server.NewServer(cacheStore, logger))
+	// Serve while the snapshot loads, so that health checks report that the
+	// store isn't ready yet
+	serveErrors := make(chan error, 5)
+	go func() {
+		serveErrors <- grpcServer.Serve(lis)
+	}()
 
-	if err := grpcServer.Serve(lis); err != nil {
+	var respServer *server.RESPServer
+	if config.RESPListen != "" {
+		respListener, err := listen(config.RESPListen)
+		if err != nil {
+			log.Fatalf("Failed to listen for RESP: %v", err)
+		}
+		if reloader != nil {
+			respListener = tls.NewListener(respListener, reloader.StreamServerConfig())
+		}
+		respServer = server.NewRESPServer(cacheStore, authorizer, serverOptions...)
+		go func() {
+			serveErrors <- respServer.Serve(respListener)
+		}()
+	}
+
+	var memcachedServer *server.MemcachedServer
+	if config.MemcachedListen != "" {
+		memcachedListener, err := listen(config.MemcachedListen)
+		if err != nil {
+			log.Fatalf("Failed to listen for memcached: %v", err)
+		}
+		if reloader != nil {
+			memcachedListener = tls.NewListener(memcachedListener, reloader.StreamServerConfig())
+		}
+		memcachedServer = server.NewMemcachedServer(cacheStore, authorizer, serverOptions...)
+		go func() {
+			serveErrors <- memcachedServer.Serve(memcachedListener)
+		}()
+	}
+
+	var metricsServer *http.Server
+	if config.MetricsListen != "" {
+		metricsListener, err := listen(config.MetricsListen)
+		if err != nil {
+			log.Fatalf("Failed to listen for metrics: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", cacheMetrics.Handler())
+		metricsServer = &http.Server{Handler: mux}
+		go func() {
+			serveErrors <- metricsServer.Serve(metricsListener)
+		}()
+	}
+
+	var httpServer *http.Server
+	if config.HTTPListen != "" {
+		httpListener, err := listen(config.HTTPListen)
+		if err != nil {
+			log.Fatalf("Failed to listen for HTTP: %v", err)
+		}
+		if reloader != nil {
+			httpListener = tls.NewListener(httpListener, reloader.HTTPServerConfig())
+		}
+		// The gateway calls the cache server directly, so it needs the
+		// interceptors too
+		httpServer = &http.Server{Handler: server.NewGateway(cacheServer, unaryInterceptors, serverOptions...)}
+		go func() {
+			serveErrors <- httpServer.Serve(httpListener)
+		}()
+	}
+
+	if config.Snapshot != "" {
+		done := readiness.Loading()
+		log.Printf("Loading snapshot %v", config.Snapshot)
+		count, err := store.LoadSnapshotFile(cacheStore, config.Snapshot, store.SystemClock())
+		if err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+		log.Printf("Loaded %v entries", count)
+		done()
+	}
+	readiness.Ready()
+
+	select {
+	case err := <-serveErrors:
 		log.Fatalf("Failed to serve: %v", err)
+	case received := <-signals:
+		log.Printf("Received %v, shutting down", received)
+	}
+
+	// Stop accepting new connections, and give requests in progress a chance
+	// to finish. Streams such as Watch only end when they are forced to.
+	readiness.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		if httpServer != nil {
+			httpServer.Shutdown(context.Background())
+		}
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(config.ShutdownTimeout):
+		log.Printf("Requests still in progress after %v, forcing shutdown", config.ShutdownTimeout)
+		if httpServer != nil {
+			httpServer.Close()
+		}
+		grpcServer.Stop()
+		<-stopped
+	}
+
+	if respServer != nil {
+		respServer.Close()
+	}
+	if memcachedServer != nil {
+		memcachedServer.Close()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	if follower != nil {
+		follower.Stop()
+		primaryConn.Close()
+	}
+	if node != nil {
+		if err := node.Shutdown(); err != nil {
+			log.Printf("Failed to shut down cluster node: %v", err)
+		}
+	}
+
+	// Nothing can write to the store now, so flush it to disk
+	if sweeper != nil {
+		sweeper.Stop()
+	}
+	if config.ShutdownSnapshot != "" {
+		log.Printf("Saving snapshot %v", config.ShutdownSnapshot)
+		if err := store.SaveSnapshotFile(cacheStore, config.ShutdownSnapshot); err != nil {
+			log.Printf("Failed to save snapshot: %v", err)
+		}
+	}
+	if persistentStore != nil {
+		if err := persistentStore.Close(); err != nil {
+			log.Printf("Failed to close append-only file: %v", err)
+		}
+	}
+	log.Print("Stopped")
+}
+
+// startNode starts a cluster node that applies committed writes to the store,
+// serving Raft traffic over TCP. The store must use the clock.
+func startNode(config *Config, cacheStore store.Store, clock *cluster.Clock) (*cluster.Node, error) {
+	advertise, err := net.ResolveTCPAddr("tcp", config.ClusterAdvertise)
+	if err != nil {
+		return nil, err
+	}
+	// Raft's logs carry their own timestamps
+	logger := log.New(os.Stderr, "", 0)
+	var transport *raft.NetworkTransport
+	if config.ClusterTLSCA != "" {
+		reloader, err := tlsconfig.NewReloader(tlsconfig.Files{
+			Cert: config.TLSCert,
+			Key:  config.TLSKey,
+			CA:   config.ClusterTLSCA,
+		}, log.New(os.Stderr, "", log.LstdFlags))
+		if err != nil {
+			return nil, err
+		}
+		transport, err = cluster.NewTLSTransport(config.ClusterListen, advertise, 3, 10*time.Second, reloader.StreamServerConfig(), reloader.PeerConfig, logger.Writer())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Print("Serving Raft traffic without TLS, as cluster-tls-ca isn't set")
+		transport, err = raft.NewTCPTransport(config.ClusterListen, advertise, 3, 10*time.Second, logger.Writer())
+		if err != nil {
+			return nil, err
+		}
+	}
+	node, err := cluster.NewNode(cluster.Options{
+		ID:        config.ClusterID,
+		Address:   config.ClusterAPIAddress,
+		Dir:       config.ClusterDir,
+		Bootstrap: config.bootstrap,
+		Clock:     clock,
+		Logger:    logger,
+	}, cacheStore, transport)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+// dialPrimary connects to the primary a replica follows. Connecting doesn't
+// wait for the primary, as the follower retries until it is available.
+func dialPrimary(config *Config) (*grpc.ClientConn, error) {
+	creds := grpc.WithInsecure()
+	if config.ReplicationTLS || config.ReplicationTLSCA != "" {
+		tlsConfig, err := tlsconfig.ClientConfig(tlsconfig.Files{
+			Cert: config.TLSCert,
+			Key:  config.TLSKey,
+			CA:   config.ReplicationTLSCA,
+		}, "")
+		if err != nil {
+			return nil, err
+		}
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	dialOptions := []grpc.DialOption{creds}
+	if config.ReplicationToken != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(bearerToken(config.ReplicationToken)))
+	}
+	return grpc.Dial(config.ReplicateFrom, dialOptions...)
+}
+
+// bearerToken sends a token in the authorization header of each request to
+// the primary
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// listen listens on a TCP address, or on a Unix socket. A socket left behind by
+// a server that didn't shut down cleanly is removed first.
+func listen(address string) (net.Listener, error) {
+	network, address := listenAddress(address)
+	if network == "unix" {
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address); err != nil {
+				return nil, err
+			}
+		}
 	}
+	log.Printf("Listening on %v %v", network, address)
+	return net.Listen(network, address)
 }
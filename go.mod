@@ -3,8 +3,13 @@ module github.com/Matt-Kelly-/go-memory-cache
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/hashicorp/raft v1.3.1
+	github.com/prometheus/client_golang v1.10.0
 	github.com/stretchr/testify v1.7.0
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
 	google.golang.org/grpc v1.40.0
 	google.golang.org/grpc/cmd/protoc-gen-go-grpc v1.1.0 // indirect
 	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
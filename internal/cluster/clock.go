@@ -0,0 +1,51 @@
+package cluster
+
+import (
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"sync"
+	"time"
+)
+
+// Clock is the clock a node's store must use. While the node applies a
+// command, the clock is stopped at the time the leader stamped the command
+// with, so that every node checks expiry at the same time for the same
+// command, however late it applies it. Otherwise it reads the clock it wraps.
+type Clock struct {
+	clock store.Clock
+
+	mutex    sync.Mutex
+	applying bool
+	now      time.Time
+}
+
+// NewClock wraps a clock for a node and its store
+func NewClock(clock store.Clock) *Clock {
+	return &Clock{clock: clock}
+}
+
+// Now returns the time of the command being applied, if there is one
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.applying {
+		return c.now
+	}
+	return c.clock.Now()
+}
+
+func (c *Clock) NewTicker(interval time.Duration) store.Ticker {
+	return c.clock.NewTicker(interval)
+}
+
+// at runs apply with the clock stopped at now
+func (c *Clock) at(now time.Time, apply func()) {
+	c.mutex.Lock()
+	c.applying, c.now = true, now
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.applying = false
+		c.mutex.Unlock()
+	}()
+	apply()
+}
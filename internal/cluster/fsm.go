@@ -0,0 +1,406 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/hashicorp/raft"
+	"io"
+	"sync"
+	"time"
+)
+
+var errCorruptCommand = errors.New("raft command is corrupt")
+
+// commandType is the kind of write in a command
+type commandType byte
+
+// Command types. The store writes are the Store methods, expire deletes the
+// keys that have expired, and the members are the addresses that clients
+// reach each node's API at.
+const (
+	commandPut            commandType = 'P'
+	commandDelete         commandType = 'D'
+	commandMultiPut       commandType = 'M'
+	commandMultiDelete    commandType = 'X'
+	commandCompareAndSwap commandType = 'C'
+	commandIncrement      commandType = 'I'
+	commandExpire         commandType = 'E'
+	commandSetMember      commandType = 'S'
+	commandRemoveMember   commandType = 'R'
+)
+
+// command is a write committed through the Raft log. The leader stamps it
+// with the time, which every node applies it at, and expiry times are
+// absolute, so that every node expires keys at the same point in the log,
+// however long the command takes to reach it or however late it is replayed.
+type command struct {
+	kind     commandType
+	now      time.Time
+	key      string
+	value    string
+	expected string
+	entries  map[string]string
+	keys     []string
+	expiry   time.Time
+	delta    int64
+	id       string
+	address  string
+}
+
+// result is what applying a command returned
+type result struct {
+	value   string
+	swapped bool
+	number  int64
+	err     error
+}
+
+// encodeCommand encodes a command as its type and time, then the fields it
+// uses. Strings are length-prefixed, lists and maps are prefixed by their
+// length, and times are Unix nanoseconds (0 for none).
+func encodeCommand(c command) []byte {
+	buffer := []byte{byte(c.kind)}
+	buffer = appendExpiry(buffer, c.now)
+	switch c.kind {
+	case commandPut:
+		buffer = appendString(buffer, c.key)
+		buffer = appendString(buffer, c.value)
+		buffer = appendExpiry(buffer, c.expiry)
+	case commandDelete:
+		buffer = appendString(buffer, c.key)
+	case commandMultiPut:
+		buffer = appendUvarint(buffer, uint64(len(c.entries)))
+		for key, value := range c.entries {
+			buffer = appendString(buffer, key)
+			buffer = appendString(buffer, value)
+		}
+		buffer = appendExpiry(buffer, c.expiry)
+	case commandMultiDelete:
+		buffer = appendUvarint(buffer, uint64(len(c.keys)))
+		for _, key := range c.keys {
+			buffer = appendString(buffer, key)
+		}
+	case commandCompareAndSwap:
+		buffer = appendString(buffer, c.key)
+		buffer = appendString(buffer, c.expected)
+		buffer = appendString(buffer, c.value)
+	case commandIncrement:
+		buffer = appendString(buffer, c.key)
+		buffer = appendVarint(buffer, c.delta)
+	case commandSetMember:
+		buffer = appendString(buffer, c.id)
+		buffer = appendString(buffer, c.address)
+	case commandRemoveMember:
+		buffer = appendString(buffer, c.id)
+	}
+	return buffer
+}
+
+func decodeCommand(data []byte) (command, error) {
+	reader := &commandReader{reader: bytes.NewReader(data)}
+	commandTypeByte, err := reader.reader.ReadByte()
+	if err != nil {
+		return command{}, errCorruptCommand
+	}
+	c := command{kind: commandType(commandTypeByte)}
+	c.now = reader.expiry()
+	switch c.kind {
+	case commandPut:
+		c.key = reader.string()
+		c.value = reader.string()
+		c.expiry = reader.expiry()
+	case commandDelete:
+		c.key = reader.string()
+	case commandMultiPut:
+		count := reader.uvarint()
+		c.entries = make(map[string]string)
+		for i := uint64(0); i < count && reader.err == nil; i++ {
+			key := reader.string()
+			c.entries[key] = reader.string()
+		}
+		c.expiry = reader.expiry()
+	case commandMultiDelete:
+		count := reader.uvarint()
+		for i := uint64(0); i < count && reader.err == nil; i++ {
+			c.keys = append(c.keys, reader.string())
+		}
+	case commandCompareAndSwap:
+		c.key = reader.string()
+		c.expected = reader.string()
+		c.value = reader.string()
+	case commandIncrement:
+		c.key = reader.string()
+		c.delta = reader.varint()
+	case commandExpire:
+	case commandSetMember:
+		c.id = reader.string()
+		c.address = reader.string()
+	case commandRemoveMember:
+		c.id = reader.string()
+	default:
+		return command{}, errCorruptCommand
+	}
+	if reader.err != nil || reader.reader.Len() > 0 {
+		return command{}, errCorruptCommand
+	}
+	return c, nil
+}
+
+func appendString(buffer []byte, value string) []byte {
+	buffer = appendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+func appendExpiry(buffer []byte, expiry time.Time) []byte {
+	if expiry.IsZero() {
+		return appendVarint(buffer, 0)
+	}
+	return appendVarint(buffer, expiry.UnixNano())
+}
+
+// commandReader keeps the first error, so that it only has to be checked once
+type commandReader struct {
+	reader *bytes.Reader
+	err    error
+}
+
+func (r *commandReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	value, err := binary.ReadUvarint(r.reader)
+	r.err = err
+	return value
+}
+
+func (r *commandReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	value, err := binary.ReadVarint(r.reader)
+	r.err = err
+	return value
+}
+
+func (r *commandReader) string() string {
+	length := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if length > uint64(r.reader.Len()) {
+		r.err = errCorruptCommand
+		return ""
+	}
+	value := make([]byte, length)
+	r.reader.Read(value)
+	return string(value)
+}
+
+func (r *commandReader) expiry() time.Time {
+	nanos := r.varint()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// fsm applies committed commands to the store, and keeps the addresses of the
+// members of the cluster. The store must use the clock, which the fsm stops
+// at each command's time while applying it, so that every check of whether a
+// key has expired gives the same answer on every node.
+type fsm struct {
+	store store.Store
+	clock *Clock
+
+	mutex   sync.Mutex
+	members map[string]string // The API address of each node, by ID
+	now     time.Time         // The latest time a command was stamped with
+}
+
+func newFSM(cacheStore store.Store, clock *Clock) *fsm {
+	return &fsm{
+		store:   cacheStore,
+		clock:   clock,
+		members: make(map[string]string),
+	}
+}
+
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	c, err := decodeCommand(log.Data)
+	if err != nil {
+		return result{err: err}
+	}
+	// A new leader's clock can be behind the old one's, and time in the log
+	// never goes backwards
+	f.mutex.Lock()
+	if c.now.After(f.now) {
+		f.now = c.now
+	}
+	now := f.now
+	f.mutex.Unlock()
+	var r result
+	f.clock.at(now, func() {
+		r = f.apply(c, now)
+	})
+	return r
+}
+
+func (f *fsm) apply(c command, now time.Time) result {
+	switch c.kind {
+	case commandPut:
+		store.ApplyChange(f.store, store.Change{Type: store.ChangePut, Key: c.key, Value: c.value, Expiry: c.expiry}, f.clock)
+	case commandDelete:
+		f.store.Delete(c.key)
+	case commandMultiPut:
+		var ttl time.Duration
+		if !c.expiry.IsZero() {
+			ttl = c.expiry.Sub(now)
+			if ttl <= 0 {
+				keys := make([]string, 0, len(c.entries))
+				for key := range c.entries {
+					keys = append(keys, key)
+				}
+				f.store.MultiDelete(keys)
+				return result{}
+			}
+		}
+		f.store.MultiPut(c.entries, ttl)
+	case commandMultiDelete:
+		f.store.MultiDelete(c.keys)
+	case commandCompareAndSwap:
+		current, swapped := f.store.CompareAndSwap(c.key, c.expected, c.value)
+		return result{value: current, swapped: swapped}
+	case commandIncrement:
+		value, err := f.store.Increment(c.key, c.delta)
+		return result{number: value, err: err}
+	case commandExpire:
+		f.store.DeleteExpired()
+	case commandSetMember:
+		f.mutex.Lock()
+		f.members[c.id] = c.address
+		f.mutex.Unlock()
+	case commandRemoveMember:
+		f.mutex.Lock()
+		delete(f.members, c.id)
+		f.mutex.Unlock()
+	}
+	return result{}
+}
+
+// member returns the API address of a node, if it is known
+func (f *fsm) member(id string) (string, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	address, ok := f.members[id]
+	return address, ok
+}
+
+// Snapshot copies the members, the time in the log and the entries that are
+// live then. Raft doesn't apply commands until it returns, so the copies are
+// consistent.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mutex.Lock()
+	members := make(map[string]string, len(f.members))
+	for id, address := range f.members {
+		members[id] = address
+	}
+	now := f.now
+	f.mutex.Unlock()
+	snapshot := fsmSnapshot{members: members, now: now}
+	f.clock.at(now, func() {
+		snapshot.entries = f.store.Entries()
+	})
+	return snapshot, nil
+}
+
+// Restore replaces the members and entries with a snapshot's
+func (f *fsm) Restore(reader io.ReadCloser) error {
+	defer reader.Close()
+	buffered := bufio.NewReader(reader)
+	count, err := binary.ReadUvarint(buffered)
+	if err != nil {
+		return err
+	}
+	members := make(map[string]string)
+	for i := uint64(0); i < count; i++ {
+		id, err := readSnapshotString(buffered)
+		if err != nil {
+			return err
+		}
+		address, err := readSnapshotString(buffered)
+		if err != nil {
+			return err
+		}
+		members[id] = address
+	}
+	nanos, err := binary.ReadVarint(buffered)
+	if err != nil {
+		return err
+	}
+	var now time.Time
+	if nanos != 0 {
+		now = time.Unix(0, nanos)
+	}
+	entries, err := store.ReadSnapshot(buffered)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	f.members = members
+	f.now = now
+	f.mutex.Unlock()
+	f.clock.at(now, func() {
+		store.ReplaceEntries(f.store, entries, f.clock)
+		f.store.DeleteExpired()
+	})
+	return nil
+}
+
+func readSnapshotString(reader *bufio.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	if _, err := io.CopyN(&buffer, reader, int64(length)); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// fsmSnapshot is written as the number of members, each member's
+// length-prefixed ID and address, the time in the log in Unix nanoseconds,
+// and then a store snapshot of the entries
+type fsmSnapshot struct {
+	members map[string]string
+	now     time.Time
+	entries map[string]store.Entry
+}
+
+func (s fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	writer := bufio.NewWriter(sink)
+	header := appendUvarint(nil, uint64(len(s.members)))
+	for id, address := range s.members {
+		header = appendString(header, id)
+		header = appendString(header, address)
+	}
+	header = appendExpiry(header, s.now)
+	_, err := writer.Write(header)
+	if err == nil {
+		err = store.WriteSnapshot(writer, s.entries)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s fsmSnapshot) Release() {}
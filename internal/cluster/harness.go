@@ -0,0 +1,234 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/hashicorp/raft"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Harness runs a cluster in one process, for tests. Its nodes are connected by
+// in-memory transports, which can be cut to simulate network partitions. Each
+// node has its own store, and its API address is its ID with port 50051.
+type Harness struct {
+	options Options
+	mutex   sync.Mutex
+	nodes   map[string]*harnessNode
+}
+
+type harnessNode struct {
+	node      *Node // Nil while the node is stopped
+	store     store.Store
+	transport *raft.InmemTransport
+	isolated  bool
+}
+
+// NewHarness starts a cluster of nodes with the IDs, bootstrapped with all of
+// them as voters. The options apply to every node, except that each node's
+// ID, address, clock and bootstrap servers are filled in, and each node has
+// its own subdirectory of Dir if it is set.
+func NewHarness(options Options, ids ...string) (*Harness, error) {
+	h := &Harness{
+		options: options,
+		nodes:   make(map[string]*harnessNode),
+	}
+	var servers []Server
+	for _, id := range ids {
+		servers = append(servers, Server{ID: id, RaftAddress: id})
+	}
+	for _, id := range ids {
+		if _, err := h.start(id, servers); err != nil {
+			h.Shutdown()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Add starts a node that isn't a member of the cluster, and connects it to
+// the other nodes, so that the leader can add it with Join
+func (h *Harness) Add(id string) (*Node, error) {
+	return h.start(id, nil)
+}
+
+func (h *Harness) start(id string, bootstrap []Server) (*Node, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.nodes[id]; ok {
+		return nil, fmt.Errorf("node %v already exists", id)
+	}
+	options := h.nodeOptions(id)
+	options.Bootstrap = bootstrap
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+	entry := &harnessNode{
+		store:     store.WithRWMutex(store.NewStore(store.UseClock(options.Clock))),
+		transport: transport,
+	}
+	h.nodes[id] = entry
+	h.connect()
+	node, err := NewNode(options, entry.store, transport)
+	if err != nil {
+		delete(h.nodes, id)
+		return nil, err
+	}
+	entry.node = node
+	return node, nil
+}
+
+func (h *Harness) nodeOptions(id string) Options {
+	options := h.options
+	options.ID = id
+	options.Address = id + ":50051"
+	if options.Dir != "" {
+		options.Dir = filepath.Join(options.Dir, id)
+	}
+	options.Clock = NewClock(store.SystemClock())
+	return options
+}
+
+// Node returns the node with the ID, or nil if it is stopped or doesn't exist
+func (h *Harness) Node(id string) *Node {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if entry, ok := h.nodes[id]; ok {
+		return entry.node
+	}
+	return nil
+}
+
+// Store returns the store of the node with the ID
+func (h *Harness) Store(id string) store.Store {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if entry, ok := h.nodes[id]; ok {
+		return entry.store
+	}
+	return nil
+}
+
+// Leader returns the node that is the leader, of those with the IDs or of
+// every node if there are none, waiting until exactly one of them is. A node
+// cut off from the rest of the cluster can still think it is the leader for
+// a while, so the IDs should be on one side of any partition.
+func (h *Harness) Leader(timeout time.Duration, ids ...string) (*Node, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var leaders []*Node
+		h.mutex.Lock()
+		candidates := ids
+		if len(candidates) == 0 {
+			for id := range h.nodes {
+				candidates = append(candidates, id)
+			}
+		}
+		for _, id := range candidates {
+			if entry, ok := h.nodes[id]; ok && entry.node != nil && entry.node.raft.State() == raft.Leader {
+				leaders = append(leaders, entry.node)
+			}
+		}
+		h.mutex.Unlock()
+		if len(leaders) == 1 {
+			return leaders[0], nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%v nodes are the leader after %v", len(leaders), timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Partition cuts the nodes with the IDs off from the rest of the cluster.
+// They can still reach each other.
+func (h *Harness) Partition(ids ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, entry := range h.nodes {
+		entry.isolated = false
+	}
+	for _, id := range ids {
+		if entry, ok := h.nodes[id]; ok {
+			entry.isolated = true
+		}
+	}
+	h.connect()
+}
+
+// Heal reconnects every node
+func (h *Harness) Heal() {
+	h.Partition()
+}
+
+// connect connects the nodes on the same side of the partition, and
+// disconnects the rest. The mutex must be held.
+func (h *Harness) connect() {
+	for fromID, from := range h.nodes {
+		for toID, to := range h.nodes {
+			if fromID == toID {
+				continue
+			}
+			if from.isolated == to.isolated {
+				from.transport.Connect(raft.ServerAddress(toID), to.transport)
+			} else {
+				from.transport.Disconnect(raft.ServerAddress(toID))
+			}
+		}
+	}
+}
+
+// Stop shuts a node down, as if it had crashed. Its store keeps its contents.
+func (h *Harness) Stop(id string) error {
+	h.mutex.Lock()
+	entry, ok := h.nodes[id]
+	h.mutex.Unlock()
+	if !ok || entry.node == nil {
+		return fmt.Errorf("node %v isn't running", id)
+	}
+	err := entry.node.Shutdown()
+	h.mutex.Lock()
+	entry.node = nil
+	h.mutex.Unlock()
+	return err
+}
+
+// Restart starts a stopped node again, with an empty store that it restores
+// from its snapshots and log. The harness must have a Dir, as a node that
+// keeps its log in memory can't restart.
+func (h *Harness) Restart(id string) (*Node, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	entry, ok := h.nodes[id]
+	if !ok || entry.node != nil {
+		return nil, fmt.Errorf("node %v isn't stopped", id)
+	}
+	if h.options.Dir == "" {
+		return nil, fmt.Errorf("node %v has no directory to restart from", id)
+	}
+	options := h.nodeOptions(id)
+	entry.store = store.WithRWMutex(store.NewStore(store.UseClock(options.Clock)))
+	// Shutting down closed the transport
+	h.connect()
+	node, err := NewNode(options, entry.store, entry.transport)
+	if err != nil {
+		return nil, err
+	}
+	entry.node = node
+	return node, nil
+}
+
+// Shutdown stops every node
+func (h *Harness) Shutdown() {
+	h.mutex.Lock()
+	var nodes []*Node
+	for _, entry := range h.nodes {
+		if entry.node != nil {
+			nodes = append(nodes, entry.node)
+			entry.node = nil
+		}
+	}
+	h.mutex.Unlock()
+	for _, node := range nodes {
+		node.Shutdown()
+	}
+}
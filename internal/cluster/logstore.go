@@ -0,0 +1,506 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/hashicorp/raft"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCorruptLogFile = errors.New("raft log file is corrupt")
+
+	logFileHeader = []byte("GMCRLOG\x01") // Magic number and version
+)
+
+// Log file record types
+const (
+	logRecordEntry  byte = 'L' // A Raft log entry
+	logRecordDelete byte = 'D' // Deletes a range of entries
+	logRecordStable byte = 'S' // Sets a stable key
+)
+
+// logFileCompactionRatio is how many records the file can have for each one
+// that is still needed before it is rewritten
+const logFileCompactionRatio = 2
+
+// fileStore is a Raft log and stable store that keeps everything in memory,
+// and records every change in an append-only file that is replayed on
+// startup. Each change is synced before it returns, as Raft requires. The file
+// is rewritten when most of its records have been deleted, which happens as
+// snapshots compact the log.
+type fileStore struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	logs    map[uint64]*raft.Log
+	first   uint64
+	last    uint64
+	stable  map[string][]byte
+	records int // The number of records in the file
+}
+
+// openFileStore opens the file, creating it if it doesn't exist
+func openFileStore(path string) (*fileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileStore{
+		path:   path,
+		file:   file,
+		logs:   make(map[uint64]*raft.Log),
+		stable: make(map[string][]byte),
+	}
+	size, err := s.replay()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if size == 0 {
+		if _, err := file.Write(logFileHeader); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) FirstIndex() (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.first, nil
+}
+
+func (s *fileStore) LastIndex() (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last, nil
+}
+
+func (s *fileStore) GetLog(index uint64, log *raft.Log) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, ok := s.logs[index]
+	if !ok {
+		return raft.ErrLogNotFound
+	}
+	*log = *stored
+	return nil
+}
+
+func (s *fileStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *fileStore) StoreLogs(logs []*raft.Log) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var records []byte
+	for _, log := range logs {
+		records = append(records, encodeLogEntry(log)...)
+	}
+	if err := s.write(records, len(logs)); err != nil {
+		return err
+	}
+	for _, log := range logs {
+		s.storeLog(log)
+	}
+	return nil
+}
+
+func (s *fileStore) DeleteRange(min, max uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.write(encodeLogDelete(min, max), 1); err != nil {
+		return err
+	}
+	s.deleteRange(min, max)
+	if s.records > logFileCompactionRatio*(len(s.logs)+len(s.stable)) {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *fileStore) Set(key []byte, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.write(encodeLogStable(key, value), 1); err != nil {
+		return err
+	}
+	s.stable[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *fileStore) Get(key []byte) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.stable[string(key)]
+	if !ok {
+		// Raft checks the message of this error
+		return nil, errors.New("not found")
+	}
+	return value, nil
+}
+
+func (s *fileStore) SetUint64(key []byte, value uint64) error {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], value)
+	return s.Set(key, encoded[:])
+}
+
+func (s *fileStore) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, ErrCorruptLogFile
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func (s *fileStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// storeLog adds an entry to the log in memory. The mutex must be held, or
+// the store not yet shared.
+func (s *fileStore) storeLog(log *raft.Log) {
+	s.logs[log.Index] = log
+	if s.first == 0 || log.Index < s.first {
+		s.first = log.Index
+	}
+	if log.Index > s.last {
+		s.last = log.Index
+	}
+}
+
+// deleteRange removes entries from the log in memory. Raft only deletes from
+// either end. The mutex must be held, or the store not yet shared.
+func (s *fileStore) deleteRange(min, max uint64) {
+	for index := min; index <= max && index != 0; index++ {
+		delete(s.logs, index)
+	}
+	if min <= s.first {
+		s.first = max + 1
+	}
+	if max >= s.last {
+		s.last = min - 1
+	}
+	if len(s.logs) == 0 {
+		s.first, s.last = 0, 0
+	}
+}
+
+// write appends records to the file and syncs it. The mutex must be held.
+func (s *fileStore) write(records []byte, count int) error {
+	if _, err := s.file.Write(records); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.records += count
+	return nil
+}
+
+// compact writes the entries and stable keys to a temporary file, then
+// replaces the file with it. The mutex must be held.
+func (s *fileStore) compact() error {
+	tempPath := s.path + ".tmp"
+	temp, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(temp)
+	writer.Write(logFileHeader)
+	for key, value := range s.stable {
+		writer.Write(encodeLogStable([]byte(key), value))
+	}
+	for index := s.first; index <= s.last && index != 0; index++ {
+		if log, ok := s.logs[index]; ok {
+			writer.Write(encodeLogEntry(log))
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	syncDir(filepath.Dir(s.path))
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.records = len(s.logs) + len(s.stable)
+	return nil
+}
+
+// replay reads the records in the file into memory. It returns the size of
+// the valid part of the file, which excludes an incomplete record at the end.
+func (s *fileStore) replay() (int64, error) {
+	reader := &countingReader{
+		reader: bufio.NewReader(s.file),
+	}
+
+	header := make([]byte, len(logFileHeader))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, ErrCorruptLogFile
+	}
+	if !bytes.Equal(header, logFileHeader) {
+		return 0, ErrCorruptLogFile
+	}
+
+	for {
+		valid := reader.count
+		err := s.replayRecord(reader)
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// The last write was interrupted
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		s.records++
+	}
+}
+
+func (s *fileStore) replayRecord(reader *countingReader) error {
+	reader.record = reader.record[:0]
+	recordType, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch recordType {
+	case logRecordEntry:
+		var log raft.Log
+		if log.Index, err = readUvarint(reader); err != nil {
+			return err
+		}
+		if log.Term, err = readUvarint(reader); err != nil {
+			return err
+		}
+		logType, err := reader.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		log.Type = raft.LogType(logType)
+		if log.Data, err = readBytes(reader); err != nil {
+			return err
+		}
+		if log.Extensions, err = readBytes(reader); err != nil {
+			return err
+		}
+		appendedAt, err := binary.ReadVarint(reader)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if appendedAt != 0 {
+			log.AppendedAt = time.Unix(0, appendedAt)
+		}
+		if err := readChecksum(reader); err != nil {
+			return err
+		}
+		s.storeLog(&log)
+	case logRecordDelete:
+		min, err := readUvarint(reader)
+		if err != nil {
+			return err
+		}
+		max, err := readUvarint(reader)
+		if err != nil {
+			return err
+		}
+		if err := readChecksum(reader); err != nil {
+			return err
+		}
+		s.deleteRange(min, max)
+	case logRecordStable:
+		key, err := readBytes(reader)
+		if err != nil {
+			return err
+		}
+		value, err := readBytes(reader)
+		if err != nil {
+			return err
+		}
+		if err := readChecksum(reader); err != nil {
+			return err
+		}
+		s.stable[string(key)] = value
+	default:
+		return ErrCorruptLogFile
+	}
+	return nil
+}
+
+// encodeLogEntry encodes an entry as its index, term and type, its
+// length-prefixed data and extensions, and when it was appended in Unix
+// nanoseconds (0 for unknown). Every record ends with a CRC-32 checksum of
+// everything before it.
+func encodeLogEntry(log *raft.Log) []byte {
+	var appendedAt int64
+	if !log.AppendedAt.IsZero() {
+		appendedAt = log.AppendedAt.UnixNano()
+	}
+	record := make([]byte, 0, 2+5*binary.MaxVarintLen64+len(log.Data)+len(log.Extensions)+4)
+	record = append(record, logRecordEntry)
+	record = appendUvarint(record, log.Index)
+	record = appendUvarint(record, log.Term)
+	record = append(record, byte(log.Type))
+	record = appendBytes(record, log.Data)
+	record = appendBytes(record, log.Extensions)
+	record = appendVarint(record, appendedAt)
+	return appendChecksum(record)
+}
+
+// encodeLogDelete encodes the first and last index of the deleted range
+func encodeLogDelete(min, max uint64) []byte {
+	record := []byte{logRecordDelete}
+	record = appendUvarint(record, min)
+	record = appendUvarint(record, max)
+	return appendChecksum(record)
+}
+
+// encodeLogStable encodes a length-prefixed key and value
+func encodeLogStable(key, value []byte) []byte {
+	record := []byte{logRecordStable}
+	record = appendBytes(record, key)
+	record = appendBytes(record, value)
+	return appendChecksum(record)
+}
+
+func appendUvarint(buffer []byte, value uint64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(encoded[:], value)
+	return append(buffer, encoded[:n]...)
+}
+
+func appendVarint(buffer []byte, value int64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(encoded[:], value)
+	return append(buffer, encoded[:n]...)
+}
+
+func appendBytes(buffer []byte, value []byte) []byte {
+	buffer = appendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+func appendChecksum(record []byte) []byte {
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(record))
+	return append(record, checksum[:]...)
+}
+
+func readUvarint(reader *countingReader) (uint64, error) {
+	value, err := binary.ReadUvarint(reader)
+	return value, unexpectedEOF(err)
+}
+
+func readBytes(reader *countingReader) ([]byte, error) {
+	length, err := readUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	// Copy rather than allocating the length up front, which could be corrupt
+	var buffer bytes.Buffer
+	if _, err := io.CopyN(&buffer, reader, int64(length)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if buffer.Len() == 0 {
+		return nil, nil
+	}
+	return buffer.Bytes(), nil
+}
+
+// readChecksum checks the checksum at the end of the record
+func readChecksum(reader *countingReader) error {
+	checksum := crc32.ChecksumIEEE(reader.record)
+	var expected [4]byte
+	if _, err := io.ReadFull(reader, expected[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if binary.BigEndian.Uint32(expected[:]) != checksum {
+		return ErrCorruptLogFile
+	}
+	return nil
+}
+
+// unexpectedEOF treats the end of the file as an incomplete record, as it
+// comes after the start of one
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// syncDir flushes a directory, so that a rename in it survives a crash
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+// countingReader counts the bytes read, and keeps the bytes of the current
+// record for checksumming
+type countingReader struct {
+	reader *bufio.Reader
+	count  int64
+	record []byte
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	r.record = append(r.record, p[:n]...)
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.count++
+		r.record = append(r.record, b)
+	}
+	return b, err
+}
@@ -0,0 +1,150 @@
+package cluster
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestFileStore(t *testing.T, path string) *fileStore {
+	s, err := openFileStore(path)
+	require.Nil(t, err)
+	return s
+}
+
+func testLogs(first, last uint64) []*raft.Log {
+	var logs []*raft.Log
+	for index := first; index <= last; index++ {
+		logs = append(logs, &raft.Log{
+			Index:      index,
+			Term:       2,
+			Type:       raft.LogCommand,
+			Data:       []byte("test data"),
+			AppendedAt: time.Unix(0, int64(index)),
+		})
+	}
+	return logs
+}
+
+func requireLogs(t *testing.T, s *fileStore, first, last uint64) {
+	t.Helper()
+	firstIndex, err := s.FirstIndex()
+	require.Nil(t, err)
+	require.Equal(t, first, firstIndex)
+	lastIndex, err := s.LastIndex()
+	require.Nil(t, err)
+	require.Equal(t, last, lastIndex)
+	if first == 0 {
+		return
+	}
+	for _, expected := range testLogs(first, last) {
+		var log raft.Log
+		require.Nil(t, s.GetLog(expected.Index, &log))
+		require.Equal(t, *expected, log)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+
+	s := openTestFileStore(t, path)
+	requireLogs(t, s, 0, 0)
+	_, err := s.Get([]byte("missing"))
+	require.EqualError(t, err, "not found")
+	require.Nil(t, s.StoreLogs(testLogs(1, 10)))
+	require.Nil(t, s.StoreLog(testLogs(11, 11)[0]))
+	require.Nil(t, s.Set([]byte("test key"), []byte("test value")))
+	require.Nil(t, s.SetUint64([]byte("term"), 2))
+	requireLogs(t, s, 1, 11)
+
+	// Raft deletes old entries after a snapshot, and conflicting ones from the end
+	require.Nil(t, s.DeleteRange(1, 3))
+	require.Nil(t, s.DeleteRange(10, 11))
+	requireLogs(t, s, 4, 9)
+	var log raft.Log
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(3, &log))
+	require.Nil(t, s.Close())
+
+	s = openTestFileStore(t, path)
+	defer s.Close()
+	requireLogs(t, s, 4, 9)
+	value, err := s.Get([]byte("test key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("test value"), value)
+	term, err := s.GetUint64([]byte("term"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), term)
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+
+	s := openTestFileStore(t, path)
+	require.Nil(t, s.StoreLogs(testLogs(1, 100)))
+	require.Nil(t, s.SetUint64([]byte("term"), 2))
+	before, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Nil(t, s.DeleteRange(1, 90))
+	after, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Less(t, after.Size(), before.Size())
+
+	// The store keeps appending to the rewritten file
+	require.Nil(t, s.StoreLogs(testLogs(101, 110)))
+	require.Nil(t, s.Close())
+
+	s = openTestFileStore(t, path)
+	defer s.Close()
+	requireLogs(t, s, 91, 110)
+	term, err := s.GetUint64([]byte("term"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), term)
+}
+
+func TestFileStoreIncompleteRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+
+	s := openTestFileStore(t, path)
+	require.Nil(t, s.StoreLogs(testLogs(1, 5)))
+	require.Nil(t, s.Close())
+
+	// Simulate a crash part of the way through writing a record
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = file.Write(encodeLogEntry(testLogs(6, 6)[0])[:10])
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+
+	s = openTestFileStore(t, path)
+	requireLogs(t, s, 1, 5)
+	require.Nil(t, s.StoreLogs(testLogs(6, 7)))
+	require.Nil(t, s.Close())
+
+	s = openTestFileStore(t, path)
+	defer s.Close()
+	requireLogs(t, s, 1, 7)
+}
+
+func TestFileStoreCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+
+	s := openTestFileStore(t, path)
+	require.Nil(t, s.StoreLogs(testLogs(1, 5)))
+	require.Nil(t, s.Close())
+
+	contents, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	contents[len(contents)-8] ^= 0xff // In the last entry's data
+	require.Nil(t, ioutil.WriteFile(path, contents, 0644))
+
+	_, err = openFileStore(path)
+	require.Equal(t, ErrCorruptLogFile, err)
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("not a log file"), 0644))
+	_, err = openFileStore(path)
+	require.Equal(t, ErrCorruptLogFile, err)
+}
@@ -0,0 +1,496 @@
+// Package cluster keeps the stores of several servers consistent with Raft.
+// Writes are committed to a majority of the nodes through a replicated log
+// before they are applied to each node's store, in the same order everywhere.
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/hashicorp/raft"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoLeader       = errors.New("the cluster has no leader")
+	ErrLeadershipLost = errors.New("leadership was lost before the request finished, so a write may or may not have been applied")
+	ErrShutdown       = errors.New("the node is shut down")
+	ErrTimeout        = errors.New("timed out waiting for the cluster")
+	ErrNoClock        = errors.New("the node needs the clock that its store uses")
+)
+
+// NotLeaderError is returned by a node that isn't the leader, for requests
+// that only the leader can serve
+type NotLeaderError struct {
+	// LeaderID is the ID of the leader
+	LeaderID string
+	// LeaderAddress is where clients reach the leader's API, or empty if it
+	// isn't known
+	LeaderAddress string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderAddress == "" {
+		return fmt.Sprintf("this node isn't the leader, which is %v", e.LeaderID)
+	}
+	return fmt.Sprintf("this node isn't the leader, send requests to the leader at %v", e.LeaderAddress)
+}
+
+const (
+	defaultApplyTimeout   = 10 * time.Second
+	defaultExpireInterval = time.Second
+	// snapshotsRetained is the number of snapshots kept in the directory
+	snapshotsRetained = 2
+)
+
+// Server is a member of the cluster, as Raft knows it
+type Server struct {
+	ID string
+	// RaftAddress is where other nodes reach the node's transport
+	RaftAddress string
+}
+
+// Options configure a node. The zero value of each one, other than ID and
+// Clock, is a reasonable default.
+type Options struct {
+	// ID identifies the node. It must be unique, and must not change, even
+	// when the node's addresses do.
+	ID string
+	// Address is where clients reach the node's API. Nodes that aren't the
+	// leader send clients to the leader's address.
+	Address string
+	// Dir is the directory the Raft log and snapshots are kept in. If it is
+	// empty they are kept in memory, and a node that restarts must rejoin
+	// the cluster with a new ID.
+	Dir string
+	// Bootstrap is the initial members of a new cluster, which should
+	// include the node. It is ignored if the node already has a Raft log, so
+	// it is safe to keep setting it on the node that started the cluster.
+	Bootstrap []Server
+	// HeartbeatTimeout is how long a node waits to hear from a leader before
+	// starting an election. The default is one second.
+	HeartbeatTimeout time.Duration
+	// ApplyTimeout is how long a write or read waits for the cluster. The
+	// default is 10 seconds.
+	ApplyTimeout time.Duration
+	// SnapshotInterval and SnapshotThreshold control how often the log is
+	// compacted into a snapshot. Every interval, a snapshot is taken if
+	// there have been at least the threshold number of writes.
+	SnapshotInterval  time.Duration
+	SnapshotThreshold uint64
+	// TrailingLogs is the number of writes kept in the log after a snapshot,
+	// so that slow nodes can catch up without the whole snapshot
+	TrailingLogs uint64
+	// Clock is the clock the node's store was made with, which must be one
+	// of its own, from NewClock. The store checks expiry against the time
+	// the leader stamped each write with, rather than the time it applies
+	// it, so that every node's store agrees on which keys have expired.
+	Clock *Clock
+	// ExpireInterval is how often the leader commits the deletion of
+	// expired keys, which nodes must not delete any other way. The default
+	// is one second.
+	ExpireInterval time.Duration
+	// Logger receives Raft's logs. The default discards them.
+	Logger *log.Logger
+}
+
+// Node is a member of a cluster. Its writes go through the Raft log, which
+// applies them to its store once they are committed.
+type Node struct {
+	options    Options
+	raft       *raft.Raft
+	fsm        *fsm
+	closers    []io.Closer
+	leadership chan bool
+	stop       chan struct{}
+	workers    sync.WaitGroup
+}
+
+// NewNode starts a node that applies committed writes to the store, which
+// nothing else should write to, including a sweeper. The store should start
+// empty, as the node restores it from the latest snapshot and the log. The
+// transport connects it to the other nodes.
+func NewNode(options Options, cacheStore store.Store, transport raft.Transport) (*Node, error) {
+	if options.ApplyTimeout <= 0 {
+		options.ApplyTimeout = defaultApplyTimeout
+	}
+	if options.Clock == nil {
+		return nil, ErrNoClock
+	}
+	if options.ExpireInterval <= 0 {
+		options.ExpireInterval = defaultExpireInterval
+	}
+	var logOutput io.Writer = ioutil.Discard
+	if options.Logger != nil {
+		logOutput = options.Logger.Writer()
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(options.ID)
+	config.LogOutput = logOutput
+	config.LogLevel = "INFO"
+	if options.HeartbeatTimeout > 0 {
+		config.HeartbeatTimeout = options.HeartbeatTimeout
+		config.ElectionTimeout = options.HeartbeatTimeout
+		config.LeaderLeaseTimeout = options.HeartbeatTimeout / 2
+	}
+	if options.SnapshotInterval > 0 {
+		config.SnapshotInterval = options.SnapshotInterval
+	}
+	if options.SnapshotThreshold > 0 {
+		config.SnapshotThreshold = options.SnapshotThreshold
+	}
+	if options.TrailingLogs > 0 {
+		config.TrailingLogs = options.TrailingLogs
+	}
+	leadership := make(chan bool, 1)
+	config.NotifyCh = leadership
+	if err := raft.ValidateConfig(config); err != nil {
+		return nil, err
+	}
+
+	var (
+		logs      raft.LogStore
+		stable    raft.StableStore
+		snapshots raft.SnapshotStore
+		closers   []io.Closer
+	)
+	if options.Dir == "" {
+		inmem := raft.NewInmemStore()
+		logs, stable, snapshots = inmem, inmem, raft.NewInmemSnapshotStore()
+	} else {
+		if err := os.MkdirAll(options.Dir, 0755); err != nil {
+			return nil, err
+		}
+		file, err := openFileStore(filepath.Join(options.Dir, "raft.log"))
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, file)
+		logs, stable = file, file
+		snapshots, err = raft.NewFileSnapshotStore(options.Dir, snapshotsRetained, logOutput)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	closeAll := func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}
+
+	if len(options.Bootstrap) > 0 {
+		existing, err := raft.HasExistingState(logs, stable, snapshots)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if !existing {
+			var configuration raft.Configuration
+			for _, server := range options.Bootstrap {
+				configuration.Servers = append(configuration.Servers, raft.Server{
+					Suffrage: raft.Voter,
+					ID:       raft.ServerID(server.ID),
+					Address:  raft.ServerAddress(server.RaftAddress),
+				})
+			}
+			if err := raft.BootstrapCluster(config, logs, stable, snapshots, transport, configuration); err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+	}
+
+	machine := newFSM(cacheStore, options.Clock)
+	r, err := raft.NewRaft(config, machine, logs, stable, snapshots, transport)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	n := &Node{
+		options:    options,
+		raft:       r,
+		fsm:        machine,
+		closers:    closers,
+		leadership: leadership,
+		stop:       make(chan struct{}),
+	}
+	n.workers.Add(2)
+	go n.run()
+	go n.expire()
+	return n, nil
+}
+
+// run records the node's API address whenever it becomes the leader, so that
+// the other nodes can send clients to it
+func (n *Node) run() {
+	defer n.workers.Done()
+	for {
+		select {
+		case leader := <-n.leadership:
+			if !leader || n.options.Address == "" {
+				continue
+			}
+			if address, ok := n.fsm.member(n.options.ID); ok && address == n.options.Address {
+				continue
+			}
+			n.apply(command{kind: commandSetMember, id: n.options.ID, address: n.options.Address})
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// expire commits the deletion of expired keys while the node is the leader.
+// Followers delete them when they apply the command, so keys leave every
+// store at the same point in the log. A failed command is retried next time.
+func (n *Node) expire() {
+	defer n.workers.Done()
+	ticker := n.options.Clock.NewTicker(n.options.ExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if n.raft.State() == raft.Leader {
+				n.apply(command{kind: commandExpire})
+			}
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// ID returns the node's ID
+func (n *Node) ID() string {
+	return n.options.ID
+}
+
+// Put sets a key, with a time to live if ttl is positive
+func (n *Node) Put(key, value string, ttl time.Duration) error {
+	_, err := n.apply(command{kind: commandPut, key: key, value: value, expiry: n.expiry(ttl)})
+	return err
+}
+
+func (n *Node) Delete(key string) error {
+	_, err := n.apply(command{kind: commandDelete, key: key})
+	return err
+}
+
+func (n *Node) MultiPut(entries map[string]string, ttl time.Duration) error {
+	_, err := n.apply(command{kind: commandMultiPut, entries: entries, expiry: n.expiry(ttl)})
+	return err
+}
+
+func (n *Node) MultiDelete(keys []string) error {
+	_, err := n.apply(command{kind: commandMultiDelete, keys: keys})
+	return err
+}
+
+func (n *Node) CompareAndSwap(key, expected, value string) (string, bool, error) {
+	r, err := n.apply(command{kind: commandCompareAndSwap, key: key, expected: expected, value: value})
+	return r.value, r.swapped, err
+}
+
+// Increment returns the store's errors, such as store.ErrNotInteger, as well
+// as the cluster's
+func (n *Node) Increment(key string, delta int64) (int64, error) {
+	r, err := n.apply(command{kind: commandIncrement, key: key, delta: delta})
+	return r.number, err
+}
+
+func (n *Node) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return n.options.Clock.clock.Now().Add(ttl)
+}
+
+// apply stamps a command with the time and commits it, and returns what
+// applying it to this node's store returned
+func (n *Node) apply(c command) (result, error) {
+	if n.raft.State() != raft.Leader {
+		return result{}, n.notLeader()
+	}
+	c.now = n.options.Clock.clock.Now()
+	future := n.raft.Apply(encodeCommand(c), n.options.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		return result{}, n.raftError(err)
+	}
+	r := future.Response().(result)
+	return r, r.err
+}
+
+// VerifyLeader returns nil if this node is the leader, once it has applied
+// every write that was committed before it was called. Reads from its store
+// that follow are linearizable: they see every write that finished before
+// VerifyLeader was called.
+func (n *Node) VerifyLeader() error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+	// The last index includes writes that may never be committed, and a new
+	// leader doesn't know what the old one committed until it commits a
+	// write of its own. A barrier is committed by a majority, which confirms
+	// that the node is still the leader, and isn't done until every write
+	// before it has been applied.
+	if err := n.raft.Barrier(n.options.ApplyTimeout).Error(); err != nil {
+		return n.raftError(err)
+	}
+	return nil
+}
+
+// Join adds a node to the cluster as a voter, or updates its addresses if it
+// is already a member. It must be called on the leader.
+func (n *Node) Join(id, raftAddress, address string) error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+	future := n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(raftAddress), 0, n.options.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		return n.raftError(err)
+	}
+	_, err := n.apply(command{kind: commandSetMember, id: id, address: address})
+	return err
+}
+
+// Remove removes a node from the cluster. It must be called on the leader,
+// which can remove itself, after which the other nodes elect a new leader.
+func (n *Node) Remove(id string) error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+	// Forget the address first, while this node is sure to still be the
+	// leader
+	if _, err := n.apply(command{kind: commandRemoveMember, id: id}); err != nil {
+		return err
+	}
+	future := n.raft.RemoveServer(raft.ServerID(id), 0, n.options.ApplyTimeout)
+	return n.raftError(future.Error())
+}
+
+// Snapshot compacts the log into a snapshot of the store now, rather than
+// waiting for the snapshot interval
+func (n *Node) Snapshot() error {
+	err := n.raft.Snapshot().Error()
+	if err == raft.ErrNothingNewToSnapshot {
+		return nil
+	}
+	return n.raftError(err)
+}
+
+// Member is a node in the cluster
+type Member struct {
+	ID          string
+	RaftAddress string
+	// Address is where clients reach the node's API, or empty if it isn't
+	// known
+	Address string
+	Voter   bool
+}
+
+// Status describes the node and the cluster, as the node sees them
+type Status struct {
+	ID string
+	// State is Leader, Follower, Candidate or Shutdown
+	State    string
+	LeaderID string
+	// LeaderAddress is where clients reach the leader's API, or empty if it
+	// isn't known
+	LeaderAddress string
+	Term          uint64
+	// LastIndex is the index of the last entry in the log, and AppliedIndex
+	// the index of the last one applied to the store
+	LastIndex    uint64
+	AppliedIndex uint64
+	// LastContact is when a follower last heard from the leader
+	LastContact time.Time
+	Members     []Member
+}
+
+// Status reports on the node, and the cluster as it sees it
+func (n *Node) Status() (Status, error) {
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return Status{}, n.raftError(err)
+	}
+	status := Status{
+		ID:           n.options.ID,
+		State:        n.raft.State().String(),
+		LastIndex:    n.raft.LastIndex(),
+		AppliedIndex: n.raft.AppliedIndex(),
+		LastContact:  n.raft.LastContact(),
+	}
+	status.Term, _ = strconv.ParseUint(n.raft.Stats()["term"], 10, 64)
+	leader := n.raft.Leader()
+	for _, server := range future.Configuration().Servers {
+		address, _ := n.fsm.member(string(server.ID))
+		status.Members = append(status.Members, Member{
+			ID:          string(server.ID),
+			RaftAddress: string(server.Address),
+			Address:     address,
+			Voter:       server.Suffrage == raft.Voter,
+		})
+		if server.Address == leader {
+			status.LeaderID = string(server.ID)
+			status.LeaderAddress = address
+		}
+	}
+	return status, nil
+}
+
+// Shutdown stops the node. Its store keeps the writes applied so far.
+func (n *Node) Shutdown() error {
+	err := n.raft.Shutdown().Error()
+	close(n.stop)
+	n.workers.Wait()
+	for _, closer := range n.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// notLeader returns a NotLeaderError naming the leader, or ErrNoLeader if
+// there isn't one
+func (n *Node) notLeader() error {
+	leader := n.raft.Leader()
+	if leader == "" {
+		return ErrNoLeader
+	}
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return n.raftError(err)
+	}
+	for _, server := range future.Configuration().Servers {
+		if server.Address == leader {
+			address, _ := n.fsm.member(string(server.ID))
+			return &NotLeaderError{LeaderID: string(server.ID), LeaderAddress: address}
+		}
+	}
+	return ErrNoLeader
+}
+
+// raftError translates Raft's errors into the package's
+func (n *Node) raftError(err error) error {
+	switch err {
+	case raft.ErrNotLeader:
+		return n.notLeader()
+	case raft.ErrLeadershipLost, raft.ErrLeadershipTransferInProgress:
+		return ErrLeadershipLost
+	case raft.ErrRaftShutdown:
+		return ErrShutdown
+	case raft.ErrEnqueueTimeout:
+		return ErrTimeout
+	default:
+		return err
+	}
+}
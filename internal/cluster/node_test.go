@@ -0,0 +1,287 @@
+package cluster_test
+
+import (
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/cluster"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// testOptions make elections quick, so that tests don't wait long for leaders
+var testOptions = cluster.Options{
+	HeartbeatTimeout: 100 * time.Millisecond,
+	ApplyTimeout:     2 * time.Second,
+}
+
+func startHarness(t *testing.T, options cluster.Options, ids ...string) *cluster.Harness {
+	h, err := cluster.NewHarness(options, ids...)
+	require.Nil(t, err)
+	t.Cleanup(h.Shutdown)
+	return h
+}
+
+func leader(t *testing.T, h *cluster.Harness, ids ...string) *cluster.Node {
+	t.Helper()
+	node, err := h.Leader(5*time.Second, ids...)
+	require.Nil(t, err)
+	return node
+}
+
+// requireConsistent waits for the stores of the nodes to have the same entries
+// as the leader's, with the same expiry times
+func requireConsistent(t *testing.T, h *cluster.Harness, leader *cluster.Node, ids ...string) {
+	t.Helper()
+	expected := h.Store(leader.ID()).Entries()
+	for _, id := range ids {
+		require.Eventually(t, func() bool {
+			entries := h.Store(id).Entries()
+			if len(entries) != len(expected) {
+				return false
+			}
+			for key, entry := range expected {
+				actual, ok := entries[key]
+				if !ok || actual.Value != entry.Value || !actual.Expiry.Equal(entry.Expiry) {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 10*time.Millisecond, id)
+	}
+}
+
+func TestClusterWrites(t *testing.T) {
+	h := startHarness(t, testOptions, "a", "b", "c")
+	node := leader(t, h)
+
+	require.Nil(t, node.Put("test key", "test value", 0))
+	require.Nil(t, node.Put("expiring", "test value", time.Hour))
+	require.Nil(t, node.MultiPut(map[string]string{"x": "1", "y": "2", "z": "3"}, time.Minute))
+	require.Nil(t, node.MultiDelete([]string{"x", "y"}))
+	require.Nil(t, node.Delete("z"))
+	current, swapped, err := node.CompareAndSwap("test key", "wrong value", "new value")
+	require.Nil(t, err)
+	require.False(t, swapped)
+	require.Equal(t, "test value", current)
+	_, swapped, err = node.CompareAndSwap("test key", "test value", "new value")
+	require.Nil(t, err)
+	require.True(t, swapped)
+	value, err := node.Increment("counter", 5)
+	require.Nil(t, err)
+	require.Equal(t, int64(5), value)
+	_, err = node.Increment("test key", 1)
+	require.Equal(t, store.ErrNotInteger, err)
+
+	entries := h.Store(node.ID()).Entries()
+	require.Len(t, entries, 3)
+	require.Equal(t, "new value", entries["test key"].Value)
+	require.Equal(t, "5", entries["counter"].Value)
+	require.False(t, entries["expiring"].Expiry.IsZero())
+	requireConsistent(t, h, node, "a", "b", "c")
+}
+
+func TestClusterFollowers(t *testing.T) {
+	h := startHarness(t, testOptions, "a", "b", "c")
+	node := leader(t, h)
+	require.Nil(t, node.VerifyLeader())
+
+	// Followers send clients to the leader, once it has recorded its address
+	for _, id := range []string{"a", "b", "c"} {
+		if id == node.ID() {
+			continue
+		}
+		follower := h.Node(id)
+		require.Eventually(t, func() bool {
+			err, ok := follower.Put("test key", "test value", 0).(*cluster.NotLeaderError)
+			return ok && err.LeaderAddress != ""
+		}, 5*time.Second, 10*time.Millisecond)
+		err := follower.Put("test key", "test value", 0)
+		require.Equal(t, &cluster.NotLeaderError{LeaderID: node.ID(), LeaderAddress: node.ID() + ":50051"}, err)
+		require.Equal(t, "this node isn't the leader, send requests to the leader at "+node.ID()+":50051", err.Error())
+		require.IsType(t, &cluster.NotLeaderError{}, follower.VerifyLeader())
+		require.IsType(t, &cluster.NotLeaderError{}, follower.Join("d", "d", "d:50051"))
+	}
+}
+
+func TestClusterPartition(t *testing.T) {
+	h := startHarness(t, testOptions, "a", "b", "c", "d", "e")
+	oldLeader := leader(t, h)
+	require.Nil(t, oldLeader.Put("test key", "before", 0))
+
+	// Cut the leader and one other node off from the majority
+	minority := []string{oldLeader.ID()}
+	var majority []string
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if id != oldLeader.ID() {
+			majority = append(majority, id)
+		}
+	}
+	minority, majority = append(minority, majority[0]), majority[1:]
+	h.Partition(minority...)
+
+	// The old leader can't commit writes or serve reads, and steps down
+	require.NotNil(t, oldLeader.Put("test key", "minority", 0))
+	require.NotNil(t, oldLeader.VerifyLeader())
+
+	newLeader := leader(t, h, majority...)
+	require.Nil(t, newLeader.Put("test key", "majority", 0))
+	require.Nil(t, newLeader.VerifyLeader())
+	value, _ := h.Store(newLeader.ID()).Get("test key")
+	require.Equal(t, "majority", value)
+	for _, id := range minority {
+		value, _ := h.Store(id).Get("test key")
+		require.Equal(t, "before", value, id)
+	}
+
+	// Once the partition heals, the minority catches up, and the write it
+	// couldn't commit is discarded
+	h.Heal()
+	newLeader = leader(t, h)
+	requireConsistent(t, h, newLeader, "a", "b", "c", "d", "e")
+	value, _ = h.Store(oldLeader.ID()).Get("test key")
+	require.Equal(t, "majority", value)
+}
+
+func TestClusterMembership(t *testing.T) {
+	h := startHarness(t, testOptions, "a")
+	node := leader(t, h)
+	require.Nil(t, node.Put("test key", "test value", 0))
+
+	for _, id := range []string{"b", "c"} {
+		_, err := h.Add(id)
+		require.Nil(t, err)
+		require.Nil(t, node.Join(id, id, id+":50051"))
+	}
+	requireConsistent(t, h, node, "b", "c")
+	var status cluster.Status
+	require.Eventually(t, func() bool {
+		status, _ = h.Node("c").Status()
+		return status.AppliedIndex == status.LastIndex
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "c", status.ID)
+	require.Equal(t, "Follower", status.State)
+	require.Equal(t, "a", status.LeaderID)
+	require.Equal(t, "a:50051", status.LeaderAddress)
+	require.Equal(t, []cluster.Member{
+		{ID: "a", RaftAddress: "a", Address: "a:50051", Voter: true},
+		{ID: "b", RaftAddress: "b", Address: "b:50051", Voter: true},
+		{ID: "c", RaftAddress: "c", Address: "c:50051", Voter: true},
+	}, status.Members)
+
+	// The leader can remove itself, and the rest elect a new one
+	require.Nil(t, node.Remove("a"))
+	newLeader := leader(t, h, "b", "c")
+	require.Nil(t, newLeader.Put("other key", "other value", 0))
+	status, err := newLeader.Status()
+	require.Nil(t, err)
+	require.Len(t, status.Members, 2)
+	value, _ := h.Store("a").Get("other key")
+	require.Equal(t, "", value)
+}
+
+func TestClusterSnapshot(t *testing.T) {
+	options := testOptions
+	options.TrailingLogs = 10
+	h := startHarness(t, options, "a", "b", "c")
+	node := leader(t, h)
+	for i := 0; i < 100; i++ {
+		require.Nil(t, node.Put(fmt.Sprintf("key %v", i), fmt.Sprintf("value %v", i), 0))
+	}
+	require.Nil(t, node.Snapshot())
+
+	// A new node is too far behind for the log, so it restores the snapshot
+	_, err := h.Add("d")
+	require.Nil(t, err)
+	require.Nil(t, node.Join("d", "d", "d:50051"))
+	requireConsistent(t, h, node, "d")
+	require.Eventually(t, func() bool {
+		status, _ := h.Node("d").Status()
+		return status.LeaderAddress == node.ID()+":50051"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClusterRestart(t *testing.T) {
+	options := testOptions
+	options.Dir = t.TempDir()
+	options.TrailingLogs = 10
+	h := startHarness(t, options, "a", "b", "c")
+	node := leader(t, h)
+	for i := 0; i < 50; i++ {
+		require.Nil(t, node.Put(fmt.Sprintf("key %v", i), "value", time.Hour))
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		require.Nil(t, h.Node(id).Snapshot())
+	}
+	_, err := node.Increment("counter", 1)
+	require.Nil(t, err)
+
+	// A node that restarts restores its snapshot and log, then catches up
+	var follower string
+	for _, id := range []string{"a", "b", "c"} {
+		if id != node.ID() {
+			follower = id
+		}
+	}
+	require.Nil(t, h.Stop(follower))
+	_, err = node.Increment("counter", 1)
+	require.Nil(t, err)
+	_, err = h.Restart(follower)
+	require.Nil(t, err)
+	requireConsistent(t, h, node, follower)
+
+	// So does the whole cluster
+	for _, id := range []string{"a", "b", "c"} {
+		require.Nil(t, h.Stop(id))
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := h.Restart(id)
+		require.Nil(t, err)
+	}
+	node = leader(t, h)
+	require.Nil(t, node.VerifyLeader())
+	value, _ := h.Store(node.ID()).Get("counter")
+	require.Equal(t, "2", value)
+	require.Len(t, h.Store(node.ID()).Entries(), 51)
+	requireConsistent(t, h, node, "a", "b", "c")
+}
+
+func TestClusterExpiry(t *testing.T) {
+	options := testOptions
+	options.Dir = t.TempDir()
+	options.ExpireInterval = 100 * time.Millisecond
+	h := startHarness(t, options, "a", "b", "c")
+	node := leader(t, h)
+	require.Nil(t, node.Put("counter", "1", 500*time.Millisecond))
+	require.Nil(t, node.Put("kept", "value", time.Hour))
+	_, err := node.Increment("counter", 1)
+	require.Nil(t, err)
+	_, swapped, err := node.CompareAndSwap("kept", "value", "swapped")
+	require.Nil(t, err)
+	require.True(t, swapped)
+
+	// Once the key has expired, the leader commits its deletion
+	require.Eventually(t, func() bool {
+		return h.Store(node.ID()).Stats().Entries == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = node.Increment("counter", 1)
+	require.Nil(t, err)
+
+	// A node that replays the log after the key expired applies each write
+	// at the time the leader made it, so the key is live when it was
+	// incremented, and deleted when the leader deleted it
+	var follower string
+	for _, id := range []string{"a", "b", "c"} {
+		if id != node.ID() {
+			follower = id
+		}
+	}
+	require.Nil(t, h.Stop(follower))
+	_, err = h.Restart(follower)
+	require.Nil(t, err)
+	requireConsistent(t, h, node, "a", "b", "c")
+	entries := h.Store(follower).Entries()
+	require.Equal(t, "1", entries["counter"].Value)
+	require.True(t, entries["counter"].Expiry.IsZero())
+	require.Equal(t, "swapped", entries["kept"].Value)
+}
@@ -0,0 +1,44 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"github.com/hashicorp/raft"
+	"io"
+	"net"
+	"time"
+)
+
+// tlsStreamLayer carries Raft traffic over TLS connections
+type tlsStreamLayer struct {
+	net.Listener
+	advertise  net.Addr
+	dialConfig func() *tls.Config
+}
+
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), l.dialConfig())
+}
+
+func (l *tlsStreamLayer) Addr() net.Addr {
+	if l.advertise != nil {
+		return l.advertise
+	}
+	return l.Listener.Addr()
+}
+
+// NewTLSTransport is like raft.NewTCPTransport, except that connections are
+// accepted with the server config, and made to other nodes with a config
+// returned by dialConfig for each connection, so that certificates can be
+// reloaded. The listen address is advertised if advertise is nil.
+func NewTLSTransport(bindAddr string, advertise net.Addr, maxPool int, timeout time.Duration, serverConfig *tls.Config, dialConfig func() *tls.Config, logOutput io.Writer) (*raft.NetworkTransport, error) {
+	listener, err := tls.Listen("tcp", bindAddr, serverConfig)
+	if err != nil {
+		return nil, err
+	}
+	stream := &tlsStreamLayer{
+		Listener:   listener,
+		advertise:  advertise,
+		dialConfig: dialConfig,
+	}
+	return raft.NewNetworkTransport(stream, maxPool, timeout, logOutput), nil
+}
@@ -0,0 +1,80 @@
+package cluster_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/cluster"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned creates a certificate for 127.0.0.1 that is also its own CA
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "node"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTLSTransport(t *testing.T) {
+	certificate, pool := selfSigned(t)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	dialConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      pool,
+	}
+	newTransport := func(dialConfig *tls.Config) *raft.NetworkTransport {
+		transport, err := cluster.NewTLSTransport("127.0.0.1:0", nil, 1, time.Second, serverConfig, func() *tls.Config {
+			return dialConfig.Clone()
+		}, ioutil.Discard)
+		require.Nil(t, err)
+		t.Cleanup(func() {
+			transport.Close()
+		})
+		return transport
+	}
+	server := newTransport(dialConfig)
+	go func() {
+		for rpc := range server.Consumer() {
+			rpc.Respond(&raft.AppendEntriesResponse{Term: 2, Success: true}, nil)
+		}
+	}()
+
+	var response raft.AppendEntriesResponse
+	client := newTransport(dialConfig)
+	require.Nil(t, client.AppendEntries("server", server.LocalAddr(), &raft.AppendEntriesRequest{Term: 2}, &response))
+	require.Equal(t, raft.AppendEntriesResponse{Term: 2, Success: true}, response)
+
+	// Nodes without a certificate signed by the CA are rejected
+	stranger := newTransport(&tls.Config{RootCAs: pool})
+	require.NotNil(t, stranger.AppendEntries("server", server.LocalAddr(), &raft.AppendEntriesRequest{Term: 2}, &response))
+}
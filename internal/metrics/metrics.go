@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"context"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"time"
+)
+
+// Metrics collects Prometheus metrics for a store and the gRPC server in front
+// of it, in its own registry
+type Metrics struct {
+	registry    *prometheus.Registry
+	hits        prometheus.Counter
+	misses      prometheus.Counter
+	puts        prometheus.Counter
+	deletes     prometheus.Counter
+	expirations prometheus.Counter
+	rpcDuration *prometheus.HistogramVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_hits_total",
+			Help: "Number of keys read that existed.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_misses_total",
+			Help: "Number of keys read that did not exist.",
+		}),
+		puts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_puts_total",
+			Help: "Number of values written.",
+		}),
+		deletes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_deletes_total",
+			Help: "Number of keys deleted.",
+		}),
+		expirations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_expirations_total",
+			Help: "Number of expired keys removed.",
+		}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Time taken to handle each RPC.",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"method", "code"}),
+	}
+	m.registry.MustRegister(m.hits, m.misses, m.puts, m.deletes, m.expirations, m.rpcDuration)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// WithStore counts the operations on the store. The number of entries, their
+// size and the number of evictions are read from the store's stats when the
+// metrics are scraped. It should only be called once.
+func (m *Metrics) WithStore(s store.Store) store.Store {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "cache_entries",
+			Help: "Number of entries in the cache, including expired entries that have not been removed.",
+		}, func() float64 {
+			return float64(s.Stats().Entries)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "cache_bytes",
+			Help: "Approximate size of all keys and values.",
+		}, func() float64 {
+			return float64(s.Stats().Bytes)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "cache_evictions_total",
+			Help: "Number of entries removed to stay within a limit.",
+		}, func() float64 {
+			return float64(s.Stats().Evictions)
+		}),
+	)
+	return &metricsDecorator{
+		store:   s,
+		metrics: m,
+	}
+}
+
+// UnaryInterceptor records the duration of each RPC
+func (m *Metrics) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		response, err := handler(ctx, request)
+		m.observe(info.FullMethod, start, err)
+		return response, err
+	}
+}
+
+// StreamInterceptor records the duration of each streaming RPC, until the
+// stream ends
+func (m *Metrics) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(server, stream)
+		m.observe(info.FullMethod, start, err)
+		return err
+	}
+}
+
+func (m *Metrics) observe(method string, start time.Time, err error) {
+	m.rpcDuration.WithLabelValues(method, status.Code(err).String()).Observe(time.Since(start).Seconds())
+}
+
+type metricsDecorator struct {
+	store   store.Store
+	metrics *Metrics
+}
+
+// lookup counts a read as a hit or a miss
+func (s *metricsDecorator) lookup(found bool) {
+	if found {
+		s.metrics.hits.Inc()
+	} else {
+		s.metrics.misses.Inc()
+	}
+}
+
+// Unwrap returns the store the decorator wraps, so that store.Observer can
+// find an observer below it
+func (s *metricsDecorator) Unwrap() store.Store {
+	return s.store
+}
+
+func (s *metricsDecorator) Has(key string) bool {
+	ok := s.store.Has(key)
+	s.lookup(ok)
+	return ok
+}
+
+func (s *metricsDecorator) Get(key string) (string, bool) {
+	value, ok := s.store.Get(key)
+	s.lookup(ok)
+	return value, ok
+}
+
+func (s *metricsDecorator) GetEntry(key string) (store.Entry, bool) {
+	return s.store.GetEntry(key)
+}
+
+func (s *metricsDecorator) Put(key, value string) {
+	s.store.Put(key, value)
+	s.metrics.puts.Inc()
+}
+
+func (s *metricsDecorator) PutWithTTL(key, value string, ttl time.Duration) {
+	s.store.PutWithTTL(key, value, ttl)
+	s.metrics.puts.Inc()
+}
+
+func (s *metricsDecorator) Delete(key string) {
+	s.store.Delete(key)
+	s.metrics.deletes.Inc()
+}
+
+func (s *metricsDecorator) MultiGet(keys []string) map[string]string {
+	values := s.store.MultiGet(keys)
+	for _, key := range keys {
+		_, ok := values[key]
+		s.lookup(ok)
+	}
+	return values
+}
+
+func (s *metricsDecorator) MultiPut(entries map[string]string, ttl time.Duration) {
+	s.store.MultiPut(entries, ttl)
+	s.metrics.puts.Add(float64(len(entries)))
+}
+
+func (s *metricsDecorator) MultiDelete(keys []string) {
+	s.store.MultiDelete(keys)
+	s.metrics.deletes.Add(float64(len(keys)))
+}
+
+func (s *metricsDecorator) CompareAndSwap(key, expected, value string) (string, bool) {
+	current, swapped := s.store.CompareAndSwap(key, expected, value)
+	if swapped {
+		s.metrics.puts.Inc()
+	}
+	return current, swapped
+}
+
+func (s *metricsDecorator) Increment(key string, delta int64) (int64, error) {
+	value, err := s.store.Increment(key, delta)
+	if err == nil {
+		s.metrics.puts.Inc()
+	}
+	return value, err
+}
+
+func (s *metricsDecorator) DeleteExpired() []string {
+	keys := s.store.DeleteExpired()
+	s.metrics.expirations.Add(float64(len(keys)))
+	return keys
+}
+
+func (s *metricsDecorator) Entries() map[string]store.Entry {
+	return s.store.Entries()
+}
+
+func (s *metricsDecorator) Scan(prefix, cursor string, limit int) ([]string, string) {
+	return s.store.Scan(prefix, cursor, limit)
+}
+
+func (s *metricsDecorator) Stats() store.Stats {
+	return s.store.Stats()
+}
@@ -0,0 +1,83 @@
+package metrics_test
+
+import (
+	"context"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/metrics"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// scrape reads the metrics from the handler over HTTP
+func scrape(t *testing.T, m *metrics.Metrics) string {
+	httpServer := httptest.NewServer(m.Handler())
+	defer httpServer.Close()
+
+	response, err := http.Get(httpServer.URL + "/metrics")
+	require.Nil(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	body, err := ioutil.ReadAll(response.Body)
+	require.Nil(t, err)
+	return string(body)
+}
+
+func TestStoreMetrics(t *testing.T) {
+	m := metrics.New()
+	s := m.WithStore(store.NewStore(store.MaxBytes(30)))
+
+	s.Put("test key 1", "test value")
+	s.Get("test key 1")
+	s.Has("other key")
+	s.MultiGet([]string{"test key 1", "other key", "another key"})
+	s.MultiPut(map[string]string{"test key 2": "test value"}, 0)
+	s.CompareAndSwap("test key 2", "test value", "new value")
+	s.CompareAndSwap("test key 2", "test value", "new value")
+	s.Delete("test key 2")
+
+	body := scrape(t, m)
+	require.Contains(t, body, "cache_hits_total 2\n")
+	require.Contains(t, body, "cache_misses_total 3\n")
+	require.Contains(t, body, "cache_puts_total 3\n")
+	require.Contains(t, body, "cache_deletes_total 1\n")
+	require.Contains(t, body, "cache_evictions_total 1\n")
+	require.Contains(t, body, "cache_entries 0\n")
+	require.Contains(t, body, "cache_bytes 0\n")
+}
+
+func TestRPCMetrics(t *testing.T) {
+	m := metrics.New()
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(m.UnaryInterceptor()),
+		grpc.StreamInterceptor(m.StreamInterceptor()),
+	)
+	api.RegisterCacheServer(grpcServer, server.NewServer(m.WithStore(store.NewStore())))
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewCacheClient(conn)
+
+	_, err = client.Put(context.Background(), &api.PutRequest{Key: "test key", Value: "test value"})
+	require.Nil(t, err)
+	_, err = client.Get(context.Background(), &api.GetRequest{})
+	require.NotNil(t, err)
+
+	body := scrape(t, m)
+	require.Contains(t, body, `grpc_server_handling_seconds_count{code="OK",method="/api.Cache/Put"} 1`)
+	require.Contains(t, body, `grpc_server_handling_seconds_count{code="InvalidArgument",method="/api.Cache/Get"} 1`)
+	require.Contains(t, body, `grpc_server_handling_seconds_bucket{code="OK",method="/api.Cache/Put",le="+Inf"} 1`)
+}
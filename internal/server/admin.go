@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bufio"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const snapshotChunkSize = 64 * 1024
+
+type adminServer struct {
+	api.UnimplementedAdminServer
+	config
+
+	store     store.Store
+	clock     store.Clock
+	readiness *Readiness
+}
+
+// NewAdminServer serves the admin API for the store. The store is reported as
+// not ready while a snapshot is loading. Of the options, only ReadOnly and
+// Clustered apply, as snapshots can't be loaded on either.
+func NewAdminServer(store store.Store, clock store.Clock, readiness *Readiness, options ...Option) api.AdminServer {
+	return adminServer{
+		config:    newConfig(options),
+		store:     store,
+		clock:     clock,
+		readiness: readiness,
+	}
+}
+
+func (s adminServer) SaveSnapshot(request *api.SaveSnapshotRequest, stream api.Admin_SaveSnapshotServer) error {
+	writer := bufio.NewWriterSize(chunkWriter{stream: stream}, snapshotChunkSize)
+	if err := store.SaveSnapshot(s.store, writer); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func (s adminServer) LoadSnapshot(stream api.Admin_LoadSnapshotServer) error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	if s.cluster != nil {
+		return status.Error(codes.FailedPrecondition, "snapshots can't be loaded in cluster mode, as the store is only written through the Raft log")
+	}
+	done := s.readiness.Loading()
+	defer done()
+	count, err := store.LoadSnapshot(s.store, &chunkReader{stream: stream}, s.clock)
+	switch err {
+	case nil:
+	case store.ErrInvalidSnapshot, store.ErrUnsupportedSnapshotVersion, store.ErrSnapshotChecksum:
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return err
+	}
+	return stream.SendAndClose(&api.LoadSnapshotResponse{
+		Entries: int64(count),
+	})
+}
+
+// chunkWriter sends each write as a snapshot chunk
+type chunkWriter struct {
+	stream api.Admin_SaveSnapshotServer
+}
+
+func (w chunkWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&api.SnapshotChunk{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// chunkReader reads the data from received snapshot chunks
+type chunkReader struct {
+	stream  api.Admin_LoadSnapshotServer
+	pending []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		chunk, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.pending = chunk.Data
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
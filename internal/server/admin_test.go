@@ -0,0 +1,73 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/status"
+	"io"
+	"strings"
+	"testing"
+)
+
+// startAdminServer serves the admin API for the store over an in-memory
+// connection
+func startAdminServer(t *testing.T, cacheStore store.Store) api.AdminClient {
+	return api.NewAdminClient(serve(t, func(grpcServer *grpc.Server) {
+		api.RegisterAdminServer(grpcServer, server.NewAdminServer(cacheStore, store.SystemClock(), server.NewReadiness(health.NewServer())))
+	}))
+}
+
+func saveSnapshot(t *testing.T, client api.AdminClient) [][]byte {
+	stream, err := client.SaveSnapshot(context.Background(), &api.SaveSnapshotRequest{})
+	require.Nil(t, err)
+	var chunks [][]byte
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return chunks
+		}
+		require.Nil(t, err)
+		chunks = append(chunks, chunk.Data)
+	}
+}
+
+func loadSnapshot(t *testing.T, client api.AdminClient, chunks [][]byte) (*api.LoadSnapshotResponse, error) {
+	stream, err := client.LoadSnapshot(context.Background())
+	require.Nil(t, err)
+	for _, chunk := range chunks {
+		require.Nil(t, stream.Send(&api.SnapshotChunk{Data: chunk}))
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestSnapshot(t *testing.T) {
+	// Large enough to need several chunks
+	contents := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		contents[fmt.Sprintf("test key %v", i)] = strings.Repeat("test value ", 10)
+	}
+	source := startAdminServer(t, store.NewStoreWithContents(contents))
+	destinationStore := store.NewStore()
+	destination := startAdminServer(t, destinationStore)
+
+	chunks := saveSnapshot(t, source)
+	require.Greater(t, len(chunks), 1)
+
+	response, err := loadSnapshot(t, destination, chunks)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(contents)), response.Entries)
+	require.Equal(t, len(contents), destinationStore.Stats().Entries)
+}
+
+func TestLoadInvalidSnapshot(t *testing.T) {
+	client := startAdminServer(t, store.NewStore())
+	_, err := loadSnapshot(t, client, [][]byte{[]byte("not a snapshot")})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
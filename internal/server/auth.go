@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"strings"
+)
+
+// AllOperations grants every operation in a permission
+const AllOperations = "*"
+
+// guardedServices are the services that require a token. Health checks and
+// reflection are left open.
+var guardedServices = []grpc.ServiceDesc{api.Cache_ServiceDesc, api.Admin_ServiceDesc, api.Replication_ServiceDesc, api.Cluster_ServiceDesc}
+
+// Permission allows some operations on the keys starting with a prefix.
+// Operations are named after the RPC methods, such as Get or Scan. An empty
+// prefix covers every key, and is needed for operations that don't name any
+// keys, such as Stats and the Admin, Replication and Cluster services.
+type Permission struct {
+	Prefix     string   `yaml:"prefix"`
+	Operations []string `yaml:"operations"`
+}
+
+// Token is a bearer token and the permissions it grants. The name identifies
+// the token in errors without revealing it.
+type Token struct {
+	Name        string       `yaml:"name"`
+	Token       string       `yaml:"token"`
+	Permissions []Permission `yaml:"permissions"`
+}
+
+// Authorizer checks the bearer token sent with each request to the Cache,
+// Admin, Replication and Cluster services, and that it allows the operation on
+// every key the request names
+type Authorizer struct {
+	tokens map[[sha256.Size]byte]*Token // Keyed by hash, so lookups don't leak the tokens through timing
+}
+
+func NewAuthorizer(tokens []Token) (*Authorizer, error) {
+	operations := make(map[string]bool)
+	for _, service := range guardedServices {
+		for _, method := range service.Methods {
+			operations[method.MethodName] = true
+		}
+		for _, stream := range service.Streams {
+			operations[stream.StreamName] = true
+		}
+	}
+
+	a := &Authorizer{
+		tokens: make(map[[sha256.Size]byte]*Token, len(tokens)),
+	}
+	for i := range tokens {
+		token := &tokens[i]
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %q is empty", token.Name)
+		}
+		hash := sha256.Sum256([]byte(token.Token))
+		if _, ok := a.tokens[hash]; ok {
+			return nil, fmt.Errorf("token %q is a duplicate", token.Name)
+		}
+		for _, permission := range token.Permissions {
+			for _, operation := range permission.Operations {
+				if operation != AllOperations && !operations[operation] {
+					return nil, fmt.Errorf("token %q has unknown operation %q", token.Name, operation)
+				}
+			}
+		}
+		a.tokens[hash] = token
+	}
+	return a, nil
+}
+
+// LoadTokenFile reads a YAML list of tokens, each with a name, a token and a
+// list of permissions with a prefix and operations
+func LoadTokenFile(path string) (*Authorizer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	if err := yaml.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	authorizer, err := NewAuthorizer(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return authorizer, nil
+}
+
+func (a *Authorizer) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		operation, guarded := guardedOperation(info.FullMethod)
+		if !guarded {
+			return handler(ctx, request)
+		}
+		token, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := authorize(token, operation, request); err != nil {
+			return nil, err
+		}
+		return handler(ctx, request)
+	}
+}
+
+// StreamInterceptor authenticates the stream when it starts, and authorizes
+// each message received
+func (a *Authorizer) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		operation, guarded := guardedOperation(info.FullMethod)
+		if !guarded {
+			return handler(server, stream)
+		}
+		token, err := a.authenticate(stream.Context())
+		if err != nil {
+			return err
+		}
+		return handler(server, &authorizedStream{
+			ServerStream: stream,
+			token:        token,
+			operation:    operation,
+		})
+	}
+}
+
+type authorizedStream struct {
+	grpc.ServerStream
+	token     *Token
+	operation string
+}
+
+func (s *authorizedStream) RecvMsg(message interface{}) error {
+	if err := s.ServerStream.RecvMsg(message); err != nil {
+		return err
+	}
+	return authorize(s.token, s.operation, message)
+}
+
+// guardedOperation returns the operation for a method, and whether it needs a
+// token
+func guardedOperation(fullMethod string) (string, bool) {
+	for _, service := range guardedServices {
+		prefix := "/" + service.ServiceName + "/"
+		if strings.HasPrefix(fullMethod, prefix) {
+			return strings.TrimPrefix(fullMethod, prefix), true
+		}
+	}
+	return "", false
+}
+
+// authenticate finds the token in the authorization header
+func (a *Authorizer) authenticate(ctx context.Context) (*Token, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	const scheme = "bearer "
+	if len(values[0]) < len(scheme) || !strings.EqualFold(values[0][:len(scheme)], scheme) {
+		return nil, status.Error(codes.Unauthenticated, "authorization must be a bearer token")
+	}
+	token, ok := a.lookup(values[0][len(scheme):])
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	return token, nil
+}
+
+// lookup finds a token by its secret value
+func (a *Authorizer) lookup(secret string) (*Token, bool) {
+	token, ok := a.tokens[sha256.Sum256([]byte(secret))]
+	return token, ok
+}
+
+// authorize checks that the token allows the operation on every key and
+// prefix in the request. The keys are left out of the error, as they may be
+// sensitive.
+func authorize(token *Token, operation string, request interface{}) error {
+	keys := requestKeys(request)
+	if len(keys) == 0 {
+		// Requests that don't name any keys may affect all of them
+		keys = []string{""}
+	}
+	for _, key := range keys {
+		if !token.allows(operation, key) {
+			if key == "" {
+				return status.Errorf(codes.PermissionDenied, "token %q may not call %v", token.Name, operation)
+			}
+			return status.Errorf(codes.PermissionDenied, "token %q may not call %v on this key", token.Name, operation)
+		}
+	}
+	return nil
+}
+
+// allows returns whether a permission covers the operation on the key, or on
+// every key starting with it
+func (t *Token) allows(operation, key string) bool {
+	for _, permission := range t.Permissions {
+		if !strings.HasPrefix(key, permission.Prefix) {
+			continue
+		}
+		for _, allowed := range permission.Operations {
+			if allowed == operation || allowed == AllOperations {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requestKeys returns the keys and prefixes named by a request, using the
+// getters of the generated messages. A prefix is checked like a key, as a
+// permission covers every key starting with it.
+func requestKeys(request interface{}) []string {
+	var keys []string
+	if r, ok := request.(interface{ GetKey() string }); ok {
+		keys = append(keys, r.GetKey())
+	}
+	if r, ok := request.(interface{ GetPrefix() string }); ok {
+		keys = append(keys, r.GetPrefix())
+	}
+	if r, ok := request.(interface{ GetKeys() []string }); ok {
+		keys = append(keys, r.GetKeys()...)
+	}
+	if r, ok := request.(interface{ GetEntries() map[string]string }); ok {
+		for key := range r.GetEntries() {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
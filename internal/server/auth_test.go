@@ -0,0 +1,149 @@
+package server_test
+
+import (
+	"context"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const tokenFile = `
+- name: sessions
+  token: session-token
+  permissions:
+    - prefix: "session:"
+      operations: [Get, Put, Scan, Watch]
+    - prefix: "session:shared:"
+      operations: [Delete]
+- name: admin
+  token: admin-token
+  permissions:
+    - operations: ["*"]
+`
+
+func startAuthorizedServer(t *testing.T, cacheStore store.Store) *grpc.ClientConn {
+	path := filepath.Join(t.TempDir(), "tokens.yaml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(tokenFile), 0600))
+	authorizer, err := server.LoadTokenFile(path)
+	require.Nil(t, err)
+
+	return serve(t, func(grpcServer *grpc.Server) {
+		api.RegisterCacheServer(grpcServer, server.NewServer(cacheStore))
+		api.RegisterAdminServer(grpcServer, server.NewAdminServer(cacheStore, store.SystemClock(), nil))
+		healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	}, grpc.UnaryInterceptor(authorizer.UnaryInterceptor()), grpc.StreamInterceptor(authorizer.StreamInterceptor()))
+}
+
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestAuthentication(t *testing.T) {
+	conn := startAuthorizedServer(t, store.NewStore())
+	client := api.NewCacheClient(conn)
+
+	for _, ctx := range []context.Context{
+		context.Background(),
+		withToken("wrong-token"),
+		metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic YWRtaW4="),
+	} {
+		_, err := client.Get(ctx, &api.GetRequest{Key: "session:1"})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+
+	// Health checks don't need a token
+	_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.Nil(t, err)
+
+	_, err = client.Get(metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer admin-token"), &api.GetRequest{Key: "anything"})
+	require.Nil(t, err)
+}
+
+func TestAuthorization(t *testing.T) {
+	conn := startAuthorizedServer(t, store.WithRWMutex(store.NewStore()))
+	client := api.NewCacheClient(conn)
+	ctx := withToken("session-token")
+
+	requireDenied := func(err error) {
+		require.Equal(t, codes.PermissionDenied, status.Code(err), "%v", err)
+	}
+
+	_, err := client.Put(ctx, &api.PutRequest{Key: "session:1", Value: "a"})
+	require.Nil(t, err)
+	_, err = client.Get(ctx, &api.GetRequest{Key: "session:1"})
+	require.Nil(t, err)
+
+	// Operations and keys outside the permissions
+	_, err = client.Has(ctx, &api.HasRequest{Key: "session:1"})
+	requireDenied(err)
+	_, err = client.Get(ctx, &api.GetRequest{Key: "user:1"})
+	requireDenied(err)
+	require.Equal(t, `token "sessions" may not call Get on this key`, status.Convert(err).Message())
+	_, err = client.Delete(ctx, &api.DeleteRequest{Key: "session:1"})
+	requireDenied(err)
+	_, err = client.Delete(ctx, &api.DeleteRequest{Key: "session:shared:1"})
+	require.Nil(t, err)
+	_, err = client.Stats(ctx, &api.StatsRequest{})
+	requireDenied(err)
+	require.Equal(t, `token "sessions" may not call Stats`, status.Convert(err).Message())
+
+	// Every key in a batch must be allowed
+	_, err = client.MultiPut(withToken("admin-token"), &api.MultiPutRequest{Entries: map[string]string{"session:2": "b", "user:2": "c"}})
+	require.Nil(t, err)
+	_, err = client.MultiPut(ctx, &api.MultiPutRequest{Entries: map[string]string{"session:2": "b", "user:2": "c"}})
+	requireDenied(err)
+
+	// A prefix must be within the permission's prefix
+	stream, err := client.Scan(ctx, &api.ScanRequest{Prefix: "session:"})
+	require.Nil(t, err)
+	response, err := stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, []string{"session:1", "session:2"}, response.Keys)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	stream, err = client.Scan(ctx, &api.ScanRequest{Prefix: "sess"})
+	require.Nil(t, err)
+	_, err = stream.Recv()
+	requireDenied(err)
+
+	watch, err := client.Watch(ctx, &api.WatchRequest{Key: "", Prefix: true})
+	require.Nil(t, err)
+	_, err = watch.Recv()
+	requireDenied(err)
+
+	// The admin service needs an unrestricted permission
+	snapshot, err := api.NewAdminClient(conn).SaveSnapshot(ctx, &api.SaveSnapshotRequest{})
+	require.Nil(t, err)
+	_, err = snapshot.Recv()
+	requireDenied(err)
+	snapshot, err = api.NewAdminClient(conn).SaveSnapshot(withToken("admin-token"), &api.SaveSnapshotRequest{})
+	require.Nil(t, err)
+	_, err = snapshot.Recv()
+	require.Nil(t, err)
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	_, err := server.NewAuthorizer([]server.Token{{Name: "empty"}})
+	require.EqualError(t, err, `token "empty" is empty`)
+
+	_, err = server.NewAuthorizer([]server.Token{{Name: "a", Token: "x"}, {Name: "b", Token: "x"}})
+	require.EqualError(t, err, `token "b" is a duplicate`)
+
+	_, err = server.NewAuthorizer([]server.Token{{Name: "a", Token: "x", Permissions: []server.Permission{{Operations: []string{"Gte"}}}}})
+	require.EqualError(t, err, `token "a" has unknown operation "Gte"`)
+
+	_, err = server.NewAuthorizer([]server.Token{{Name: "a", Token: "x", Permissions: []server.Permission{{Operations: []string{"Watch", "LoadSnapshot"}}}}})
+	require.Nil(t, err)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/cluster"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// Cluster commits writes through consensus before they are applied to the
+// store, as *cluster.Node does
+type Cluster interface {
+	Put(key, value string, ttl time.Duration) error
+	Delete(key string) error
+	MultiPut(entries map[string]string, ttl time.Duration) error
+	MultiDelete(keys []string) error
+	CompareAndSwap(key, expected, value string) (string, bool, error)
+	Increment(key string, delta int64) (int64, error)
+	// VerifyLeader returns nil if reads from the store are linearizable
+	VerifyLeader() error
+}
+
+// standalone writes straight to the store, for servers that aren't clustered.
+// Writes report the error that stopped them from being recorded, if there is
+// one.
+type standalone struct {
+	store      store.Store
+	unrecorded func() error
+}
+
+func (s standalone) Put(key, value string, ttl time.Duration) error {
+	if ttl > 0 {
+		s.store.PutWithTTL(key, value, ttl)
+	} else {
+		s.store.Put(key, value)
+	}
+	return s.unrecorded()
+}
+
+func (s standalone) Delete(key string) error {
+	s.store.Delete(key)
+	return s.unrecorded()
+}
+
+func (s standalone) MultiPut(entries map[string]string, ttl time.Duration) error {
+	s.store.MultiPut(entries, ttl)
+	return s.unrecorded()
+}
+
+func (s standalone) MultiDelete(keys []string) error {
+	s.store.MultiDelete(keys)
+	return s.unrecorded()
+}
+
+func (s standalone) CompareAndSwap(key, expected, value string) (string, bool, error) {
+	current, swapped := s.store.CompareAndSwap(key, expected, value)
+	return current, swapped, s.unrecorded()
+}
+
+func (s standalone) Increment(key string, delta int64) (int64, error) {
+	value, err := s.store.Increment(key, delta)
+	if err != nil {
+		return 0, err
+	}
+	return value, s.unrecorded()
+}
+
+func (s standalone) VerifyLeader() error {
+	return nil
+}
+
+// clusterError converts an error from a cluster into a status. Requests sent
+// to a node that isn't the leader fail with FailedPrecondition errors naming
+// the leader, which they should be sent to instead.
+func clusterError(err error) error {
+	switch err {
+	case store.ErrNotInteger, store.ErrOverflow:
+		return incrementError(err)
+	case cluster.ErrTimeout:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	notLeader, ok := err.(*cluster.NotLeaderError)
+	if !ok {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	st := status.New(codes.FailedPrecondition, notLeader.Error())
+	metadata := map[string]string{"leader_id": notLeader.LeaderID}
+	if notLeader.LeaderAddress != "" {
+		metadata["leader"] = notLeader.LeaderAddress
+	}
+	detailed, detailsErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   "NOT_LEADER",
+		Domain:   "go-memory-cache",
+		Metadata: metadata,
+	})
+	if detailsErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+type clusterServer struct {
+	api.UnimplementedClusterServer
+
+	node *cluster.Node
+}
+
+// NewClusterServer serves the cluster API for a node, which reports on the
+// cluster and changes its members
+func NewClusterServer(node *cluster.Node) api.ClusterServer {
+	return clusterServer{
+		node: node,
+	}
+}
+
+func (s clusterServer) Status(ctx context.Context, request *api.ClusterStatusRequest) (*api.ClusterStatusResponse, error) {
+	nodeStatus, err := s.node.Status()
+	if err != nil {
+		return nil, clusterError(err)
+	}
+	response := &api.ClusterStatusResponse{
+		Id:            nodeStatus.ID,
+		State:         nodeStatus.State,
+		LeaderId:      nodeStatus.LeaderID,
+		LeaderAddress: nodeStatus.LeaderAddress,
+		Term:          nodeStatus.Term,
+		LastIndex:     nodeStatus.LastIndex,
+		AppliedIndex:  nodeStatus.AppliedIndex,
+	}
+	if !nodeStatus.LastContact.IsZero() {
+		response.LastContactMs = time.Since(nodeStatus.LastContact).Milliseconds()
+	}
+	for _, member := range nodeStatus.Members {
+		response.Members = append(response.Members, &api.ClusterMember{
+			Id:          member.ID,
+			RaftAddress: member.RaftAddress,
+			Address:     member.Address,
+			Voter:       member.Voter,
+		})
+	}
+	return response, nil
+}
+
+func (s clusterServer) Join(ctx context.Context, request *api.JoinRequest) (*api.JoinResponse, error) {
+	v := config{}.validator()
+	if request.Id == "" {
+		v.violation("id", "must not be empty")
+	}
+	if request.RaftAddress == "" {
+		v.violation("raft_address", "must not be empty")
+	}
+	if request.Address == "" {
+		v.violation("address", "must not be empty")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := s.node.Join(request.Id, request.RaftAddress, request.Address); err != nil {
+		return nil, clusterError(err)
+	}
+	return &api.JoinResponse{}, nil
+}
+
+func (s clusterServer) Remove(ctx context.Context, request *api.RemoveRequest) (*api.RemoveResponse, error) {
+	v := config{}.validator()
+	if request.Id == "" {
+		v.violation("id", "must not be empty")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := s.node.Remove(request.Id); err != nil {
+		return nil, clusterError(err)
+	}
+	return &api.RemoveResponse{}, nil
+}
@@ -0,0 +1,174 @@
+package server_test
+
+import (
+	"context"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/cluster"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+// startCluster serves the cache, admin and cluster APIs for each node of an
+// in-process cluster, and returns the connections to them by node ID
+func startCluster(t *testing.T, ids ...string) (*cluster.Harness, map[string]*grpc.ClientConn) {
+	h, err := cluster.NewHarness(cluster.Options{HeartbeatTimeout: 100 * time.Millisecond, ApplyTimeout: 2 * time.Second}, ids...)
+	require.Nil(t, err)
+	t.Cleanup(h.Shutdown)
+	conns := make(map[string]*grpc.ClientConn)
+	for _, id := range ids {
+		node, nodeStore := h.Node(id), h.Store(id)
+		conns[id] = serve(t, func(grpcServer *grpc.Server) {
+			api.RegisterCacheServer(grpcServer, server.NewServer(nodeStore, server.Clustered(node)))
+			api.RegisterAdminServer(grpcServer, server.NewAdminServer(nodeStore, store.SystemClock(), nil, server.Clustered(node)))
+			api.RegisterClusterServer(grpcServer, server.NewClusterServer(node))
+		})
+	}
+	return h, conns
+}
+
+func TestClustered(t *testing.T) {
+	h, conns := startCluster(t, "a", "b", "c")
+	leader, err := h.Leader(5 * time.Second)
+	require.Nil(t, err)
+	client := api.NewCacheClient(conns[leader.ID()])
+	ctx := context.Background()
+
+	_, err = client.Put(ctx, &api.PutRequest{Key: "a", Value: "1"})
+	require.Nil(t, err)
+	_, err = client.MultiPut(ctx, &api.MultiPutRequest{Entries: map[string]string{"b": "2", "c": "3"}, TtlMs: 60000})
+	require.Nil(t, err)
+	_, err = client.Delete(ctx, &api.DeleteRequest{Key: "c"})
+	require.Nil(t, err)
+	swapped, err := client.CompareAndSwap(ctx, &api.CompareAndSwapRequest{Key: "a", Expected: "1", Value: "10"})
+	require.Nil(t, err)
+	require.True(t, swapped.Swapped)
+	incremented, err := client.Increment(ctx, &api.IncrementRequest{Key: "a", Delta: 5})
+	require.Nil(t, err)
+	require.Equal(t, int64(15), incremented.Value)
+	_, err = client.Decrement(ctx, &api.DecrementRequest{Key: "a", Delta: 1})
+	require.Nil(t, err)
+	response, err := client.MultiGet(ctx, &api.MultiGetRequest{Keys: []string{"a", "b", "c"}})
+	require.Nil(t, err)
+	require.Equal(t, "14", response.Values[0].Value)
+	require.Equal(t, "2", response.Values[1].Value)
+	require.False(t, response.Values[2].Exists)
+
+	_, err = client.Put(ctx, &api.PutRequest{Key: "text", Value: "not a number"})
+	require.Nil(t, err)
+	_, err = client.Increment(ctx, &api.IncrementRequest{Key: "text", Delta: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Every node applies the writes
+	for _, id := range []string{"a", "b", "c"} {
+		require.Eventually(t, func() bool {
+			value, _ := h.Store(id).Get("a")
+			return value == "14"
+		}, 5*time.Second, 10*time.Millisecond, id)
+	}
+}
+
+func TestClusteredFollower(t *testing.T) {
+	h, conns := startCluster(t, "a", "b", "c")
+	leader, err := h.Leader(5 * time.Second)
+	require.Nil(t, err)
+	var follower string
+	for _, id := range []string{"a", "b", "c"} {
+		if id != leader.ID() {
+			follower = id
+		}
+	}
+	client := api.NewCacheClient(conns[follower])
+	ctx := context.Background()
+
+	// Followers send both reads and writes to the leader, once they know its
+	// address
+	require.Eventually(t, func() bool {
+		_, err := client.Get(ctx, &api.GetRequest{Key: "a"})
+		details := status.Convert(err).Details()
+		return len(details) == 1 && details[0].(*errdetails.ErrorInfo).Metadata["leader"] != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = client.Put(ctx, &api.PutRequest{Key: "a", Value: "1"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	details := status.Convert(err).Details()
+	require.Len(t, details, 1)
+	info := details[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "NOT_LEADER", info.Reason)
+	require.Equal(t, map[string]string{"leader_id": leader.ID(), "leader": leader.ID() + ":50051"}, info.Metadata)
+	for _, err := range []error{
+		func() error { _, err := client.Has(ctx, &api.HasRequest{Key: "a"}); return err }(),
+		func() error { _, err := client.MultiGet(ctx, &api.MultiGetRequest{Keys: []string{"a"}}); return err }(),
+		func() error { _, err := client.Delete(ctx, &api.DeleteRequest{Key: "a"}); return err }(),
+		func() error { _, err := client.Increment(ctx, &api.IncrementRequest{Key: "a", Delta: 1}); return err }(),
+		func() error {
+			stream, err := client.Scan(ctx, &api.ScanRequest{})
+			require.Nil(t, err)
+			_, err = stream.Recv()
+			return err
+		}(),
+	} {
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	}
+
+	// Stats are local, so any node serves them
+	_, err = client.Stats(ctx, &api.StatsRequest{})
+	require.Nil(t, err)
+}
+
+func TestClusteredLoadSnapshot(t *testing.T) {
+	h, conns := startCluster(t, "a")
+	leader, err := h.Leader(5 * time.Second)
+	require.Nil(t, err)
+	stream, err := api.NewAdminClient(conns[leader.ID()]).LoadSnapshot(context.Background())
+	require.Nil(t, err)
+	_, err = stream.CloseAndRecv()
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestClusterService(t *testing.T) {
+	h, conns := startCluster(t, "a", "b")
+	leader, err := h.Leader(5 * time.Second)
+	require.Nil(t, err)
+	client := api.NewClusterClient(conns[leader.ID()])
+	ctx := context.Background()
+
+	_, err = h.Add("c")
+	require.Nil(t, err)
+	_, err = client.Join(ctx, &api.JoinRequest{Id: "c", RaftAddress: "c", Address: "c:50051"})
+	require.Nil(t, err)
+	response, err := client.Status(ctx, &api.ClusterStatusRequest{})
+	require.Nil(t, err)
+	require.Equal(t, leader.ID(), response.Id)
+	require.Equal(t, "Leader", response.State)
+	require.Equal(t, leader.ID(), response.LeaderId)
+	require.Equal(t, leader.ID()+":50051", response.LeaderAddress)
+	require.NotZero(t, response.Term)
+	require.Len(t, response.Members, 3)
+	require.Equal(t, &api.ClusterMember{Id: "c", RaftAddress: "c", Address: "c:50051", Voter: true}, response.Members[2])
+
+	_, err = client.Remove(ctx, &api.RemoveRequest{Id: "c"})
+	require.Nil(t, err)
+	response, err = client.Status(ctx, &api.ClusterStatusRequest{})
+	require.Nil(t, err)
+	require.Len(t, response.Members, 2)
+
+	_, err = client.Join(ctx, &api.JoinRequest{Id: "d"})
+	requireViolations(t, err, "raft_address", "address")
+	_, err = client.Remove(ctx, &api.RemoveRequest{})
+	requireViolations(t, err, "id")
+
+	// Only the leader changes the members
+	for _, id := range []string{"a", "b"} {
+		if id == leader.ID() {
+			continue
+		}
+		_, err = api.NewClusterClient(conns[id]).Remove(ctx, &api.RemoveRequest{Id: leader.ID()})
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+)
+
+// serverVersion is the version the text protocols report
+const serverVersion = "1.0.0"
+
+// connServer accepts connections for the text protocols, and keeps track of
+// them so that they can all be closed
+type connServer struct {
+	handle func(conn net.Conn)
+
+	mutex     sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	handlers  sync.WaitGroup
+}
+
+func newConnServer(handle func(conn net.Conn)) *connServer {
+	return &connServer{
+		handle:    handle,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections until the listener fails or the server is closed.
+// It returns nil once the server is closed.
+func (s *connServer) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listeners[listener] = struct{}{}
+	s.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			delete(s.listeners, listener)
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.mutex.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *connServer) serveConn(conn net.Conn) {
+	defer s.handlers.Done()
+	defer func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.conns, conn)
+		conn.Close()
+	}()
+	// A bug handling one connection shouldn't take the server down
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic serving %v: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+	s.handle(conn)
+}
+
+// Close stops accepting connections, and closes the open ones. It waits for
+// commands in progress, so the store isn't changed once it returns.
+func (s *connServer) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.handlers.Wait()
+}
+
+// connections returns the number of open connections
+func (s *connServer) connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.conns)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"google.golang.org/grpc"
+	"log"
+	"sync"
+	"time"
+)
+
+// followerRetryInterval is how long a follower waits to reconnect after losing
+// its primary
+const followerRetryInterval = time.Second
+
+// FollowerStatus describes how far a replica is behind its primary
+type FollowerStatus struct {
+	Primary   string
+	Connected bool
+	// LogID and Sequence are the primary's change log, and the last change
+	// from it that was applied
+	LogID    string
+	Sequence uint64
+	// PrimarySequence is the last change the primary reported making
+	PrimarySequence uint64
+	// Lag is how long since the replica was last up to date, or 0 if it is
+	Lag time.Duration
+}
+
+// Follower keeps the store of a replica up to date with a primary
+type Follower struct {
+	client  api.ReplicationClient
+	primary string
+	store   store.Store
+	clock   store.Clock
+	logger  *log.Logger
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mutex    sync.Mutex
+	status   FollowerStatus
+	upToDate time.Time // When the replica was last up to date
+}
+
+// StartFollower replicates the primary at the other end of the connection
+// into the store, which nothing else should write to. A follower starts with a
+// full sync from a snapshot, then applies the primary's changes as they
+// happen. It reconnects when the connection fails, catching up from the
+// primary's change log if it can, or with another full sync if it can't.
+//
+// Reads from the store can see a mix of old and new data during a full sync.
+// The address of the primary is only used for reporting.
+func StartFollower(conn grpc.ClientConnInterface, primary string, store store.Store, clock store.Clock, logger *log.Logger) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		client:   api.NewReplicationClient(conn),
+		primary:  primary,
+		store:    store,
+		clock:    clock,
+		logger:   logger,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		status:   FollowerStatus{Primary: primary},
+		upToDate: clock.Now(),
+	}
+	go f.run(ctx)
+	return f
+}
+
+// Stop stops following the primary, and waits for any change being applied
+func (f *Follower) Stop() {
+	f.cancel()
+	<-f.done
+}
+
+func (f *Follower) Status() FollowerStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	status := f.status
+	if !status.Connected || status.Sequence < status.PrimarySequence {
+		status.Lag = f.clock.Now().Sub(f.upToDate)
+	}
+	return status
+}
+
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+	retry := f.clock.NewTicker(followerRetryInterval)
+	defer retry.Stop()
+	for {
+		err := f.follow(ctx)
+		f.mutex.Lock()
+		f.status.Connected = false
+		f.mutex.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		f.logger.Printf("Lost replication from %v: %v", f.primary, err)
+		select {
+		case <-retry.C():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow applies the changes from one stream, until it fails
+func (f *Follower) follow(ctx context.Context) error {
+	f.mutex.Lock()
+	request := &api.FollowRequest{
+		LogId:    f.status.LogID,
+		Sequence: f.status.Sequence,
+	}
+	f.mutex.Unlock()
+	stream, err := f.client.Follow(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	var snapshot bytes.Buffer
+	for {
+		response, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		f.mutex.Lock()
+		f.status.Connected = true
+		f.status.PrimarySequence = response.PrimarySequence
+		logID, sequence := f.status.LogID, f.status.Sequence
+		f.mutex.Unlock()
+
+		switch {
+		case len(response.SnapshotChunk) > 0 || response.SnapshotComplete:
+			snapshot.Write(response.SnapshotChunk)
+			if !response.SnapshotComplete {
+				continue
+			}
+			if err := f.loadSnapshot(&snapshot); err != nil {
+				return err
+			}
+			snapshot.Reset()
+			f.logger.Printf("Synced with %v at change %v", f.primary, response.SnapshotSequence)
+			logID, sequence = response.LogId, response.SnapshotSequence
+		case response.LogId != logID:
+			return errors.New("the primary's change log has changed")
+		default:
+			for _, message := range response.Changes {
+				change, err := changeFromProto(message)
+				if err != nil {
+					return err
+				}
+				if change.Sequence != sequence+1 {
+					return fmt.Errorf("received change %v after change %v", change.Sequence, sequence)
+				}
+				store.ApplyChange(f.store, change, f.clock)
+				sequence = change.Sequence
+			}
+		}
+
+		f.mutex.Lock()
+		f.status.LogID, f.status.Sequence = logID, sequence
+		if sequence >= f.status.PrimarySequence {
+			f.upToDate = f.clock.Now()
+		}
+		f.mutex.Unlock()
+	}
+}
+
+// loadSnapshot replaces the contents of the store with the snapshot
+func (f *Follower) loadSnapshot(snapshot *bytes.Buffer) error {
+	entries, err := store.ReadSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	store.ReplaceEntries(f.store, entries, f.clock)
+	return nil
+}
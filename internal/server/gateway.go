@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// gatewayKeysPath is the path keys are served under. The rest of the
+	// path, unescaped, is the key.
+	gatewayKeysPath = "/v1/keys/"
+	// gatewayMaxValueSize stands in for the value size limit when the server
+	// has none. It is gRPC's default limit on the size of a request.
+	gatewayMaxValueSize = 4 * 1024 * 1024
+	// gatewayBodyOverhead allows for the rest of a PUT body, besides the key
+	// and value
+	gatewayBodyOverhead = 1024
+	// gatewayMethods are the methods allowed on keys
+	gatewayMethods = "GET, HEAD, PUT, DELETE"
+)
+
+// Gateway serves the keys of the cache over HTTP and JSON, for clients that
+// can't use gRPC. Each request calls the gRPC method it corresponds to
+// through the interceptors, so it is logged, authorized and measured in the
+// same way, with the HTTP headers as metadata and the response headers
+// copied back. The API is described by api/openapi.yaml.
+type Gateway struct {
+	cache         api.CacheServer
+	interceptor   grpc.UnaryServerInterceptor
+	maxBodyLength int
+}
+
+// NewGateway creates a gateway to the cache server. The interceptors are
+// called in order, as grpc.ChainUnaryInterceptor does. The options should be
+// the cache server's, so that request bodies are only read up to the size
+// that its limits allow.
+func NewGateway(cache api.CacheServer, interceptors []grpc.UnaryServerInterceptor, options ...Option) *Gateway {
+	return &Gateway{
+		cache:         cache,
+		interceptor:   chainUnaryInterceptors(interceptors),
+		maxBodyLength: newConfig(options).maxBodyLength(),
+	}
+}
+
+// maxBodyLength returns the size of the largest PUT body that the limits
+// allow. JSON escapes can make each byte of the key and value six bytes
+// long. Without a key length limit, the key is bounded by the size of the
+// request headers, as it is also in the path.
+func (c config) maxBodyLength() int {
+	keyLength, valueSize := c.maxKeyLength, c.maxValueSize
+	if keyLength <= 0 {
+		keyLength = http.DefaultMaxHeaderBytes
+	}
+	if valueSize <= 0 {
+		valueSize = gatewayMaxValueSize
+	}
+	return 6*(keyLength+valueSize) + gatewayBodyOverhead
+}
+
+func chainUnaryInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(ctx context.Context, request interface{}) (interface{}, error) {
+				return interceptor(ctx, request, info, next)
+			}
+		}
+		return handler(ctx, request)
+	}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, gatewayKeysPath) {
+		writeGatewayError(w, status.Error(codes.NotFound, "unknown path"))
+		return
+	}
+	key, err := url.PathUnescape(strings.TrimPrefix(path, gatewayKeysPath))
+	if err != nil {
+		writeGatewayError(w, status.Error(codes.InvalidArgument, "invalid key: must be escaped correctly"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		response, err := g.call(w, r, "Get", &api.GetRequest{Key: key, NotFoundError: true}, func(ctx context.Context, request interface{}) (interface{}, error) {
+			return g.cache.Get(ctx, request.(*api.GetRequest))
+		})
+		if err != nil {
+			writeGatewayError(w, err)
+			return
+		}
+		writeGatewayResponse(w, http.StatusOK, response.(proto.Message))
+	case http.MethodHead:
+		response, err := g.call(w, r, "Has", &api.HasRequest{Key: key}, func(ctx context.Context, request interface{}) (interface{}, error) {
+			return g.cache.Has(ctx, request.(*api.HasRequest))
+		})
+		switch {
+		case err != nil:
+			w.WriteHeader(httpStatusFromCode(status.Code(err)))
+		case !response.(*api.HasResponse).Exists:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	case http.MethodPut:
+		request, err := readPutRequest(r.Body, key, g.maxBodyLength)
+		if err != nil {
+			writeGatewayError(w, err)
+			return
+		}
+		_, err = g.call(w, r, "Put", request, func(ctx context.Context, request interface{}) (interface{}, error) {
+			return g.cache.Put(ctx, request.(*api.PutRequest))
+		})
+		if err != nil {
+			writeGatewayError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		_, err := g.call(w, r, "Delete", &api.DeleteRequest{Key: key}, func(ctx context.Context, request interface{}) (interface{}, error) {
+			return g.cache.Delete(ctx, request.(*api.DeleteRequest))
+		})
+		if err != nil {
+			writeGatewayError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", gatewayMethods)
+		writeGatewayStatus(w, http.StatusMethodNotAllowed, status.New(codes.Unimplemented, "method not allowed"))
+	}
+}
+
+// call calls a method of the cache server through the interceptors, and
+// copies the headers they set to the response
+func (g *Gateway) call(w http.ResponseWriter, r *http.Request, method string, request interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	md := metadata.MD{}
+	for name, values := range r.Header {
+		md.Append(name, values...)
+	}
+	stream := &gatewayStream{method: "/api.Cache/" + method, header: metadata.MD{}}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	ctx = grpc.NewContextWithServerTransportStream(ctx, stream)
+
+	response, err := g.interceptor(ctx, request, &grpc.UnaryServerInfo{
+		Server:     g.cache,
+		FullMethod: stream.method,
+	}, handler)
+	for name, values := range stream.header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	return response, err
+}
+
+// readPutRequest reads a PutRequest in JSON from the body. The key comes from
+// the path, so a key in the body must be the same.
+func readPutRequest(body io.Reader, key string, maxLength int) (*api.PutRequest, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, int64(maxLength)+1))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to read request body: %v", err)
+	}
+	if len(data) > maxLength {
+		return nil, status.Error(codes.InvalidArgument, "request body is too large")
+	}
+	request := &api.PutRequest{}
+	if err := protojson.Unmarshal(data, request); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request body: %v", err)
+	}
+	if request.Key != "" && request.Key != key {
+		return nil, status.Error(codes.InvalidArgument, "invalid key: must match the path")
+	}
+	request.Key = key
+	return request, nil
+}
+
+// gatewayStream collects the headers set by the interceptors, such as the
+// request ID
+type gatewayStream struct {
+	method string
+	header metadata.MD
+}
+
+func (s *gatewayStream) Method() string {
+	return s.method
+}
+
+func (s *gatewayStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *gatewayStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *gatewayStream) SetTrailer(md metadata.MD) error {
+	return nil
+}
+
+// writeGatewayResponse writes the message as JSON, including fields with
+// default values
+func writeGatewayResponse(w http.ResponseWriter, code int, message proto.Message) {
+	body, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(message)
+	if err != nil {
+		writeGatewayError(w, status.Errorf(codes.Internal, "failed to encode response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// writeGatewayError writes the status of the error as JSON, with the HTTP
+// status code corresponding to its gRPC code
+func writeGatewayError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	if st.Code() == codes.Unauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeGatewayStatus(w, httpStatusFromCode(st.Code()), st)
+}
+
+func writeGatewayStatus(w http.ResponseWriter, code int, st *status.Status) {
+	writeGatewayResponse(w, code, st.Proto())
+}
+
+// httpStatusFromCode maps gRPC codes to HTTP status codes, as the gRPC
+// gateway does, except for FailedPrecondition. This server only returns it
+// for writes to replicas and requests to followers, which are fine to send
+// to another server, so they aren't reported as bad requests.
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // Client closed request
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
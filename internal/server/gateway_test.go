@@ -0,0 +1,159 @@
+package server_test
+
+import (
+	"bytes"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startGateway serves the store through a gateway, and returns its URL
+func startGateway(t *testing.T, cacheStore store.Store, interceptors ...grpc.UnaryServerInterceptor) string {
+	options := []server.Option{server.MaxKeyLength(8), server.MaxValueSize(20)}
+	httpServer := httptest.NewServer(server.NewGateway(server.NewServer(cacheStore, options...), interceptors, options...))
+	t.Cleanup(httpServer.Close)
+	return httpServer.URL + "/v1/keys/"
+}
+
+// do sends a request and returns the response with its body read
+func do(t *testing.T, method, url, body string, header ...string) (*http.Response, string) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.Nil(t, err)
+	for i := 0; i < len(header); i += 2 {
+		request.Header.Set(header[i], header[i+1])
+	}
+	response, err := http.DefaultClient.Do(request)
+	require.Nil(t, err)
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	require.Nil(t, err)
+	return response, string(data)
+}
+
+// requireJSON checks the status and JSON body of a response
+func requireJSON(t *testing.T, response *http.Response, body string, expectedStatus int, expectedBody string) {
+	t.Helper()
+	require.Equal(t, expectedStatus, response.StatusCode)
+	require.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	require.JSONEq(t, expectedBody, body)
+}
+
+func TestGateway(t *testing.T) {
+	url := startGateway(t, store.WithRWMutex(store.NewStore()))
+
+	response, body := do(t, "GET", url+"a", "")
+	requireJSON(t, response, body, http.StatusNotFound, `{"code": 5, "message": "key not found", "details": []}`)
+	response, _ = do(t, "HEAD", url+"a", "")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response, body = do(t, "PUT", url+"a", `{"value": "hello"}`)
+	require.Equal(t, http.StatusNoContent, response.StatusCode, body)
+	response, body = do(t, "GET", url+"a", "")
+	requireJSON(t, response, body, http.StatusOK, `{"exists": true, "value": "hello"}`)
+	response, _ = do(t, "HEAD", url+"a", "")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	// Keys are unescaped, and can contain slashes
+	response, _ = do(t, "PUT", url+"b%2F%20c", `{"value": ""}`)
+	require.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, body = do(t, "GET", url+"b/%20c", "")
+	requireJSON(t, response, body, http.StatusOK, `{"exists": true, "value": ""}`)
+
+	response, _ = do(t, "DELETE", url+"a", "")
+	require.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, _ = do(t, "GET", url+"a", "")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestGatewayTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	url := startGateway(t, store.NewStore(store.UseClock(clock)))
+
+	response, _ := do(t, "PUT", url+"a", `{"value": "1", "ttlMs": 1000}`)
+	require.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, _ = do(t, "PUT", url+"b", `{"key": "b", "value": "2", "ttl_ms": "2000"}`)
+	require.Equal(t, http.StatusNoContent, response.StatusCode)
+	clock.advance(time.Second)
+	response, _ = do(t, "HEAD", url+"a", "")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+	response, _ = do(t, "HEAD", url+"b", "")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestGatewayErrors(t *testing.T) {
+	url := startGateway(t, store.NewStore())
+
+	response, body := do(t, "GET", url+"too-long-key", "")
+	requireJSON(t, response, body, http.StatusBadRequest, `{"code": 3, "message": "invalid key: must be at most 8 bytes long", "details": [
+		{"@type": "type.googleapis.com/google.rpc.BadRequest", "fieldViolations": [{"field": "key", "description": "must be at most 8 bytes long"}]}
+	]}`)
+	response, _ = do(t, "HEAD", url+"too-long-key", "")
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response, _ = do(t, "PUT", url+"a", `value`)
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response, _ = do(t, "PUT", url+"a", `{"value": "1", "expiry": 10}`)
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response, body = do(t, "PUT", url+"a", `{"key": "b", "value": "1"}`)
+	requireJSON(t, response, body, http.StatusBadRequest, `{"code": 3, "message": "invalid key: must match the path", "details": []}`)
+
+	// Bodies are read up to the size that the limits allow, with every byte
+	// escaped
+	escaped := strings.Repeat(`\u0001`, 8)
+	response, body = do(t, "PUT", url+"a", `{"key": "`+escaped+`", "value": "`+strings.Repeat(`\u0001`, 20)+`"}`)
+	requireJSON(t, response, body, http.StatusBadRequest, `{"code": 3, "message": "invalid key: must match the path", "details": []}`)
+	response, body = do(t, "PUT", url+"a", `{"value": "1"}`+strings.Repeat(" ", 6*28+1024))
+	requireJSON(t, response, body, http.StatusBadRequest, `{"code": 3, "message": "request body is too large", "details": []}`)
+
+	response, _ = do(t, "POST", url+"a", "")
+	require.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+	require.Equal(t, "GET, HEAD, PUT, DELETE", response.Header.Get("Allow"))
+	response, _ = do(t, "GET", strings.TrimSuffix(url, "keys/")+"values/a", "")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestGatewayReadOnly(t *testing.T) {
+	options := []server.Option{server.ReadOnly("primary:50051")}
+	httpServer := httptest.NewServer(server.NewGateway(server.NewServer(store.NewStore(), options...), nil, options...))
+	t.Cleanup(httpServer.Close)
+
+	response, _ := do(t, "PUT", httpServer.URL+"/v1/keys/a", `{"value": "1"}`)
+	require.Equal(t, http.StatusConflict, response.StatusCode)
+	response, _ = do(t, "GET", httpServer.URL+"/v1/keys/a", "")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestGatewayInterceptors(t *testing.T) {
+	authorizer, err := server.NewAuthorizer([]server.Token{
+		{Name: "sessions", Token: "session-token", Permissions: []server.Permission{
+			{Prefix: "s:", Operations: []string{"Get", "Put"}},
+		}},
+	})
+	require.Nil(t, err)
+	var logs bytes.Buffer
+	requestLogger := server.NewRequestLogger(log.New(&logs, "", 0), nil)
+	url := startGateway(t, store.NewStore(), requestLogger.UnaryInterceptor(), authorizer.UnaryInterceptor())
+
+	response, _ := do(t, "GET", url+"s:1", "")
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	require.Equal(t, "Bearer", response.Header.Get("WWW-Authenticate"))
+
+	response, _ = do(t, "PUT", url+"s:1", `{"value": "1"}`, "Authorization", "Bearer session-token", "X-Request-Id", "request-1")
+	require.Equal(t, http.StatusNoContent, response.StatusCode)
+	require.Equal(t, "request-1", response.Header.Get("X-Request-Id"))
+	require.Contains(t, logs.String(), `"request_id":"request-1","method":"/api.Cache/Put","key":"s:1","value_size":1`)
+
+	response, body := do(t, "GET", url+"u:1", "", "Authorization", "Bearer session-token")
+	requireJSON(t, response, body, http.StatusForbidden, `{"code": 7, "message": "token \"sessions\" may not call Get on this key", "details": []}`)
+	response, _ = do(t, "DELETE", url+"s:1", "", "Authorization", "Bearer session-token")
+	require.Equal(t, http.StatusForbidden, response.StatusCode)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log"
+	"regexp"
+	"time"
+)
+
+// RequestIDHeader is the metadata key for the request ID. A request ID sent by
+// the client is used if there is one, otherwise one is generated. Either way it
+// is sent back in the response headers.
+const RequestIDHeader = "x-request-id"
+
+const redacted = "[redacted]"
+
+// RequestLogger logs a JSON line for each request. Values are never logged,
+// only their size, and keys matching any of the redaction patterns are
+// replaced.
+type RequestLogger struct {
+	logger     *log.Logger
+	redactions []*regexp.Regexp
+}
+
+func NewRequestLogger(logger *log.Logger, redactions []*regexp.Regexp) *RequestLogger {
+	return &RequestLogger{
+		logger:     logger,
+		redactions: redactions,
+	}
+}
+
+// requestLog is the JSON line logged for a request
+type requestLog struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Key        string  `json:"key,omitempty"`
+	Prefix     string  `json:"prefix,omitempty"`
+	KeyCount   int     `json:"key_count,omitempty"`
+	ValueSize  int     `json:"value_size,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+	Code       string  `json:"code"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func (l *RequestLogger) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		entry := requestLog{
+			RequestID: requestID(ctx),
+			Method:    info.FullMethod,
+		}
+		grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, entry.RequestID))
+		l.describe(&entry, request)
+
+		response, err := handler(ctx, request)
+		l.log(&entry, start, err)
+		return response, err
+	}
+}
+
+func (l *RequestLogger) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		entry := requestLog{
+			RequestID: requestID(stream.Context()),
+			Method:    info.FullMethod,
+		}
+		stream.SetHeader(metadata.Pairs(RequestIDHeader, entry.RequestID))
+
+		err := handler(server, &loggedStream{
+			ServerStream: stream,
+			logger:       l,
+			entry:        &entry,
+		})
+		l.log(&entry, start, err)
+		return err
+	}
+}
+
+// loggedStream describes the first message received, which is the request for
+// server streaming methods
+type loggedStream struct {
+	grpc.ServerStream
+	logger   *RequestLogger
+	entry    *requestLog
+	received bool
+}
+
+func (s *loggedStream) RecvMsg(message interface{}) error {
+	err := s.ServerStream.RecvMsg(message)
+	if err == nil && !s.received {
+		s.received = true
+		s.logger.describe(s.entry, message)
+	}
+	return err
+}
+
+// describe adds the keys and value sizes of the request to the log entry,
+// using the getters of the generated messages
+func (l *RequestLogger) describe(entry *requestLog, request interface{}) {
+	if r, ok := request.(interface{ GetKey() string }); ok {
+		entry.Key = l.redact(r.GetKey())
+	}
+	if r, ok := request.(interface{ GetPrefix() string }); ok {
+		entry.Prefix = l.redact(r.GetPrefix())
+	}
+	if r, ok := request.(interface{ GetKeys() []string }); ok {
+		entry.KeyCount = len(r.GetKeys())
+	}
+	if r, ok := request.(interface{ GetValue() string }); ok {
+		entry.ValueSize = len(r.GetValue())
+	}
+	if r, ok := request.(interface{ GetEntries() map[string]string }); ok {
+		entry.KeyCount = len(r.GetEntries())
+		for _, value := range r.GetEntries() {
+			entry.ValueSize += len(value)
+		}
+	}
+}
+
+func (l *RequestLogger) redact(key string) string {
+	for _, pattern := range l.redactions {
+		if pattern.MatchString(key) {
+			return redacted
+		}
+	}
+	return key
+}
+
+func (l *RequestLogger) log(entry *requestLog, start time.Time, err error) {
+	entry.Time = start.UTC().Format(time.RFC3339Nano)
+	entry.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+	st := status.Convert(err)
+	entry.Code = st.Code().String()
+	entry.Error = st.Message()
+	line, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		l.logger.Printf("Failed to log request: %v", marshalErr)
+		return
+	}
+	l.logger.Print(string(line))
+}
+
+// requestID returns the ID sent by the client, or generates a new one
+func requestID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(RequestIDHeader); len(ids) > 0 && ids[0] != "" {
+			return ids[0]
+		}
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
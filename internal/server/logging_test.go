@@ -0,0 +1,106 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logBuffer collects log lines from the server goroutines
+type logBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func (b *logBuffer) lines(t *testing.T) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var fields map[string]interface{}
+		require.Nil(t, json.Unmarshal([]byte(line), &fields), line)
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+// startLoggedServer serves the cache API with the logging interceptors
+func startLoggedServer(t *testing.T, output io.Writer, redactions ...*regexp.Regexp) api.CacheClient {
+	requestLogger := server.NewRequestLogger(log.New(output, "", 0), redactions)
+	return api.NewCacheClient(serve(t, func(grpcServer *grpc.Server) {
+		api.RegisterCacheServer(grpcServer, server.NewServer(store.NewStore()))
+	}, grpc.UnaryInterceptor(requestLogger.UnaryInterceptor()), grpc.StreamInterceptor(requestLogger.StreamInterceptor())))
+}
+
+func TestRequestLogging(t *testing.T) {
+	var output logBuffer
+	client := startLoggedServer(t, &output, regexp.MustCompile(`^secret:`))
+
+	var header metadata.MD
+	ctx := metadata.AppendToOutgoingContext(context.Background(), server.RequestIDHeader, "test request")
+	_, err := client.Put(ctx, &api.PutRequest{
+		Key:   "test key",
+		Value: "private value",
+	}, grpc.Header(&header))
+	require.Nil(t, err)
+	require.Equal(t, []string{"test request"}, header.Get(server.RequestIDHeader))
+
+	_, err = client.Get(context.Background(), &api.GetRequest{
+		Key:           "secret:key",
+		NotFoundError: true,
+	}, grpc.Header(&header))
+	require.NotNil(t, err)
+	generatedID := header.Get(server.RequestIDHeader)
+	require.Len(t, generatedID, 1)
+
+	stream, err := client.Scan(context.Background(), &api.ScanRequest{
+		Prefix: "test",
+	})
+	require.Nil(t, err)
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	require.Equal(t, io.EOF, err)
+
+	require.NotContains(t, output.String(), "private value")
+	require.NotContains(t, output.String(), "secret:key")
+	lines := output.lines(t)
+	require.Len(t, lines, 3)
+
+	require.Equal(t, "test request", lines[0]["request_id"])
+	require.Equal(t, "/api.Cache/Put", lines[0]["method"])
+	require.Equal(t, "test key", lines[0]["key"])
+	require.Equal(t, float64(len("private value")), lines[0]["value_size"])
+	require.Equal(t, "OK", lines[0]["code"])
+	require.Contains(t, lines[0], "duration_ms")
+
+	require.Equal(t, generatedID[0], lines[1]["request_id"])
+	require.Equal(t, "[redacted]", lines[1]["key"])
+	require.Equal(t, "NotFound", lines[1]["code"])
+
+	require.Equal(t, "/api.Cache/Scan", lines[2]["method"])
+	require.Equal(t, "test", lines[2]["prefix"])
+	require.Equal(t, "OK", lines[2]["code"])
+}
@@ -0,0 +1,568 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"google.golang.org/grpc/status"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxMemcachedValueLength bounds the memory a single command can make the
+	// server allocate, when there is no value size limit
+	maxMemcachedValueLength = 512 * 1024 * 1024
+	// maxMemcachedAuthLength bounds the data of commands from clients that
+	// haven't authenticated, which only has to hold a username and token
+	maxMemcachedAuthLength = 4 * 1024
+	// maxMemcachedRelativeExpiry is the largest expiry time that is relative,
+	// in seconds. Larger ones are Unix timestamps.
+	maxMemcachedRelativeExpiry = 30 * 24 * 60 * 60
+	// memcachedFlushPageSize is the number of keys deleted at a time by
+	// flush_all
+	memcachedFlushPageSize = 1000
+)
+
+// MemcachedServer serves the memcached text protocol from the store, so that
+// memcached clients can be pointed at it. Requests are validated using the
+// same options as the gRPC server.
+//
+// The store has no client flags or versions. Flags are accepted, as long as
+// they fit in 32 bits, but not stored, so values are always returned with
+// flags of 0. The CAS unique value is a hash of the value, so a cas succeeds
+// if the value was changed and then changed back.
+type MemcachedServer struct {
+	// Counters for stats, updated atomically
+	cmdGet    uint64
+	cmdSet    uint64
+	getHits   uint64
+	getMisses uint64
+
+	*connServer
+	config
+	store      store.Store
+	authorizer *Authorizer
+	started    time.Time
+}
+
+// NewMemcachedServer creates a memcached server for the store. If the
+// authorizer isn't nil, clients must authenticate as memcached's text
+// protocol does, with a set command whose data is a username and a token
+// separated by a space. The username is ignored, and the token's permissions
+// apply to the gRPC methods each command corresponds to.
+func NewMemcachedServer(store store.Store, authorizer *Authorizer, options ...Option) *MemcachedServer {
+	s := &MemcachedServer{
+		config:     newConfig(options),
+		store:      store,
+		authorizer: authorizer,
+		started:    time.Now(),
+	}
+	s.connServer = newConnServer(s.serveConn)
+	return s
+}
+
+// memcachedSession is the state of one connection
+type memcachedSession struct {
+	server *MemcachedServer
+	reader *bufio.Reader
+	writer *bufio.Writer
+	token  *Token // Nil until authenticated
+}
+
+// errMemcachedClosed stops a session after its reply is sent
+type errMemcachedClosed struct{}
+
+func (errMemcachedClosed) Error() string {
+	return "connection closed"
+}
+
+func (s *MemcachedServer) serveConn(conn net.Conn) {
+	session := &memcachedSession{
+		server: s,
+		reader: bufio.NewReaderSize(conn, 64*1024),
+		writer: bufio.NewWriter(conn),
+	}
+	for {
+		line, err := session.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			session.writer.WriteString("CLIENT_ERROR line too long\r\n")
+			session.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		args := strings.Fields(string(line))
+		if len(args) == 0 {
+			session.writer.WriteString("ERROR\r\n")
+			continue
+		}
+		err = session.execute(args)
+		// Replies to pipelined commands are sent together
+		if err != nil || session.reader.Buffered() == 0 {
+			if flushErr := session.writer.Flush(); flushErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a command. An error closes the connection.
+func (c *memcachedSession) execute(args []string) error {
+	name := args[0]
+	if name == "quit" {
+		return errMemcachedClosed{}
+	}
+	if c.server.authorizer != nil && c.token == nil {
+		if name == "set" {
+			return c.authenticate(args)
+		}
+		c.writer.WriteString("CLIENT_ERROR unauthenticated\r\n")
+		return nil
+	}
+
+	switch name {
+	case "get", "gets":
+		c.get(args)
+	case "set", "add", "replace", "cas":
+		return c.storage(args)
+	case "delete":
+		c.delete(args)
+	case "incr", "decr":
+		c.incr(args)
+	case "flush_all":
+		c.flushAll(args)
+	case "stats":
+		c.stats(args)
+	case "version":
+		c.writer.WriteString("VERSION " + serverVersion + "\r\n")
+	default:
+		c.writer.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+// reply writes a reply, unless the client asked for none
+func (c *memcachedSession) reply(noreply bool, message string) {
+	if !noreply {
+		c.writer.WriteString(message + "\r\n")
+	}
+}
+
+// authorized checks that the token allows the operation on every key, and
+// that the server accepts writes if it is one, replying with an error if not
+func (c *memcachedSession) authorized(noreply bool, operation string, keys ...string) bool {
+	if c.server.primary != "" && writeOperations[operation] {
+		c.reply(noreply, "SERVER_ERROR this server is a read-only replica, send writes to the primary at "+c.server.primary)
+		return false
+	}
+	if writeOperations[operation] {
+		if err := c.server.unrecorded(); err != nil {
+			c.reply(noreply, "SERVER_ERROR "+err.Error())
+			return false
+		}
+		if err := c.server.loading(); err != nil {
+			c.reply(noreply, "SERVER_ERROR "+err.Error())
+			return false
+		}
+	}
+	if c.token == nil {
+		return true
+	}
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	for _, key := range keys {
+		if !c.token.allows(operation, key) {
+			c.reply(noreply, "CLIENT_ERROR permission denied")
+			return false
+		}
+	}
+	return true
+}
+
+// valid writes an error reply and returns false if the validator found a
+// problem
+func (c *memcachedSession) valid(noreply bool, v *validator) bool {
+	if err := v.err(); err != nil {
+		c.reply(noreply, "CLIENT_ERROR "+status.Convert(err).Message())
+		return false
+	}
+	return true
+}
+
+// authenticate reads the data of a set command as a username and token
+func (c *memcachedSession) authenticate(args []string) error {
+	if len(args) < 5 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	data, ok, err := c.readData(args, 4)
+	if err != nil || !ok {
+		return err
+	}
+	fields := strings.Fields(data)
+	if len(fields) != 2 {
+		c.writer.WriteString("CLIENT_ERROR authentication failure\r\n")
+		return nil
+	}
+	token, ok := c.server.authorizer.lookup(fields[1])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR authentication failure\r\n")
+		return nil
+	}
+	c.token = token
+	c.writer.WriteString("STORED\r\n")
+	return nil
+}
+
+// readData reads the data block of a storage command, whose length is the
+// argument at the index. It returns false if it replied with an error, and an
+// error if the connection can't continue. Data longer than the session may
+// store is discarded as it is read, rather than buffered.
+func (c *memcachedSession) readData(args []string, index int) (string, bool, error) {
+	length, err := strconv.Atoi(args[index])
+	if err != nil || length < 0 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return "", false, nil
+	}
+	if length > c.maxDataLength() {
+		if _, err := io.CopyN(ioutil.Discard, c.reader, int64(length)+2); err != nil {
+			return "", false, err
+		}
+		c.writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return "", false, nil
+	}
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return "", false, err
+	}
+	if data[length] != '\r' || data[length+1] != '\n' {
+		// The rest of the connection can't be parsed reliably
+		c.writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return "", false, errMemcachedClosed{}
+	}
+	return string(data[:length]), true, nil
+}
+
+// maxDataLength returns the length of the longest data block the session
+// accepts
+func (c *memcachedSession) maxDataLength() int {
+	switch {
+	case c.server.authorizer != nil && c.token == nil:
+		return maxMemcachedAuthLength
+	case c.server.maxValueSize > 0 && c.server.maxValueSize < maxMemcachedValueLength:
+		return c.server.maxValueSize
+	default:
+		return maxMemcachedValueLength
+	}
+}
+
+// memcachedTTL converts an expiry time, which is either relative in seconds
+// or a Unix timestamp, to a time to live. A ttl of zero means no expiry, and
+// expired is true if the item has already expired.
+func memcachedTTL(exptime int64, now time.Time) (ttl time.Duration, expired bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= maxMemcachedRelativeExpiry:
+		return time.Duration(exptime) * time.Second, false
+	default:
+		ttl = time.Unix(exptime, 0).Sub(now)
+		return ttl, ttl <= 0
+	}
+}
+
+// casUnique identifies a value for gets and cas
+func casUnique(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	return hash.Sum64()
+}
+
+// get handles get and gets, which also returns the CAS unique value
+func (c *memcachedSession) get(args []string) {
+	keys := args[1:]
+	if len(keys) == 0 {
+		c.writer.WriteString("ERROR\r\n")
+		return
+	}
+	v := c.server.validator()
+	for _, key := range keys {
+		v.key("key", key)
+	}
+	if !c.valid(false, v) || !c.authorized(false, "Get", keys...) {
+		return
+	}
+
+	values := c.server.store.MultiGet(keys)
+	atomic.AddUint64(&c.server.cmdGet, uint64(len(keys)))
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			atomic.AddUint64(&c.server.getMisses, 1)
+			continue
+		}
+		atomic.AddUint64(&c.server.getHits, 1)
+		if args[0] == "gets" {
+			fmt.Fprintf(c.writer, "VALUE %v 0 %v %v\r\n", key, len(value), casUnique(value))
+		} else {
+			fmt.Fprintf(c.writer, "VALUE %v 0 %v\r\n", key, len(value))
+		}
+		c.writer.WriteString(value + "\r\n")
+	}
+	c.writer.WriteString("END\r\n")
+}
+
+// storage handles set, add, replace and cas:
+//
+//	<command> <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+func (c *memcachedSession) storage(args []string) error {
+	name := args[0]
+	count := 5
+	if name == "cas" {
+		count = 6
+	}
+	noreply := len(args) == count+1 && args[count] == "noreply"
+	if len(args) != count && !noreply {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	value, ok, err := c.readData(args, 4)
+	if err != nil || !ok {
+		return err
+	}
+
+	key := args[1]
+	_, flagsErr := strconv.ParseUint(args[2], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[3], 10, 64)
+	var unique uint64
+	var uniqueErr error
+	if name == "cas" {
+		unique, uniqueErr = strconv.ParseUint(args[5], 10, 64)
+	}
+	if flagsErr != nil || exptimeErr != nil || uniqueErr != nil {
+		c.reply(noreply, "CLIENT_ERROR bad command line format")
+		return nil
+	}
+	v := c.server.validator()
+	v.key("key", key)
+	v.value("value", value)
+	operation := "Put"
+	if name == "cas" {
+		operation = "CompareAndSwap"
+	}
+	if !c.valid(noreply, v) || !c.authorized(noreply, operation, key) {
+		return nil
+	}
+
+	atomic.AddUint64(&c.server.cmdSet, 1)
+	ttl, expired := memcachedTTL(exptime, time.Now())
+	cacheStore := c.server.store
+	// add and replace check the key and then write it, so they can race with
+	// other writes to the same key
+	switch name {
+	case "add":
+		if cacheStore.Has(key) {
+			c.reply(noreply, "NOT_STORED")
+			return nil
+		}
+	case "replace":
+		if !cacheStore.Has(key) {
+			c.reply(noreply, "NOT_STORED")
+			return nil
+		}
+	case "cas":
+		current, ok := cacheStore.Get(key)
+		if !ok {
+			c.reply(noreply, "NOT_FOUND")
+			return nil
+		}
+		if casUnique(current) != unique {
+			c.reply(noreply, "EXISTS")
+			return nil
+		}
+		if _, swapped := cacheStore.CompareAndSwap(key, current, value); !swapped {
+			c.reply(noreply, "EXISTS")
+			return nil
+		}
+		// The swap keeps the old expiry, so a new one is set by writing the
+		// value again
+		if ttl == 0 && !expired {
+			c.reply(noreply, "STORED")
+			return nil
+		}
+	}
+
+	switch {
+	case expired:
+		cacheStore.Delete(key)
+	case ttl > 0:
+		cacheStore.PutWithTTL(key, value, ttl)
+	default:
+		cacheStore.Put(key, value)
+	}
+	c.reply(noreply, "STORED")
+	return nil
+}
+
+// delete handles delete <key> [0] [noreply]
+func (c *memcachedSession) delete(args []string) {
+	noreply := args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) == 3 && args[2] == "0" {
+		args = args[:2]
+	}
+	if len(args) != 2 {
+		c.reply(noreply, "CLIENT_ERROR bad command line format")
+		return
+	}
+	key := args[1]
+	v := c.server.validator()
+	v.key("key", key)
+	if !c.valid(noreply, v) || !c.authorized(noreply, "Delete", key) {
+		return
+	}
+	if !c.server.store.Has(key) {
+		c.reply(noreply, "NOT_FOUND")
+		return
+	}
+	c.server.store.Delete(key)
+	c.reply(noreply, "DELETED")
+}
+
+// incr handles incr and decr <key> <value> [noreply]. Values are unsigned
+// 64-bit integers, which wrap around when incremented and stop at zero when
+// decremented, and missing keys aren't created.
+func (c *memcachedSession) incr(args []string) {
+	noreply := len(args) == 4 && args[3] == "noreply"
+	if len(args) != 3 && !noreply {
+		c.writer.WriteString("ERROR\r\n")
+		return
+	}
+	key := args[1]
+	delta, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		c.reply(noreply, "CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	operation := "Increment"
+	if args[0] == "decr" {
+		operation = "Decrement"
+	}
+	v := c.server.validator()
+	v.key("key", key)
+	if !c.valid(noreply, v) || !c.authorized(noreply, operation, key) {
+		return
+	}
+
+	// The store's Increment is signed and creates missing keys, so swap the
+	// value instead, retrying if it changes in between
+	for {
+		current, ok := c.server.store.Get(key)
+		if !ok {
+			c.reply(noreply, "NOT_FOUND")
+			return
+		}
+		value, err := strconv.ParseUint(current, 10, 64)
+		if err != nil {
+			c.reply(noreply, "CLIENT_ERROR cannot increment or decrement non-numeric value")
+			return
+		}
+		switch {
+		case args[0] == "incr":
+			value += delta
+		case delta > value:
+			value = 0
+		default:
+			value -= delta
+		}
+		next := strconv.FormatUint(value, 10)
+		if _, swapped := c.server.store.CompareAndSwap(key, current, next); swapped {
+			c.reply(noreply, next)
+			return
+		}
+	}
+}
+
+// flushAll handles flush_all [0] [noreply], deleting every key a page at a
+// time. Delayed flushes aren't supported.
+func (c *memcachedSession) flushAll(args []string) {
+	noreply := args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) > 2 {
+		c.reply(noreply, "CLIENT_ERROR bad command line format")
+		return
+	}
+	if len(args) == 2 && args[1] != "0" {
+		c.reply(noreply, "CLIENT_ERROR delayed flush is not supported")
+		return
+	}
+	if !c.authorized(noreply, "MultiDelete") {
+		return
+	}
+	cursor := ""
+	for {
+		keys, next := c.server.store.Scan("", cursor, memcachedFlushPageSize)
+		c.server.store.MultiDelete(keys)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	c.reply(noreply, "OK")
+}
+
+// stats reports the general statistics. Other groups of statistics aren't
+// supported.
+func (c *memcachedSession) stats(args []string) {
+	if len(args) > 1 {
+		c.writer.WriteString("ERROR\r\n")
+		return
+	}
+	if !c.authorized(false, "Stats") {
+		return
+	}
+	s := c.server
+	storeStats := s.store.Stats()
+	now := time.Now()
+	for _, stat := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"pid", os.Getpid()},
+		{"uptime", int64(now.Sub(s.started).Seconds())},
+		{"time", now.Unix()},
+		{"version", serverVersion},
+		{"curr_connections", s.connections()},
+		{"cmd_get", atomic.LoadUint64(&s.cmdGet)},
+		{"cmd_set", atomic.LoadUint64(&s.cmdSet)},
+		{"get_hits", atomic.LoadUint64(&s.getHits)},
+		{"get_misses", atomic.LoadUint64(&s.getMisses)},
+		{"curr_items", storeStats.Entries},
+		{"bytes", storeStats.Bytes},
+		{"limit_maxbytes", storeStats.MaxBytes},
+		{"evictions", storeStats.Evictions},
+	} {
+		fmt.Fprintf(c.writer, "STAT %v %v\r\n", stat.name, stat.value)
+	}
+	c.writer.WriteString("END\r\n")
+}
@@ -0,0 +1,182 @@
+package server_test
+
+import (
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startMemcachedServer serves the store over the memcached text protocol on a
+// local port, and returns a function to open connections to it
+func startMemcachedServer(t *testing.T, cacheStore store.Store, authorizer *server.Authorizer, options ...server.Option) func() net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	memcachedServer := server.NewMemcachedServer(cacheStore, authorizer, options...)
+	go memcachedServer.Serve(listener)
+	t.Cleanup(memcachedServer.Close)
+
+	return func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.Nil(t, err)
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		return conn
+	}
+}
+
+// casUniqueOf returns the CAS unique value of a key from a gets reply
+func casUniqueOf(t *testing.T, conn net.Conn, key string) string {
+	t.Helper()
+	_, err := conn.Write([]byte("gets " + key + "\r\n"))
+	require.Nil(t, err)
+	reply := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(reply)
+	require.Nil(t, err)
+	match := regexp.MustCompile(`^VALUE \S+ 0 \d+ (\d+)\r\n`).FindSubmatch(reply[:n])
+	require.NotNil(t, match, "received %q", reply[:n])
+	return string(match[1])
+}
+
+func TestMemcachedCommands(t *testing.T) {
+	conn := startMemcachedServer(t, store.WithRWMutex(store.NewStore()), nil)()
+
+	exchange(t, conn, "get a\r\n", "END\r\n")
+	exchange(t, conn, "set a 0 0 5\r\nhello\r\n", "STORED\r\n")
+	exchange(t, conn, "get a b a\r\n", "VALUE a 0 5\r\nhello\r\n", "VALUE a 0 5\r\nhello\r\n", "END\r\n")
+	exchange(t, conn, "add a 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	exchange(t, conn, "add b 0 0 1\r\nx\r\n", "STORED\r\n")
+	exchange(t, conn, "replace c 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	exchange(t, conn, "replace b 0 0 2\r\n10\r\n", "STORED\r\n")
+	exchange(t, conn, "incr b 5\r\n", "15\r\n")
+	exchange(t, conn, "decr b 20\r\n", "0\r\n")
+	exchange(t, conn, "incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	exchange(t, conn, "incr c 1\r\n", "NOT_FOUND\r\n")
+	exchange(t, conn, "set c 0 0 20\r\n18446744073709551615\r\n", "STORED\r\n")
+	exchange(t, conn, "incr c 2\r\n", "1\r\n")
+	exchange(t, conn, "delete c\r\n", "DELETED\r\n")
+	exchange(t, conn, "delete c\r\n", "NOT_FOUND\r\n")
+	exchange(t, conn, "version\r\n", "VERSION 1.0.0\r\n")
+
+	// Flags are accepted, but not stored
+	exchange(t, conn, "set e 4294967295 0 1\r\nx\r\n", "STORED\r\n")
+	exchange(t, conn, "get e\r\n", "VALUE e 0 1\r\nx\r\n", "END\r\n")
+
+	// Replies can be suppressed
+	exchange(t, conn, "set d 0 0 1 noreply\r\n1\r\ndelete d noreply\r\nget d\r\n", "END\r\n")
+
+	exchange(t, conn, "flush_all\r\n", "OK\r\n")
+	exchange(t, conn, "get a b\r\n", "END\r\n")
+
+	exchange(t, conn, "quit\r\n")
+	_, err := conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestMemcachedCAS(t *testing.T) {
+	conn := startMemcachedServer(t, store.WithRWMutex(store.NewStore()), nil)()
+
+	exchange(t, conn, "cas a 0 0 1 1\r\nx\r\n", "NOT_FOUND\r\n")
+	exchange(t, conn, "set a 0 0 1\r\n1\r\n", "STORED\r\n")
+	unique := casUniqueOf(t, conn, "a")
+	exchange(t, conn, fmt.Sprintf("cas a 0 0 1 %v\r\n2\r\n", unique), "STORED\r\n")
+	exchange(t, conn, fmt.Sprintf("cas a 0 0 1 %v\r\n3\r\n", unique), "EXISTS\r\n")
+	exchange(t, conn, "get a\r\n", "VALUE a 0 1\r\n2\r\n", "END\r\n")
+}
+
+func TestMemcachedExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	conn := startMemcachedServer(t, store.NewStore(store.UseClock(clock)), nil)()
+
+	exchange(t, conn, "set a 0 10 1\r\n1\r\n", "STORED\r\n")
+	exchange(t, conn, "set b 0 1 1\r\n2\r\n", "STORED\r\n")
+	exchange(t, conn, "set c 0 -1 1\r\n3\r\n", "STORED\r\n")
+	clock.advance(time.Second)
+	exchange(t, conn, "get a b c\r\n", "VALUE a 0 1\r\n1\r\n", "END\r\n")
+
+	// Times after 30 days are Unix timestamps
+	exchange(t, conn, fmt.Sprintf("set d 0 %v 1\r\n4\r\n", time.Now().Add(-time.Hour).Unix()), "STORED\r\n")
+	exchange(t, conn, "get d\r\n", "END\r\n")
+}
+
+func TestMemcachedErrors(t *testing.T) {
+	connect := startMemcachedServer(t, store.NewStore(), nil, server.MaxKeyLength(3), server.MaxValueSize(4))
+	conn := connect()
+
+	exchange(t, conn, "touch a 10\r\n", "ERROR\r\n")
+	exchange(t, conn, "get\r\n", "ERROR\r\n")
+	exchange(t, conn, "get long\r\n", "CLIENT_ERROR invalid key: must be at most 3 bytes long\r\n")
+	exchange(t, conn, "set a 0 0\r\n", "CLIENT_ERROR bad command line format\r\n")
+	exchange(t, conn, "set a 4294967296 0 1\r\nx\r\n", "CLIENT_ERROR bad command line format\r\n")
+	exchange(t, conn, "incr a x\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n")
+	exchange(t, conn, "flush_all 10\r\n", "CLIENT_ERROR delayed flush is not supported\r\n")
+	exchange(t, conn, "stats slabs\r\n", "ERROR\r\n")
+
+	// Data larger than a value can be is discarded, and the connection
+	// carries on
+	exchange(t, conn, "set a 0 0 5\r\nhello\r\nget a\r\n", "SERVER_ERROR object too large for cache\r\n", "END\r\n")
+
+	// Data of the wrong length closes the connection
+	exchange(t, conn, "set a 0 0 1\r\nxyz\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	_, err := conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestMemcachedStats(t *testing.T) {
+	conn := startMemcachedServer(t, store.NewStore(store.MaxBytes(1024)), nil)()
+
+	exchange(t, conn, "set a 0 0 1\r\n1\r\n", "STORED\r\n")
+	exchange(t, conn, "get a b\r\n", "VALUE a 0 1\r\n1\r\n", "END\r\n")
+	_, err := conn.Write([]byte("stats\r\n"))
+	require.Nil(t, err)
+	var reply string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !strings.HasSuffix(reply, "END\r\n") {
+		buffer := make([]byte, 1024)
+		n, err := conn.Read(buffer)
+		require.Nil(t, err)
+		reply += string(buffer[:n])
+	}
+	for _, stat := range []string{
+		"STAT curr_connections 1\r\n",
+		"STAT cmd_get 2\r\n",
+		"STAT cmd_set 1\r\n",
+		"STAT get_hits 1\r\n",
+		"STAT get_misses 1\r\n",
+		"STAT curr_items 1\r\n",
+		"STAT limit_maxbytes 1024\r\n",
+		"STAT version 1.0.0\r\n",
+	} {
+		require.Contains(t, reply, stat)
+	}
+}
+
+func TestMemcachedAuthorization(t *testing.T) {
+	authorizer, err := server.NewAuthorizer([]server.Token{
+		{Name: "sessions", Token: "session-token", Permissions: []server.Permission{
+			{Prefix: "session:", Operations: []string{"Get", "Put"}},
+		}},
+	})
+	require.Nil(t, err)
+	conn := startMemcachedServer(t, store.NewStore(), authorizer)()
+
+	exchange(t, conn, "get session:1\r\n", "CLIENT_ERROR unauthenticated\r\n")
+	exchange(t, conn, "set auth 0 0 10\r\nuser wrong\r\n", "CLIENT_ERROR authentication failure\r\n")
+	// Before authenticating, data longer than a token is discarded unread
+	exchange(t, conn, "set auth 0 0 5000\r\n"+strings.Repeat("x", 5000)+"\r\n", "SERVER_ERROR object too large for cache\r\n")
+	exchange(t, conn, "set auth 0 0 18\r\nuser session-token\r\n", "STORED\r\n")
+	exchange(t, conn, "set session:1 0 0 5000\r\n"+strings.Repeat("x", 5000)+"\r\n", "STORED\r\n")
+	exchange(t, conn, "set session:1 0 0 1\r\na\r\n", "STORED\r\n")
+	exchange(t, conn, "get session:1\r\n", "VALUE session:1 0 1\r\na\r\n", "END\r\n")
+	exchange(t, conn, "get session:1 user:1\r\n", "CLIENT_ERROR permission denied\r\n")
+	exchange(t, conn, "delete session:1\r\n", "CLIENT_ERROR permission denied\r\n")
+	exchange(t, conn, "flush_all\r\n", "CLIENT_ERROR permission denied\r\n")
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"sync"
+)
+
+// Readiness reports whether the store is ready through the standard gRPC health
+// service. The store is not ready until Ready is called, or while a snapshot
+// is loading.
+type Readiness struct {
+	mutex   sync.Mutex
+	health  *health.Server
+	ready   bool
+	loading int // The number of loads in progress
+}
+
+// NewReadiness reports that the store isn't ready yet, for the whole server
+// and for each service
+func NewReadiness(health *health.Server) *Readiness {
+	r := &Readiness{
+		health: health,
+	}
+	r.update()
+	return r
+}
+
+// Ready reports that the store has finished starting up
+func (r *Readiness) Ready() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.ready = true
+	r.update()
+}
+
+// Loading reports that the store isn't ready until the returned function is
+// called
+func (r *Readiness) Loading() func() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.loading++
+	r.update()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.loading--
+			r.update()
+		})
+	}
+}
+
+// isReady reports whether the store has started up, and no snapshot is loading
+func (r *Readiness) isReady() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.ready && r.loading == 0
+}
+
+// Shutdown reports that the server is shutting down, so the store will never
+// be ready again
+func (r *Readiness) Shutdown() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.health.Shutdown()
+}
+
+// update sets the status of every service. The mutex must be held.
+func (r *Readiness) update() {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if r.ready && r.loading == 0 {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	for _, service := range []string{"", api.Cache_ServiceDesc.ServiceName, api.Admin_ServiceDesc.ServiceName} {
+		r.health.SetServingStatus(service, status)
+	}
+}
@@ -0,0 +1,87 @@
+package server_test
+
+import (
+	"context"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	healthServer := health.NewServer()
+	readiness := server.NewReadiness(healthServer)
+	client := healthpb.NewHealthClient(serve(t, func(grpcServer *grpc.Server) {
+		healthpb.RegisterHealthServer(grpcServer, healthServer)
+	}))
+
+	requireStatus := func(expected healthpb.HealthCheckResponse_ServingStatus) {
+		for _, service := range []string{"", api.Cache_ServiceDesc.ServiceName} {
+			response, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{
+				Service: service,
+			})
+			require.Nil(t, err)
+			require.Equal(t, expected, response.Status)
+		}
+	}
+
+	requireStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	readiness.Ready()
+	requireStatus(healthpb.HealthCheckResponse_SERVING)
+
+	// Serving resumes once every load has finished
+	done1 := readiness.Loading()
+	done2 := readiness.Loading()
+	requireStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	done1()
+	done1()
+	requireStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	done2()
+	requireStatus(healthpb.HealthCheckResponse_SERVING)
+
+	readiness.Shutdown()
+	requireStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	readiness.Loading()()
+	requireStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+func TestRequireReadiness(t *testing.T) {
+	readiness := server.NewReadiness(health.NewServer())
+	requireReadiness := server.RequireReadiness(readiness)
+	cacheStore := store.WithRWMutex(store.NewStore())
+	client := api.NewCacheClient(serve(t, func(grpcServer *grpc.Server) {
+		api.RegisterCacheServer(grpcServer, server.NewServer(cacheStore, requireReadiness))
+	}))
+	respConn := startRESPServer(t, cacheStore, nil, requireReadiness)()
+	memcachedConn := startMemcachedServer(t, cacheStore, nil, requireReadiness)()
+	ctx := context.Background()
+
+	// Writes are refused until the store is ready, and reads are served
+	_, err := client.Put(ctx, &api.PutRequest{Key: "a", Value: "1"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, "the store is loading, try again once it is ready", status.Convert(err).Message())
+	_, err = client.Get(ctx, &api.GetRequest{Key: "a"})
+	require.Nil(t, err)
+	exchange(t, respConn, command("SET", "a", "1"), "-LOADING the store is loading, try again once it is ready\r\n")
+	exchange(t, memcachedConn, "set a 0 0 1\r\n1\r\n", "SERVER_ERROR the store is loading, try again once it is ready\r\n")
+	require.False(t, cacheStore.Has("a"))
+
+	readiness.Ready()
+	_, err = client.Put(ctx, &api.PutRequest{Key: "a", Value: "1"})
+	require.Nil(t, err)
+
+	// And while a snapshot loads
+	done := readiness.Loading()
+	_, err = client.Delete(ctx, &api.DeleteRequest{Key: "a"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	done()
+	_, err = client.Delete(ctx, &api.DeleteRequest{Key: "a"})
+	require.Nil(t, err)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicationHeartbeatInterval is how often an idle primary tells its
+	// replicas that they are up to date
+	replicationHeartbeatInterval = time.Second
+	// maxChangesPerMessage bounds the size of the messages sent to replicas
+	maxChangesPerMessage = 1000
+)
+
+type replicationServer struct {
+	api.UnimplementedReplicationServer
+
+	log      store.ChangeLogStore // Nil on replicas
+	follower *Follower            // Nil on primaries
+	clock    store.Clock
+	replicas *int64 // The number of Follow streams, updated atomically
+}
+
+// NewReplicationServer serves the replication API. Primaries have a change
+// log, which replicas follow, and replicas have a follower, which reports how
+// far behind they are. Replicas can't be followed themselves.
+func NewReplicationServer(log store.ChangeLogStore, follower *Follower, clock store.Clock) api.ReplicationServer {
+	return replicationServer{
+		log:      log,
+		follower: follower,
+		clock:    clock,
+		replicas: new(int64),
+	}
+}
+
+func (s replicationServer) Follow(request *api.FollowRequest, stream api.Replication_FollowServer) error {
+	if s.follower != nil {
+		return status.Errorf(codes.FailedPrecondition, "this server is a replica, follow the primary at %v", s.follower.primary)
+	}
+	if s.log == nil {
+		return status.Error(codes.Unimplemented, "replication is not enabled")
+	}
+	atomic.AddInt64(s.replicas, 1)
+	defer atomic.AddInt64(s.replicas, -1)
+	heartbeat := s.clock.NewTicker(replicationHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	sequence := request.Sequence
+	fullSync := request.LogId != s.log.ID()
+	for {
+		// Take the channel first, so that a change made after reading the log
+		// isn't missed
+		changed := s.log.Changed()
+		var changes []store.Change
+		if !fullSync {
+			var ok bool
+			changes, ok = s.log.ChangesSince(sequence, maxChangesPerMessage)
+			fullSync = !ok
+		}
+		if fullSync {
+			snapshotSequence, err := s.sendSnapshot(stream)
+			if err != nil {
+				return err
+			}
+			sequence = snapshotSequence
+			fullSync = false
+			continue
+		}
+
+		if len(changes) > 0 {
+			response := s.response()
+			for _, change := range changes {
+				response.Changes = append(response.Changes, changeToProto(change))
+			}
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+			sequence = changes[len(changes)-1].Sequence
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C():
+			if err := stream.Send(s.response()); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// sendSnapshot sends a snapshot of the store, and returns the sequence number
+// of the last change it includes
+func (s replicationServer) sendSnapshot(stream api.Replication_FollowServer) (uint64, error) {
+	entries, sequence := s.log.Snapshot()
+	writer := bufio.NewWriterSize(followChunkWriter{server: s, stream: stream}, snapshotChunkSize)
+	if err := store.WriteSnapshot(writer, entries); err != nil {
+		return 0, err
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+	response := s.response()
+	response.SnapshotComplete = true
+	response.SnapshotSequence = sequence
+	return sequence, stream.Send(response)
+}
+
+// response starts a message to a replica
+func (s replicationServer) response() *api.FollowResponse {
+	return &api.FollowResponse{
+		LogId:           s.log.ID(),
+		PrimarySequence: s.log.Sequence(),
+	}
+}
+
+func (s replicationServer) Status(ctx context.Context, request *api.ReplicationStatusRequest) (*api.ReplicationStatusResponse, error) {
+	if s.follower != nil {
+		followerStatus := s.follower.Status()
+		return &api.ReplicationStatusResponse{
+			Role:            api.ReplicationStatusResponse_REPLICA,
+			Primary:         followerStatus.Primary,
+			LogId:           followerStatus.LogID,
+			Sequence:        followerStatus.Sequence,
+			PrimarySequence: followerStatus.PrimarySequence,
+			LagChanges:      followerStatus.PrimarySequence - followerStatus.Sequence,
+			LagMs:           followerStatus.Lag.Milliseconds(),
+			Connected:       followerStatus.Connected,
+		}, nil
+	}
+	if s.log == nil {
+		return nil, status.Error(codes.Unimplemented, "replication is not enabled")
+	}
+	return &api.ReplicationStatusResponse{
+		Role:     api.ReplicationStatusResponse_PRIMARY,
+		LogId:    s.log.ID(),
+		Sequence: s.log.Sequence(),
+		Replicas: atomic.LoadInt64(s.replicas),
+	}, nil
+}
+
+// followChunkWriter sends each write as a snapshot chunk to a replica
+type followChunkWriter struct {
+	server replicationServer
+	stream api.Replication_FollowServer
+}
+
+func (w followChunkWriter) Write(p []byte) (int, error) {
+	response := w.server.response()
+	response.SnapshotChunk = p
+	if err := w.stream.Send(response); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func changeToProto(change store.Change) *api.Change {
+	message := &api.Change{
+		Sequence: change.Sequence,
+		Key:      change.Key,
+		Value:    change.Value,
+	}
+	switch change.Type {
+	case store.ChangePut:
+		message.Type = api.Change_PUT
+	case store.ChangeUpdate:
+		message.Type = api.Change_UPDATE
+	case store.ChangeDelete:
+		message.Type = api.Change_DELETE
+	}
+	if !change.Expiry.IsZero() {
+		message.ExpiryUnixNano = change.Expiry.UnixNano()
+	}
+	return message
+}
+
+func changeFromProto(message *api.Change) (store.Change, error) {
+	change := store.Change{
+		Sequence: message.Sequence,
+		Key:      message.Key,
+		Value:    message.Value,
+	}
+	switch message.Type {
+	case api.Change_PUT:
+		change.Type = store.ChangePut
+	case api.Change_UPDATE:
+		change.Type = store.ChangeUpdate
+	case api.Change_DELETE:
+		change.Type = store.ChangeDelete
+	default:
+		return store.Change{}, fmt.Errorf("unknown change type %v", message.Type)
+	}
+	if message.ExpiryUnixNano != 0 {
+		change.Expiry = time.Unix(0, message.ExpiryUnixNano)
+	}
+	return change, nil
+}
@@ -0,0 +1,248 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startPrimary serves the cache and replication APIs for a store with a
+// change log of the capacity
+func startPrimary(t *testing.T, capacity int) (store.ChangeLogStore, *grpc.ClientConn) {
+	primary := store.WithChangeLog(store.WithRWMutex(store.NewStore()), capacity)
+	conn := serve(t, func(grpcServer *grpc.Server) {
+		api.RegisterCacheServer(grpcServer, server.NewServer(primary))
+		api.RegisterReplicationServer(grpcServer, server.NewReplicationServer(primary, nil, store.SystemClock()))
+	})
+	return primary, conn
+}
+
+// requireReplicated waits for the replica to have the same entries as the
+// primary. Expiry times only have to be close, as the change log reads the
+// clock separately from the store.
+func requireReplicated(t *testing.T, primary, replica store.Store) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		entries := replica.Entries()
+		if len(entries) != len(primary.Entries()) {
+			return false
+		}
+		for key, entry := range primary.Entries() {
+			replicated, ok := entries[key]
+			if !ok || replicated.Value != entry.Value || replicated.Expiry.IsZero() != entry.Expiry.IsZero() {
+				return false
+			}
+			if difference := replicated.Expiry.Sub(entry.Expiry); difference > time.Second || difference < -time.Second {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplication(t *testing.T) {
+	primary, conn := startPrimary(t, 100)
+	primary.Put("existing", "1")
+	primary.PutWithTTL("expiring", "2", time.Hour)
+
+	replica := store.WithRWMutex(store.NewStore())
+	replica.Put("stale", "x")
+	follower := server.StartFollower(conn, "primary:50051", replica, store.SystemClock(), log.New(ioutil.Discard, "", 0))
+	defer follower.Stop()
+	requireReplicated(t, primary, replica)
+	require.False(t, replica.Has("stale"))
+
+	primary.Put("a", "1")
+	primary.CompareAndSwap("a", "1", "2")
+	primary.Increment("counter", 5)
+	primary.MultiPut(map[string]string{"b": "3", "c": "4"}, time.Minute)
+	primary.MultiDelete([]string{"b", "existing"})
+	requireReplicated(t, primary, replica)
+
+	require.Eventually(t, func() bool {
+		return follower.Status().Sequence == primary.Sequence()
+	}, 5*time.Second, 10*time.Millisecond)
+	status := follower.Status()
+	require.True(t, status.Connected)
+	require.Equal(t, primary.ID(), status.LogID)
+	require.Equal(t, primary.Sequence(), status.PrimarySequence)
+	require.Equal(t, time.Duration(0), status.Lag)
+
+	response, err := api.NewReplicationClient(conn).Status(context.Background(), &api.ReplicationStatusRequest{})
+	require.Nil(t, err)
+	require.Equal(t, api.ReplicationStatusResponse_PRIMARY, response.Role)
+	require.Equal(t, primary.Sequence(), response.Sequence)
+	require.Equal(t, int64(1), response.Replicas)
+}
+
+func TestReplicationFollow(t *testing.T) {
+	primary, conn := startPrimary(t, 3)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		primary.Put(key, "1")
+	}
+	client := api.NewReplicationClient(conn)
+
+	// Changes still in the log are sent without a snapshot
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Follow(ctx, &api.FollowRequest{LogId: primary.ID(), Sequence: 3})
+	require.Nil(t, err)
+	response, err := stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), response.PrimarySequence)
+	require.Len(t, response.Changes, 2)
+	require.Equal(t, uint64(4), response.Changes[0].Sequence)
+	require.Equal(t, "d", response.Changes[0].Key)
+
+	// Older changes, or changes from another log, need a snapshot
+	for _, request := range []*api.FollowRequest{
+		{LogId: primary.ID(), Sequence: 1},
+		{LogId: "other", Sequence: 4},
+	} {
+		stream, err := client.Follow(ctx, request)
+		require.Nil(t, err)
+		var snapshot bytes.Buffer
+		for {
+			response, err := stream.Recv()
+			require.Nil(t, err)
+			require.Empty(t, response.Changes)
+			snapshot.Write(response.SnapshotChunk)
+			if response.SnapshotComplete {
+				require.Equal(t, uint64(5), response.SnapshotSequence)
+				break
+			}
+		}
+		entries, err := store.ReadSnapshot(&snapshot)
+		require.Nil(t, err)
+		require.Len(t, entries, 5)
+	}
+}
+
+func TestReplicationReconnect(t *testing.T) {
+	primary := store.WithChangeLog(store.WithRWMutex(store.NewStore()), 100)
+	var mutex sync.Mutex
+	var listener *bufconn.Listener
+	var grpcServer *grpc.Server
+	start := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		listener = bufconn.Listen(1024 * 1024)
+		grpcServer = grpc.NewServer()
+		api.RegisterReplicationServer(grpcServer, server.NewReplicationServer(primary, nil, store.SystemClock()))
+		go grpcServer.Serve(listener)
+		t.Cleanup(grpcServer.Stop)
+	}
+	start()
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return listener.Dial()
+	}))
+	require.Nil(t, err)
+	defer conn.Close()
+
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+	replica := store.WithRWMutex(store.NewStore())
+	follower := server.StartFollower(conn, "primary:50051", replica, store.SystemClock(), logger)
+	primary.Put("a", "1")
+	requireReplicated(t, primary, replica)
+
+	// The follower catches up from the log after losing the primary
+	mutex.Lock()
+	grpcServer.Stop()
+	mutex.Unlock()
+	require.Eventually(t, func() bool {
+		return !follower.Status().Connected
+	}, 5*time.Second, 10*time.Millisecond)
+	primary.Put("b", "2")
+	require.Equal(t, uint64(1), follower.Status().Sequence)
+	require.Greater(t, int64(follower.Status().Lag), int64(0))
+	start()
+	requireReplicated(t, primary, replica)
+	follower.Stop()
+	require.Equal(t, 1, strings.Count(logs.String(), "Synced with primary:50051"), logs.String())
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	replica := store.WithRWMutex(store.NewStore())
+	replica.Put("a", "1")
+	conn := serve(t, func(grpcServer *grpc.Server) {
+		api.RegisterCacheServer(grpcServer, server.NewServer(replica, server.ReadOnly("primary:50051")))
+		api.RegisterAdminServer(grpcServer, server.NewAdminServer(replica, store.SystemClock(), nil, server.ReadOnly("primary:50051")))
+	})
+	client := api.NewCacheClient(conn)
+	ctx := context.Background()
+
+	response, err := client.Get(ctx, &api.GetRequest{Key: "a"})
+	require.Nil(t, err)
+	require.Equal(t, "1", response.Value)
+
+	_, err = client.Put(ctx, &api.PutRequest{Key: "a", Value: "2"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Equal(t, "this server is a read-only replica, send writes to the primary at primary:50051", status.Convert(err).Message())
+	details := status.Convert(err).Details()
+	require.Len(t, details, 1)
+	require.Equal(t, "primary:50051", details[0].(*errdetails.ErrorInfo).Metadata["primary"])
+	for _, err := range []error{
+		func() error { _, err := client.Delete(ctx, &api.DeleteRequest{Key: "a"}); return err }(),
+		func() error { _, err := client.MultiPut(ctx, &api.MultiPutRequest{}); return err }(),
+		func() error { _, err := client.Increment(ctx, &api.IncrementRequest{Key: "a", Delta: 1}); return err }(),
+		func() error {
+			stream, err := api.NewAdminClient(conn).LoadSnapshot(ctx)
+			require.Nil(t, err)
+			_, err = stream.CloseAndRecv()
+			return err
+		}(),
+	} {
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	}
+
+	respConn := startRESPServer(t, replica, nil, server.ReadOnly("primary:50051"))()
+	exchange(t, respConn, command("GET", "a"), "$1\r\n1\r\n")
+	exchange(t, respConn, command("SET", "a", "2"), "-READONLY You can't write against a read only replica.\r\n")
+	memcachedConn := startMemcachedServer(t, replica, nil, server.ReadOnly("primary:50051"))()
+	exchange(t, memcachedConn, "set a 0 0 1\r\n2\r\n", "SERVER_ERROR this server is a read-only replica, send writes to the primary at primary:50051\r\n")
+	require.Equal(t, "1", func() string { value, _ := replica.Get("a"); return value }())
+}
+
+func TestReplicaStatus(t *testing.T) {
+	_, primaryConn := startPrimary(t, 100)
+	replica := store.WithRWMutex(store.NewStore())
+	follower := server.StartFollower(primaryConn, "primary:50051", replica, store.SystemClock(), log.New(ioutil.Discard, "", 0))
+	defer follower.Stop()
+	conn := serve(t, func(grpcServer *grpc.Server) {
+		api.RegisterReplicationServer(grpcServer, server.NewReplicationServer(nil, follower, store.SystemClock()))
+	})
+	client := api.NewReplicationClient(conn)
+
+	require.Eventually(t, func() bool {
+		return follower.Status().Connected
+	}, 5*time.Second, 10*time.Millisecond)
+	response, err := client.Status(context.Background(), &api.ReplicationStatusRequest{})
+	require.Nil(t, err)
+	require.Equal(t, api.ReplicationStatusResponse_REPLICA, response.Role)
+	require.Equal(t, "primary:50051", response.Primary)
+	require.True(t, response.Connected)
+
+	// Replicas can't be followed
+	stream, err := client.Follow(context.Background(), &api.FollowRequest{})
+	require.Nil(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
@@ -0,0 +1,798 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"google.golang.org/grpc/status"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxRESPArguments and maxRESPBulkLength bound the memory a single command
+	// can make the server allocate, when there are no key and value size
+	// limits
+	maxRESPArguments  = 1024 * 1024
+	maxRESPBulkLength = 512 * 1024 * 1024
+	// minRESPBulkLength is the longest bulk string accepted whatever the
+	// limits, for arguments that are neither keys nor values, such as SCAN
+	// patterns
+	minRESPBulkLength = 4 * 1024
+	// maxRESPAuthArguments and maxRESPAuthBulkLength bound the commands of
+	// clients that haven't authenticated, which only have to hold HELLO with
+	// a protocol version, a username, a token and a client name
+	maxRESPAuthArguments  = 7
+	maxRESPAuthBulkLength = 4 * 1024
+	// respArgumentsCapacity is the most arguments allocated for before they
+	// arrive
+	respArgumentsCapacity = 16
+	// respScanCount is the number of keys SCAN reads when no COUNT is given
+	respScanCount = 10
+	// maxRESPCursors is the number of SCAN cursors kept for each connection,
+	// as Redis cursors are integers and the store's cursors are keys
+	maxRESPCursors = 1024
+)
+
+// errRESPProtocol is a malformed command, which closes the connection
+type errRESPProtocol string
+
+func (e errRESPProtocol) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// RESPServer serves a subset of the Redis protocol from the store, so that
+// redis-cli and Redis client libraries can be used. Both RESP2 and RESP3 are
+// supported, and clients can pipeline commands. Requests are validated using
+// the same options as the gRPC server.
+type RESPServer struct {
+	*connServer
+	config
+	store      store.Store
+	authorizer *Authorizer
+}
+
+// NewRESPServer creates a RESP server for the store. If the authorizer isn't
+// nil, clients must send a token with AUTH or HELLO, and the token's
+// permissions apply to the gRPC methods each command corresponds to.
+func NewRESPServer(store store.Store, authorizer *Authorizer, options ...Option) *RESPServer {
+	s := &RESPServer{
+		config:     newConfig(options),
+		store:      store,
+		authorizer: authorizer,
+	}
+	s.connServer = newConnServer(s.serveConn)
+	return s
+}
+
+// respSession is the state of one connection
+type respSession struct {
+	server   *RESPServer
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	protocol int    // 2 or 3
+	token    *Token // Nil until authenticated
+	cursors  map[uint64]string
+	cursorID uint64
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	session := &respSession{
+		server:   s,
+		reader:   bufio.NewReader(conn),
+		writer:   bufio.NewWriter(conn),
+		protocol: 2,
+		cursors:  make(map[uint64]string),
+	}
+	for {
+		args, err := session.readCommand()
+		if err != nil {
+			var protocolErr errRESPProtocol
+			if errors.As(err, &protocolErr) {
+				session.writeError("ERR " + protocolErr.Error())
+				session.writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := session.execute(args)
+		// Replies to pipelined commands are sent together
+		if quit || session.reader.Buffered() == 0 {
+			if err := session.writer.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings, or an inline command separated
+// by spaces. Arrays and bulk strings longer than the session's limits are
+// rejected from their lengths, before they are read.
+func (c *respSession) readCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	maxArguments, maxBulkLength := c.limits()
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > maxArguments {
+		return nil, errRESPProtocol("invalid multibulk length")
+	}
+	// Redis ignores empty and null arrays
+	if count <= 0 {
+		return nil, nil
+	}
+	// The count is the client's claim, so the slice only grows as arguments
+	// arrive
+	capacity := count
+	if capacity > respArgumentsCapacity {
+		capacity = respArgumentsCapacity
+	}
+	args := make([]string, 0, capacity)
+	for i := 0; i < count; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRESPProtocol(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, errRESPProtocol("invalid bulk length")
+		}
+		// Copy rather than allocating the claimed length up front
+		var buffer bytes.Buffer
+		if _, err := io.CopyN(&buffer, c.reader, int64(length)+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		data := buffer.Bytes()
+		if data[length] != '\r' || data[length+1] != '\n' {
+			return nil, errRESPProtocol("bulk string not terminated by CRLF")
+		}
+		args = append(args, string(data[:length]))
+	}
+	return args, nil
+}
+
+// limits returns the most arguments a command may have, and the length of
+// the longest bulk string. Until a client has authenticated, they only allow
+// the commands that authenticate. After that, no argument needs to be longer
+// than the longest key or value.
+func (c *respSession) limits() (arguments, bulkLength int) {
+	if c.server.authorizer != nil && c.token == nil {
+		return maxRESPAuthArguments, maxRESPAuthBulkLength
+	}
+	if c.server.maxKeyLength <= 0 || c.server.maxValueSize <= 0 {
+		return maxRESPArguments, maxRESPBulkLength
+	}
+	bulkLength = minRESPBulkLength
+	if c.server.maxKeyLength > bulkLength {
+		bulkLength = c.server.maxKeyLength
+	}
+	if c.server.maxValueSize > bulkLength {
+		bulkLength = c.server.maxValueSize
+	}
+	if bulkLength > maxRESPBulkLength {
+		bulkLength = maxRESPBulkLength
+	}
+	return maxRESPArguments, bulkLength
+}
+
+// readLine reads a line without its CRLF. Lines longer than the reader's
+// buffer are rejected.
+func (c *respSession) readLine() (string, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errRESPProtocol("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+func (c *respSession) writeSimple(value string) {
+	c.writer.WriteString("+" + value + "\r\n")
+}
+
+func (c *respSession) writeError(message string) {
+	c.writer.WriteString("-" + message + "\r\n")
+}
+
+func (c *respSession) writeInteger(value int64) {
+	c.writer.WriteString(":" + strconv.FormatInt(value, 10) + "\r\n")
+}
+
+func (c *respSession) writeBulk(value string) {
+	c.writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+func (c *respSession) writeNull() {
+	if c.protocol == 3 {
+		c.writer.WriteString("_\r\n")
+	} else {
+		c.writer.WriteString("$-1\r\n")
+	}
+}
+
+func (c *respSession) writeArray(length int) {
+	c.writer.WriteString("*" + strconv.Itoa(length) + "\r\n")
+}
+
+// writeMap starts a map, which is sent as an array of keys and values in RESP2
+func (c *respSession) writeMap(length int) {
+	if c.protocol == 3 {
+		c.writer.WriteString("%" + strconv.Itoa(length) + "\r\n")
+	} else {
+		c.writeArray(length * 2)
+	}
+}
+
+// respCommand describes a command. Arity is the number of arguments including
+// the command name, or the negated minimum if it varies, as in Redis.
+type respCommand struct {
+	arity int
+	// operation is the gRPC method the command is authorized as, or empty if
+	// it is allowed without a token
+	operation string
+	// keys returns the keys to authorize
+	keys    func(args []string) []string
+	execute func(c *respSession, args []string)
+}
+
+var respCommands map[string]respCommand
+
+func init() {
+	firstKey := func(args []string) []string { return args[1:2] }
+	allKeys := func(args []string) []string { return args[1:] }
+	noKeys := func(args []string) []string { return nil }
+	respCommands = map[string]respCommand{
+		"auth":   {arity: -2, execute: (*respSession).auth},
+		"hello":  {arity: -1, execute: (*respSession).hello},
+		"ping":   {arity: -1, execute: (*respSession).ping},
+		"echo":   {arity: 2, execute: (*respSession).echo},
+		"quit":   {arity: 1, execute: (*respSession).quit},
+		"select": {arity: 2, execute: (*respSession).selectDB},
+		"get":    {arity: 2, operation: "Get", keys: firstKey, execute: (*respSession).get},
+		"set":    {arity: -3, operation: "Put", keys: firstKey, execute: (*respSession).set},
+		"exists": {arity: -2, operation: "Has", keys: allKeys, execute: (*respSession).exists},
+		"del":    {arity: -2, operation: "Delete", keys: allKeys, execute: (*respSession).del},
+		"expire": {arity: 3, operation: "Put", keys: firstKey, execute: (*respSession).expire},
+		"incr":   {arity: 2, operation: "Increment", keys: firstKey, execute: (*respSession).incr},
+		"incrby": {arity: 3, operation: "Increment", keys: firstKey, execute: (*respSession).incr},
+		"decr":   {arity: 2, operation: "Decrement", keys: firstKey, execute: (*respSession).incr},
+		"decrby": {arity: 3, operation: "Decrement", keys: firstKey, execute: (*respSession).incr},
+		"scan":   {arity: -2, operation: "Scan", keys: scanKeys, execute: (*respSession).scan},
+		"dbsize": {arity: 1, operation: "Stats", keys: noKeys, execute: (*respSession).dbsize},
+	}
+}
+
+// execute runs a command, and returns whether the connection should be closed
+func (c *respSession) execute(args []string) bool {
+	name := strings.ToLower(args[0])
+	command, ok := respCommands[name]
+	if !ok {
+		var quoted []string
+		for _, arg := range args[1:] {
+			quoted = append(quoted, "'"+arg+"'")
+		}
+		c.writeError(fmt.Sprintf("ERR unknown command '%v', with args beginning with: %v", args[0], strings.Join(quoted, " ")))
+		return false
+	}
+	if (command.arity > 0 && len(args) != command.arity) || (command.arity < 0 && len(args) < -command.arity) {
+		c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%v' command", name))
+		return false
+	}
+	if command.operation != "" && c.server.authorizer != nil {
+		if c.token == nil {
+			c.writeError("NOAUTH Authentication required.")
+			return false
+		}
+		keys := command.keys(args)
+		if len(keys) == 0 {
+			keys = []string{""}
+		}
+		for _, key := range keys {
+			if !c.token.allows(command.operation, key) {
+				c.writeError(fmt.Sprintf("NOPERM this token has no permissions to run the '%v' command on this key", name))
+				return false
+			}
+		}
+	}
+	if c.server.primary != "" && writeOperations[command.operation] {
+		c.writeError("READONLY You can't write against a read only replica.")
+		return false
+	}
+	if writeOperations[command.operation] {
+		if err := c.server.unrecorded(); err != nil {
+			c.writeError("MISCONF " + err.Error())
+			return false
+		}
+		if err := c.server.loading(); err != nil {
+			c.writeError("LOADING " + err.Error())
+			return false
+		}
+	}
+	command.execute(c, args)
+	return name == "quit"
+}
+
+// validate writes an error reply and returns false if the validator found a
+// problem
+func (c *respSession) validate(v *validator) bool {
+	if err := v.err(); err != nil {
+		c.writeError("ERR " + status.Convert(err).Message())
+		return false
+	}
+	return true
+}
+
+// authenticate checks a token, replying with an error if it isn't valid
+func (c *respSession) authenticate(secret string) bool {
+	if c.server.authorizer == nil {
+		c.writeError("ERR AUTH called without any tokens configured")
+		return false
+	}
+	token, ok := c.server.authorizer.lookup(secret)
+	if !ok {
+		c.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+	c.token = token
+	return true
+}
+
+// auth accepts AUTH token, or AUTH username token with the username ignored
+func (c *respSession) auth(args []string) {
+	if len(args) > 3 {
+		c.writeError("ERR syntax error")
+		return
+	}
+	if c.authenticate(args[len(args)-1]) {
+		c.writeSimple("OK")
+	}
+}
+
+// hello switches protocol, optionally authenticating, and describes the
+// server
+func (c *respSession) hello(args []string) {
+	protocol := c.protocol
+	if len(args) > 1 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			c.writeError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if version != 2 && version != 3 {
+			c.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+		protocol = version
+	}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "auth":
+			if i+2 >= len(args) {
+				c.writeError("ERR syntax error")
+				return
+			}
+			if !c.authenticate(args[i+2]) {
+				return
+			}
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				c.writeError("ERR syntax error")
+				return
+			}
+			i++
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+	c.protocol = protocol
+
+	c.writeMap(6)
+	c.writeBulk("server")
+	c.writeBulk("go-memory-cache")
+	c.writeBulk("version")
+	c.writeBulk(serverVersion)
+	c.writeBulk("proto")
+	c.writeInteger(int64(c.protocol))
+	c.writeBulk("mode")
+	c.writeBulk("standalone")
+	c.writeBulk("role")
+	c.writeBulk("master")
+	c.writeBulk("modules")
+	c.writeArray(0)
+}
+
+func (c *respSession) ping(args []string) {
+	switch len(args) {
+	case 1:
+		c.writeSimple("PONG")
+	case 2:
+		c.writeBulk(args[1])
+	default:
+		c.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (c *respSession) echo(args []string) {
+	c.writeBulk(args[1])
+}
+
+func (c *respSession) quit(args []string) {
+	c.writeSimple("OK")
+}
+
+// selectDB only accepts database 0, as there is only one
+func (c *respSession) selectDB(args []string) {
+	if args[1] != "0" {
+		c.writeError("ERR DB index is out of range")
+		return
+	}
+	c.writeSimple("OK")
+}
+
+func (c *respSession) get(args []string) {
+	v := c.server.validator()
+	v.key("key", args[1])
+	if !c.validate(v) {
+		return
+	}
+	value, ok := c.server.store.Get(args[1])
+	if !ok {
+		c.writeNull()
+		return
+	}
+	c.writeBulk(value)
+}
+
+// set accepts SET key value [EX seconds | PX milliseconds]
+func (c *respSession) set(args []string) {
+	key, value := args[1], args[2]
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		var unit time.Duration
+		switch strings.ToLower(args[i]) {
+		case "ex":
+			unit = time.Second
+		case "px":
+			unit = time.Millisecond
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+		if ttl != 0 || i+1 >= len(args) {
+			c.writeError("ERR syntax error")
+			return
+		}
+		amount, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || amount > math.MaxInt64/int64(unit) {
+			c.writeError("ERR value is not an integer or out of range")
+			return
+		}
+		if amount <= 0 {
+			c.writeError("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(amount) * unit
+		i++
+	}
+
+	v := c.server.validator()
+	v.key("key", key)
+	v.value("value", value)
+	if !c.validate(v) {
+		return
+	}
+	if ttl > 0 {
+		c.server.store.PutWithTTL(key, value, ttl)
+	} else {
+		c.server.store.Put(key, value)
+	}
+	c.writeSimple("OK")
+}
+
+// exists counts the keys that exist, counting repeated keys each time
+func (c *respSession) exists(args []string) {
+	v := c.server.validator()
+	for _, key := range args[1:] {
+		v.key("key", key)
+	}
+	if !c.validate(v) {
+		return
+	}
+	var count int64
+	for _, key := range args[1:] {
+		if c.server.store.Has(key) {
+			count++
+		}
+	}
+	c.writeInteger(count)
+}
+
+// del deletes the keys, and counts the ones that existed
+func (c *respSession) del(args []string) {
+	keys := args[1:]
+	v := c.server.validator()
+	for _, key := range keys {
+		v.key("key", key)
+	}
+	if !c.validate(v) {
+		return
+	}
+	existing := c.server.store.MultiGet(keys)
+	c.server.store.MultiDelete(keys)
+	c.writeInteger(int64(len(existing)))
+}
+
+// expire sets a time to live on an existing key, or deletes it if the time
+// isn't positive. The store can't change a key's expiry alone, so the value
+// is read and written back, and a write in between can be overwritten.
+func (c *respSession) expire(args []string) {
+	key := args[1]
+	seconds, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || seconds > math.MaxInt64/int64(time.Second) {
+		c.writeError("ERR value is not an integer or out of range")
+		return
+	}
+	v := c.server.validator()
+	v.key("key", key)
+	if !c.validate(v) {
+		return
+	}
+	value, ok := c.server.store.Get(key)
+	if !ok {
+		c.writeInteger(0)
+		return
+	}
+	if seconds <= 0 {
+		c.server.store.Delete(key)
+	} else {
+		c.server.store.PutWithTTL(key, value, time.Duration(seconds)*time.Second)
+	}
+	c.writeInteger(1)
+}
+
+// incr handles INCR, INCRBY, DECR and DECRBY
+func (c *respSession) incr(args []string) {
+	name := strings.ToLower(args[0])
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		delta, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			c.writeError("ERR value is not an integer or out of range")
+			return
+		}
+	}
+	if strings.HasPrefix(name, "decr") {
+		if delta == math.MinInt64 {
+			c.writeError("ERR decrement would overflow")
+			return
+		}
+		delta = -delta
+	}
+	v := c.server.validator()
+	v.key("key", args[1])
+	if !c.validate(v) {
+		return
+	}
+	value, err := c.server.store.Increment(args[1], delta)
+	switch err {
+	case nil:
+		c.writeInteger(value)
+	case store.ErrOverflow:
+		c.writeError("ERR increment or decrement would overflow")
+	default:
+		c.writeError("ERR value is not an integer or out of range")
+	}
+}
+
+// scanKeys returns the fixed prefix of a SCAN pattern, which is the only part
+// that can be authorized
+func scanKeys(args []string) []string {
+	pattern, _, err := parseScanOptions(args)
+	if err != nil {
+		return nil
+	}
+	return []string{globPrefix(pattern)}
+}
+
+// parseScanOptions reads SCAN cursor [MATCH pattern] [COUNT count]
+func parseScanOptions(args []string) (string, int, error) {
+	pattern, count := "*", respScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return "", 0, errors.New("ERR syntax error")
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			var err error
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return "", 0, errors.New("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return "", 0, errors.New("ERR syntax error")
+			}
+		default:
+			return "", 0, errors.New("ERR syntax error")
+		}
+	}
+	return pattern, count, nil
+}
+
+// scan reads a page of keys from the store, starting after the key saved for
+// the cursor. Keys that don't match the pattern are left out, so a page can
+// be empty before the scan is complete.
+func (c *respSession) scan(args []string) {
+	pattern, count, err := parseScanOptions(args)
+	if err != nil {
+		c.writeError(err.Error())
+		return
+	}
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.writeError("ERR invalid cursor")
+		return
+	}
+	after := ""
+	if id != 0 {
+		var ok bool
+		after, ok = c.cursors[id]
+		if !ok {
+			c.writeError("ERR invalid cursor")
+			return
+		}
+		delete(c.cursors, id)
+	}
+	prefix := globPrefix(pattern)
+	v := c.server.validator()
+	v.prefix("pattern", prefix)
+	if !c.validate(v) {
+		return
+	}
+
+	keys, next := c.server.store.Scan(prefix, after, count)
+	nextID := uint64(0)
+	if next != "" {
+		if len(c.cursors) >= maxRESPCursors {
+			// Abandoned scans would otherwise use memory forever
+			c.cursors = make(map[uint64]string)
+		}
+		c.cursorID++
+		nextID = c.cursorID
+		c.cursors[nextID] = next
+	}
+	var matches []string
+	for _, key := range keys {
+		if globMatch(pattern, key) {
+			matches = append(matches, key)
+		}
+	}
+	c.writeArray(2)
+	c.writeBulk(strconv.FormatUint(nextID, 10))
+	c.writeArray(len(matches))
+	for _, key := range matches {
+		c.writeBulk(key)
+	}
+}
+
+func (c *respSession) dbsize(args []string) {
+	c.writeInteger(int64(c.server.store.Stats().Entries))
+}
+
+// globPrefix returns the part of a pattern before its first special
+// character
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch matches a Redis glob pattern, where * matches any characters, ?
+// matches one, [abc], [a-z] and [^a] match a class and \ escapes the next
+// character
+// globMatch matches a string against a Redis glob pattern. After a star
+// fails to match, only the last star is retried, one byte further along the
+// string, so matching takes at most len(pattern)*len(s) steps.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	// Where the pattern after the last star was, and where in s it started
+	// matching, or -1 before the first star
+	star, starMatch := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				p++
+				star, starMatch = p, i
+				continue
+			}
+			if width, ok := globMatchByte(pattern[p:], s[i]); ok {
+				p += width
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starMatch++
+		p, i = star, starMatch
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globMatchByte matches a byte against the start of a pattern that doesn't
+// start with a star, and returns the length of the part that matched it
+func globMatchByte(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// An unterminated class matches literally
+			return 1, c == '['
+		}
+		class := pattern[1 : end+1]
+		negate := strings.HasPrefix(class, "^")
+		if negate {
+			class = class[1:]
+		}
+		return end + 2, classMatch(class, c) != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, c == pattern[1]
+		}
+	}
+	return 1, c == pattern[0]
+}
+
+func classMatch(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			low, high := class[i], class[i+2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package server_test
+
+import (
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startRESPServer serves the store over RESP on a local port, and returns a
+// function to open connections to it
+func startRESPServer(t *testing.T, cacheStore store.Store, authorizer *server.Authorizer, options ...server.Option) func() net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	respServer := server.NewRESPServer(cacheStore, authorizer, options...)
+	go respServer.Serve(listener)
+	t.Cleanup(respServer.Close)
+
+	return func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.Nil(t, err)
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		return conn
+	}
+}
+
+// command encodes a command as an array of bulk strings
+func command(args ...string) string {
+	encoded := fmt.Sprintf("*%v\r\n", len(args))
+	for _, arg := range args {
+		encoded += fmt.Sprintf("$%v\r\n%v\r\n", len(arg), arg)
+	}
+	return encoded
+}
+
+// exchange sends the request and checks that exactly the expected replies are
+// received
+func exchange(t *testing.T, conn net.Conn, request string, expected ...string) {
+	t.Helper()
+	_, err := conn.Write([]byte(request))
+	require.Nil(t, err)
+	want := strings.Join(expected, "")
+	got := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, got)
+	require.Nil(t, err, "received %q", got)
+	require.Equal(t, want, string(got))
+}
+
+func TestRESPCommands(t *testing.T) {
+	conn := startRESPServer(t, store.WithRWMutex(store.NewStore()), nil)()
+
+	exchange(t, conn, command("PING"), "+PONG\r\n")
+	exchange(t, conn, command("ping", "hello"), "$5\r\nhello\r\n")
+	exchange(t, conn, command("GET", "a"), "$-1\r\n")
+	exchange(t, conn, command("SET", "a", "1"), "+OK\r\n")
+	exchange(t, conn, command("GET", "a"), "$1\r\n1\r\n")
+	exchange(t, conn, command("EXISTS", "a", "b", "a"), ":2\r\n")
+	exchange(t, conn, command("INCR", "a"), ":2\r\n")
+	exchange(t, conn, command("INCRBY", "a", "10"), ":12\r\n")
+	exchange(t, conn, command("DECR", "a"), ":11\r\n")
+	exchange(t, conn, command("DECRBY", "a", "5"), ":6\r\n")
+	exchange(t, conn, command("SET", "b", "text"), "+OK\r\n")
+	exchange(t, conn, command("INCR", "b"), "-ERR value is not an integer or out of range\r\n")
+	exchange(t, conn, command("DBSIZE"), ":2\r\n")
+	exchange(t, conn, command("DEL", "a", "b", "c"), ":2\r\n")
+	exchange(t, conn, command("EXISTS", "a"), ":0\r\n")
+
+	// Inline commands, as typed into telnet
+	exchange(t, conn, "SET c 3\r\nGET c\r\n", "+OK\r\n", "$1\r\n3\r\n")
+}
+
+// fakeClock is a clock that only moves when advanced
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(interval time.Duration) store.Ticker {
+	panic("not used")
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRESPExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	conn := startRESPServer(t, store.NewStore(store.UseClock(clock)), nil)()
+
+	exchange(t, conn, command("SET", "a", "1", "EX", "10"), "+OK\r\n")
+	exchange(t, conn, command("SET", "b", "2", "PX", "500"), "+OK\r\n")
+	exchange(t, conn, command("SET", "c", "3"), "+OK\r\n")
+	exchange(t, conn, command("EXPIRE", "c", "1"), ":1\r\n")
+	exchange(t, conn, command("EXPIRE", "missing", "1"), ":0\r\n")
+	clock.advance(time.Second)
+	exchange(t, conn, command("EXISTS", "a", "b", "c"), ":1\r\n")
+	exchange(t, conn, command("EXPIRE", "a", "0"), ":1\r\n")
+	exchange(t, conn, command("EXISTS", "a"), ":0\r\n")
+
+	exchange(t, conn, command("SET", "a", "1", "EX", "0"), "-ERR invalid expire time in 'set' command\r\n")
+	exchange(t, conn, command("SET", "a", "1", "EX"), "-ERR syntax error\r\n")
+	exchange(t, conn, command("SET", "a", "1", "NX"), "-ERR syntax error\r\n")
+	exchange(t, conn, command("SET", "a", "1", "EX", "ten"), "-ERR value is not an integer or out of range\r\n")
+}
+
+func TestRESPPipelining(t *testing.T) {
+	conn := startRESPServer(t, store.NewStore(), nil)()
+
+	var request string
+	var replies []string
+	for i := 0; i < 100; i++ {
+		request += command("SET", fmt.Sprint("key", i), fmt.Sprint(i))
+		replies = append(replies, "+OK\r\n")
+	}
+	for i := 0; i < 100; i++ {
+		request += command("GET", fmt.Sprint("key", i))
+		replies = append(replies, fmt.Sprintf("$%v\r\n%v\r\n", len(fmt.Sprint(i)), i))
+	}
+	exchange(t, conn, request, replies...)
+}
+
+func TestRESP3(t *testing.T) {
+	conn := startRESPServer(t, store.NewStore(), nil)()
+
+	exchange(t, conn, command("HELLO", "4"), "-NOPROTO unsupported protocol version\r\n")
+	exchange(t, conn, command("HELLO", "3"), "%6\r\n"+
+		"$6\r\nserver\r\n$15\r\ngo-memory-cache\r\n"+
+		"$7\r\nversion\r\n$5\r\n1.0.0\r\n"+
+		"$5\r\nproto\r\n:3\r\n"+
+		"$4\r\nmode\r\n$10\r\nstandalone\r\n"+
+		"$4\r\nrole\r\n$6\r\nmaster\r\n"+
+		"$7\r\nmodules\r\n*0\r\n")
+	exchange(t, conn, command("GET", "a"), "_\r\n")
+}
+
+func TestRESPErrors(t *testing.T) {
+	connect := startRESPServer(t, store.NewStore(), nil, server.MaxKeyLength(3))
+	conn := connect()
+
+	exchange(t, conn, command("FLUSHALL", "ASYNC"), "-ERR unknown command 'FLUSHALL', with args beginning with: 'ASYNC'\r\n")
+	exchange(t, conn, command("GET"), "-ERR wrong number of arguments for 'get' command\r\n")
+	exchange(t, conn, command("GET", "long"), "-ERR invalid key: must be at most 3 bytes long\r\n")
+	exchange(t, conn, command("SELECT", "1"), "-ERR DB index is out of range\r\n")
+	exchange(t, conn, command("AUTH", "token"), "-ERR AUTH called without any tokens configured\r\n")
+
+	// Malformed commands close the connection
+	exchange(t, conn, "*1\r\n:1\r\n", "-ERR Protocol error: expected '$', got ':'\r\n")
+	_, err := conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+
+	// Empty and null arrays are ignored, as Redis does
+	conn = connect()
+	exchange(t, conn, "*-1\r\n*0\r\n"+command("PING"), "+PONG\r\n")
+	exchange(t, conn, "*-2147483648\r\n"+command("PING"), "+PONG\r\n")
+
+	// Bulk strings longer than any argument can be are rejected from their
+	// length
+	conn = startRESPServer(t, store.NewStore(), nil, server.MaxKeyLength(3), server.MaxValueSize(5000))()
+	exchange(t, conn, command("SET", "a", strings.Repeat("x", 5000)), "+OK\r\n")
+	exchange(t, conn, "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$5001\r\n", "-ERR Protocol error: invalid bulk length\r\n")
+
+	conn = connect()
+	exchange(t, conn, command("QUIT"), "+OK\r\n")
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestRESPScan(t *testing.T) {
+	conn := startRESPServer(t, store.NewStore(), nil)()
+	for _, key := range []string{"a1", "a2", "a3", "b1", "ab"} {
+		exchange(t, conn, command("SET", key, "x"), "+OK\r\n")
+	}
+
+	exchange(t, conn, command("SCAN", "0", "MATCH", "a*", "COUNT", "2"), "*2\r\n$1\r\n1\r\n*2\r\n$2\r\na1\r\n$2\r\na2\r\n")
+	exchange(t, conn, command("SCAN", "1", "MATCH", "a*", "COUNT", "2"), "*2\r\n$1\r\n0\r\n*2\r\n$2\r\na3\r\n$2\r\nab\r\n")
+	exchange(t, conn, command("SCAN", "1"), "-ERR invalid cursor\r\n")
+	exchange(t, conn, command("SCAN", "0", "MATCH", "?1"), "*2\r\n$1\r\n0\r\n*2\r\n$2\r\na1\r\n$2\r\nb1\r\n")
+	exchange(t, conn, command("SCAN", "0", "MATCH", "a[^b0-2]"), "*2\r\n$1\r\n0\r\n*1\r\n$2\r\na3\r\n")
+	exchange(t, conn, command("SCAN", "0", "COUNT", "0"), "-ERR syntax error\r\n")
+	exchange(t, conn, command("SCAN", "0", "MATCH", "[ab]\\1"), "*2\r\n$1\r\n0\r\n*2\r\n$2\r\na1\r\n$2\r\nb1\r\n")
+	exchange(t, conn, command("SCAN", "0", "MATCH", "*b*"), "*2\r\n$1\r\n0\r\n*2\r\n$2\r\nab\r\n$2\r\nb1\r\n")
+
+	// Patterns with many stars take time proportional to their length times
+	// the key's, rather than backtracking through every way to split the key
+	long := strings.Repeat("a", 10000)
+	exchange(t, conn, command("SET", long, "x"), "+OK\r\n")
+	start := time.Now()
+	exchange(t, conn, command("SCAN", "0", "MATCH", "*a*a*a*a*a*b"), "*2\r\n$1\r\n0\r\n*0\r\n")
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestRESPAuthorization(t *testing.T) {
+	authorizer, err := server.NewAuthorizer([]server.Token{
+		{Name: "sessions", Token: "session-token", Permissions: []server.Permission{
+			{Prefix: "session:", Operations: []string{"Get", "Put", "Scan"}},
+		}},
+	})
+	require.Nil(t, err)
+	connect := startRESPServer(t, store.NewStore(), authorizer)
+	conn := connect()
+
+	exchange(t, conn, command("PING"), "+PONG\r\n")
+	exchange(t, conn, command("GET", "session:1"), "-NOAUTH Authentication required.\r\n")
+
+	// Until a client authenticates, its commands only have to fit a token
+	exchange(t, conn, "*1000000\r\n", "-ERR Protocol error: invalid multibulk length\r\n")
+	conn = connect()
+	exchange(t, conn, "*2\r\n$4\r\nAUTH\r\n$5000\r\n", "-ERR Protocol error: invalid bulk length\r\n")
+	conn = connect()
+	exchange(t, conn, command("AUTH", "wrong"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	exchange(t, conn, command("AUTH", "default", "session-token"), "+OK\r\n")
+	exchange(t, conn, command("SET", "session:1", "a"), "+OK\r\n")
+	exchange(t, conn, command("GET", "session:1"), "$1\r\na\r\n")
+	exchange(t, conn, command("GET", "user:1"), "-NOPERM this token has no permissions to run the 'get' command on this key\r\n")
+	exchange(t, conn, command("DEL", "session:1"), "-NOPERM this token has no permissions to run the 'del' command on this key\r\n")
+	exchange(t, conn, command("SCAN", "0", "MATCH", "session:*"), "*2\r\n$1\r\n0\r\n*1\r\n$9\r\nsession:1\r\n")
+	exchange(t, conn, command("SCAN", "0"), "-NOPERM this token has no permissions to run the 'scan' command on this key\r\n")
+
+	conn = connect()
+	exchange(t, conn, command("HELLO", "2", "AUTH", "default", "session-token"), "*12\r\n")
+}
@@ -2,27 +2,48 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"github.com/Matt-Kelly-/go-memory-cache/api"
 	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
-	"log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"math"
+	"sort"
+	"time"
 )
 
 type defaultServer struct {
 	api.UnimplementedCacheServer
+	config
 
-	store  store.Store
-	logger *log.Logger
+	store     store.Store
+	consensus Cluster // The cluster, or the store itself if not clustered
 }
 
-func NewServer(store store.Store, logger *log.Logger) api.CacheServer {
-	return defaultServer{
+// NewServer serves the cache API from the store. Requests are validated using
+// the options, and rejected with InvalidArgument errors.
+func NewServer(store store.Store, options ...Option) api.CacheServer {
+	s := defaultServer{
+		config: newConfig(options),
 		store:  store,
-		logger: logger,
 	}
+	s.consensus = standalone{store: store, unrecorded: s.unrecorded}
+	if s.cluster != nil {
+		s.consensus = s.cluster
+	}
+	return s
 }
 
 func (s defaultServer) Has(ctx context.Context, request *api.HasRequest) (*api.HasResponse, error) {
-	s.logger.Printf("Request: Has %v", request)
+	v := s.validator()
+	v.key("key", request.Key)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := s.consensus.VerifyLeader(); err != nil {
+		return nil, clusterError(err)
+	}
 	result := s.store.Has(request.Key)
 	return &api.HasResponse{
 		Exists: result,
@@ -30,8 +51,18 @@ func (s defaultServer) Has(ctx context.Context, request *api.HasRequest) (*api.H
 }
 
 func (s defaultServer) Get(ctx context.Context, request *api.GetRequest) (*api.GetResponse, error) {
-	s.logger.Printf("Request: Get %v", request)
+	v := s.validator()
+	v.key("key", request.Key)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := s.consensus.VerifyLeader(); err != nil {
+		return nil, clusterError(err)
+	}
 	value, exists := s.store.Get(request.Key)
+	if !exists && request.NotFoundError {
+		return nil, status.Error(codes.NotFound, "key not found")
+	}
 	return &api.GetResponse{
 		Exists: exists,
 		Value:  value,
@@ -39,13 +70,272 @@ func (s defaultServer) Get(ctx context.Context, request *api.GetRequest) (*api.G
 }
 
 func (s defaultServer) Put(ctx context.Context, request *api.PutRequest) (*api.PutResponse, error) {
-	s.logger.Printf("Request: Put %v", request)
-	s.store.Put(request.Key, request.Value)
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	v := s.validator()
+	v.key("key", request.Key)
+	v.value("value", request.Value)
+	v.ttl("ttl_ms", request.TtlMs)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := s.consensus.Put(request.Key, request.Value, time.Duration(request.TtlMs)*time.Millisecond); err != nil {
+		return nil, clusterError(err)
+	}
 	return &api.PutResponse{}, nil
 }
 
 func (s defaultServer) Delete(ctx context.Context, request *api.DeleteRequest) (*api.DeleteResponse, error) {
-	s.logger.Printf("Request: Delete %v", request)
-	s.store.Delete(request.Key)
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	v := s.validator()
+	v.key("key", request.Key)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := s.consensus.Delete(request.Key); err != nil {
+		return nil, clusterError(err)
+	}
 	return &api.DeleteResponse{}, nil
 }
+
+func (s defaultServer) MultiGet(ctx context.Context, request *api.MultiGetRequest) (*api.MultiGetResponse, error) {
+	v := s.validator()
+	for i, key := range request.Keys {
+		v.key(fmt.Sprintf("keys[%v]", i), key)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := s.consensus.VerifyLeader(); err != nil {
+		return nil, clusterError(err)
+	}
+	values := s.store.MultiGet(request.Keys)
+	response := &api.MultiGetResponse{
+		Values: make([]*api.GetResponse, len(request.Keys)),
+	}
+	for i, key := range request.Keys {
+		value, exists := values[key]
+		response.Values[i] = &api.GetResponse{
+			Exists: exists,
+			Value:  value,
+		}
+	}
+	return response, nil
+}
+
+func (s defaultServer) MultiPut(ctx context.Context, request *api.MultiPutRequest) (*api.MultiPutResponse, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	v := s.validator()
+	// The keys are checked in order, so that the same request always reports
+	// the same first violation
+	keys := make([]string, 0, len(request.Entries))
+	for key := range request.Entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v.key(fmt.Sprintf("entries[%q]", key), key)
+		v.value(fmt.Sprintf("entries[%q].value", key), request.Entries[key])
+	}
+	v.ttl("ttl_ms", request.TtlMs)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := s.consensus.MultiPut(request.Entries, time.Duration(request.TtlMs)*time.Millisecond); err != nil {
+		return nil, clusterError(err)
+	}
+	return &api.MultiPutResponse{}, nil
+}
+
+func (s defaultServer) MultiDelete(ctx context.Context, request *api.MultiDeleteRequest) (*api.MultiDeleteResponse, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	v := s.validator()
+	for i, key := range request.Keys {
+		v.key(fmt.Sprintf("keys[%v]", i), key)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := s.consensus.MultiDelete(request.Keys); err != nil {
+		return nil, clusterError(err)
+	}
+	return &api.MultiDeleteResponse{}, nil
+}
+
+func (s defaultServer) Stats(ctx context.Context, request *api.StatsRequest) (*api.StatsResponse, error) {
+	stats := s.store.Stats()
+	return &api.StatsResponse{
+		Entries:   int64(stats.Entries),
+		Bytes:     stats.Bytes,
+		MaxBytes:  stats.MaxBytes,
+		Evictions: stats.Evictions,
+	}, nil
+}
+
+func (s defaultServer) CompareAndSwap(ctx context.Context, request *api.CompareAndSwapRequest) (*api.CompareAndSwapResponse, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	v := s.validator()
+	v.key("key", request.Key)
+	v.value("value", request.Value)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	current, swapped, err := s.consensus.CompareAndSwap(request.Key, request.Expected, request.Value)
+	if err != nil {
+		return nil, clusterError(err)
+	}
+	response := &api.CompareAndSwapResponse{
+		Swapped: swapped,
+	}
+	if !swapped {
+		response.Value = current
+	}
+	return response, nil
+}
+
+func (s defaultServer) Increment(ctx context.Context, request *api.IncrementRequest) (*api.IncrementResponse, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	v := s.validator()
+	v.key("key", request.Key)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	value, err := s.consensus.Increment(request.Key, request.Delta)
+	if err != nil {
+		return nil, clusterError(err)
+	}
+	return &api.IncrementResponse{
+		Value: value,
+	}, nil
+}
+
+func (s defaultServer) Decrement(ctx context.Context, request *api.DecrementRequest) (*api.DecrementResponse, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	v := s.validator()
+	v.key("key", request.Key)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if request.Delta == math.MinInt64 {
+		return nil, incrementError(store.ErrOverflow)
+	}
+	value, err := s.consensus.Increment(request.Key, -request.Delta)
+	if err != nil {
+		return nil, clusterError(err)
+	}
+	return &api.DecrementResponse{
+		Value: value,
+	}, nil
+}
+
+// scanPageSize is the number of keys read from the store, and sent, at a time
+const scanPageSize = 100
+
+func (s defaultServer) Scan(request *api.ScanRequest, stream api.Cache_ScanServer) error {
+	v := s.validator()
+	v.prefix("prefix", request.Prefix)
+	if request.Limit < 0 {
+		v.violation("limit", "must not be negative")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	if err := s.consensus.VerifyLeader(); err != nil {
+		return clusterError(err)
+	}
+	cursor := request.Cursor
+	remaining := request.Limit
+	for {
+		limit := scanPageSize
+		if remaining > 0 && remaining < scanPageSize {
+			limit = int(remaining)
+		}
+		keys, next := s.store.Scan(request.Prefix, cursor, limit)
+		if err := stream.Send(&api.ScanResponse{
+			Keys:   keys,
+			Cursor: next,
+		}); err != nil {
+			return err
+		}
+		if request.Limit > 0 {
+			remaining -= int64(len(keys))
+			if remaining == 0 {
+				return nil
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (s defaultServer) Watch(request *api.WatchRequest, stream api.Cache_WatchServer) error {
+	v := s.validator()
+	if request.Prefix {
+		v.prefix("key", request.Key)
+	} else {
+		v.key("key", request.Key)
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	observable, ok := store.Observer(s.store)
+	if !ok {
+		return status.Error(codes.Unimplemented, "watching is not enabled")
+	}
+	subscription := observable.Subscribe(request.Key, request.Prefix)
+	defer subscription.Close()
+	// Let the client know that it won't miss any later changes
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return status.Error(codes.ResourceExhausted, subscription.Err().Error())
+			}
+			if err := stream.Send(&api.WatchEvent{
+				Type:  watchEventTypes[event.Type],
+				Key:   event.Key,
+				Value: event.Value,
+			}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+var watchEventTypes = map[store.EventType]api.WatchEvent_Type{
+	store.EventPut:    api.WatchEvent_PUT,
+	store.EventDelete: api.WatchEvent_DELETE,
+	store.EventExpire: api.WatchEvent_EXPIRE,
+}
+
+func incrementError(err error) error {
+	switch err {
+	case store.ErrNotInteger:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case store.ErrOverflow:
+		return status.Error(codes.OutOfRange, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
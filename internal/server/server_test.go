@@ -2,17 +2,48 @@ package server_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/Matt-Kelly-/go-memory-cache/api"
 	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
 	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
 	"github.com/stretchr/testify/require"
-	"io/ioutil"
-	"log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-func newLogger() *log.Logger {
-	return log.New(ioutil.Discard, "", 0)
+// serve starts a server with the services registered, and returns a connection
+// to it over an in-memory listener
+func serve(t *testing.T, register func(grpcServer *grpc.Server), options ...grpc.ServerOption) *grpc.ClientConn {
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(options...)
+	register(grpcServer)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+// startServer serves the cache API for the store over an in-memory connection
+func startServer(t *testing.T, cacheStore store.Store) api.CacheClient {
+	return api.NewCacheClient(serve(t, func(grpcServer *grpc.Server) {
+		api.RegisterCacheServer(grpcServer, server.NewServer(cacheStore))
+	}))
 }
 
 func TestHas(t *testing.T) {
@@ -20,7 +51,7 @@ func TestHas(t *testing.T) {
 		mockStore := new(store.MockStore)
 		mockStore.On("Has", "test key").Return(true)
 
-		testServer := server.NewServer(mockStore, newLogger())
+		testServer := server.NewServer(mockStore)
 		response, err := testServer.Has(context.Background(), &api.HasRequest{
 			Key: "test key",
 		})
@@ -34,7 +65,7 @@ func TestHas(t *testing.T) {
 		mockStore := new(store.MockStore)
 		mockStore.On("Has", "test key").Return(false)
 
-		testServer := server.NewServer(mockStore, newLogger())
+		testServer := server.NewServer(mockStore)
 		response, err := testServer.Has(context.Background(), &api.HasRequest{
 			Key: "test key",
 		})
@@ -50,7 +81,7 @@ func TestGet(t *testing.T) {
 		mockStore := new(store.MockStore)
 		mockStore.On("Get", "test key").Return("test value", true)
 
-		testServer := server.NewServer(mockStore, newLogger())
+		testServer := server.NewServer(mockStore)
 		response, err := testServer.Get(context.Background(), &api.GetRequest{
 			Key: "test key",
 		})
@@ -65,7 +96,7 @@ func TestGet(t *testing.T) {
 		mockStore := new(store.MockStore)
 		mockStore.On("Get", "test key").Return("", false)
 
-		testServer := server.NewServer(mockStore, newLogger())
+		testServer := server.NewServer(mockStore)
 		response, err := testServer.Get(context.Background(), &api.GetRequest{
 			Key: "test key",
 		})
@@ -77,27 +108,76 @@ func TestGet(t *testing.T) {
 	})
 }
 
+func TestGetNotFoundError(t *testing.T) {
+	t.Run("exists", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("Get", "test key").Return("test value", true)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Get(context.Background(), &api.GetRequest{
+			Key:           "test key",
+			NotFoundError: true,
+		})
+
+		require.Nil(t, err)
+		require.Equal(t, "test value", response.Value)
+	})
+
+	t.Run("does not exist", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("Get", "test key").Return("", false)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Get(context.Background(), &api.GetRequest{
+			Key:           "test key",
+			NotFoundError: true,
+		})
+
+		require.Nil(t, response)
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
 func TestPut(t *testing.T) {
-	mockStore := new(store.MockStore)
-	mockStore.On("Put", "test key", "test value")
+	t.Run("without ttl", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("Put", "test key", "test value")
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Put(context.Background(), &api.PutRequest{
+			Key:   "test key",
+			Value: "test value",
+		})
+
+		require.NotNil(t, response)
+		require.Nil(t, err)
 
-	testServer := server.NewServer(mockStore, newLogger())
-	response, err := testServer.Put(context.Background(), &api.PutRequest{
-		Key:   "test key",
-		Value: "test value",
+		mockStore.AssertCalled(t, "Put", "test key", "test value")
 	})
 
-	require.NotNil(t, response)
-	require.Nil(t, err)
+	t.Run("with ttl", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("PutWithTTL", "test key", "test value", 1500*time.Millisecond)
 
-	mockStore.AssertCalled(t, "Put", "test key", "test value")
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Put(context.Background(), &api.PutRequest{
+			Key:   "test key",
+			Value: "test value",
+			TtlMs: 1500,
+		})
+
+		require.NotNil(t, response)
+		require.Nil(t, err)
+
+		mockStore.AssertCalled(t, "PutWithTTL", "test key", "test value", 1500*time.Millisecond)
+	})
 }
 
 func TestDelete(t *testing.T) {
 	mockStore := new(store.MockStore)
 	mockStore.On("Delete", "test key")
 
-	testServer := server.NewServer(mockStore, newLogger())
+	testServer := server.NewServer(mockStore)
 	response, err := testServer.Delete(context.Background(), &api.DeleteRequest{
 		Key: "test key",
 	})
@@ -107,3 +187,336 @@ func TestDelete(t *testing.T) {
 
 	mockStore.AssertCalled(t, "Delete", "test key")
 }
+
+func TestMultiGet(t *testing.T) {
+	mockStore := new(store.MockStore)
+	mockStore.On("MultiGet", []string{"test key 1", "test key 2", "test key 1"}).Return(map[string]string{
+		"test key 1": "test value 1",
+	})
+
+	testServer := server.NewServer(mockStore)
+	response, err := testServer.MultiGet(context.Background(), &api.MultiGetRequest{
+		Keys: []string{"test key 1", "test key 2", "test key 1"},
+	})
+
+	require.Nil(t, err)
+	require.Len(t, response.Values, 3)
+	require.True(t, response.Values[0].Exists)
+	require.Equal(t, "test value 1", response.Values[0].Value)
+	require.False(t, response.Values[1].Exists)
+	require.True(t, response.Values[2].Exists)
+}
+
+func TestMultiPut(t *testing.T) {
+	entries := map[string]string{
+		"test key 1": "test value 1",
+		"test key 2": "test value 2",
+	}
+	mockStore := new(store.MockStore)
+	mockStore.On("MultiPut", entries, 1500*time.Millisecond)
+
+	testServer := server.NewServer(mockStore)
+	response, err := testServer.MultiPut(context.Background(), &api.MultiPutRequest{
+		Entries: entries,
+		TtlMs:   1500,
+	})
+
+	require.NotNil(t, response)
+	require.Nil(t, err)
+
+	mockStore.AssertCalled(t, "MultiPut", entries, 1500*time.Millisecond)
+}
+
+func TestMultiDelete(t *testing.T) {
+	mockStore := new(store.MockStore)
+	mockStore.On("MultiDelete", []string{"test key 1", "test key 2"})
+
+	testServer := server.NewServer(mockStore)
+	response, err := testServer.MultiDelete(context.Background(), &api.MultiDeleteRequest{
+		Keys: []string{"test key 1", "test key 2"},
+	})
+
+	require.NotNil(t, response)
+	require.Nil(t, err)
+
+	mockStore.AssertCalled(t, "MultiDelete", []string{"test key 1", "test key 2"})
+}
+
+func TestStats(t *testing.T) {
+	mockStore := new(store.MockStore)
+	mockStore.On("Stats").Return(store.Stats{
+		Entries:   2,
+		Bytes:     40,
+		MaxBytes:  100,
+		Evictions: 3,
+	})
+
+	testServer := server.NewServer(mockStore)
+	response, err := testServer.Stats(context.Background(), &api.StatsRequest{})
+
+	require.NotNil(t, response)
+	require.Equal(t, int64(2), response.Entries)
+	require.Equal(t, int64(40), response.Bytes)
+	require.Equal(t, int64(100), response.MaxBytes)
+	require.Equal(t, uint64(3), response.Evictions)
+	require.Nil(t, err)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	t.Run("swapped", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("CompareAndSwap", "test key", "test value", "new test value").Return("new test value", true)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.CompareAndSwap(context.Background(), &api.CompareAndSwapRequest{
+			Key:      "test key",
+			Expected: "test value",
+			Value:    "new test value",
+		})
+
+		require.NotNil(t, response)
+		require.True(t, response.Swapped)
+		require.Equal(t, "", response.Value)
+		require.Nil(t, err)
+	})
+
+	t.Run("not swapped", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("CompareAndSwap", "test key", "test value", "new test value").Return("other value", false)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.CompareAndSwap(context.Background(), &api.CompareAndSwapRequest{
+			Key:      "test key",
+			Expected: "test value",
+			Value:    "new test value",
+		})
+
+		require.NotNil(t, response)
+		require.False(t, response.Swapped)
+		require.Equal(t, "other value", response.Value)
+		require.Nil(t, err)
+	})
+}
+
+func TestIncrement(t *testing.T) {
+	t.Run("integer", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("Increment", "test key", int64(5)).Return(int64(7), nil)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Increment(context.Background(), &api.IncrementRequest{
+			Key:   "test key",
+			Delta: 5,
+		})
+
+		require.NotNil(t, response)
+		require.Equal(t, int64(7), response.Value)
+		require.Nil(t, err)
+	})
+
+	t.Run("not an integer", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("Increment", "test key", int64(5)).Return(int64(0), store.ErrNotInteger)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Increment(context.Background(), &api.IncrementRequest{
+			Key:   "test key",
+			Delta: 5,
+		})
+
+		require.Nil(t, response)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("Increment", "test key", int64(5)).Return(int64(0), store.ErrOverflow)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Increment(context.Background(), &api.IncrementRequest{
+			Key:   "test key",
+			Delta: 5,
+		})
+
+		require.Nil(t, response)
+		require.Equal(t, codes.OutOfRange, status.Code(err))
+	})
+}
+
+func TestDecrement(t *testing.T) {
+	t.Run("integer", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("Increment", "test key", int64(-5)).Return(int64(-3), nil)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Decrement(context.Background(), &api.DecrementRequest{
+			Key:   "test key",
+			Delta: 5,
+		})
+
+		require.NotNil(t, response)
+		require.Equal(t, int64(-3), response.Value)
+		require.Nil(t, err)
+	})
+
+	t.Run("not an integer", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+		mockStore.On("Increment", "test key", int64(-5)).Return(int64(0), store.ErrNotInteger)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Decrement(context.Background(), &api.DecrementRequest{
+			Key:   "test key",
+			Delta: 5,
+		})
+
+		require.Nil(t, response)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("minimum delta", func(t *testing.T) {
+		mockStore := new(store.MockStore)
+
+		testServer := server.NewServer(mockStore)
+		response, err := testServer.Decrement(context.Background(), &api.DecrementRequest{
+			Key:   "test key",
+			Delta: math.MinInt64,
+		})
+
+		require.Nil(t, response)
+		require.Equal(t, codes.OutOfRange, status.Code(err))
+		mockStore.AssertNotCalled(t, "Increment", "test key", int64(math.MinInt64))
+	})
+}
+
+// scan collects the pages of a scan
+func scan(t *testing.T, client api.CacheClient, request *api.ScanRequest) []*api.ScanResponse {
+	stream, err := client.Scan(context.Background(), request)
+	require.Nil(t, err)
+	var pages []*api.ScanResponse
+	for {
+		page, err := stream.Recv()
+		if err == io.EOF {
+			return pages
+		}
+		require.Nil(t, err)
+		pages = append(pages, page)
+	}
+}
+
+func TestScan(t *testing.T) {
+	contents := make(map[string]string)
+	for i := 0; i < 250; i++ {
+		contents[fmt.Sprintf("session:%03d", i)] = "test value"
+	}
+	contents["user:1"] = "test value"
+	client := startServer(t, store.NewStoreWithContents(contents))
+
+	t.Run("all", func(t *testing.T) {
+		pages := scan(t, client, &api.ScanRequest{
+			Prefix: "session:",
+		})
+		var keys []string
+		for _, page := range pages {
+			keys = append(keys, page.Keys...)
+		}
+		require.Len(t, keys, 250)
+		require.Equal(t, "session:000", keys[0])
+		require.Equal(t, "session:249", keys[249])
+		require.Greater(t, len(pages), 1)
+		require.Equal(t, "", pages[len(pages)-1].Cursor)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		pages := scan(t, client, &api.ScanRequest{
+			Prefix: "session:",
+			Cursor: "session:099",
+			Limit:  5,
+		})
+		require.Len(t, pages, 1)
+		require.Equal(t, []string{"session:100", "session:101", "session:102", "session:103", "session:104"}, pages[0].Keys)
+		require.Equal(t, "session:104", pages[0].Cursor)
+	})
+
+	t.Run("negative limit", func(t *testing.T) {
+		stream, err := client.Scan(context.Background(), &api.ScanRequest{
+			Limit: -1,
+		})
+		require.Nil(t, err)
+		_, err = stream.Recv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestWatch(t *testing.T) {
+	t.Run("events", func(t *testing.T) {
+		cacheStore := store.WithObserver(store.NewStore(), 10)
+		client := startServer(t, cacheStore)
+		stream, err := client.Watch(context.Background(), &api.WatchRequest{
+			Key:    "session:",
+			Prefix: true,
+		})
+		require.Nil(t, err)
+		// The headers are sent once the server has subscribed
+		_, err = stream.Header()
+		require.Nil(t, err)
+
+		cacheStore.Put("session:1", "test value")
+		cacheStore.Put("user:1", "test value")
+		cacheStore.Delete("session:1")
+
+		event, err := stream.Recv()
+		require.Nil(t, err)
+		require.Equal(t, api.WatchEvent_PUT, event.Type)
+		require.Equal(t, "session:1", event.Key)
+		require.Equal(t, "test value", event.Value)
+		event, err = stream.Recv()
+		require.Nil(t, err)
+		require.Equal(t, api.WatchEvent_DELETE, event.Type)
+		require.Equal(t, "session:1", event.Key)
+	})
+
+	t.Run("not enabled", func(t *testing.T) {
+		client := startServer(t, store.NewStore())
+		stream, err := client.Watch(context.Background(), &api.WatchRequest{
+			Key: "test key",
+		})
+		require.Nil(t, err)
+		_, err = stream.Recv()
+		require.Equal(t, codes.Unimplemented, status.Code(err))
+	})
+}
+
+func TestPersistence(t *testing.T) {
+	// The file fails while the first write is being recorded
+	var checks int32
+	persistence := server.Persistence(func() error {
+		if atomic.AddInt32(&checks, 1) > 1 {
+			return errors.New("no space left on device")
+		}
+		return nil
+	})
+	cacheStore := store.WithRWMutex(store.NewStore())
+	conn := serve(t, func(grpcServer *grpc.Server) {
+		api.RegisterCacheServer(grpcServer, server.NewServer(cacheStore, persistence))
+	})
+	client := api.NewCacheClient(conn)
+	ctx := context.Background()
+
+	_, err := client.Put(ctx, &api.PutRequest{Key: "a", Value: "1"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, "writes can't be recorded: no space left on device", status.Convert(err).Message())
+	require.True(t, cacheStore.Has("a"))
+
+	// Later writes are rejected, and reads still served
+	_, err = client.Delete(ctx, &api.DeleteRequest{Key: "a"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.True(t, cacheStore.Has("a"))
+	_, err = client.Get(ctx, &api.GetRequest{Key: "a"})
+	require.Nil(t, err)
+
+	respConn := startRESPServer(t, cacheStore, nil, persistence)()
+	exchange(t, respConn, command("GET", "a"), "$1\r\n1\r\n")
+	exchange(t, respConn, command("SET", "a", "2"), "-MISCONF writes can't be recorded: no space left on device\r\n")
+	memcachedConn := startMemcachedServer(t, cacheStore, nil, persistence)()
+	exchange(t, memcachedConn, "set a 0 0 1\r\n2\r\n", "SERVER_ERROR writes can't be recorded: no space left on device\r\n")
+}
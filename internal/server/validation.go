@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"regexp"
+	"time"
+)
+
+type Option func(*config)
+
+type config struct {
+	maxKeyLength int
+	maxValueSize int
+	keyPattern   *regexp.Regexp
+	primary      string       // Set on read-only replicas
+	cluster      Cluster      // Set on clustered servers
+	persistence  func() error // Set on servers that record writes
+	readiness    *Readiness   // Set on servers that wait for the store to load
+}
+
+func newConfig(options []Option) config {
+	var c config
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
+// MaxKeyLength rejects keys longer than the limit in bytes. A limit of zero or
+// less means there is no limit.
+func MaxKeyLength(limit int) Option {
+	return func(c *config) {
+		c.maxKeyLength = limit
+	}
+}
+
+// MaxValueSize rejects values larger than the limit in bytes. A limit of zero
+// or less means there is no limit.
+func MaxValueSize(limit int) Option {
+	return func(c *config) {
+		c.maxValueSize = limit
+	}
+}
+
+// KeyPattern rejects keys that don't match the pattern, such as
+// `^[a-zA-Z0-9:_-]*$` to limit the characters allowed. A nil pattern allows
+// every key.
+func KeyPattern(pattern *regexp.Regexp) Option {
+	return func(c *config) {
+		c.keyPattern = pattern
+	}
+}
+
+// ReadOnly rejects writes with FailedPrecondition errors, for replicas. The
+// errors name the primary, which writes should be sent to instead.
+func ReadOnly(primary string) Option {
+	return func(c *config) {
+		c.primary = primary
+	}
+}
+
+// Clustered sends writes through the cluster, which applies them to the store
+// once they are committed, rather than writing to the store directly. Reads
+// are only served once the cluster confirms they are linearizable, which
+// needs the server to be the leader.
+func Clustered(cluster Cluster) Option {
+	return func(c *config) {
+		c.cluster = cluster
+	}
+}
+
+// Persistence rejects writes with Unavailable errors once err returns an
+// error, such as when an append-only file can no longer be written, so that
+// writes aren't acknowledged without being recorded. A write during which
+// recording fails is also reported as Unavailable, although the store has
+// applied it.
+func Persistence(err func() error) Option {
+	return func(c *config) {
+		c.persistence = err
+	}
+}
+
+// RequireReadiness rejects writes with Unavailable errors until the readiness
+// reports that the store is ready, and while a snapshot loads, so that the
+// snapshot doesn't overwrite them
+func RequireReadiness(readiness *Readiness) Option {
+	return func(c *config) {
+		c.readiness = readiness
+	}
+}
+
+// writeOperations are the methods that change the store
+var writeOperations = map[string]bool{
+	"Put":            true,
+	"Delete":         true,
+	"MultiPut":       true,
+	"MultiDelete":    true,
+	"CompareAndSwap": true,
+	"Increment":      true,
+	"Decrement":      true,
+	"LoadSnapshot":   true,
+}
+
+// writable returns a FailedPrecondition error naming the primary if the
+// server is a read-only replica, or an Unavailable error if writes can't be
+// recorded or the store is loading
+func (c config) writable() error {
+	if c.primary == "" {
+		if err := c.unrecorded(); err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		if err := c.loading(); err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		return nil
+	}
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("this server is a read-only replica, send writes to the primary at %v", c.primary))
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   "READ_ONLY_REPLICA",
+		Domain:   "go-memory-cache",
+		Metadata: map[string]string{"primary": c.primary},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// unrecorded returns the error that stops writes from being recorded, if
+// there is one
+func (c config) unrecorded() error {
+	if c.persistence == nil {
+		return nil
+	}
+	if err := c.persistence(); err != nil {
+		return fmt.Errorf("writes can't be recorded: %w", err)
+	}
+	return nil
+}
+
+// errLoading is returned for writes that arrive before the store is ready
+var errLoading = errors.New("the store is loading, try again once it is ready")
+
+// loading returns errLoading if the store isn't ready for writes yet
+func (c config) loading() error {
+	if c.readiness != nil && !c.readiness.isReady() {
+		return errLoading
+	}
+	return nil
+}
+
+// validator collects the problems with a request, so they can all be reported
+// at once
+type validator struct {
+	config
+	violations []*errdetails.BadRequest_FieldViolation
+}
+
+func (c config) validator() *validator {
+	return &validator{
+		config: c,
+	}
+}
+
+func (v *validator) violation(field, format string, args ...interface{}) {
+	v.violations = append(v.violations, &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+// key checks a key, which must not be empty
+func (v *validator) key(field, key string) {
+	if key == "" {
+		v.violation(field, "must not be empty")
+		return
+	}
+	v.prefix(field, key)
+}
+
+// prefix checks the start of a key, which can be empty
+func (v *validator) prefix(field, prefix string) {
+	if v.maxKeyLength > 0 && len(prefix) > v.maxKeyLength {
+		v.violation(field, "must be at most %v bytes long", v.maxKeyLength)
+	}
+	if v.keyPattern != nil && !v.keyPattern.MatchString(prefix) {
+		v.violation(field, "must match %v", v.keyPattern)
+	}
+}
+
+func (v *validator) value(field, value string) {
+	if v.maxValueSize > 0 && len(value) > v.maxValueSize {
+		v.violation(field, "must be at most %v bytes long", v.maxValueSize)
+	}
+}
+
+// maxTTLMs is the longest time to live, in milliseconds, that fits in a
+// time.Duration
+const maxTTLMs = math.MaxInt64 / int64(time.Millisecond)
+
+// ttl checks a time to live in milliseconds, where zero means no expiry
+func (v *validator) ttl(field string, ttlMs int64) {
+	if ttlMs < 0 {
+		v.violation(field, "must not be negative")
+	} else if ttlMs > maxTTLMs {
+		v.violation(field, "must be at most %v", maxTTLMs)
+	}
+}
+
+// err returns an InvalidArgument error with the violations as details, or nil
+// if there are none
+func (v *validator) err() error {
+	if len(v.violations) == 0 {
+		return nil
+	}
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("invalid %v: %v", v.violations[0].Field, v.violations[0].Description))
+	detailed, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: v.violations,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,134 @@
+package server_test
+
+import (
+	"context"
+	"github.com/Matt-Kelly-/go-memory-cache/api"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/server"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requireViolations checks that the error is InvalidArgument, with a field
+// violation for each of the fields
+func requireViolations(t *testing.T, err error, fields ...string) {
+	st := status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+	require.Len(t, st.Details(), 1)
+	badRequest, ok := st.Details()[0].(*errdetails.BadRequest)
+	require.True(t, ok)
+	var violated []string
+	for _, violation := range badRequest.FieldViolations {
+		violated = append(violated, violation.Field)
+	}
+	require.Equal(t, fields, violated)
+}
+
+func TestValidation(t *testing.T) {
+	newServer := func() api.CacheServer {
+		return server.NewServer(store.NewStore(),
+			server.MaxKeyLength(10),
+			server.MaxValueSize(20),
+			server.KeyPattern(regexp.MustCompile(`^[a-z0-9:]*$`)),
+		)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		_, err := newServer().Put(context.Background(), &api.PutRequest{
+			Key:   "test:key",
+			Value: "test value",
+		})
+		require.Nil(t, err)
+	})
+
+	t.Run("empty key", func(t *testing.T) {
+		_, err := newServer().Get(context.Background(), &api.GetRequest{})
+		requireViolations(t, err, "key")
+	})
+
+	t.Run("long key", func(t *testing.T) {
+		_, err := newServer().Has(context.Background(), &api.HasRequest{
+			Key: strings.Repeat("a", 11),
+		})
+		requireViolations(t, err, "key")
+	})
+
+	t.Run("key charset", func(t *testing.T) {
+		_, err := newServer().Delete(context.Background(), &api.DeleteRequest{
+			Key: "Test Key",
+		})
+		requireViolations(t, err, "key")
+	})
+
+	t.Run("large value", func(t *testing.T) {
+		_, err := newServer().Put(context.Background(), &api.PutRequest{
+			Key:   "test:key",
+			Value: strings.Repeat("a", 21),
+		})
+		requireViolations(t, err, "value")
+	})
+
+	t.Run("several violations", func(t *testing.T) {
+		_, err := newServer().Put(context.Background(), &api.PutRequest{
+			Key:   "Test Key",
+			Value: strings.Repeat("a", 21),
+		})
+		requireViolations(t, err, "key", "value")
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		_, err := newServer().MultiGet(context.Background(), &api.MultiGetRequest{
+			Keys: []string{"test:key", "", "test:key"},
+		})
+		requireViolations(t, err, "keys[1]")
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		_, err := newServer().Put(context.Background(), &api.PutRequest{
+			Key:   "test:key",
+			TtlMs: -1,
+		})
+		requireViolations(t, err, "ttl_ms")
+		_, err = newServer().MultiPut(context.Background(), &api.MultiPutRequest{
+			Entries: map[string]string{"test:key": "test value"},
+			TtlMs:   math.MaxInt64/int64(time.Millisecond) + 1,
+		})
+		requireViolations(t, err, "ttl_ms")
+		_, err = newServer().Put(context.Background(), &api.PutRequest{
+			Key:   "test:key",
+			TtlMs: math.MaxInt64 / int64(time.Millisecond),
+		})
+		require.Nil(t, err)
+	})
+
+	t.Run("batch order", func(t *testing.T) {
+		_, err := newServer().MultiPut(context.Background(), &api.MultiPutRequest{
+			Entries: map[string]string{
+				"d": strings.Repeat("a", 21),
+				"c": "",
+				"B": "",
+				"a": strings.Repeat("a", 21),
+			},
+		})
+		requireViolations(t, err, `entries["B"]`, `entries["a"].value`, `entries["d"].value`)
+		require.EqualError(t, err, `rpc error: code = InvalidArgument desc = invalid entries["B"]: must match ^[a-z0-9:]*$`)
+	})
+
+	t.Run("no limits", func(t *testing.T) {
+		testServer := server.NewServer(store.NewStore())
+		_, err := testServer.Put(context.Background(), &api.PutRequest{
+			Key:   strings.Repeat("Test Key ", 1000),
+			Value: strings.Repeat("test value", 1000),
+		})
+		require.Nil(t, err)
+		_, err = testServer.Put(context.Background(), &api.PutRequest{})
+		requireViolations(t, err, "key")
+	})
+}
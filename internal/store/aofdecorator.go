@@ -0,0 +1,627 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FsyncPolicy controls how often the append-only file is flushed to disk
+type FsyncPolicy int
+
+const (
+	// FsyncAlways flushes after every write, so no write is lost once it has
+	// returned, unless Err reports that the file can't be written
+	FsyncAlways FsyncPolicy = iota
+	// FsyncEverySecond flushes once a second, so up to a second of writes can be lost
+	FsyncEverySecond
+	// FsyncNever leaves flushing to the operating system
+	FsyncNever
+)
+
+func ParseFsyncPolicy(policy string) (FsyncPolicy, error) {
+	switch policy {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySecond, nil
+	case "never":
+		return FsyncNever, nil
+	default:
+		return 0, fmt.Errorf("invalid fsync policy: %v", policy)
+	}
+}
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncEverySecond:
+		return "everysec"
+	case FsyncNever:
+		return "never"
+	default:
+		return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+	}
+}
+
+type AppendOnlyFileOptions struct {
+	Fsync FsyncPolicy
+	// CompactionInterval is how often the file is rewritten from the contents
+	// of the store, or 0 to only compact when Compact is called
+	CompactionInterval time.Duration
+	// Clock is used for expiry times and background work. The default is the
+	// system clock.
+	Clock Clock
+}
+
+// PersistentStore is a store that can be flushed to disk
+type PersistentStore interface {
+	Store
+	// Compact rewrites the file from the current contents of the store
+	Compact() error
+	// Sync flushes the file to disk. It also reports any error from an earlier
+	// write, as Store methods can't return errors.
+	Sync() error
+	// Err returns the first error writing or flushing the file, after which
+	// writes are applied to the store without being recorded
+	Err() error
+	// Close syncs the file and stops background work
+	Close() error
+}
+
+var (
+	ErrCorruptAppendOnlyFile = errors.New("append-only file is corrupt")
+
+	aofHeader = []byte("GMCAOF\x00\x01") // Magic number and version
+)
+
+// Append-only file record types
+const (
+	aofPut    byte = 'P' // Sets a value and expiry
+	aofUpdate byte = 'U' // Sets the value of an existing key, keeping its expiry
+	aofDelete byte = 'D'
+)
+
+type aofDecorator struct {
+	mutex   sync.Mutex // This mutex keeps the file in the same order as the store
+	store   Store
+	path    string
+	file    *os.File
+	options AppendOnlyFileOptions
+	dirty   bool         // Whether there are writes that have not been synced
+	err     error        // The first write error, reported by Sync
+	failed  atomic.Value // The first write error, for Err to read without waiting for writes
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// WithAppendOnlyFile records every write to the store in a file, so that the
+// contents survive a restart. An existing file is replayed into the store
+// first, so the store should start empty.
+func WithAppendOnlyFile(store Store, path string, options AppendOnlyFileOptions) (PersistentStore, error) {
+	if options.Clock == nil {
+		options.Clock = SystemClock()
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := replayAppendOnlyFile(store, file, options.Clock)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if size == 0 {
+		if _, err := file.Write(aofHeader); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else if err := file.Truncate(size); err != nil {
+		// Remove any incomplete record left by a crash
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s := &aofDecorator{
+		store:   store,
+		path:    path,
+		file:    file,
+		options: options,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	// Create the tickers before returning, so that they see every clock tick
+	var syncTicker, compactionTicker Ticker
+	if options.Fsync == FsyncEverySecond {
+		syncTicker = options.Clock.NewTicker(time.Second)
+	}
+	if options.CompactionInterval > 0 {
+		compactionTicker = options.Clock.NewTicker(options.CompactionInterval)
+	}
+	go s.run(syncTicker, compactionTicker)
+	return s, nil
+}
+
+// run does background work using the tickers, either of which can be nil
+func (s *aofDecorator) run(syncTicker, compactionTicker Ticker) {
+	defer close(s.done)
+
+	var syncTicks, compactionTicks <-chan time.Time
+	if syncTicker != nil {
+		defer syncTicker.Stop()
+		syncTicks = syncTicker.C()
+	}
+	if compactionTicker != nil {
+		defer compactionTicker.Stop()
+		compactionTicks = compactionTicker.C()
+	}
+
+	for {
+		select {
+		case <-syncTicks:
+			s.Sync()
+		case <-compactionTicks:
+			s.Compact()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *aofDecorator) Has(key string) bool {
+	return s.store.Has(key)
+}
+
+func (s *aofDecorator) Get(key string) (string, bool) {
+	return s.store.Get(key)
+}
+
+func (s *aofDecorator) GetEntry(key string) (Entry, bool) {
+	return s.store.GetEntry(key)
+}
+
+func (s *aofDecorator) Put(key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.Put(key, value)
+	s.append(aofPut, key, value, time.Time{})
+}
+
+func (s *aofDecorator) PutWithTTL(key, value string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.PutWithTTL(key, value, ttl)
+	s.write(s.putRecord(key, value))
+}
+
+func (s *aofDecorator) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.Delete(key)
+	s.append(aofDelete, key, "", time.Time{})
+}
+
+func (s *aofDecorator) MultiGet(keys []string) map[string]string {
+	return s.store.MultiGet(keys)
+}
+
+// MultiPut writes the records for the batch together, so that it is synced at
+// most once
+func (s *aofDecorator) MultiPut(entries map[string]string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiPut(entries, ttl)
+	var records []byte
+	for key, value := range entries {
+		records = append(records, s.putRecord(key, value)...)
+	}
+	s.write(records)
+}
+
+func (s *aofDecorator) MultiDelete(keys []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiDelete(keys)
+	var records []byte
+	for _, key := range keys {
+		records = append(records, encodeAOFRecord(aofDelete, key, "", time.Time{})...)
+	}
+	s.write(records)
+}
+
+func (s *aofDecorator) CompareAndSwap(key, expected, value string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, swapped := s.store.CompareAndSwap(key, expected, value)
+	if swapped {
+		s.append(aofUpdate, key, value, time.Time{})
+	}
+	return current, swapped
+}
+
+func (s *aofDecorator) Increment(key string, delta int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	existed := s.store.Has(key)
+	value, err := s.store.Increment(key, delta)
+	if err != nil {
+		return 0, err
+	}
+	recordType := aofUpdate
+	if !existed {
+		// New keys never expire
+		recordType = aofPut
+	}
+	s.append(recordType, key, strconv.FormatInt(value, 10), time.Time{})
+	return value, nil
+}
+
+func (s *aofDecorator) DeleteExpired() []string {
+	// Expiry times are recorded, so there is nothing to write
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.DeleteExpired()
+}
+
+func (s *aofDecorator) Entries() map[string]Entry {
+	return s.store.Entries()
+}
+
+func (s *aofDecorator) Scan(prefix, cursor string, limit int) ([]string, string) {
+	return s.store.Scan(prefix, cursor, limit)
+}
+
+func (s *aofDecorator) Stats() Stats {
+	return s.store.Stats()
+}
+
+// putRecord encodes a put with the expiry time the store gave the key, which
+// can differ from the decorator's clock. The mutex must be held.
+func (s *aofDecorator) putRecord(key, value string) []byte {
+	entry, ok := s.store.GetEntry(key)
+	if !ok {
+		// The key has already gone, because it expired straight away
+		return encodeAOFRecord(aofDelete, key, "", time.Time{})
+	}
+	return encodeAOFRecord(aofPut, key, value, entry.Expiry)
+}
+
+// append writes a record to the file. The mutex must be held.
+func (s *aofDecorator) append(recordType byte, key, value string, expiry time.Time) {
+	s.write(encodeAOFRecord(recordType, key, value, expiry))
+}
+
+// write writes encoded records to the file. The mutex must be held.
+func (s *aofDecorator) write(records []byte) {
+	if s.err != nil || len(records) == 0 {
+		return
+	}
+	if _, err := s.file.Write(records); err != nil {
+		s.fail(err)
+		return
+	}
+	s.dirty = true
+	if s.options.Fsync == FsyncAlways {
+		s.sync()
+	}
+}
+
+func (s *aofDecorator) Err() error {
+	err, _ := s.failed.Load().(error)
+	return err
+}
+
+// fail records the first write error. The mutex must be held.
+func (s *aofDecorator) fail(err error) {
+	if s.err == nil {
+		s.err = err
+		s.failed.Store(err)
+	}
+}
+
+func (s *aofDecorator) Sync() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sync()
+	return s.err
+}
+
+// sync flushes the file if there are new writes. The mutex must be held.
+func (s *aofDecorator) sync() {
+	if !s.dirty || s.err != nil {
+		return
+	}
+	if err := s.file.Sync(); err != nil {
+		s.fail(err)
+		return
+	}
+	s.dirty = false
+}
+
+// Compact writes the current entries to a temporary file, then replaces the
+// log with it. Writes are blocked until it finishes.
+func (s *aofDecorator) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	tempPath := s.path + ".tmp"
+	temp, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(temp)
+	writer.Write(aofHeader)
+	for key, entry := range s.store.Entries() {
+		writer.Write(encodeAOFRecord(aofPut, key, entry.Value, entry.Expiry))
+	}
+	if err := writer.Flush(); err != nil {
+		temp.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, s.path); err != nil {
+		temp.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	syncDir(filepath.Dir(s.path))
+
+	// The temporary file is now the log, so keep appending to it
+	s.file.Close()
+	temp.Close()
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.fail(err)
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *aofDecorator) Close() error {
+	close(s.stop)
+	<-s.done
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sync()
+	if err := s.file.Close(); err != nil && s.err == nil {
+		s.fail(err)
+	}
+	return s.err
+}
+
+// syncDir flushes a directory, so that a rename in it survives a crash
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+// encodeAOFRecord encodes a record as its type, the length-prefixed key and
+// value, the expiry in Unix nanoseconds (0 for none), and a CRC-32 checksum
+// of everything before it
+func encodeAOFRecord(recordType byte, key, value string, expiry time.Time) []byte {
+	var expiryNanos int64
+	if !expiry.IsZero() {
+		expiryNanos = expiry.UnixNano()
+	}
+	record := make([]byte, 0, 1+3*binary.MaxVarintLen64+len(key)+len(value)+4)
+	record = append(record, recordType)
+	record = appendUvarint(record, uint64(len(key)))
+	record = append(record, key...)
+	record = appendUvarint(record, uint64(len(value)))
+	record = append(record, value...)
+	record = appendVarint(record, expiryNanos)
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(record))
+	return append(record, checksum[:]...)
+}
+
+func appendUvarint(buffer []byte, value uint64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(encoded[:], value)
+	return append(buffer, encoded[:n]...)
+}
+
+func appendVarint(buffer []byte, value int64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(encoded[:], value)
+	return append(buffer, encoded[:n]...)
+}
+
+// replayAppendOnlyFile applies the records in the file to the store. It
+// returns the size of the valid part of the file, which excludes an incomplete
+// record at the end. A record that runs past the end of the file, but is
+// followed by a complete record, has a corrupt length rather than being cut
+// short by a crash.
+func replayAppendOnlyFile(store Store, file *os.File, clock Clock) (int64, error) {
+	reader := &countingReader{
+		reader: bufio.NewReader(file),
+	}
+
+	header := make([]byte, len(aofHeader))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, ErrCorruptAppendOnlyFile
+	}
+	if !bytes.Equal(header, aofHeader) {
+		return 0, ErrCorruptAppendOnlyFile
+	}
+
+	for {
+		valid := reader.count
+		recordType, key, value, expiry, err := decodeAOFRecord(reader)
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			follows, err := recordFollows(file, valid)
+			if err != nil {
+				return 0, err
+			}
+			if follows {
+				return 0, ErrCorruptAppendOnlyFile
+			}
+			// The last write was interrupted
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var ttl time.Duration
+		if !expiry.IsZero() {
+			ttl = expiry.Sub(clock.Now())
+			if ttl <= 0 {
+				store.Delete(key)
+				continue
+			}
+		}
+
+		switch recordType {
+		case aofPut:
+			store.PutWithTTL(key, value, ttl)
+		case aofUpdate:
+			if current, ok := store.Get(key); ok {
+				store.CompareAndSwap(key, current, value)
+			}
+		case aofDelete:
+			store.Delete(key)
+		}
+	}
+}
+
+// recordFollows reports whether a complete record, with a valid checksum,
+// starts anywhere in the file after the offset
+func recordFollows(file *os.File, offset int64) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := info.Size()
+	for start := offset + 1; start < size; start++ {
+		reader := &countingReader{
+			reader: bufio.NewReaderSize(io.NewSectionReader(file, start, size-start), 64),
+		}
+		if _, _, _, _, err := decodeAOFRecord(reader); err == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func decodeAOFRecord(reader *countingReader) (byte, string, string, time.Time, error) {
+	reader.record = reader.record[:0]
+
+	recordType, err := reader.ReadByte()
+	if err != nil {
+		return 0, "", "", time.Time{}, err
+	}
+	if recordType != aofPut && recordType != aofUpdate && recordType != aofDelete {
+		return 0, "", "", time.Time{}, ErrCorruptAppendOnlyFile
+	}
+	key, err := readString(reader)
+	if err != nil {
+		return 0, "", "", time.Time{}, err
+	}
+	value, err := readString(reader)
+	if err != nil {
+		return 0, "", "", time.Time{}, err
+	}
+	expiryNanos, err := binary.ReadVarint(reader)
+	if err != nil {
+		return 0, "", "", time.Time{}, unexpectedEOF(err)
+	}
+	checksum := crc32.ChecksumIEEE(reader.record)
+
+	var expected [4]byte
+	if _, err := io.ReadFull(reader, expected[:]); err != nil {
+		return 0, "", "", time.Time{}, unexpectedEOF(err)
+	}
+	if binary.BigEndian.Uint32(expected[:]) != checksum {
+		return 0, "", "", time.Time{}, ErrCorruptAppendOnlyFile
+	}
+
+	var expiry time.Time
+	if expiryNanos != 0 {
+		expiry = time.Unix(0, expiryNanos)
+	}
+	return recordType, key, value, expiry, nil
+}
+
+func readString(reader *countingReader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	// Copy rather than allocating the length up front, which could be corrupt
+	var buffer bytes.Buffer
+	if _, err := io.CopyN(&buffer, reader, int64(length)); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return buffer.String(), nil
+}
+
+// unexpectedEOF treats the end of the file as an incomplete record, as it
+// comes after the start of one
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// countingReader counts the bytes read, and keeps the bytes of the current
+// record for checksumming
+type countingReader struct {
+	reader *bufio.Reader
+	count  int64
+	record []byte
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	r.record = append(r.record, p[:n]...)
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.count++
+		r.record = append(r.record, b)
+	}
+	return b, err
+}
@@ -0,0 +1,262 @@
+package store_test
+
+import (
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// createAppendOnlyFileStore creates a store with a new file in a temporary
+// directory, which is removed at the end of the test
+func createAppendOnlyFileStore(t *testing.T, options ...store.Option) store.Store {
+	s, err := store.WithAppendOnlyFile(store.NewStore(options...), filepath.Join(t.TempDir(), "test.aof"), store.AppendOnlyFileOptions{
+		Fsync: store.FsyncNever,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+func TestAppendOnlyFileDecorator(t *testing.T) {
+	suite.Run(t, &storeTestSuite{
+		createStore: func() store.Store {
+			return createAppendOnlyFileStore(t)
+		},
+		createStoreWithContents: func(contents map[string]string) store.Store {
+			s := createAppendOnlyFileStore(t)
+			for k, v := range contents {
+				s.Put(k, v)
+			}
+			return s
+		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return createAppendOnlyFileStore(t, store.UseClock(clock))
+		},
+	})
+}
+
+func TestAppendOnlyFileDecoratorLocking(t *testing.T) {
+	suite.Run(t, &storeLockingTestSuite{
+		createStore: func() store.Store {
+			s, err := store.WithAppendOnlyFile(store.WithRWMutex(store.NewStore()), filepath.Join(t.TempDir(), "test.aof"), store.AppendOnlyFileOptions{
+				Fsync: store.FsyncNever,
+			})
+			require.Nil(t, err)
+			t.Cleanup(func() {
+				s.Close()
+			})
+			return s
+		},
+	})
+}
+
+func openAppendOnlyFile(t *testing.T, path string, clock store.Clock) store.PersistentStore {
+	s, err := store.WithAppendOnlyFile(store.NewStore(store.UseClock(clock)), path, store.AppendOnlyFileOptions{
+		Fsync: store.FsyncAlways,
+		Clock: clock,
+	})
+	require.Nil(t, err)
+	return s
+}
+
+func TestAppendOnlyFileReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.aof")
+	clock := newFakeClock()
+
+	s := openAppendOnlyFile(t, path, clock)
+	s.Put("put", "test value")
+	s.Put("replaced", "test value")
+	s.Put("replaced", "new test value")
+	s.Put("deleted", "test value")
+	s.Delete("deleted")
+	s.PutWithTTL("expiring", "test value", time.Hour)
+	s.PutWithTTL("expired", "test value", time.Minute)
+	s.Put("swapped", "test value")
+	s.CompareAndSwap("swapped", "test value", "new test value")
+	s.PutWithTTL("swapped with ttl", "test value", time.Hour)
+	s.CompareAndSwap("swapped with ttl", "test value", "new test value")
+	s.Increment("created counter", 2)
+	s.Put("counter", "10")
+	s.Increment("counter", -3)
+	s.MultiPut(map[string]string{
+		"batch 1": "test value",
+		"batch 2": "test value",
+	}, time.Hour)
+	s.MultiPut(map[string]string{
+		"batch deleted": "test value",
+	}, 0)
+	s.MultiDelete([]string{"batch deleted", "put missing"})
+	require.Nil(t, s.Close())
+
+	clock.Advance(time.Minute)
+	s = openAppendOnlyFile(t, path, clock)
+	defer s.Close()
+	require.Equal(t, map[string]store.Entry{
+		"put":              {Value: "test value"},
+		"replaced":         {Value: "new test value"},
+		"expiring":         {Value: "test value", Expiry: clock.Now().Add(time.Hour - time.Minute)},
+		"swapped":          {Value: "new test value"},
+		"swapped with ttl": {Value: "new test value", Expiry: clock.Now().Add(time.Hour - time.Minute)},
+		"created counter":  {Value: "2"},
+		"counter":          {Value: "7"},
+		"batch 1":          {Value: "test value", Expiry: clock.Now().Add(time.Hour - time.Minute)},
+		"batch 2":          {Value: "test value", Expiry: clock.Now().Add(time.Hour - time.Minute)},
+	}, s.Entries())
+}
+
+func TestAppendOnlyFileCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.aof")
+	clock := newFakeClock()
+
+	s := openAppendOnlyFile(t, path, clock)
+	for i := 0; i < 100; i++ {
+		s.Put("test key", "test value")
+	}
+	s.PutWithTTL("expiring", "test value", time.Hour)
+	before, err := os.Stat(path)
+	require.Nil(t, err)
+
+	require.Nil(t, s.Compact())
+	after, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Less(t, after.Size(), before.Size())
+
+	// Writes after compaction go to the new file
+	s.Put("other key", "other value")
+	require.Nil(t, s.Close())
+
+	s = openAppendOnlyFile(t, path, clock)
+	defer s.Close()
+	require.Equal(t, map[string]store.Entry{
+		"test key":  {Value: "test value"},
+		"expiring":  {Value: "test value", Expiry: clock.Now().Add(time.Hour)},
+		"other key": {Value: "other value"},
+	}, s.Entries())
+}
+
+func TestAppendOnlyFileBackgroundCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.aof")
+	clock := newFakeClock()
+
+	s, err := store.WithAppendOnlyFile(store.NewStore(), path, store.AppendOnlyFileOptions{
+		Fsync:              store.FsyncEverySecond,
+		CompactionInterval: time.Hour,
+		Clock:              clock,
+	})
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		s.Put("test key", "test value")
+	}
+	before, err := os.Stat(path)
+	require.Nil(t, err)
+
+	clock.Advance(time.Hour)
+	require.Nil(t, s.Close())
+	after, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Less(t, after.Size(), before.Size())
+}
+
+func TestAppendOnlyFileIncompleteRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.aof")
+	clock := newFakeClock()
+
+	s := openAppendOnlyFile(t, path, clock)
+	s.Put("test key", "test value")
+	require.Nil(t, s.Close())
+
+	// Simulate a crash part of the way through writing a record
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = file.Write([]byte{'P', 10, 't', 'e'})
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+
+	s = openAppendOnlyFile(t, path, clock)
+	s.Put("other key", "other value")
+	require.Nil(t, s.Close())
+
+	s = openAppendOnlyFile(t, path, clock)
+	defer s.Close()
+	require.Equal(t, map[string]store.Entry{
+		"test key":  {Value: "test value"},
+		"other key": {Value: "other value"},
+	}, s.Entries())
+}
+
+func TestAppendOnlyFileCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.aof")
+	clock := newFakeClock()
+
+	s := openAppendOnlyFile(t, path, clock)
+	s.Put("test key", "test value")
+	require.Nil(t, s.Close())
+
+	contents, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	contents[len(contents)-6] ^= 0xff
+	require.Nil(t, ioutil.WriteFile(path, contents, 0644))
+
+	_, err = store.WithAppendOnlyFile(store.NewStore(), path, store.AppendOnlyFileOptions{})
+	require.Equal(t, store.ErrCorruptAppendOnlyFile, err)
+}
+
+func TestAppendOnlyFileCorruptLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.aof")
+	clock := newFakeClock()
+
+	s := openAppendOnlyFile(t, path, clock)
+	s.Put("test key", "test value")
+	s.Put("other key", "other value")
+	require.Nil(t, s.Close())
+
+	// A key length that runs past the end of the file isn't mistaken for an
+	// interrupted write, as a complete record follows it
+	contents, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	contents[9] = 0x7f
+	require.Nil(t, ioutil.WriteFile(path, contents, 0644))
+
+	_, err = store.WithAppendOnlyFile(store.NewStore(), path, store.AppendOnlyFileOptions{})
+	require.Equal(t, store.ErrCorruptAppendOnlyFile, err)
+}
+
+func TestAppendOnlyFileStoreExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.aof")
+	clock := newFakeClock()
+
+	// The file records the expiry times the store gives keys, even when its
+	// clock isn't the decorator's
+	s, err := store.WithAppendOnlyFile(store.NewStore(store.UseClock(clock)), path, store.AppendOnlyFileOptions{
+		Fsync: store.FsyncAlways,
+	})
+	require.Nil(t, err)
+	s.PutWithTTL("expiring", "test value", time.Hour)
+	s.MultiPut(map[string]string{"batch": "test value"}, time.Hour)
+	require.Nil(t, s.Close())
+
+	s = openAppendOnlyFile(t, path, clock)
+	defer s.Close()
+	require.Equal(t, map[string]store.Entry{
+		"expiring": {Value: "test value", Expiry: clock.Now().Add(time.Hour)},
+		"batch":    {Value: "test value", Expiry: clock.Now().Add(time.Hour)},
+	}, s.Entries())
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for _, policy := range []store.FsyncPolicy{store.FsyncAlways, store.FsyncEverySecond, store.FsyncNever} {
+		parsed, err := store.ParseFsyncPolicy(policy.String())
+		require.Nil(t, err)
+		require.Equal(t, policy, parsed)
+	}
+
+	_, err := store.ParseFsyncPolicy("sometimes")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,305 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ChangeType is the kind of change recorded in a change log
+type ChangeType int
+
+const (
+	// ChangePut sets a value and expiry
+	ChangePut ChangeType = iota
+	// ChangeUpdate sets the value of an existing key, keeping its expiry
+	ChangeUpdate
+	// ChangeDelete deletes a key, whether or not it exists
+	ChangeDelete
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangePut:
+		return "put"
+	case ChangeUpdate:
+		return "update"
+	case ChangeDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("ChangeType(%d)", int(t))
+	}
+}
+
+// Change is a numbered write to a store. Value is set for puts and updates,
+// and Expiry for puts that expire.
+type Change struct {
+	Sequence uint64
+	Type     ChangeType
+	Key      string
+	Value    string
+	Expiry   time.Time
+}
+
+// ChangeLogStore is a store that numbers its writes, and keeps the most recent
+// ones so that they can be applied to a copy of the store
+type ChangeLogStore interface {
+	Store
+	// ID identifies the log. Sequence numbers from logs with different IDs
+	// can't be compared.
+	ID() string
+	// Sequence returns the sequence number of the last change, or 0 if there
+	// have been none
+	Sequence() uint64
+	// ChangesSince returns up to limit changes after the sequence number. It
+	// returns false if some of them are no longer in the log, or if the
+	// sequence number is ahead of the log.
+	ChangesSince(sequence uint64, limit int) ([]Change, bool)
+	// Changed returns a channel that is closed after the next change
+	Changed() <-chan struct{}
+	// Snapshot returns the entries of the store, and the sequence number of
+	// the last change they include
+	Snapshot() (map[string]Entry, uint64)
+}
+
+type changeLogDecorator struct {
+	mutex    sync.Mutex // This mutex keeps the log in the same order as the store
+	store    Store
+	id       string
+	sequence uint64
+	changes  []Change // A ring of the most recent changes
+	count    int      // The number of changes in the ring
+	changed  chan struct{}
+}
+
+// WithChangeLog records every write to the store in a log of the last
+// capacity changes. Expiry times are recorded rather than expired keys, so a
+// copy of the store expires keys by itself.
+func WithChangeLog(store Store, capacity int) ChangeLogStore {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// The ID only has to differ from the previous run's
+		binary.BigEndian.PutUint64(id[:], uint64(time.Now().UnixNano()))
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &changeLogDecorator{
+		store:   store,
+		id:      hex.EncodeToString(id[:]),
+		changes: make([]Change, capacity),
+		changed: make(chan struct{}),
+	}
+}
+
+func (s *changeLogDecorator) ID() string {
+	return s.id
+}
+
+func (s *changeLogDecorator) Sequence() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sequence
+}
+
+func (s *changeLogDecorator) ChangesSince(sequence uint64, limit int) ([]Change, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	oldest := s.sequence - uint64(s.count) + 1
+	if sequence > s.sequence || sequence+1 < oldest {
+		return nil, false
+	}
+	count := int(s.sequence - sequence)
+	if limit > 0 && count > limit {
+		count = limit
+	}
+	changes := make([]Change, count)
+	for i := range changes {
+		changes[i] = s.changes[(sequence+1+uint64(i))%uint64(len(s.changes))]
+	}
+	return changes, true
+}
+
+func (s *changeLogDecorator) Changed() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.changed
+}
+
+func (s *changeLogDecorator) Snapshot() (map[string]Entry, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.Entries(), s.sequence
+}
+
+func (s *changeLogDecorator) Has(key string) bool {
+	return s.store.Has(key)
+}
+
+func (s *changeLogDecorator) Get(key string) (string, bool) {
+	return s.store.Get(key)
+}
+
+func (s *changeLogDecorator) GetEntry(key string) (Entry, bool) {
+	return s.store.GetEntry(key)
+}
+
+func (s *changeLogDecorator) Put(key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.Put(key, value)
+	s.record(Change{Type: ChangePut, Key: key, Value: value})
+	s.notify()
+}
+
+func (s *changeLogDecorator) PutWithTTL(key, value string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.PutWithTTL(key, value, ttl)
+	s.recordPut(key, value)
+	s.notify()
+}
+
+func (s *changeLogDecorator) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.Delete(key)
+	s.record(Change{Type: ChangeDelete, Key: key})
+	s.notify()
+}
+
+func (s *changeLogDecorator) MultiGet(keys []string) map[string]string {
+	return s.store.MultiGet(keys)
+}
+
+func (s *changeLogDecorator) MultiPut(entries map[string]string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiPut(entries, ttl)
+	// The changes are recorded in order, so that every copy of the log is the
+	// same
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s.recordPut(key, entries[key])
+	}
+	s.notify()
+}
+
+func (s *changeLogDecorator) MultiDelete(keys []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiDelete(keys)
+	for _, key := range keys {
+		s.record(Change{Type: ChangeDelete, Key: key})
+	}
+	s.notify()
+}
+
+func (s *changeLogDecorator) CompareAndSwap(key, expected, value string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, swapped := s.store.CompareAndSwap(key, expected, value)
+	if swapped {
+		s.record(Change{Type: ChangeUpdate, Key: key, Value: value})
+		s.notify()
+	}
+	return current, swapped
+}
+
+func (s *changeLogDecorator) Increment(key string, delta int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	existed := s.store.Has(key)
+	value, err := s.store.Increment(key, delta)
+	if err != nil {
+		return 0, err
+	}
+	changeType := ChangeUpdate
+	if !existed {
+		// New keys never expire
+		changeType = ChangePut
+	}
+	s.record(Change{Type: changeType, Key: key, Value: strconv.FormatInt(value, 10)})
+	s.notify()
+	return value, nil
+}
+
+func (s *changeLogDecorator) DeleteExpired() []string {
+	// Expiry times are recorded, so there is nothing to log
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.DeleteExpired()
+}
+
+func (s *changeLogDecorator) Entries() map[string]Entry {
+	return s.store.Entries()
+}
+
+func (s *changeLogDecorator) Scan(prefix, cursor string, limit int) ([]string, string) {
+	return s.store.Scan(prefix, cursor, limit)
+}
+
+func (s *changeLogDecorator) Stats() Stats {
+	return s.store.Stats()
+}
+
+// recordPut records a put with the expiry that the store gave the key, so that
+// copies expire it at the same time. The mutex must be held.
+func (s *changeLogDecorator) recordPut(key, value string) {
+	entry, ok := s.store.GetEntry(key)
+	if !ok {
+		// The key has already gone, because it expired straight away
+		s.record(Change{Type: ChangeDelete, Key: key})
+		return
+	}
+	s.record(Change{Type: ChangePut, Key: key, Value: value, Expiry: entry.Expiry})
+}
+
+// record numbers the change and adds it to the log, replacing the oldest
+// change if the log is full. The mutex must be held.
+func (s *changeLogDecorator) record(change Change) {
+	s.sequence++
+	change.Sequence = s.sequence
+	s.changes[s.sequence%uint64(len(s.changes))] = change
+	if s.count < len(s.changes) {
+		s.count++
+	}
+}
+
+// notify wakes up everything waiting for a change. The mutex must be held.
+func (s *changeLogDecorator) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// ApplyChange makes a change from another store's log to the store, as the
+// append-only file replays its records
+func ApplyChange(store Store, change Change, clock Clock) {
+	switch change.Type {
+	case ChangePut:
+		var ttl time.Duration
+		if !change.Expiry.IsZero() {
+			ttl = change.Expiry.Sub(clock.Now())
+			if ttl <= 0 {
+				store.Delete(change.Key)
+				return
+			}
+		}
+		store.PutWithTTL(change.Key, change.Value, ttl)
+	case ChangeUpdate:
+		if current, ok := store.Get(change.Key); ok {
+			store.CompareAndSwap(change.Key, current, change.Value)
+		}
+	case ChangeDelete:
+		store.Delete(change.Key)
+	}
+}
@@ -0,0 +1,172 @@
+package store_test
+
+import (
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChangeLogDecorator(t *testing.T) {
+	suite.Run(t, &storeTestSuite{
+		createStore: func() store.Store {
+			return store.WithChangeLog(store.NewStore(), 10)
+		},
+		createStoreWithContents: func(contents map[string]string) store.Store {
+			return store.WithChangeLog(store.NewStoreWithContents(contents), 10)
+		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return store.WithChangeLog(store.NewStore(store.UseClock(clock)), 10)
+		},
+	})
+}
+
+func TestChangeLogDecoratorLocking(t *testing.T) {
+	suite.Run(t, &storeLockingTestSuite{
+		createStore: func() store.Store {
+			return store.WithChangeLog(store.WithRWMutex(store.NewStore()), 10)
+		},
+	})
+}
+
+func TestChangeLogDecoratorChanges(t *testing.T) {
+	clock := newFakeClock()
+	s := store.WithChangeLog(store.NewStore(store.UseClock(clock)), 100)
+	require.Equal(t, uint64(0), s.Sequence())
+	changed := s.Changed()
+
+	s.Put("test key", "test value")
+	s.PutWithTTL("other key", "10", time.Minute)
+	s.CompareAndSwap("test key", "test value", "new test value")
+	s.CompareAndSwap("test key", "test value", "unused test value")
+	s.Delete("test key")
+	s.Increment("test key", 5)
+	s.Increment("test key", 1)
+	s.Increment("other key", 1)
+	clock.Advance(time.Minute)
+	s.DeleteExpired()
+
+	select {
+	case <-changed:
+	default:
+		require.Fail(t, "changed channel was not closed")
+	}
+	expiry := clock.Now()
+	require.Equal(t, uint64(7), s.Sequence())
+	changes, ok := s.ChangesSince(0, 0)
+	require.True(t, ok)
+	require.Equal(t, []store.Change{
+		{Sequence: 1, Type: store.ChangePut, Key: "test key", Value: "test value"},
+		{Sequence: 2, Type: store.ChangePut, Key: "other key", Value: "10", Expiry: expiry},
+		{Sequence: 3, Type: store.ChangeUpdate, Key: "test key", Value: "new test value"},
+		{Sequence: 4, Type: store.ChangeDelete, Key: "test key"},
+		{Sequence: 5, Type: store.ChangePut, Key: "test key", Value: "5"},
+		{Sequence: 6, Type: store.ChangeUpdate, Key: "test key", Value: "6"},
+		{Sequence: 7, Type: store.ChangeUpdate, Key: "other key", Value: "11"},
+	}, changes)
+
+	changes, ok = s.ChangesSince(5, 1)
+	require.True(t, ok)
+	require.Equal(t, []store.Change{
+		{Sequence: 6, Type: store.ChangeUpdate, Key: "test key", Value: "6"},
+	}, changes)
+	changes, ok = s.ChangesSince(7, 10)
+	require.True(t, ok)
+	require.Empty(t, changes)
+	_, ok = s.ChangesSince(8, 10)
+	require.False(t, ok)
+}
+
+// tickingClock moves forward every time it is read
+type tickingClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(time.Millisecond)
+	return c.now
+}
+
+func (c *tickingClock) NewTicker(interval time.Duration) store.Ticker {
+	panic("not used")
+}
+
+func TestChangeLogDecoratorExpiry(t *testing.T) {
+	clock := &tickingClock{now: time.Unix(0, 0)}
+	s := store.WithChangeLog(store.NewStore(store.UseClock(clock)), 10)
+	s.PutWithTTL("test key", "test value", time.Minute)
+	s.MultiPut(map[string]string{"c": "3", "a": "1", "b": "2"}, time.Minute)
+	s.PutWithTTL("expired key", "test value", time.Millisecond)
+
+	// The store's expiry times are recorded, and batches are recorded in order
+	changes, ok := s.ChangesSince(0, 0)
+	require.True(t, ok)
+	entries := s.Entries()
+	var keys []string
+	for _, change := range changes[:4] {
+		keys = append(keys, change.Key)
+		require.Equal(t, store.ChangePut, change.Type)
+		require.Equal(t, entries[change.Key].Expiry, change.Expiry, change.Key)
+	}
+	require.Equal(t, []string{"test key", "a", "b", "c"}, keys)
+	require.Equal(t, store.Change{Sequence: 5, Type: store.ChangeDelete, Key: "expired key"}, changes[4])
+}
+
+func TestChangeLogDecoratorCapacity(t *testing.T) {
+	s := store.WithChangeLog(store.NewStore(), 3)
+	s.MultiPut(map[string]string{"a": "1", "b": "2"}, 0)
+	s.MultiDelete([]string{"a", "b"})
+	s.Put("c", "3")
+
+	// Only the last 3 changes are kept
+	_, ok := s.ChangesSince(1, 0)
+	require.False(t, ok)
+	changes, ok := s.ChangesSince(2, 0)
+	require.True(t, ok)
+	require.Equal(t, []store.Change{
+		{Sequence: 3, Type: store.ChangeDelete, Key: "a"},
+		{Sequence: 4, Type: store.ChangeDelete, Key: "b"},
+		{Sequence: 5, Type: store.ChangePut, Key: "c", Value: "3"},
+	}, changes)
+
+	entries, sequence := s.Snapshot()
+	require.Equal(t, uint64(5), sequence)
+	require.Equal(t, map[string]store.Entry{"c": {Value: "3"}}, entries)
+}
+
+func TestChangeLogDecoratorID(t *testing.T) {
+	first := store.WithChangeLog(store.NewStore(), 10)
+	second := store.WithChangeLog(store.NewStore(), 10)
+	require.Len(t, first.ID(), 32)
+	require.NotEqual(t, first.ID(), second.ID())
+}
+
+func TestApplyChange(t *testing.T) {
+	clock := newFakeClock()
+	primary := store.WithChangeLog(store.NewStore(store.UseClock(clock)), 100)
+	replica := store.NewStore(store.UseClock(clock))
+
+	primary.PutWithTTL("a", "1", time.Minute)
+	primary.PutWithTTL("b", "2", time.Second)
+	primary.Put("c", "3")
+	primary.Increment("a", 1)
+	primary.Increment("d", 1)
+	primary.Delete("c")
+	clock.Advance(time.Second)
+	changes, ok := primary.ChangesSince(0, 0)
+	require.True(t, ok)
+	for _, change := range changes {
+		store.ApplyChange(replica, change, clock)
+	}
+
+	require.Equal(t, primary.Entries(), replica.Entries())
+	require.Equal(t, map[string]store.Entry{
+		"a": {Value: "2", Expiry: clock.Now().Add(59 * time.Second)},
+		"d": {Value: "1"},
+	}, replica.Entries())
+}
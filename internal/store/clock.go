@@ -0,0 +1,46 @@
+package store
+
+import (
+	"time"
+)
+
+// Clock is the source of time used for expiry. It can be replaced in tests to
+// control the passing of time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(interval time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, in the same way as time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct{}
+
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(interval time.Duration) Ticker {
+	return systemTicker{
+		ticker: time.NewTicker(interval),
+	}
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t systemTicker) Stop() {
+	t.ticker.Stop()
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type copyOnWriteStore struct {
+	mutex    sync.Mutex   // This mutex serialises writers
+	snapshot atomic.Value // Holds an immutable *defaultStore
+}
+
+// NewCopyOnWriteStore creates a store that never blocks readers. Every write
+// copies the whole map and atomically swaps in the new copy, so it suits
+// read-mostly workloads with few entries.
+func NewCopyOnWriteStore(options ...Option) Store {
+	return NewCopyOnWriteStoreWithContents(nil, options...)
+}
+
+func NewCopyOnWriteStoreWithContents(contents map[string]string, options ...Option) Store {
+	s := &copyOnWriteStore{}
+	s.snapshot.Store(NewStoreWithContents(contents, options...).(*defaultStore))
+	return s
+}
+
+func (s *copyOnWriteStore) current() *defaultStore {
+	return s.snapshot.Load().(*defaultStore)
+}
+
+// update applies a write to a copy of the current snapshot, then publishes it
+func (s *copyOnWriteStore) update(write func(next *defaultStore)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	next := s.current().clone()
+	write(next)
+	s.snapshot.Store(next)
+}
+
+func (s *copyOnWriteStore) Has(key string) bool {
+	return s.current().Has(key)
+}
+
+func (s *copyOnWriteStore) Get(key string) (string, bool) {
+	return s.current().Get(key)
+}
+
+func (s *copyOnWriteStore) GetEntry(key string) (Entry, bool) {
+	return s.current().GetEntry(key)
+}
+
+func (s *copyOnWriteStore) Put(key, value string) {
+	s.update(func(next *defaultStore) {
+		next.Put(key, value)
+	})
+}
+
+func (s *copyOnWriteStore) PutWithTTL(key, value string, ttl time.Duration) {
+	s.update(func(next *defaultStore) {
+		next.PutWithTTL(key, value, ttl)
+	})
+}
+
+func (s *copyOnWriteStore) Delete(key string) {
+	s.update(func(next *defaultStore) {
+		next.Delete(key)
+	})
+}
+
+// MultiGet reads all of the keys from the same snapshot
+func (s *copyOnWriteStore) MultiGet(keys []string) map[string]string {
+	return s.current().MultiGet(keys)
+}
+
+// MultiPut publishes the whole batch at once, so readers see all of it or none
+// of it
+func (s *copyOnWriteStore) MultiPut(entries map[string]string, ttl time.Duration) {
+	s.update(func(next *defaultStore) {
+		next.MultiPut(entries, ttl)
+	})
+}
+
+func (s *copyOnWriteStore) MultiDelete(keys []string) {
+	s.update(func(next *defaultStore) {
+		next.MultiDelete(keys)
+	})
+}
+
+func (s *copyOnWriteStore) CompareAndSwap(key, expected, value string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Avoid copying the map when the swap will fail
+	if current, ok := s.current().Get(key); !ok || current != expected {
+		return current, false
+	}
+	next := s.current().clone()
+	current, swapped := next.CompareAndSwap(key, expected, value)
+	s.snapshot.Store(next)
+	return current, swapped
+}
+
+func (s *copyOnWriteStore) Increment(key string, delta int64) (int64, error) {
+	var (
+		value int64
+		err   error
+	)
+	s.update(func(next *defaultStore) {
+		value, err = next.Increment(key, delta)
+	})
+	return value, err
+}
+
+func (s *copyOnWriteStore) DeleteExpired() []string {
+	// Avoid copying the map when nothing has expired
+	if !s.current().anyExpired() {
+		return nil
+	}
+	var keys []string
+	s.update(func(next *defaultStore) {
+		keys = next.DeleteExpired()
+	})
+	return keys
+}
+
+func (s *copyOnWriteStore) Entries() map[string]Entry {
+	return s.current().Entries()
+}
+
+func (s *copyOnWriteStore) Scan(prefix, cursor string, limit int) ([]string, string) {
+	return s.current().Scan(prefix, cursor, limit)
+}
+
+func (s *copyOnWriteStore) Stats() Stats {
+	return s.current().Stats()
+}
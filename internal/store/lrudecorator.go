@@ -0,0 +1,274 @@
+package store
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type lruDecorator struct {
+	mutex     sync.Mutex // This mutex protects the recency list, and keeps writes and evictions in the same order as the store
+	store     Store
+	capacity  int
+	maxBytes  int64
+	recency   *list.List // Entries ordered from most to least recently used
+	elements  map[string]*list.Element
+	bytes     int64
+	evictions uint64
+	clock     Clock
+	earliest  time.Time // No tracked key expires before this, or zero if none expire
+}
+
+// lruEntry is a key in the recency list, with the size and expiry time of its
+// entry
+type lruEntry struct {
+	key    string
+	size   int64
+	expiry time.Time
+}
+
+// WithLRU limits the store to a maximum number of entries, evicting the least
+// recently used key when the limit is exceeded. Has and Get count as uses. A
+// capacity of zero or less means there is no limit on the number of entries.
+// The MaxBytes option also limits the approximate size of the entries in the
+// same way, except that an entry larger than the whole budget is evicted
+// alone. Evictions are made by deleting keys from the wrapped store, so
+// decorators it wraps record them like any other delete. Keys already in the
+// store are tracked as the least recently used, in no particular order.
+// Expired keys that haven't been deleted yet are deleted before any other key
+// is evicted. The UseClock option should be the store's clock, which is used
+// to tell when there may be some.
+func WithLRU(store Store, capacity int, options ...Option) Store {
+	config := newConfig(options)
+	s := &lruDecorator{
+		store:    store,
+		capacity: capacity,
+		maxBytes: config.maxBytes,
+		recency:  list.New(),
+		elements: make(map[string]*list.Element),
+		clock:    config.clock,
+	}
+	for key, entry := range store.Entries() {
+		s.touch(key, entry.Value, entry.Expiry)
+	}
+	s.evict("")
+	return s
+}
+
+// Unwrap returns the store the decorator wraps
+func (s *lruDecorator) Unwrap() Store {
+	return s.store
+}
+
+func (s *lruDecorator) Has(key string) bool {
+	ok := s.store.Has(key)
+	if ok {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.use(key)
+	}
+	return ok
+}
+
+func (s *lruDecorator) Get(key string) (string, bool) {
+	value, ok := s.store.Get(key)
+	if ok {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.use(key)
+	}
+	return value, ok
+}
+
+func (s *lruDecorator) GetEntry(key string) (Entry, bool) {
+	return s.store.GetEntry(key)
+}
+
+func (s *lruDecorator) Put(key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.Put(key, value)
+	s.touch(key, value, time.Time{})
+	s.evict(key)
+}
+
+func (s *lruDecorator) PutWithTTL(key, value string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.PutWithTTL(key, value, ttl)
+	s.touch(key, value, s.expiry(key))
+	s.evict(key)
+}
+
+func (s *lruDecorator) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.Delete(key)
+	s.forget(key)
+}
+
+func (s *lruDecorator) MultiGet(keys []string) map[string]string {
+	values := s.store.MultiGet(keys)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key := range values {
+		s.use(key)
+	}
+	return values
+}
+
+func (s *lruDecorator) MultiPut(entries map[string]string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiPut(entries, ttl)
+	for key, value := range entries {
+		s.touch(key, value, s.expiry(key))
+	}
+	for key := range entries {
+		s.evict(key)
+	}
+}
+
+func (s *lruDecorator) MultiDelete(keys []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiDelete(keys)
+	for _, key := range keys {
+		s.forget(key)
+	}
+}
+
+func (s *lruDecorator) CompareAndSwap(key, expected, value string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, swapped := s.store.CompareAndSwap(key, expected, value)
+	if swapped {
+		s.touch(key, value, s.expiry(key))
+		s.evict(key)
+	}
+	return current, swapped
+}
+
+func (s *lruDecorator) Increment(key string, delta int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, err := s.store.Increment(key, delta)
+	if err != nil {
+		return 0, err
+	}
+	s.touch(key, strconv.FormatInt(value, 10), s.expiry(key))
+	s.evict(key)
+	return value, nil
+}
+
+func (s *lruDecorator) DeleteExpired() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deleteExpired()
+}
+
+// deleteExpired deletes the expired keys, and finds the earliest expiry time
+// of the rest. The mutex must be held.
+func (s *lruDecorator) deleteExpired() []string {
+	keys := s.store.DeleteExpired()
+	for _, key := range keys {
+		s.forget(key)
+	}
+	s.earliest = time.Time{}
+	for _, element := range s.elements {
+		expiry := element.Value.(*lruEntry).expiry
+		if !expiry.IsZero() && (s.earliest.IsZero() || expiry.Before(s.earliest)) {
+			s.earliest = expiry
+		}
+	}
+	return keys
+}
+
+func (s *lruDecorator) Entries() map[string]Entry {
+	return s.store.Entries()
+}
+
+func (s *lruDecorator) Scan(prefix, cursor string, limit int) ([]string, string) {
+	return s.store.Scan(prefix, cursor, limit)
+}
+
+func (s *lruDecorator) Stats() Stats {
+	stats := s.store.Stats()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats.Evictions += s.evictions
+	if s.maxBytes > 0 {
+		stats.MaxBytes = s.maxBytes
+	}
+	return stats
+}
+
+// use marks a key that was read as the most recently used. Keys that aren't
+// tracked were deleted after the read, so they aren't added.
+func (s *lruDecorator) use(key string) {
+	if element, ok := s.elements[key]; ok {
+		s.recency.MoveToFront(element)
+	}
+}
+
+// expiry returns the expiry time the store gave a key that was just written
+func (s *lruDecorator) expiry(key string) time.Time {
+	entry, _ := s.store.GetEntry(key)
+	return entry.Expiry
+}
+
+// touch marks a key that was written as the most recently used
+func (s *lruDecorator) touch(key, value string, expiry time.Time) {
+	if !expiry.IsZero() && (s.earliest.IsZero() || expiry.Before(s.earliest)) {
+		s.earliest = expiry
+	}
+	size := entrySize(key, value)
+	if element, ok := s.elements[key]; ok {
+		entry := element.Value.(*lruEntry)
+		s.bytes += size - entry.size
+		entry.size = size
+		entry.expiry = expiry
+		s.recency.MoveToFront(element)
+		return
+	}
+	s.elements[key] = s.recency.PushFront(&lruEntry{key: key, size: size, expiry: expiry})
+	s.bytes += size
+}
+
+func (s *lruDecorator) forget(key string) {
+	if element, ok := s.elements[key]; ok {
+		s.bytes -= element.Value.(*lruEntry).size
+		s.recency.Remove(element)
+		delete(s.elements, key)
+	}
+}
+
+// remove deletes an entry from the store to stay within a limit
+func (s *lruDecorator) remove(key string) {
+	s.store.Delete(key)
+	s.forget(key)
+	s.evictions++
+}
+
+// evict deletes least recently used keys until the store is within its
+// limits. The key that was just written is evicted first if it exceeds the
+// byte budget alone, rather than making room for it that it can't use. Expired
+// keys are deleted before any live key is evicted, but only when one may have
+// expired, as finding them means checking every key.
+func (s *lruDecorator) evict(key string) {
+	if element, ok := s.elements[key]; ok && s.maxBytes > 0 && element.Value.(*lruEntry).size > s.maxBytes {
+		s.remove(key)
+	}
+	if s.full() && !s.earliest.IsZero() && !s.clock.Now().Before(s.earliest) {
+		s.deleteExpired()
+	}
+	for s.full() {
+		s.remove(s.recency.Back().Value.(*lruEntry).key)
+	}
+}
+
+// full returns whether the store is beyond its limits
+func (s *lruDecorator) full() bool {
+	return (s.capacity > 0 && s.recency.Len() > s.capacity) || (s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
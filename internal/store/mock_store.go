@@ -2,18 +2,75 @@
 
 package store
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	time "time"
+
+	mock "github.com/stretchr/testify/mock"
+)
 
 // MockStore is an autogenerated mock type for the Store type
 type MockStore struct {
 	mock.Mock
 }
 
+// CompareAndSwap provides a mock function with given fields: key, expected, value
+func (_m *MockStore) CompareAndSwap(key string, expected string, value string) (string, bool) {
+	ret := _m.Called(key, expected, value)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string, string, string) string); ok {
+		r0 = rf(key, expected, value)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(string, string, string) bool); ok {
+		r1 = rf(key, expected, value)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	return r0, r1
+}
+
 // Delete provides a mock function with given fields: key
 func (_m *MockStore) Delete(key string) {
 	_m.Called(key)
 }
 
+// DeleteExpired provides a mock function with given fields:
+func (_m *MockStore) DeleteExpired() []string {
+	ret := _m.Called()
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func() []string); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	return r0
+}
+
+// Entries provides a mock function with given fields:
+func (_m *MockStore) Entries() map[string]Entry {
+	ret := _m.Called()
+
+	var r0 map[string]Entry
+	if rf, ok := ret.Get(0).(func() map[string]Entry); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]Entry)
+		}
+	}
+
+	return r0
+}
+
 // Get provides a mock function with given fields: key
 func (_m *MockStore) Get(key string) (string, bool) {
 	ret := _m.Called(key)
@@ -35,6 +92,27 @@ func (_m *MockStore) Get(key string) (string, bool) {
 	return r0, r1
 }
 
+// GetEntry provides a mock function with given fields: key
+func (_m *MockStore) GetEntry(key string) (Entry, bool) {
+	ret := _m.Called(key)
+
+	var r0 Entry
+	if rf, ok := ret.Get(0).(func(string) Entry); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Get(0).(Entry)
+	}
+
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(string) bool); ok {
+		r1 = rf(key)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	return r0, r1
+}
+
 // Has provides a mock function with given fields: key
 func (_m *MockStore) Has(key string) bool {
 	ret := _m.Called(key)
@@ -49,7 +127,96 @@ func (_m *MockStore) Has(key string) bool {
 	return r0
 }
 
+// Increment provides a mock function with given fields: key, delta
+func (_m *MockStore) Increment(key string, delta int64) (int64, error) {
+	ret := _m.Called(key, delta)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(string, int64) int64); ok {
+		r0 = rf(key, delta)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, int64) error); ok {
+		r1 = rf(key, delta)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MultiDelete provides a mock function with given fields: keys
+func (_m *MockStore) MultiDelete(keys []string) {
+	_m.Called(keys)
+}
+
+// MultiGet provides a mock function with given fields: keys
+func (_m *MockStore) MultiGet(keys []string) map[string]string {
+	ret := _m.Called(keys)
+
+	var r0 map[string]string
+	if rf, ok := ret.Get(0).(func([]string) map[string]string); ok {
+		r0 = rf(keys)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]string)
+		}
+	}
+
+	return r0
+}
+
+// MultiPut provides a mock function with given fields: entries, ttl
+func (_m *MockStore) MultiPut(entries map[string]string, ttl time.Duration) {
+	_m.Called(entries, ttl)
+}
+
 // Put provides a mock function with given fields: key, value
 func (_m *MockStore) Put(key string, value string) {
 	_m.Called(key, value)
 }
+
+// PutWithTTL provides a mock function with given fields: key, value, ttl
+func (_m *MockStore) PutWithTTL(key string, value string, ttl time.Duration) {
+	_m.Called(key, value, ttl)
+}
+
+// Scan provides a mock function with given fields: prefix, cursor, limit
+func (_m *MockStore) Scan(prefix string, cursor string, limit int) ([]string, string) {
+	ret := _m.Called(prefix, cursor, limit)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(string, string, int) []string); ok {
+		r0 = rf(prefix, cursor, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 string
+	if rf, ok := ret.Get(1).(func(string, string, int) string); ok {
+		r1 = rf(prefix, cursor, limit)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	return r0, r1
+}
+
+// Stats provides a mock function with given fields:
+func (_m *MockStore) Stats() Stats {
+	ret := _m.Called()
+
+	var r0 Stats
+	if rf, ok := ret.Get(0).(func() Stats); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(Stats)
+	}
+
+	return r0
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"sync"
+	"time"
 )
 
 type mutexDecorator struct {
@@ -27,14 +28,84 @@ func (s *mutexDecorator) Get(key string) (string, bool) {
 	return s.store.Get(key)
 }
 
+func (s *mutexDecorator) GetEntry(key string) (Entry, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.GetEntry(key)
+}
+
 func (s *mutexDecorator) Put(key, value string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.store.Put(key, value)
 }
 
+func (s *mutexDecorator) PutWithTTL(key, value string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.PutWithTTL(key, value, ttl)
+}
+
 func (s *mutexDecorator) Delete(key string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.store.Delete(key)
 }
+
+// MultiGet reads all of the keys under a single lock, so the values are
+// consistent with each other
+func (s *mutexDecorator) MultiGet(keys []string) map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.MultiGet(keys)
+}
+
+// MultiPut writes all of the keys under a single lock, so the batch is applied
+// atomically
+func (s *mutexDecorator) MultiPut(entries map[string]string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiPut(entries, ttl)
+}
+
+func (s *mutexDecorator) MultiDelete(keys []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiDelete(keys)
+}
+
+func (s *mutexDecorator) CompareAndSwap(key, expected, value string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.CompareAndSwap(key, expected, value)
+}
+
+func (s *mutexDecorator) Increment(key string, delta int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.Increment(key, delta)
+}
+
+func (s *mutexDecorator) DeleteExpired() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.DeleteExpired()
+}
+
+func (s *mutexDecorator) Entries() map[string]Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.Entries()
+}
+
+func (s *mutexDecorator) Scan(prefix, cursor string, limit int) ([]string, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.Scan(prefix, cursor, limit)
+}
+
+func (s *mutexDecorator) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.Stats()
+}
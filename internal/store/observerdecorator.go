@@ -0,0 +1,324 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of change to a key
+type EventType int
+
+const (
+	// EventPut is published when a key is set, including by CompareAndSwap and
+	// Increment
+	EventPut EventType = iota
+	// EventDelete is published when an existing key is deleted
+	EventDelete
+	// EventExpire is published when DeleteExpired removes a key
+	EventExpire
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event describes a change to a key. Value is only set for puts.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value string
+}
+
+// ErrSubscriberTooSlow is reported by a subscription that was closed because
+// its buffer filled up
+var ErrSubscriberTooSlow = errors.New("subscriber fell behind")
+
+// ObservableStore is a store that publishes its changes to subscribers
+type ObservableStore interface {
+	Store
+	// Subscribe starts receiving events for a key, or for every key starting
+	// with it if prefix is true. The subscription must be closed when it is no
+	// longer needed.
+	Subscribe(key string, prefix bool) *Subscription
+}
+
+// Observer finds the observer in a chain of decorators, starting from the
+// outermost. Decorators that can wrap an observer, such as WithLRU's, let
+// it look through them with an Unwrap method, so that the observer can sit
+// below them and publish the deletes they make.
+func Observer(s Store) (ObservableStore, bool) {
+	for {
+		if observable, ok := s.(ObservableStore); ok {
+			return observable, true
+		}
+		wrapper, ok := s.(interface{ Unwrap() Store })
+		if !ok {
+			return nil, false
+		}
+		s = wrapper.Unwrap()
+	}
+}
+
+// Subscription receives the events for some keys, in the order they happened
+type Subscription struct {
+	observer *observerDecorator
+	key      string
+	prefix   bool
+	events   chan Event
+	err      error // Set before events is closed
+}
+
+// Events returns the channel of events. It is closed when the subscription is
+// closed, or when the subscriber falls behind.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns ErrSubscriberTooSlow if the events channel was closed because
+// the subscriber fell behind
+func (s *Subscription) Err() error {
+	s.observer.mutex.RLock()
+	defer s.observer.mutex.RUnlock()
+	return s.err
+}
+
+func (s *Subscription) Close() {
+	s.observer.mutex.Lock()
+	defer s.observer.mutex.Unlock()
+	s.observer.unsubscribe(s)
+}
+
+func (s *Subscription) matches(key string) bool {
+	if s.prefix {
+		return strings.HasPrefix(key, s.key)
+	}
+	return key == s.key
+}
+
+// observerStripes is the number of locks that keys are spread between, so
+// that writes to different keys rarely wait for each other
+const observerStripes = 64
+
+type observerDecorator struct {
+	stripes       [observerStripes]sync.Mutex // These mutexes keep each key's events in the same order as the store
+	mutex         sync.RWMutex                // This mutex protects the subscriptions
+	store         Store
+	bufferSize    int
+	subscriptions map[*Subscription]struct{}
+}
+
+// WithObserver publishes every change made through the decorator to
+// subscribers. Each subscriber has a buffer of events, and a subscriber that
+// lets it fill up is dropped rather than blocking writers. The events for a
+// key are published in the order its changes were made.
+func WithObserver(store Store, bufferSize int) ObservableStore {
+	return &observerDecorator{
+		store:         store,
+		bufferSize:    bufferSize,
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+func (s *observerDecorator) Subscribe(key string, prefix bool) *Subscription {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subscription := &Subscription{
+		observer: s,
+		key:      key,
+		prefix:   prefix,
+		events:   make(chan Event, s.bufferSize),
+	}
+	s.subscriptions[subscription] = struct{}{}
+	return subscription
+}
+
+func (s *observerDecorator) Has(key string) bool {
+	return s.store.Has(key)
+}
+
+func (s *observerDecorator) Get(key string) (string, bool) {
+	return s.store.Get(key)
+}
+
+func (s *observerDecorator) GetEntry(key string) (Entry, bool) {
+	return s.store.GetEntry(key)
+}
+
+func (s *observerDecorator) Put(key, value string) {
+	unlock := s.lock(key)
+	defer unlock()
+	s.store.Put(key, value)
+	s.publish(Event{Type: EventPut, Key: key, Value: value})
+}
+
+func (s *observerDecorator) PutWithTTL(key, value string, ttl time.Duration) {
+	unlock := s.lock(key)
+	defer unlock()
+	s.store.PutWithTTL(key, value, ttl)
+	s.publish(Event{Type: EventPut, Key: key, Value: value})
+}
+
+func (s *observerDecorator) Delete(key string) {
+	unlock := s.lock(key)
+	defer unlock()
+	existed := s.store.Has(key)
+	s.store.Delete(key)
+	if existed {
+		s.publish(Event{Type: EventDelete, Key: key})
+	}
+}
+
+func (s *observerDecorator) MultiGet(keys []string) map[string]string {
+	return s.store.MultiGet(keys)
+}
+
+func (s *observerDecorator) MultiPut(entries map[string]string, ttl time.Duration) {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	unlock := s.lock(keys...)
+	defer unlock()
+	s.store.MultiPut(entries, ttl)
+	for key, value := range entries {
+		s.publish(Event{Type: EventPut, Key: key, Value: value})
+	}
+}
+
+func (s *observerDecorator) MultiDelete(keys []string) {
+	unlock := s.lock(keys...)
+	defer unlock()
+	existing := s.store.MultiGet(keys)
+	s.store.MultiDelete(keys)
+	for key := range existing {
+		s.publish(Event{Type: EventDelete, Key: key})
+	}
+}
+
+func (s *observerDecorator) CompareAndSwap(key, expected, value string) (string, bool) {
+	unlock := s.lock(key)
+	defer unlock()
+	current, swapped := s.store.CompareAndSwap(key, expected, value)
+	if swapped {
+		s.publish(Event{Type: EventPut, Key: key, Value: value})
+	}
+	return current, swapped
+}
+
+func (s *observerDecorator) Increment(key string, delta int64) (int64, error) {
+	unlock := s.lock(key)
+	defer unlock()
+	value, err := s.store.Increment(key, delta)
+	if err != nil {
+		return 0, err
+	}
+	s.publish(Event{Type: EventPut, Key: key, Value: strconv.FormatInt(value, 10)})
+	return value, nil
+}
+
+func (s *observerDecorator) DeleteExpired() []string {
+	// The expired keys aren't known until they are deleted
+	unlock := s.lockAll()
+	defer unlock()
+	keys := s.store.DeleteExpired()
+	for _, key := range keys {
+		s.publish(Event{Type: EventExpire, Key: key})
+	}
+	return keys
+}
+
+func (s *observerDecorator) Entries() map[string]Entry {
+	return s.store.Entries()
+}
+
+func (s *observerDecorator) Scan(prefix, cursor string, limit int) ([]string, string) {
+	return s.store.Scan(prefix, cursor, limit)
+}
+
+func (s *observerDecorator) Stats() Stats {
+	return s.store.Stats()
+}
+
+// lock locks the stripes of the keys, in order so that writes to several keys
+// can't deadlock, and returns a function that unlocks them
+func (s *observerDecorator) lock(keys ...string) func() {
+	var locked [observerStripes]bool
+	for _, key := range keys {
+		locked[hashKey(key)%observerStripes] = true
+	}
+	for i := range s.stripes {
+		if locked[i] {
+			s.stripes[i].Lock()
+		}
+	}
+	return func() {
+		for i := range s.stripes {
+			if locked[i] {
+				s.stripes[i].Unlock()
+			}
+		}
+	}
+}
+
+// lockAll locks every stripe, and returns a function that unlocks them
+func (s *observerDecorator) lockAll() func() {
+	for i := range s.stripes {
+		s.stripes[i].Lock()
+	}
+	return func() {
+		for i := range s.stripes {
+			s.stripes[i].Unlock()
+		}
+	}
+}
+
+// publish sends the event to every matching subscriber without blocking, and
+// drops the subscribers whose buffers are full. The key's stripe must be
+// locked.
+func (s *observerDecorator) publish(event Event) {
+	var slow []*Subscription
+	s.mutex.RLock()
+	for subscription := range s.subscriptions {
+		if !subscription.matches(event.Key) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			slow = append(slow, subscription)
+		}
+	}
+	s.mutex.RUnlock()
+	if len(slow) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, subscription := range slow {
+		if _, ok := s.subscriptions[subscription]; ok {
+			subscription.err = ErrSubscriberTooSlow
+		}
+		s.unsubscribe(subscription)
+	}
+}
+
+// unsubscribe stops sending events to the subscription. The mutex must be held.
+func (s *observerDecorator) unsubscribe(subscription *Subscription) {
+	if _, ok := s.subscriptions[subscription]; ok {
+		delete(s.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
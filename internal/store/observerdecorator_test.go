@@ -0,0 +1,169 @@
+package store_test
+
+import (
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObserverDecorator(t *testing.T) {
+	suite.Run(t, &storeTestSuite{
+		createStore: func() store.Store {
+			return store.WithObserver(store.NewStore(), 10)
+		},
+		createStoreWithContents: func(contents map[string]string) store.Store {
+			return store.WithObserver(store.NewStoreWithContents(contents), 10)
+		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return store.WithObserver(store.NewStore(store.UseClock(clock)), 10)
+		},
+	})
+}
+
+func TestObserverDecoratorLocking(t *testing.T) {
+	suite.Run(t, &storeLockingTestSuite{
+		createStore: func() store.Store {
+			return store.WithObserver(store.WithRWMutex(store.NewStore()), 10)
+		},
+	})
+}
+
+// receive reads the events that have been published so far
+func receive(subscription *store.Subscription) []store.Event {
+	var events []store.Event
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestObserverDecoratorEvents(t *testing.T) {
+	clock := newFakeClock()
+	s := store.WithObserver(store.NewStore(store.UseClock(clock)), 100)
+	subscription := s.Subscribe("test key", false)
+	defer subscription.Close()
+
+	s.Put("test key", "test value")
+	s.Put("other key", "test value")
+	s.CompareAndSwap("test key", "test value", "new test value")
+	s.CompareAndSwap("test key", "test value", "unused test value")
+	s.Delete("test key")
+	s.Delete("test key")
+	s.Increment("test key", 5)
+	s.MultiPut(map[string]string{"test key": "batch value"}, time.Minute)
+	clock.Advance(time.Minute)
+	s.DeleteExpired()
+
+	require.Equal(t, []store.Event{
+		{Type: store.EventPut, Key: "test key", Value: "test value"},
+		{Type: store.EventPut, Key: "test key", Value: "new test value"},
+		{Type: store.EventDelete, Key: "test key"},
+		{Type: store.EventPut, Key: "test key", Value: "5"},
+		{Type: store.EventPut, Key: "test key", Value: "batch value"},
+		{Type: store.EventExpire, Key: "test key"},
+	}, receive(subscription))
+}
+
+func TestObserverDecoratorEvictions(t *testing.T) {
+	// The observer sits below the LRU, and is found through it
+	s := store.WithLRU(store.WithObserver(store.NewStore(), 100), 1)
+	observable, ok := store.Observer(s)
+	require.True(t, ok)
+	subscription := observable.Subscribe("test key", false)
+	defer subscription.Close()
+
+	s.Put("test key", "test value")
+	s.Put("other key", "test value")
+
+	require.Equal(t, []store.Event{
+		{Type: store.EventPut, Key: "test key", Value: "test value"},
+		{Type: store.EventDelete, Key: "test key"},
+	}, receive(subscription))
+	_, ok = store.Observer(store.WithLRU(store.NewStore(), 1))
+	require.False(t, ok)
+}
+
+func TestObserverDecoratorPrefix(t *testing.T) {
+	s := store.WithObserver(store.NewStore(), 100)
+	subscription := s.Subscribe("session:", true)
+	defer subscription.Close()
+
+	s.Put("session:1", "test value")
+	s.Put("user:1", "test value")
+	s.MultiDelete([]string{"session:1", "session:2", "user:1"})
+
+	require.Equal(t, []store.Event{
+		{Type: store.EventPut, Key: "session:1", Value: "test value"},
+		{Type: store.EventDelete, Key: "session:1"},
+	}, receive(subscription))
+}
+
+func TestObserverDecoratorSlowSubscriber(t *testing.T) {
+	s := store.WithObserver(store.NewStore(), 2)
+	slow := s.Subscribe("test key", false)
+	defer slow.Close()
+	other := s.Subscribe("other key", false)
+	defer other.Close()
+
+	// Writes carry on when the buffer is full, and the subscriber is dropped
+	for i := 0; i < 3; i++ {
+		s.Put("test key", "test value")
+	}
+	s.Put("other key", "test value")
+
+	require.Len(t, receive(slow), 2)
+	_, ok := <-slow.Events()
+	require.False(t, ok)
+	require.Equal(t, store.ErrSubscriberTooSlow, slow.Err())
+
+	require.Len(t, receive(other), 1)
+	require.Nil(t, other.Err())
+}
+
+func TestObserverDecoratorClose(t *testing.T) {
+	s := store.WithObserver(store.NewStore(), 10)
+	subscription := s.Subscribe("test key", false)
+	subscription.Close()
+	subscription.Close()
+
+	s.Put("test key", "test value")
+	_, ok := <-subscription.Events()
+	require.False(t, ok)
+	require.Nil(t, subscription.Err())
+}
+
+func TestObserverDecoratorOrder(t *testing.T) {
+	s := store.WithObserver(store.WithRWMutex(store.NewStore()), 1000)
+	subscription := s.Subscribe("test key", false)
+	defer subscription.Close()
+
+	// Concurrent writes to a key are published in the order they were made
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.Increment("test key", 1)
+				s.Put("other key", "test value")
+			}
+		}()
+	}
+	wg.Wait()
+	events := receive(subscription)
+	require.Len(t, events, 500)
+	for i, event := range events {
+		require.Equal(t, strconv.Itoa(i+1), event.Value)
+	}
+}
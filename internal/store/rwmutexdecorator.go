@@ -2,6 +2,7 @@ package store
 
 import (
 	"sync"
+	"time"
 )
 
 type rwMutexDecorator struct {
@@ -27,14 +28,84 @@ func (s *rwMutexDecorator) Get(key string) (string, bool) {
 	return s.store.Get(key)
 }
 
+func (s *rwMutexDecorator) GetEntry(key string) (Entry, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.store.GetEntry(key)
+}
+
 func (s *rwMutexDecorator) Put(key, value string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.store.Put(key, value)
 }
 
+func (s *rwMutexDecorator) PutWithTTL(key, value string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.PutWithTTL(key, value, ttl)
+}
+
 func (s *rwMutexDecorator) Delete(key string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.store.Delete(key)
 }
+
+// MultiGet reads all of the keys under a single lock, so the values are
+// consistent with each other
+func (s *rwMutexDecorator) MultiGet(keys []string) map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.store.MultiGet(keys)
+}
+
+// MultiPut writes all of the keys under a single lock, so the batch is applied
+// atomically
+func (s *rwMutexDecorator) MultiPut(entries map[string]string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiPut(entries, ttl)
+}
+
+func (s *rwMutexDecorator) MultiDelete(keys []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store.MultiDelete(keys)
+}
+
+func (s *rwMutexDecorator) CompareAndSwap(key, expected, value string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.CompareAndSwap(key, expected, value)
+}
+
+func (s *rwMutexDecorator) Increment(key string, delta int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.Increment(key, delta)
+}
+
+func (s *rwMutexDecorator) DeleteExpired() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.DeleteExpired()
+}
+
+func (s *rwMutexDecorator) Entries() map[string]Entry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.store.Entries()
+}
+
+func (s *rwMutexDecorator) Scan(prefix, cursor string, limit int) ([]string, string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.store.Scan(prefix, cursor, limit)
+}
+
+func (s *rwMutexDecorator) Stats() Stats {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.store.Stats()
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"time"
+)
+
+type shardedStore struct {
+	shards []Store
+}
+
+// NewShardedStore partitions keys between a number of stores, each protected
+// by its own lock, so that operations on different keys rarely contend. The
+// options are applied to every shard, with any byte budget split evenly
+// between them.
+func NewShardedStore(shardCount int, options ...Option) Store {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	shards := make([]Store, shardCount)
+	for i := range shards {
+		shard := newDefaultStore(options...)
+		if shard.maxBytes > 0 {
+			shard.maxBytes /= int64(shardCount)
+			if shard.maxBytes == 0 {
+				shard.maxBytes = 1
+			}
+		}
+		shards[i] = WithRWMutex(shard)
+	}
+	return &shardedStore{
+		shards: shards,
+	}
+}
+
+// shard chooses the shard for a key
+func (s *shardedStore) shard(key string) Store {
+	return s.shards[hashKey(key)%uint32(len(s.shards))]
+}
+
+// hashKey returns the 32-bit FNV-1a hash of a key
+func hashKey(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+func (s *shardedStore) Has(key string) bool {
+	return s.shard(key).Has(key)
+}
+
+func (s *shardedStore) Get(key string) (string, bool) {
+	return s.shard(key).Get(key)
+}
+
+func (s *shardedStore) GetEntry(key string) (Entry, bool) {
+	return s.shard(key).GetEntry(key)
+}
+
+func (s *shardedStore) Put(key, value string) {
+	s.shard(key).Put(key, value)
+}
+
+func (s *shardedStore) PutWithTTL(key, value string, ttl time.Duration) {
+	s.shard(key).PutWithTTL(key, value, ttl)
+}
+
+func (s *shardedStore) Delete(key string) {
+	s.shard(key).Delete(key)
+}
+
+// MultiGet reads the keys from each shard with a single batch, so the values
+// are only consistent within each shard
+func (s *shardedStore) MultiGet(keys []string) map[string]string {
+	values := make(map[string]string, len(keys))
+	for shard, shardKeys := range s.groupKeys(keys) {
+		for key, value := range shard.MultiGet(shardKeys) {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// MultiPut writes to each shard with a single batch, so the batch is only
+// atomic within each shard
+func (s *shardedStore) MultiPut(entries map[string]string, ttl time.Duration) {
+	batches := make(map[Store]map[string]string)
+	for key, value := range entries {
+		shard := s.shard(key)
+		if batches[shard] == nil {
+			batches[shard] = make(map[string]string)
+		}
+		batches[shard][key] = value
+	}
+	for shard, batch := range batches {
+		shard.MultiPut(batch, ttl)
+	}
+}
+
+func (s *shardedStore) MultiDelete(keys []string) {
+	for shard, shardKeys := range s.groupKeys(keys) {
+		shard.MultiDelete(shardKeys)
+	}
+}
+
+// groupKeys splits the keys by shard
+func (s *shardedStore) groupKeys(keys []string) map[Store][]string {
+	groups := make(map[Store][]string)
+	for _, key := range keys {
+		shard := s.shard(key)
+		groups[shard] = append(groups[shard], key)
+	}
+	return groups
+}
+
+func (s *shardedStore) CompareAndSwap(key, expected, value string) (string, bool) {
+	return s.shard(key).CompareAndSwap(key, expected, value)
+}
+
+func (s *shardedStore) Increment(key string, delta int64) (int64, error) {
+	return s.shard(key).Increment(key, delta)
+}
+
+func (s *shardedStore) DeleteExpired() []string {
+	var keys []string
+	for _, shard := range s.shards {
+		keys = append(keys, shard.DeleteExpired()...)
+	}
+	return keys
+}
+
+func (s *shardedStore) Entries() map[string]Entry {
+	entries := make(map[string]Entry)
+	for _, shard := range s.shards {
+		for key, entry := range shard.Entries() {
+			entries[key] = entry
+		}
+	}
+	return entries
+}
+
+// Scan merges a page from every shard. Each shard returns its first keys after
+// the cursor, so the first keys overall are among them.
+func (s *shardedStore) Scan(prefix, cursor string, limit int) ([]string, string) {
+	page := newScanPage(limit)
+	for _, shard := range s.shards {
+		shardKeys, next := shard.Scan(prefix, cursor, limit)
+		for _, key := range shardKeys {
+			page.add(key)
+		}
+		page.more = page.more || next != ""
+	}
+	return page.keys()
+}
+
+func (s *shardedStore) Stats() Stats {
+	var stats Stats
+	for _, shard := range s.shards {
+		shardStats := shard.Stats()
+		stats.Entries += shardStats.Entries
+		stats.Bytes += shardStats.Bytes
+		stats.MaxBytes += shardStats.MaxBytes
+		stats.Evictions += shardStats.Evictions
+	}
+	return stats
+}
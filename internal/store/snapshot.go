@@ -0,0 +1,289 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot starts with a magic number, a version and the number of entries.
+// Each entry is its length-prefixed key and value, and its expiry in Unix
+// nanoseconds (0 for none). It ends with a CRC-32C checksum of everything
+// before it.
+var snapshotMagic = []byte("GMCS")
+
+const snapshotVersion uint16 = 1
+
+var (
+	ErrInvalidSnapshot            = errors.New("not a snapshot")
+	ErrUnsupportedSnapshotVersion = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksum           = errors.New("snapshot checksum mismatch")
+
+	snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// SaveSnapshot writes a consistent snapshot of the store. The entries are
+// copied before anything is written, so a locking decorator is only held for
+// the copy, not for the whole dump.
+func SaveSnapshot(store Store, w io.Writer) error {
+	return WriteSnapshot(w, store.Entries())
+}
+
+// LoadSnapshot reads a snapshot and adds its entries to the store, skipping
+// entries that have expired. Nothing is added unless the whole snapshot is
+// valid. It returns the number of entries added.
+func LoadSnapshot(store Store, r io.Reader, clock Clock) (int, error) {
+	entries, err := ReadSnapshot(r)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	now := clock.Now()
+	for key, entry := range entries {
+		var ttl time.Duration
+		if !entry.Expiry.IsZero() {
+			ttl = entry.Expiry.Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+		}
+		store.PutWithTTL(key, entry.Value, ttl)
+		count++
+	}
+	return count, nil
+}
+
+// replacePageSize is the number of keys checked at a time when ReplaceEntries
+// removes the keys that aren't in the new entries
+const replacePageSize = 1000
+
+// ReplaceEntries replaces the contents of the store with the entries, skipping
+// entries that have expired. Keys that aren't in the entries are deleted, and
+// the rest are overwritten, so that keys in both never disappear along the
+// way. Reads can see a mix of old and new entries until it returns.
+func ReplaceEntries(store Store, entries map[string]Entry, clock Clock) {
+	cursor := ""
+	for {
+		keys, next := store.Scan("", cursor, replacePageSize)
+		var removed []string
+		for _, key := range keys {
+			if _, ok := entries[key]; !ok {
+				removed = append(removed, key)
+			}
+		}
+		store.MultiDelete(removed)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	for key, entry := range entries {
+		ApplyChange(store, Change{
+			Type:   ChangePut,
+			Key:    key,
+			Value:  entry.Value,
+			Expiry: entry.Expiry,
+		}, clock)
+	}
+}
+
+// SaveSnapshotFile writes a snapshot to a temporary file, then renames it, so
+// the file at the path is always a complete snapshot
+func SaveSnapshotFile(store Store, path string) error {
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = SaveSnapshot(store, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+func LoadSnapshotFile(store Store, path string, clock Clock) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return LoadSnapshot(store, bufio.NewReader(file), clock)
+}
+
+func WriteSnapshot(w io.Writer, entries map[string]Entry) error {
+	checksum := crc32.New(snapshotTable)
+	writer := &snapshotWriter{
+		writer: io.MultiWriter(w, checksum),
+	}
+
+	writer.write(snapshotMagic)
+	var version [2]byte
+	binary.BigEndian.PutUint16(version[:], snapshotVersion)
+	writer.write(version[:])
+	writer.writeUvarint(uint64(len(entries)))
+	for key, entry := range entries {
+		var expiryNanos int64
+		if !entry.Expiry.IsZero() {
+			expiryNanos = entry.Expiry.UnixNano()
+		}
+		writer.writeString(key)
+		writer.writeString(entry.Value)
+		writer.writeVarint(expiryNanos)
+	}
+	if writer.err != nil {
+		return writer.err
+	}
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], checksum.Sum32())
+	_, err := w.Write(sum[:])
+	return err
+}
+
+func ReadSnapshot(r io.Reader) (map[string]Entry, error) {
+	checksum := crc32.New(snapshotTable)
+	reader := &snapshotReader{
+		reader:   bufio.NewReader(r),
+		checksum: checksum,
+	}
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return nil, ErrInvalidSnapshot
+	}
+	var version [2]byte
+	if _, err := io.ReadFull(reader, version[:]); err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+	if binary.BigEndian.Uint16(version[:]) != snapshotVersion {
+		return nil, ErrUnsupportedSnapshotVersion
+	}
+
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, snapshotError(err)
+	}
+	entries := make(map[string]Entry)
+	for i := uint64(0); i < count; i++ {
+		key, err := reader.readString()
+		if err != nil {
+			return nil, snapshotError(err)
+		}
+		value, err := reader.readString()
+		if err != nil {
+			return nil, snapshotError(err)
+		}
+		expiryNanos, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, snapshotError(err)
+		}
+		entry := Entry{
+			Value: value,
+		}
+		if expiryNanos != 0 {
+			entry.Expiry = time.Unix(0, expiryNanos)
+		}
+		entries[key] = entry
+	}
+
+	expected := checksum.Sum32()
+	var sum [4]byte
+	if _, err := io.ReadFull(reader.reader, sum[:]); err != nil {
+		return nil, snapshotError(err)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != expected {
+		return nil, ErrSnapshotChecksum
+	}
+	return entries, nil
+}
+
+// snapshotError reports a snapshot that ends early as invalid
+func snapshotError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidSnapshot
+	}
+	return err
+}
+
+// snapshotWriter keeps the first error, so that it only has to be checked once
+type snapshotWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (w *snapshotWriter) write(data []byte) {
+	if w.err == nil {
+		_, w.err = w.writer.Write(data)
+	}
+}
+
+func (w *snapshotWriter) writeUvarint(value uint64) {
+	var encoded [binary.MaxVarintLen64]byte
+	w.write(encoded[:binary.PutUvarint(encoded[:], value)])
+}
+
+func (w *snapshotWriter) writeVarint(value int64) {
+	var encoded [binary.MaxVarintLen64]byte
+	w.write(encoded[:binary.PutVarint(encoded[:], value)])
+}
+
+func (w *snapshotWriter) writeString(value string) {
+	w.writeUvarint(uint64(len(value)))
+	w.write([]byte(value))
+}
+
+// snapshotReader checksums everything it reads
+type snapshotReader struct {
+	reader   *bufio.Reader
+	checksum hash.Hash32
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.checksum.Write(p[:n])
+	return n, err
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.checksum.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (r *snapshotReader) readString() (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	// Copy rather than allocating the length up front, which could be corrupt
+	var buffer bytes.Buffer
+	if _, err := io.CopyN(&buffer, r, int64(length)); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,153 @@
+package store_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/store"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	clock := newFakeClock()
+	source := store.NewStore(store.UseClock(clock))
+	source.Put("test key 1", "test value 1")
+	source.PutWithTTL("test key 2", "test value 2", time.Hour)
+	source.PutWithTTL("expired", "test value", time.Minute)
+	clock.Advance(time.Minute)
+
+	var buffer bytes.Buffer
+	require.Nil(t, store.SaveSnapshot(source, &buffer))
+
+	destination := store.NewStore(store.UseClock(clock))
+	count, err := store.LoadSnapshot(destination, &buffer, clock)
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, source.Entries(), destination.Entries())
+}
+
+func TestSnapshotExpiresWhileSaved(t *testing.T) {
+	clock := newFakeClock()
+	source := store.NewStore(store.UseClock(clock))
+	source.Put("test key 1", "test value 1")
+	source.PutWithTTL("test key 2", "test value 2", time.Minute)
+
+	var buffer bytes.Buffer
+	require.Nil(t, store.SaveSnapshot(source, &buffer))
+
+	clock.Advance(time.Minute)
+	destination := store.NewStore(store.UseClock(clock))
+	count, err := store.LoadSnapshot(destination, &buffer, clock)
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	require.True(t, destination.Has("test key 1"))
+	require.False(t, destination.Has("test key 2"))
+}
+
+func TestReplaceEntries(t *testing.T) {
+	clock := newFakeClock()
+	s := store.NewStore(store.UseClock(clock))
+	for i := 0; i < 2500; i++ {
+		s.Put(fmt.Sprintf("old key %v", i), "old value")
+	}
+	s.Put("test key", "old value")
+
+	store.ReplaceEntries(s, map[string]store.Entry{
+		"test key":  {Value: "test value", Expiry: clock.Now().Add(time.Minute)},
+		"other key": {Value: "other value"},
+		"expired":   {Value: "expired value", Expiry: clock.Now()},
+	}, clock)
+	require.Equal(t, map[string]store.Entry{
+		"test key":  {Value: "test value", Expiry: clock.Now().Add(time.Minute)},
+		"other key": {Value: "other value"},
+	}, s.Entries())
+}
+
+func TestSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.snapshot")
+	source := store.NewStoreWithContents(map[string]string{
+		"test key": "test value",
+	})
+	require.Nil(t, store.SaveSnapshotFile(source, path))
+
+	destination := store.NewStore()
+	count, err := store.LoadSnapshotFile(destination, path, store.SystemClock())
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	require.True(t, destination.Has("test key"))
+}
+
+func saveTestSnapshot(t *testing.T) []byte {
+	var buffer bytes.Buffer
+	require.Nil(t, store.WriteSnapshot(&buffer, map[string]store.Entry{
+		"test key": {Value: "test value"},
+	}))
+	return buffer.Bytes()
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+
+	t.Run("checksum", func(t *testing.T) {
+		snapshot := saveTestSnapshot(t)
+		snapshot[len(snapshot)-6] ^= 0xff
+		destination := store.NewStore()
+		_, err := store.LoadSnapshot(destination, bytes.NewReader(snapshot), store.SystemClock())
+		require.Equal(t, store.ErrSnapshotChecksum, err)
+		require.False(t, destination.Has("test key"))
+	})
+
+	t.Run("version", func(t *testing.T) {
+		snapshot := saveTestSnapshot(t)
+		snapshot[5] = 99
+		_, err := store.ReadSnapshot(bytes.NewReader(snapshot))
+		require.Equal(t, store.ErrUnsupportedSnapshotVersion, err)
+	})
+
+	t.Run("magic", func(t *testing.T) {
+		_, err := store.ReadSnapshot(bytes.NewReader([]byte("not a snapshot")))
+		require.Equal(t, store.ErrInvalidSnapshot, err)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		snapshot := saveTestSnapshot(t)
+		_, err := store.ReadSnapshot(bytes.NewReader(snapshot[:len(snapshot)-10]))
+		require.Equal(t, store.ErrInvalidSnapshot, err)
+	})
+
+}
+
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	source := store.WithRWMutex(store.NewStore())
+	for i := 0; i < 1000; i++ {
+		source.Put(fmt.Sprintf("test key %v", i), "test value")
+	}
+
+	// Writes continue while the snapshot is saved, for race detection
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				source.Put(fmt.Sprintf("new test key %v", i), "test value")
+			}
+		}
+	}()
+
+	var buffer bytes.Buffer
+	err := store.SaveSnapshot(source, &buffer)
+	close(stop)
+	wg.Wait()
+	require.Nil(t, err)
+
+	entries, err := store.ReadSnapshot(&buffer)
+	require.Nil(t, err)
+	require.GreaterOrEqual(t, len(entries), 1000)
+}
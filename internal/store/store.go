@@ -1,50 +1,427 @@
 package store
 
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
 //go:generate mockery --name=Store --inpackage --case underscore
 
 type Store interface {
 	Has(key string) bool
 	Get(key string) (string, bool)
+	// GetEntry returns the value and expiry of a key, and whether it exists.
+	GetEntry(key string) (Entry, bool)
 	Put(key, value string)
+	// PutWithTTL sets the value for a key, which expires after the ttl. A ttl
+	// of zero or less means the value never expires.
+	PutWithTTL(key, value string, ttl time.Duration)
 	Delete(key string)
+	// MultiGet returns the values of the keys that exist.
+	MultiGet(keys []string) map[string]string
+	// MultiPut sets the values for several keys, which expire after the ttl.
+	// A ttl of zero or less means the values never expire.
+	MultiPut(entries map[string]string, ttl time.Duration)
+	MultiDelete(keys []string)
+	// CompareAndSwap sets the value for a key only if it currently holds the
+	// expected value, keeping any expiry. It returns the value held afterwards,
+	// and whether the swap happened.
+	CompareAndSwap(key, expected, value string) (string, bool)
+	// Increment adds the delta to an integer value, creating the key if it is
+	// missing, and returns the new value. The delta can be negative.
+	Increment(key string, delta int64) (int64, error)
+	// DeleteExpired removes all expired entries, and returns their keys.
+	DeleteExpired() []string
+	// Entries returns a copy of all entries that have not expired.
+	Entries() map[string]Entry
+	// Scan returns up to limit keys with the prefix that sort after the
+	// cursor, in order, and the cursor for the next page. The cursor is empty
+	// when there are no more keys. A limit of zero or less means no limit.
+	// Because each page starts after the last key returned, a key is never
+	// returned twice, and a key that exists for the whole scan is never missed.
+	Scan(prefix, cursor string, limit int) ([]string, string)
+	Stats() Stats
+}
+
+type Entry struct {
+	Value  string
+	Expiry time.Time // Zero if the entry never expires
+}
+
+var (
+	ErrNotInteger = errors.New("value is not a 64-bit integer")
+	ErrOverflow   = errors.New("increment would overflow a 64-bit integer")
+)
+
+type Stats struct {
+	Entries   int    // Includes expired entries that have not been deleted yet
+	Bytes     int64  // Approximate size of all keys and values
+	MaxBytes  int64  // Byte budget, or 0 if there is no budget
+	Evictions uint64 // Entries removed to stay within a limit
+}
+
+type Option func(*config)
+
+type config struct {
+	clock    Clock
+	maxBytes int64
+}
+
+func newConfig(options []Option) config {
+	c := config{
+		clock: SystemClock(),
+	}
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
+// UseClock sets the clock used to check expiry. The default is the system
+// clock.
+func UseClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// MaxBytes sets a budget for the approximate size of all keys and values.
+// Entries are evicted after a write exceeds the budget, starting with expired
+// entries, except that an entry larger than the whole budget is evicted alone.
+// A budget of zero or less means there is no limit.
+func MaxBytes(budget int64) Option {
+	return func(c *config) {
+		c.maxBytes = budget
+	}
 }
 
 type defaultStore struct {
-	contents map[string]string
+	config
+
+	contents  map[string]string
+	expiries  map[string]time.Time // Only keys with a TTL have an expiry
+	bytes     int64
+	evictions uint64
 }
 
-func newDefaultStore() *defaultStore {
+func newDefaultStore(options ...Option) *defaultStore {
 	return &defaultStore{
+		config:   newConfig(options),
 		contents: make(map[string]string),
+		expiries: make(map[string]time.Time),
 	}
 }
 
-func NewStore() Store {
-	return newDefaultStore()
+// clone returns a copy of the store that can be modified independently
+func (s *defaultStore) clone() *defaultStore {
+	c := &defaultStore{
+		config:    s.config,
+		contents:  make(map[string]string, len(s.contents)),
+		expiries:  make(map[string]time.Time, len(s.expiries)),
+		bytes:     s.bytes,
+		evictions: s.evictions,
+	}
+	for k, v := range s.contents {
+		c.contents[k] = v
+	}
+	for k, v := range s.expiries {
+		c.expiries[k] = v
+	}
+	return c
 }
 
-func NewStoreWithContents(contents map[string]string) Store {
-	s := newDefaultStore()
+func NewStore(options ...Option) Store {
+	return newDefaultStore(options...)
+}
+
+func NewStoreWithContents(contents map[string]string, options ...Option) Store {
+	s := newDefaultStore(options...)
 	for k, v := range contents {
-		s.contents[k] = v
+		s.set(k, v)
 	}
+	s.enforceBudget("")
 	return s
 }
 
+// expired reports whether the key has a TTL that has passed. Expired entries
+// are left in place until DeleteExpired is called, so that reads never modify
+// the store.
+func (s *defaultStore) expired(key string) bool {
+	expiry, ok := s.expiries[key]
+	return ok && !s.clock.Now().Before(expiry)
+}
+
 func (s *defaultStore) Has(key string) bool {
 	_, ok := s.contents[key]
-	return ok
+	return ok && !s.expired(key)
 }
 
 func (s *defaultStore) Get(key string) (string, bool) {
 	value, ok := s.contents[key]
-	return value, ok
+	if !ok || s.expired(key) {
+		return "", false
+	}
+	return value, true
+}
+
+func (s *defaultStore) GetEntry(key string) (Entry, bool) {
+	value, ok := s.Get(key)
+	if !ok {
+		return Entry{}, false
+	}
+	return Entry{Value: value, Expiry: s.expiries[key]}, true
 }
 
 func (s *defaultStore) Put(key, value string) {
-	s.contents[key] = value
+	s.set(key, value)
+	delete(s.expiries, key)
+	s.enforceBudget(key)
+}
+
+func (s *defaultStore) PutWithTTL(key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		s.Put(key, value)
+		return
+	}
+	s.set(key, value)
+	s.expiries[key] = s.clock.Now().Add(ttl)
+	s.enforceBudget(key)
 }
 
 func (s *defaultStore) Delete(key string) {
-	delete(s.contents, key)
+	s.remove(key)
+}
+
+func (s *defaultStore) MultiGet(keys []string) map[string]string {
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if value, ok := s.Get(key); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func (s *defaultStore) MultiPut(entries map[string]string, ttl time.Duration) {
+	for key, value := range entries {
+		s.PutWithTTL(key, value, ttl)
+	}
+}
+
+func (s *defaultStore) MultiDelete(keys []string) {
+	for _, key := range keys {
+		s.remove(key)
+	}
+}
+
+func (s *defaultStore) CompareAndSwap(key, expected, value string) (string, bool) {
+	current, ok := s.Get(key)
+	if !ok || current != expected {
+		return current, false
+	}
+	s.set(key, value)
+	s.enforceBudget(key)
+	return value, true
+}
+
+func (s *defaultStore) Increment(key string, delta int64) (int64, error) {
+	current, ok := s.Get(key)
+	result, err := increment(current, ok, delta)
+	if err != nil {
+		return 0, err
+	}
+	s.set(key, strconv.FormatInt(result, 10))
+	if !ok {
+		// The key may have expired, so make sure the new value doesn't
+		delete(s.expiries, key)
+	}
+	s.enforceBudget(key)
+	return result, nil
+}
+
+// anyExpired reports whether DeleteExpired would remove anything
+func (s *defaultStore) anyExpired() bool {
+	now := s.clock.Now()
+	for _, expiry := range s.expiries {
+		if !now.Before(expiry) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *defaultStore) DeleteExpired() []string {
+	var keys []string
+	now := s.clock.Now()
+	for key, expiry := range s.expiries {
+		if !now.Before(expiry) {
+			s.remove(key)
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *defaultStore) Entries() map[string]Entry {
+	entries := make(map[string]Entry, len(s.contents))
+	now := s.clock.Now()
+	for key, value := range s.contents {
+		expiry, ok := s.expiries[key]
+		if ok && !now.Before(expiry) {
+			continue
+		}
+		entries[key] = Entry{
+			Value:  value,
+			Expiry: expiry,
+		}
+	}
+	return entries
+}
+
+func (s *defaultStore) Scan(prefix, cursor string, limit int) ([]string, string) {
+	page := newScanPage(limit)
+	for key := range s.contents {
+		if scanMatches(key, prefix, cursor) && !s.expired(key) {
+			page.add(key)
+		}
+	}
+	return page.keys()
+}
+
+func (s *defaultStore) Stats() Stats {
+	return Stats{
+		Entries:   len(s.contents),
+		Bytes:     s.bytes,
+		MaxBytes:  s.maxBytes,
+		Evictions: s.evictions,
+	}
+}
+
+// increment parses the current value and adds the delta to it. A missing value
+// counts as zero.
+func increment(current string, exists bool, delta int64) (int64, error) {
+	var value int64
+	if exists {
+		var err error
+		value, err = strconv.ParseInt(current, 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && value > math.MaxInt64-delta) || (delta < 0 && value < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	return value + delta, nil
+}
+
+// scanMatches reports whether a key belongs on a page of a scan
+func scanMatches(key, prefix, cursor string) bool {
+	return key > cursor && strings.HasPrefix(key, prefix)
+}
+
+// scanPage collects the first keys of a page of a scan. Only the limit
+// smallest keys seen so far are kept, in a heap with the largest at the top,
+// so a page doesn't need every matching key to be sorted.
+type scanPage struct {
+	limit    int
+	selected keyHeap
+	more     bool // Set if there are matching keys that were not kept
+}
+
+func newScanPage(limit int) *scanPage {
+	return &scanPage{limit: limit}
+}
+
+func (p *scanPage) add(key string) {
+	if p.limit <= 0 {
+		p.selected = append(p.selected, key)
+		return
+	}
+	if len(p.selected) < p.limit {
+		heap.Push(&p.selected, key)
+		return
+	}
+	p.more = true
+	if key < p.selected[0] {
+		p.selected[0] = key
+		heap.Fix(&p.selected, 0)
+	}
+}
+
+// keys returns the page in order, and the cursor for the next page
+func (p *scanPage) keys() ([]string, string) {
+	keys := []string(p.selected)
+	sort.Strings(keys)
+	if !p.more || len(keys) == 0 {
+		return keys, ""
+	}
+	return keys, keys[len(keys)-1]
+}
+
+// keyHeap is a max-heap of keys
+type keyHeap []string
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyHeap) Push(key interface{}) {
+	*h = append(*h, key.(string))
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
+func entrySize(key, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+// set writes the value without changing the expiry, and keeps the size up to date
+func (s *defaultStore) set(key, value string) {
+	if old, ok := s.contents[key]; ok {
+		s.bytes -= entrySize(key, old)
+	}
+	s.contents[key] = value
+	s.bytes += entrySize(key, value)
+}
+
+func (s *defaultStore) remove(key string) {
+	if old, ok := s.contents[key]; ok {
+		s.bytes -= entrySize(key, old)
+		delete(s.contents, key)
+	}
+	delete(s.expiries, key)
+}
+
+// enforceBudget evicts entries until the store is within its byte budget. A
+// key that was just written and exceeds the budget alone is evicted by itself,
+// rather than making room for it that it can't use.
+func (s *defaultStore) enforceBudget(key string) {
+	if s.maxBytes <= 0 || s.bytes <= s.maxBytes {
+		return
+	}
+	if value, ok := s.contents[key]; ok && entrySize(key, value) > s.maxBytes {
+		s.remove(key)
+		s.evictions++
+		return
+	}
+	s.DeleteExpired()
+	for k := range s.contents {
+		if s.bytes <= s.maxBytes {
+			return
+		}
+		if k != key {
+			s.remove(k)
+			s.evictions++
+		}
+	}
 }
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"sync"
 	"testing"
+	"time"
 )
 
 func createDefaultStore() store.Store {
@@ -22,11 +23,110 @@ func createStoreWithRWMutexDecorator() store.Store {
 	return store.WithRWMutex(store.NewStore())
 }
 
+func createStoreWithLRUDecorator() store.Store {
+	return store.WithRWMutex(store.WithLRU(store.NewStore(), lruCapacity))
+}
+
+const lruCapacity = 1024
+
+func createShardedStore() store.Store {
+	return store.NewShardedStore(shardCount)
+}
+
+const shardCount = 16
+
+func createSyncMapStore() store.Store {
+	return store.NewSyncMapStore()
+}
+
+func createCopyOnWriteStore() store.Store {
+	return store.NewCopyOnWriteStore()
+}
+
+// fakeClock is a clock that only moves when advanced by the test
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	clock    *fakeClock
+	interval time.Duration
+	next     time.Time
+	c        chan time.Time
+	stopped  bool          // Protected by the clock's mutex
+	done     chan struct{} // Closed when the ticker is stopped
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now: time.Date(2021, time.September, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(interval time.Duration) store.Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ticker := &fakeTicker{
+		clock:    c,
+		interval: interval,
+		next:     c.now.Add(interval),
+		c:        make(chan time.Time),
+		done:     make(chan struct{}),
+	}
+	c.tickers = append(c.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward, and waits for each due ticker to be
+// received, or stopped
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*fakeTicker
+	for _, ticker := range c.tickers {
+		if !ticker.stopped && !now.Before(ticker.next) {
+			ticker.next = now.Add(ticker.interval)
+			due = append(due, ticker)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, ticker := range due {
+		select {
+		case ticker.c <- now:
+		case <-ticker.done:
+		}
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	if !t.stopped {
+		t.stopped = true
+		close(t.done)
+	}
+}
+
 type storeTestSuite struct {
 	suite.Suite
 
 	createStore             func() store.Store
 	createStoreWithContents func(map[string]string) store.Store
+	createStoreWithClock    func(store.Clock) store.Store
 }
 
 func (suite *storeTestSuite) TestHas() {
@@ -84,6 +184,34 @@ func (suite *storeTestSuite) TestGet() {
 
 }
 
+func (suite *storeTestSuite) TestGetEntry() {
+
+	suite.T().Run("missing key", func(t *testing.T) {
+		s := suite.createStore()
+		entry, ok := s.GetEntry("test key")
+		require.Equal(t, store.Entry{}, entry)
+		require.False(t, ok)
+	})
+
+	suite.T().Run("expiry", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.Put("test key", "test value")
+		s.PutWithTTL("other key", "other value", time.Minute)
+		entry, ok := s.GetEntry("test key")
+		require.Equal(t, store.Entry{Value: "test value"}, entry)
+		require.True(t, ok)
+		entry, ok = s.GetEntry("other key")
+		require.Equal(t, store.Entry{Value: "other value", Expiry: clock.Now().Add(time.Minute)}, entry)
+		require.True(t, ok)
+
+		clock.Advance(time.Minute)
+		_, ok = s.GetEntry("other key")
+		require.False(t, ok)
+	})
+
+}
+
 func (suite *storeTestSuite) TestPut() {
 
 	suite.T().Run("empty store", func(t *testing.T) {
@@ -133,6 +261,404 @@ func (suite *storeTestSuite) TestDelete() {
 
 }
 
+func (suite *storeTestSuite) TestMultiGet() {
+
+	suite.T().Run("empty store", func(t *testing.T) {
+		s := suite.createStore()
+		require.Empty(t, s.MultiGet([]string{"test key 1", "test key 2"}))
+	})
+
+	suite.T().Run("some keys", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key 1": "test value 1",
+			"test key 2": "test value 2",
+			"test key 3": "test value 3",
+		})
+		require.Equal(t, map[string]string{
+			"test key 1": "test value 1",
+			"test key 3": "test value 3",
+		}, s.MultiGet([]string{"test key 1", "test key 3", "other key"}))
+	})
+
+	suite.T().Run("expired", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.Put("test key 1", "test value 1")
+		s.PutWithTTL("test key 2", "test value 2", time.Minute)
+		clock.Advance(time.Minute)
+		require.Equal(t, map[string]string{
+			"test key 1": "test value 1",
+		}, s.MultiGet([]string{"test key 1", "test key 2"}))
+	})
+
+}
+
+func (suite *storeTestSuite) TestMultiPut() {
+
+	suite.T().Run("new and existing keys", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key 1": "test value 1",
+		})
+		s.MultiPut(map[string]string{
+			"test key 1": "new test value 1",
+			"test key 2": "test value 2",
+		}, 0)
+		require.Equal(t, map[string]string{
+			"test key 1": "new test value 1",
+			"test key 2": "test value 2",
+		}, s.MultiGet([]string{"test key 1", "test key 2"}))
+	})
+
+	suite.T().Run("ttl", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.MultiPut(map[string]string{
+			"test key 1": "test value 1",
+			"test key 2": "test value 2",
+		}, time.Minute)
+		require.True(t, s.Has("test key 1"))
+		clock.Advance(time.Minute)
+		require.False(t, s.Has("test key 1"))
+		require.False(t, s.Has("test key 2"))
+	})
+
+}
+
+func (suite *storeTestSuite) TestMultiDelete() {
+
+	suite.T().Run("some keys", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key 1": "test value 1",
+			"test key 2": "test value 2",
+			"test key 3": "test value 3",
+		})
+		s.MultiDelete([]string{"test key 1", "test key 3", "other key"})
+		require.False(t, s.Has("test key 1"))
+		require.True(t, s.Has("test key 2"))
+		require.False(t, s.Has("test key 3"))
+		require.Equal(t, 1, s.Stats().Entries)
+	})
+
+}
+
+func (suite *storeTestSuite) TestPutWithTTL() {
+
+	suite.T().Run("before expiry", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.PutWithTTL("test key", "test value", time.Minute)
+		clock.Advance(time.Minute - time.Nanosecond)
+		value, ok := s.Get("test key")
+		require.Equal(t, "test value", value)
+		require.True(t, ok)
+		require.True(t, s.Has("test key"))
+	})
+
+	suite.T().Run("after expiry", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.PutWithTTL("test key", "test value", time.Minute)
+		clock.Advance(time.Minute)
+		value, ok := s.Get("test key")
+		require.Empty(t, value)
+		require.False(t, ok)
+		require.False(t, s.Has("test key"))
+	})
+
+	suite.T().Run("no ttl", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.PutWithTTL("test key", "test value", 0)
+		clock.Advance(time.Hour)
+		require.True(t, s.Has("test key"))
+	})
+
+	suite.T().Run("replaced without ttl", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.PutWithTTL("test key", "test value", time.Minute)
+		s.Put("test key", "new test value")
+		clock.Advance(time.Hour)
+		value, ok := s.Get("test key")
+		require.Equal(t, "new test value", value)
+		require.True(t, ok)
+	})
+
+}
+
+func (suite *storeTestSuite) TestDeleteExpired() {
+
+	suite.T().Run("empty store", func(t *testing.T) {
+		s := suite.createStore()
+		require.Empty(t, s.DeleteExpired())
+	})
+
+	suite.T().Run("mixed expiry", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.Put("test key 1", "test value 1")
+		s.PutWithTTL("test key 2", "test value 2", time.Minute)
+		s.PutWithTTL("test key 3", "test value 3", time.Hour)
+		clock.Advance(time.Minute)
+		require.Equal(t, []string{"test key 2"}, s.DeleteExpired())
+		require.True(t, s.Has("test key 1"))
+		require.False(t, s.Has("test key 2"))
+		require.True(t, s.Has("test key 3"))
+	})
+
+	suite.T().Run("replaced after expiry", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.PutWithTTL("test key", "test value", time.Minute)
+		clock.Advance(time.Minute)
+		s.Put("test key", "new test value")
+		require.Empty(t, s.DeleteExpired())
+		require.True(t, s.Has("test key"))
+	})
+
+}
+
+func (suite *storeTestSuite) TestCompareAndSwap() {
+
+	suite.T().Run("empty store", func(t *testing.T) {
+		s := suite.createStore()
+		current, swapped := s.CompareAndSwap("test key", "", "new test value")
+		require.Empty(t, current)
+		require.False(t, swapped)
+		require.False(t, s.Has("test key"))
+	})
+
+	suite.T().Run("wrong value", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key": "test value",
+		})
+		current, swapped := s.CompareAndSwap("test key", "other value", "new test value")
+		require.Equal(t, "test value", current)
+		require.False(t, swapped)
+		value, _ := s.Get("test key")
+		require.Equal(t, "test value", value)
+	})
+
+	suite.T().Run("right value", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key": "test value",
+		})
+		current, swapped := s.CompareAndSwap("test key", "test value", "new test value")
+		require.Equal(t, "new test value", current)
+		require.True(t, swapped)
+		value, _ := s.Get("test key")
+		require.Equal(t, "new test value", value)
+	})
+
+	suite.T().Run("keeps expiry", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.PutWithTTL("test key", "test value", time.Minute)
+		_, swapped := s.CompareAndSwap("test key", "test value", "new test value")
+		require.True(t, swapped)
+		clock.Advance(time.Minute)
+		require.False(t, s.Has("test key"))
+	})
+
+	suite.T().Run("expired", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.PutWithTTL("test key", "test value", time.Minute)
+		clock.Advance(time.Minute)
+		current, swapped := s.CompareAndSwap("test key", "test value", "new test value")
+		require.Empty(t, current)
+		require.False(t, swapped)
+	})
+
+}
+
+func (suite *storeTestSuite) TestIncrement() {
+
+	suite.T().Run("empty store", func(t *testing.T) {
+		s := suite.createStore()
+		result, err := s.Increment("test key", 5)
+		require.Nil(t, err)
+		require.Equal(t, int64(5), result)
+		value, _ := s.Get("test key")
+		require.Equal(t, "5", value)
+	})
+
+	suite.T().Run("existing value", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key": "10",
+		})
+		result, err := s.Increment("test key", -15)
+		require.Nil(t, err)
+		require.Equal(t, int64(-5), result)
+		value, _ := s.Get("test key")
+		require.Equal(t, "-5", value)
+	})
+
+	suite.T().Run("not an integer", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key": "test value",
+		})
+		_, err := s.Increment("test key", 1)
+		require.Equal(t, store.ErrNotInteger, err)
+		value, _ := s.Get("test key")
+		require.Equal(t, "test value", value)
+	})
+
+	suite.T().Run("overflow", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key": "9223372036854775807",
+		})
+		_, err := s.Increment("test key", 1)
+		require.Equal(t, store.ErrOverflow, err)
+	})
+
+	suite.T().Run("keeps expiry", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.PutWithTTL("test key", "1", time.Minute)
+		_, err := s.Increment("test key", 1)
+		require.Nil(t, err)
+		clock.Advance(time.Minute)
+		require.False(t, s.Has("test key"))
+	})
+
+	suite.T().Run("expired", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.PutWithTTL("test key", "10", time.Minute)
+		clock.Advance(time.Minute)
+		result, err := s.Increment("test key", 1)
+		require.Nil(t, err)
+		require.Equal(t, int64(1), result)
+		clock.Advance(time.Hour)
+		require.True(t, s.Has("test key"))
+	})
+
+}
+
+func (suite *storeTestSuite) TestEntries() {
+
+	suite.T().Run("empty store", func(t *testing.T) {
+		s := suite.createStore()
+		require.Empty(t, s.Entries())
+	})
+
+	suite.T().Run("mixed expiry", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.Put("test key 1", "test value 1")
+		s.PutWithTTL("test key 2", "test value 2", time.Minute)
+		s.PutWithTTL("test key 3", "test value 3", time.Hour)
+		clock.Advance(time.Minute)
+		require.Equal(t, map[string]store.Entry{
+			"test key 1": {Value: "test value 1"},
+			"test key 3": {Value: "test value 3", Expiry: clock.Now().Add(time.Hour - time.Minute)},
+		}, s.Entries())
+	})
+
+}
+
+func (suite *storeTestSuite) TestScan() {
+
+	suite.T().Run("empty store", func(t *testing.T) {
+		s := suite.createStore()
+		keys, cursor := s.Scan("", "", 10)
+		require.Empty(t, keys)
+		require.Equal(t, "", cursor)
+	})
+
+	suite.T().Run("prefix", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"session:2": "test value",
+			"session:1": "test value",
+			"user:1":    "test value",
+		})
+		keys, cursor := s.Scan("session:", "", 0)
+		require.Equal(t, []string{"session:1", "session:2"}, keys)
+		require.Equal(t, "", cursor)
+	})
+
+	suite.T().Run("pages", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key 1": "test value",
+			"test key 2": "test value",
+			"test key 3": "test value",
+		})
+		keys, cursor := s.Scan("", "", 2)
+		require.Equal(t, []string{"test key 1", "test key 2"}, keys)
+		require.Equal(t, "test key 2", cursor)
+		keys, cursor = s.Scan("", cursor, 2)
+		require.Equal(t, []string{"test key 3"}, keys)
+		require.Equal(t, "", cursor)
+	})
+
+	suite.T().Run("many pages", func(t *testing.T) {
+		contents := make(map[string]string)
+		var expected []string
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("test key %03d", i)
+			contents[key] = "test value"
+			expected = append(expected, key)
+		}
+		s := suite.createStoreWithContents(contents)
+		var scanned []string
+		keys, cursor := s.Scan("", "", 7)
+		scanned = append(scanned, keys...)
+		for cursor != "" {
+			require.Len(t, keys, 7)
+			keys, cursor = s.Scan("", cursor, 7)
+			scanned = append(scanned, keys...)
+		}
+		require.Equal(t, expected, scanned)
+	})
+
+	suite.T().Run("expired", func(t *testing.T) {
+		clock := newFakeClock()
+		s := suite.createStoreWithClock(clock)
+		s.Put("test key 1", "test value")
+		s.PutWithTTL("test key 2", "test value", time.Minute)
+		clock.Advance(time.Minute)
+		keys, _ := s.Scan("", "", 0)
+		require.Equal(t, []string{"test key 1"}, keys)
+	})
+
+}
+
+func (suite *storeTestSuite) TestStats() {
+
+	suite.T().Run("empty store", func(t *testing.T) {
+		s := suite.createStore()
+		require.Equal(t, store.Stats{}, s.Stats())
+	})
+
+	suite.T().Run("put", func(t *testing.T) {
+		s := suite.createStore()
+		s.Put("test key", "test value")
+		stats := s.Stats()
+		require.Equal(t, 1, stats.Entries)
+		require.Equal(t, int64(len("test key")+len("test value")), stats.Bytes)
+	})
+
+	suite.T().Run("replace", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key": "test value",
+		})
+		s.Put("test key", "new test value")
+		stats := s.Stats()
+		require.Equal(t, 1, stats.Entries)
+		require.Equal(t, int64(len("test key")+len("new test value")), stats.Bytes)
+	})
+
+	suite.T().Run("delete", func(t *testing.T) {
+		s := suite.createStoreWithContents(map[string]string{
+			"test key": "test value",
+		})
+		s.Delete("test key")
+		require.Equal(t, store.Stats{}, s.Stats())
+	})
+
+}
+
 func TestDefaultStore(t *testing.T) {
 	suite.Run(t, &storeTestSuite{
 		createStore: func() store.Store {
@@ -141,6 +667,9 @@ func TestDefaultStore(t *testing.T) {
 		createStoreWithContents: func(contents map[string]string) store.Store {
 			return store.NewStoreWithContents(contents)
 		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return store.NewStore(store.UseClock(clock))
+		},
 	})
 }
 
@@ -152,6 +681,9 @@ func TestMutexDecorator(t *testing.T) {
 		createStoreWithContents: func(contents map[string]string) store.Store {
 			return store.WithMutex(store.NewStoreWithContents(contents))
 		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return store.WithMutex(store.NewStore(store.UseClock(clock)))
+		},
 	})
 }
 
@@ -163,6 +695,299 @@ func TestRWMutexDecorator(t *testing.T) {
 		createStoreWithContents: func(contents map[string]string) store.Store {
 			return store.WithRWMutex(store.NewStoreWithContents(contents))
 		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return store.WithRWMutex(store.NewStore(store.UseClock(clock)))
+		},
+	})
+}
+
+func TestLRUDecorator(t *testing.T) {
+	suite.Run(t, &storeTestSuite{
+		createStore: func() store.Store {
+			return store.WithLRU(store.NewStore(), lruCapacity)
+		},
+		createStoreWithContents: func(contents map[string]string) store.Store {
+			s := store.WithLRU(store.NewStore(), lruCapacity)
+			for k, v := range contents {
+				s.Put(k, v)
+			}
+			return s
+		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return store.WithLRU(store.NewStore(store.UseClock(clock)), lruCapacity, store.UseClock(clock))
+		},
+	})
+}
+
+func TestShardedStore(t *testing.T) {
+	suite.Run(t, &storeTestSuite{
+		createStore: createShardedStore,
+		createStoreWithContents: func(contents map[string]string) store.Store {
+			s := store.NewShardedStore(shardCount)
+			for k, v := range contents {
+				s.Put(k, v)
+			}
+			return s
+		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return store.NewShardedStore(shardCount, store.UseClock(clock))
+		},
+	})
+}
+
+func TestShardedStoreStats(t *testing.T) {
+	s := store.NewShardedStore(4, store.MaxBytes(10000))
+	for i := 0; i < 100; i++ {
+		s.Put(fmt.Sprintf("test key %v", i), "test value")
+	}
+	stats := s.Stats()
+	require.Equal(t, 100, stats.Entries)
+	require.Equal(t, int64(10000), stats.MaxBytes)
+}
+
+func TestSyncMapStore(t *testing.T) {
+	suite.Run(t, &storeTestSuite{
+		createStore: createSyncMapStore,
+		createStoreWithContents: func(contents map[string]string) store.Store {
+			return store.NewSyncMapStoreWithContents(contents)
+		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return store.NewSyncMapStore(store.UseClock(clock))
+		},
+	})
+}
+
+func TestCopyOnWriteStore(t *testing.T) {
+	suite.Run(t, &storeTestSuite{
+		createStore: createCopyOnWriteStore,
+		createStoreWithContents: func(contents map[string]string) store.Store {
+			return store.NewCopyOnWriteStoreWithContents(contents)
+		},
+		createStoreWithClock: func(clock store.Clock) store.Store {
+			return store.NewCopyOnWriteStore(store.UseClock(clock))
+		},
+	})
+}
+
+func TestCopyOnWriteStoreMaxBytes(t *testing.T) {
+	s := store.NewCopyOnWriteStore(store.MaxBytes(10))
+	s.Put("key 1", "val 1")
+	s.Put("key 2", "val 2")
+	stats := s.Stats()
+	require.Equal(t, 1, stats.Entries)
+	require.Equal(t, uint64(1), stats.Evictions)
+}
+
+func TestLRUDecoratorEviction(t *testing.T) {
+
+	t.Run("least recently put", func(t *testing.T) {
+		s := store.WithLRU(store.NewStore(), 2)
+		s.Put("test key 1", "test value 1")
+		s.Put("test key 2", "test value 2")
+		s.Put("test key 3", "test value 3")
+		require.False(t, s.Has("test key 1"))
+		require.True(t, s.Has("test key 2"))
+		require.True(t, s.Has("test key 3"))
+	})
+
+	t.Run("get counts as use", func(t *testing.T) {
+		s := store.WithLRU(store.NewStore(), 2)
+		s.Put("test key 1", "test value 1")
+		s.Put("test key 2", "test value 2")
+		s.Get("test key 1")
+		s.Put("test key 3", "test value 3")
+		require.True(t, s.Has("test key 1"))
+		require.False(t, s.Has("test key 2"))
+		require.True(t, s.Has("test key 3"))
+	})
+
+	t.Run("has counts as use", func(t *testing.T) {
+		s := store.WithLRU(store.NewStore(), 2)
+		s.Put("test key 1", "test value 1")
+		s.Put("test key 2", "test value 2")
+		s.Has("test key 1")
+		s.Put("test key 3", "test value 3")
+		require.True(t, s.Has("test key 1"))
+		require.False(t, s.Has("test key 2"))
+		require.True(t, s.Has("test key 3"))
+	})
+
+	t.Run("replace counts as use", func(t *testing.T) {
+		s := store.WithLRU(store.NewStore(), 2)
+		s.Put("test key 1", "test value 1")
+		s.Put("test key 2", "test value 2")
+		s.Put("test key 1", "new test value 1")
+		s.Put("test key 3", "test value 3")
+		require.True(t, s.Has("test key 1"))
+		require.False(t, s.Has("test key 2"))
+		require.True(t, s.Has("test key 3"))
+	})
+
+	t.Run("delete frees capacity", func(t *testing.T) {
+		s := store.WithLRU(store.NewStore(), 2)
+		s.Put("test key 1", "test value 1")
+		s.Put("test key 2", "test value 2")
+		s.Delete("test key 2")
+		s.Put("test key 3", "test value 3")
+		require.True(t, s.Has("test key 1"))
+		require.True(t, s.Has("test key 3"))
+	})
+
+	t.Run("expiry frees capacity", func(t *testing.T) {
+		clock := newFakeClock()
+		s := store.WithLRU(store.NewStore(store.UseClock(clock)), 2)
+		s.Put("test key 1", "test value 1")
+		s.PutWithTTL("test key 2", "test value 2", time.Minute)
+		clock.Advance(time.Minute)
+		s.DeleteExpired()
+		s.Put("test key 3", "test value 3")
+		require.True(t, s.Has("test key 1"))
+		require.True(t, s.Has("test key 3"))
+	})
+
+	t.Run("expired keys go first", func(t *testing.T) {
+		clock := newFakeClock()
+		s := store.WithLRU(store.NewStore(store.UseClock(clock)), 2, store.UseClock(clock))
+		s.PutWithTTL("test key 1", "test value 1", time.Minute)
+		s.Put("test key 2", "test value 2")
+		s.Get("test key 1")
+		clock.Advance(time.Minute)
+		s.Put("test key 3", "test value 3")
+		require.True(t, s.Has("test key 2"))
+		require.True(t, s.Has("test key 3"))
+		require.Equal(t, store.Stats{Entries: 2, Bytes: 44}, s.Stats())
+	})
+
+	t.Run("expired keys free the byte budget", func(t *testing.T) {
+		// Each entry is 10 bytes
+		clock := newFakeClock()
+		s := store.WithLRU(store.NewStore(store.UseClock(clock)), 0, store.MaxBytes(20), store.UseClock(clock))
+		s.Put("key 1", "val 1")
+		s.MultiPut(map[string]string{"key 2": "val 2"}, time.Minute)
+		clock.Advance(time.Minute)
+		s.Put("key 3", "val 3")
+		require.True(t, s.Has("key 1"))
+		require.True(t, s.Has("key 3"))
+		require.Equal(t, uint64(0), s.Stats().Evictions)
+	})
+
+	t.Run("byte budget", func(t *testing.T) {
+		// Each entry is 10 bytes
+		s := store.WithLRU(store.NewStore(), 0, store.MaxBytes(20))
+		s.Put("key 1", "val 1")
+		s.Put("key 2", "val 2")
+		s.Get("key 1")
+		s.Put("key 3", "val 3")
+		require.True(t, s.Has("key 1"))
+		require.False(t, s.Has("key 2"))
+		require.True(t, s.Has("key 3"))
+		s.Put("key 4", "a value larger than the budget")
+		require.False(t, s.Has("key 4"))
+		require.Equal(t, store.Stats{
+			Entries:   2,
+			Bytes:     20,
+			MaxBytes:  20,
+			Evictions: 2,
+		}, s.Stats())
+	})
+
+	t.Run("existing keys", func(t *testing.T) {
+		s := store.WithLRU(store.NewStoreWithContents(map[string]string{
+			"test key 1": "test value 1",
+			"test key 2": "test value 2",
+		}), 2)
+		s.Put("test key 3", "test value 3")
+		require.Equal(t, 2, s.Stats().Entries)
+		require.True(t, s.Has("test key 3"))
+	})
+
+	t.Run("evictions are deletes", func(t *testing.T) {
+		changeLog := store.WithChangeLog(store.NewStore(), 10)
+		s := store.WithLRU(changeLog, 1)
+		s.Put("test key 1", "test value 1")
+		s.Put("test key 2", "test value 2")
+		changes, ok := changeLog.ChangesSince(2, 0)
+		require.True(t, ok)
+		require.Len(t, changes, 1)
+		require.Equal(t, store.ChangeDelete, changes[0].Type)
+		require.Equal(t, "test key 1", changes[0].Key)
+	})
+}
+
+func TestLRUDecoratorStats(t *testing.T) {
+	s := store.WithLRU(store.NewStore(), 1)
+	s.Put("test key 1", "test value 1")
+	s.Put("test key 2", "test value 2")
+	stats := s.Stats()
+	require.Equal(t, 1, stats.Entries)
+	require.Equal(t, uint64(1), stats.Evictions)
+}
+
+func TestMaxBytes(t *testing.T) {
+	// Each entry is 10 bytes
+	entrySize := int64(len("key 1") + len("val 1"))
+
+	t.Run("within budget", func(t *testing.T) {
+		s := store.NewStore(store.MaxBytes(2 * entrySize))
+		s.Put("key 1", "val 1")
+		s.Put("key 2", "val 2")
+		require.True(t, s.Has("key 1"))
+		require.True(t, s.Has("key 2"))
+		require.Equal(t, store.Stats{
+			Entries:  2,
+			Bytes:    2 * entrySize,
+			MaxBytes: 2 * entrySize,
+		}, s.Stats())
+	})
+
+	t.Run("over budget", func(t *testing.T) {
+		s := store.NewStore(store.MaxBytes(2 * entrySize))
+		s.Put("key 1", "val 1")
+		s.Put("key 2", "val 2")
+		s.Put("key 3", "val 3")
+		require.True(t, s.Has("key 3"))
+		require.Equal(t, store.Stats{
+			Entries:   2,
+			Bytes:     2 * entrySize,
+			MaxBytes:  2 * entrySize,
+			Evictions: 1,
+		}, s.Stats())
+	})
+
+	t.Run("expired entries first", func(t *testing.T) {
+		clock := newFakeClock()
+		s := store.NewStore(store.UseClock(clock), store.MaxBytes(2*entrySize))
+		s.Put("key 1", "val 1")
+		s.PutWithTTL("key 2", "val 2", time.Minute)
+		clock.Advance(time.Minute)
+		s.Put("key 3", "val 3")
+		require.True(t, s.Has("key 1"))
+		require.True(t, s.Has("key 3"))
+		require.Equal(t, uint64(0), s.Stats().Evictions)
+	})
+
+	t.Run("entry larger than budget", func(t *testing.T) {
+		s := store.NewStore(store.MaxBytes(entrySize))
+		s.Put("key 1", "val 1")
+		s.Put("key 2", "a larger value")
+		require.False(t, s.Has("key 2"))
+		require.True(t, s.Has("key 1"))
+		require.Equal(t, store.Stats{
+			Entries:   1,
+			Bytes:     entrySize,
+			MaxBytes:  entrySize,
+			Evictions: 1,
+		}, s.Stats())
+	})
+
+	t.Run("initial contents", func(t *testing.T) {
+		s := store.NewStoreWithContents(map[string]string{
+			"key 1": "val 1",
+			"key 2": "val 2",
+		}, store.MaxBytes(entrySize))
+		stats := s.Stats()
+		require.Equal(t, 1, stats.Entries)
+		require.Equal(t, uint64(1), stats.Evictions)
 	})
 }
 
@@ -178,7 +1003,7 @@ func (suite *storeLockingTestSuite) TestLocking() {
 
 	// Run operations in parallel to allow for race detection
 	var wg sync.WaitGroup
-	wg.Add(4)
+	wg.Add(14)
 	go func() {
 		testStore.Has("test key")
 		wg.Done()
@@ -191,11 +1016,250 @@ func (suite *storeLockingTestSuite) TestLocking() {
 		testStore.Put("test key", "test value")
 		wg.Done()
 	}()
+	go func() {
+		testStore.PutWithTTL("test key", "test value", time.Minute)
+		wg.Done()
+	}()
 	go func() {
 		testStore.Delete("test key")
 		wg.Done()
 	}()
+	go func() {
+		testStore.DeleteExpired()
+		wg.Done()
+	}()
+	go func() {
+		testStore.Stats()
+		wg.Done()
+	}()
+	go func() {
+		testStore.CompareAndSwap("test key", "test value", "new test value")
+		wg.Done()
+	}()
+	go func() {
+		testStore.Increment("test counter", 1)
+		wg.Done()
+	}()
+	go func() {
+		testStore.Entries()
+		wg.Done()
+	}()
+	go func() {
+		testStore.Scan("test", "", 10)
+		wg.Done()
+	}()
+	go func() {
+		testStore.MultiGet([]string{"test key", "other key"})
+		wg.Done()
+	}()
+	go func() {
+		testStore.MultiPut(map[string]string{"test key": "test value", "other key": "test value"}, 0)
+		wg.Done()
+	}()
+	go func() {
+		testStore.MultiDelete([]string{"test key", "other key"})
+		wg.Done()
+	}()
+	wg.Wait()
+}
+
+func (suite *storeLockingTestSuite) TestIncrementAtomicity() {
+
+	testStore := suite.createStore()
+
+	var wg sync.WaitGroup
+	goroutines, increments := 8, 100
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				testStore.Increment("test key", 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, _ := testStore.Get("test key")
+	require.Equal(suite.T(), fmt.Sprint(goroutines*increments), value)
+}
+
+func (suite *storeLockingTestSuite) TestCompareAndSwapAtomicity() {
+
+	testStore := suite.createStore()
+	testStore.Put("test key", "0")
+
+	// Increment a counter from several goroutines, retrying when another
+	// goroutine changes the value between reading and swapping
+	var wg sync.WaitGroup
+	goroutines, increments := 8, 100
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				for {
+					current, _ := testStore.Get("test key")
+					var count int
+					fmt.Sscan(current, &count)
+					if _, swapped := testStore.CompareAndSwap("test key", current, fmt.Sprint(count+1)); swapped {
+						break
+					}
+				}
+			}
+		}()
+	}
 	wg.Wait()
+
+	value, _ := testStore.Get("test key")
+	require.Equal(suite.T(), fmt.Sprint(goroutines*increments), value)
+}
+
+func (suite *storeLockingTestSuite) TestScanConsistency() {
+
+	testStore := suite.createStore()
+	for i := 0; i < 1000; i++ {
+		testStore.Put(fmt.Sprintf("test key %04d", i), "test value")
+	}
+
+	// Other keys are written and deleted while scanning, and the existing keys
+	// are overwritten
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				key := fmt.Sprintf("test key %04d new", i%1000)
+				testStore.Put(key, "test value")
+				testStore.Put(fmt.Sprintf("test key %04d", i%1000), "new test value")
+				testStore.Delete(key)
+			}
+		}
+	}()
+
+	seen := make(map[string]int)
+	cursor := ""
+	for {
+		var keys []string
+		keys, cursor = testStore.Scan("test key", cursor, 10)
+		for _, key := range keys {
+			seen[key]++
+		}
+		if cursor == "" {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	for key, count := range seen {
+		require.Equal(suite.T(), 1, count, key)
+	}
+	for i := 0; i < 1000; i++ {
+		require.Contains(suite.T(), seen, fmt.Sprintf("test key %04d", i))
+	}
+}
+
+// TestBatchAtomicity checks that a reader never sees part of a batch, in the
+// stores that apply batches atomically
+func TestBatchAtomicity(t *testing.T) {
+	for name, createStore := range map[string]func() store.Store{
+		"mutex":         createStoreWithMutexDecorator,
+		"rwmutex":       createStoreWithRWMutexDecorator,
+		"copy on write": createCopyOnWriteStore,
+	} {
+		t.Run(name, func(t *testing.T) {
+			testStore := createStore()
+			keys := []string{"test key 1", "test key 2", "test key 3"}
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					value := fmt.Sprint(i)
+					testStore.MultiPut(map[string]string{
+						keys[0]: value,
+						keys[1]: value,
+						keys[2]: value,
+					}, 0)
+				}
+			}()
+			for i := 0; i < 1000; i++ {
+				values := testStore.MultiGet(keys)
+				if len(values) == 0 {
+					continue
+				}
+				require.Len(t, values, len(keys))
+				require.Equal(t, values[keys[0]], values[keys[1]])
+				require.Equal(t, values[keys[0]], values[keys[2]])
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// TestSyncMapStoreSweep checks that a sweep never deletes a value that was
+// written after it saw the expired one
+func TestSyncMapStoreSweep(t *testing.T) {
+	clock := newFakeClock()
+	testStore := store.NewSyncMapStore(store.UseClock(clock))
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				testStore.DeleteExpired()
+			}
+		}
+	}()
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("test key %03d", i)
+	}
+	for i := 0; i < 100; i++ {
+		for _, key := range keys {
+			testStore.PutWithTTL(key, "test value", time.Second)
+		}
+		clock.Advance(time.Second)
+		for _, key := range keys {
+			testStore.Put(key, "new test value")
+		}
+		for _, key := range keys {
+			require.True(t, testStore.Has(key), key)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	require.Equal(t, store.Stats{
+		Entries: len(keys),
+		Bytes:   int64(len(keys) * (len("test key 000") + len("new test value"))),
+	}, testStore.Stats())
+}
+
+func TestSweeper(t *testing.T) {
+	mockStore := new(store.MockStore)
+	mockStore.On("DeleteExpired").Return([]string{"test key"})
+
+	clock := newFakeClock()
+	sweeper := store.StartSweeper(mockStore, clock, time.Second)
+	clock.Advance(time.Second)
+	clock.Advance(time.Second)
+	sweeper.Stop()
+
+	mockStore.AssertNumberOfCalls(t, "DeleteExpired", 2)
 }
 
 func TestMutexDecoratorLocking(t *testing.T) {
@@ -210,6 +1274,30 @@ func TestRWMutexDecoratorLocking(t *testing.T) {
 	})
 }
 
+func TestLRUDecoratorLocking(t *testing.T) {
+	suite.Run(t, &storeLockingTestSuite{
+		createStore: createStoreWithLRUDecorator,
+	})
+}
+
+func TestShardedStoreLocking(t *testing.T) {
+	suite.Run(t, &storeLockingTestSuite{
+		createStore: createShardedStore,
+	})
+}
+
+func TestSyncMapStoreLocking(t *testing.T) {
+	suite.Run(t, &storeLockingTestSuite{
+		createStore: createSyncMapStore,
+	})
+}
+
+func TestCopyOnWriteStoreLocking(t *testing.T) {
+	suite.Run(t, &storeLockingTestSuite{
+		createStore: createCopyOnWriteStore,
+	})
+}
+
 func benchmarkHas(b *testing.B, createStore func() store.Store) {
 	b.Run("serial miss", func(b *testing.B) {
 		testStore := createStore()
@@ -443,6 +1531,37 @@ func benchmarkReadWrite(b *testing.B, createStore func() store.Store) {
 	}
 }
 
+// benchmarkReadWriteManyKeys is like benchmarkReadWrite, but spreads the
+// operations over many keys, as a single key would all go to one shard
+func benchmarkReadWriteManyKeys(b *testing.B, createStore func() store.Store) {
+	testKeys := make([]string, 1024)
+	for i := range testKeys {
+		testKeys[i] = fmt.Sprintf("test key %v", i)
+	}
+	testValue := "test value"
+
+	// Test 0% to 100% reads in increments of 10%
+	for i := 0; i <= 10; i++ {
+		b.Run(fmt.Sprintf("%v%% reads", i*10), func(b *testing.B) {
+			testStore := createStore()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				index := rand.Intn(len(testKeys))
+				for pb.Next() {
+					index = (index + 1) % len(testKeys)
+					if i > rand.Intn(10) {
+						// Read
+						testStore.Get(testKeys[index])
+					} else {
+						// Write
+						testStore.Put(testKeys[index], testValue)
+					}
+				}
+			})
+		})
+	}
+}
+
 func BenchmarkDefaultStoreHas(b *testing.B) {
 	benchmarkHas(b, createDefaultStore)
 }
@@ -479,6 +1598,10 @@ func BenchmarkMutexDecoratorReadWrite(b *testing.B) {
 	benchmarkReadWrite(b, createStoreWithMutexDecorator)
 }
 
+func BenchmarkMutexDecoratorReadWriteManyKeys(b *testing.B) {
+	benchmarkReadWriteManyKeys(b, createStoreWithMutexDecorator)
+}
+
 func BenchmarkRWMutexDecoratorHas(b *testing.B) {
 	benchmarkHas(b, createStoreWithRWMutexDecorator)
 }
@@ -498,3 +1621,99 @@ func BenchmarkRWMutexDecoratorDelete(b *testing.B) {
 func BenchmarkRWMutexDecoratorReadWrite(b *testing.B) {
 	benchmarkReadWrite(b, createStoreWithRWMutexDecorator)
 }
+
+func BenchmarkRWMutexDecoratorReadWriteManyKeys(b *testing.B) {
+	benchmarkReadWriteManyKeys(b, createStoreWithRWMutexDecorator)
+}
+
+func BenchmarkLRUDecoratorHas(b *testing.B) {
+	benchmarkHas(b, createStoreWithLRUDecorator)
+}
+
+func BenchmarkLRUDecoratorGet(b *testing.B) {
+	benchmarkGet(b, createStoreWithLRUDecorator)
+}
+
+func BenchmarkLRUDecoratorPut(b *testing.B) {
+	benchmarkPut(b, createStoreWithLRUDecorator, true)
+}
+
+func BenchmarkLRUDecoratorDelete(b *testing.B) {
+	benchmarkDelete(b, createStoreWithLRUDecorator, true)
+}
+
+func BenchmarkLRUDecoratorReadWrite(b *testing.B) {
+	benchmarkReadWrite(b, createStoreWithLRUDecorator)
+}
+
+func BenchmarkShardedStoreHas(b *testing.B) {
+	benchmarkHas(b, createShardedStore)
+}
+
+func BenchmarkShardedStoreGet(b *testing.B) {
+	benchmarkGet(b, createShardedStore)
+}
+
+func BenchmarkShardedStorePut(b *testing.B) {
+	benchmarkPut(b, createShardedStore, true)
+}
+
+func BenchmarkShardedStoreDelete(b *testing.B) {
+	benchmarkDelete(b, createShardedStore, true)
+}
+
+func BenchmarkShardedStoreReadWrite(b *testing.B) {
+	benchmarkReadWrite(b, createShardedStore)
+}
+
+func BenchmarkShardedStoreReadWriteManyKeys(b *testing.B) {
+	benchmarkReadWriteManyKeys(b, createShardedStore)
+}
+
+func BenchmarkSyncMapStoreHas(b *testing.B) {
+	benchmarkHas(b, createSyncMapStore)
+}
+
+func BenchmarkSyncMapStoreGet(b *testing.B) {
+	benchmarkGet(b, createSyncMapStore)
+}
+
+func BenchmarkSyncMapStorePut(b *testing.B) {
+	benchmarkPut(b, createSyncMapStore, true)
+}
+
+func BenchmarkSyncMapStoreDelete(b *testing.B) {
+	benchmarkDelete(b, createSyncMapStore, true)
+}
+
+func BenchmarkSyncMapStoreReadWrite(b *testing.B) {
+	benchmarkReadWrite(b, createSyncMapStore)
+}
+
+func BenchmarkSyncMapStoreReadWriteManyKeys(b *testing.B) {
+	benchmarkReadWriteManyKeys(b, createSyncMapStore)
+}
+
+func BenchmarkCopyOnWriteStoreHas(b *testing.B) {
+	benchmarkHas(b, createCopyOnWriteStore)
+}
+
+func BenchmarkCopyOnWriteStoreGet(b *testing.B) {
+	benchmarkGet(b, createCopyOnWriteStore)
+}
+
+func BenchmarkCopyOnWriteStorePut(b *testing.B) {
+	benchmarkPut(b, createCopyOnWriteStore, true)
+}
+
+func BenchmarkCopyOnWriteStoreDelete(b *testing.B) {
+	benchmarkDelete(b, createCopyOnWriteStore, true)
+}
+
+func BenchmarkCopyOnWriteStoreReadWrite(b *testing.B) {
+	benchmarkReadWrite(b, createCopyOnWriteStore)
+}
+
+func BenchmarkCopyOnWriteStoreReadWriteManyKeys(b *testing.B) {
+	benchmarkReadWriteManyKeys(b, createCopyOnWriteStore)
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"time"
+)
+
+// Sweeper periodically removes expired entries from a store.
+type Sweeper struct {
+	store  Store
+	ticker Ticker
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// StartSweeper starts sweeping the store at the given interval. The store
+// should be the outermost decorator, so that sweeps are protected by the same
+// lock as every other operation.
+func StartSweeper(store Store, clock Clock, interval time.Duration) *Sweeper {
+	s := &Sweeper{
+		store:  store,
+		ticker: clock.NewTicker(interval),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Sweeper) run() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.ticker.C():
+			s.store.DeleteExpired()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the sweeper, and waits for any sweep in progress to finish.
+func (s *Sweeper) Stop() {
+	s.ticker.Stop()
+	close(s.stop)
+	<-s.done
+}
@@ -0,0 +1,313 @@
+package store
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+type syncMapEntry struct {
+	value  string
+	expiry time.Time // Zero if the entry never expires
+}
+
+// removedEntry marks a cell that has been, or is about to be, taken out of the
+// map. Writers that find it wait for the key to be gone and add a new cell.
+var removedEntry = unsafe.Pointer(new(syncMapEntry))
+
+// syncMapCell holds the current entry for a key. Entries are never changed,
+// only swapped, so writers can tell whether another writer got there first.
+type syncMapCell struct {
+	entry unsafe.Pointer // *syncMapEntry, or removedEntry
+}
+
+type syncMapStore struct {
+	entries  int64    // Updated atomically
+	bytes    int64    // Updated atomically
+	contents sync.Map // Values are *syncMapCell
+	clock    Clock
+}
+
+// NewSyncMapStore creates a store backed by sync.Map. Readers never block, and
+// writers only retry when another writer changes the same key first. Byte
+// budgets are not supported.
+func NewSyncMapStore(options ...Option) Store {
+	return &syncMapStore{
+		clock: newConfig(options).clock,
+	}
+}
+
+func NewSyncMapStoreWithContents(contents map[string]string, options ...Option) Store {
+	s := NewSyncMapStore(options...)
+	for k, v := range contents {
+		s.Put(k, v)
+	}
+	return s
+}
+
+// current returns the cell's entry, or nil if the cell has been removed
+func (c *syncMapCell) current() *syncMapEntry {
+	entry := atomic.LoadPointer(&c.entry)
+	if entry == removedEntry {
+		return nil
+	}
+	return (*syncMapEntry)(entry)
+}
+
+func (s *syncMapStore) expired(entry *syncMapEntry, now time.Time) bool {
+	return !entry.expiry.IsZero() && !now.Before(entry.expiry)
+}
+
+func (s *syncMapStore) load(key string) (*syncMapEntry, bool) {
+	value, ok := s.contents.Load(key)
+	if !ok {
+		return nil, false
+	}
+	entry := value.(*syncMapCell).current()
+	if entry == nil || s.expired(entry, s.clock.Now()) {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (s *syncMapStore) Has(key string) bool {
+	_, ok := s.load(key)
+	return ok
+}
+
+func (s *syncMapStore) Get(key string) (string, bool) {
+	entry, ok := s.load(key)
+	return s.valueOf(entry), ok
+}
+
+// valueOf returns the value of an entry, or an empty string for a missing entry
+func (s *syncMapStore) valueOf(entry *syncMapEntry) string {
+	if entry == nil {
+		return ""
+	}
+	return entry.value
+}
+
+func (s *syncMapStore) GetEntry(key string) (Entry, bool) {
+	entry, ok := s.load(key)
+	if !ok {
+		return Entry{}, false
+	}
+	return Entry{Value: entry.value, Expiry: entry.expiry}, true
+}
+
+func (s *syncMapStore) Put(key, value string) {
+	s.PutWithTTL(key, value, 0)
+}
+
+func (s *syncMapStore) PutWithTTL(key, value string, ttl time.Duration) {
+	entry := &syncMapEntry{
+		value: value,
+	}
+	if ttl > 0 {
+		entry.expiry = s.clock.Now().Add(ttl)
+	}
+	s.update(key, func(*syncMapEntry) (*syncMapEntry, bool) {
+		return entry, true
+	})
+}
+
+func (s *syncMapStore) Delete(key string) {
+	s.update(key, func(*syncMapEntry) (*syncMapEntry, bool) {
+		return nil, true
+	})
+}
+
+// MultiGet doesn't block writers, so the values may come from before and after
+// a concurrent batch
+func (s *syncMapStore) MultiGet(keys []string) map[string]string {
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if entry, ok := s.load(key); ok {
+			values[key] = entry.value
+		}
+	}
+	return values
+}
+
+// MultiPut writes each key on its own, so the keys of concurrent batches may
+// end up with values from different batches
+func (s *syncMapStore) MultiPut(entries map[string]string, ttl time.Duration) {
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = s.clock.Now().Add(ttl)
+	}
+	for key, value := range entries {
+		entry := &syncMapEntry{
+			value:  value,
+			expiry: expiry,
+		}
+		s.update(key, func(*syncMapEntry) (*syncMapEntry, bool) {
+			return entry, true
+		})
+	}
+}
+
+func (s *syncMapStore) MultiDelete(keys []string) {
+	for _, key := range keys {
+		s.Delete(key)
+	}
+}
+
+func (s *syncMapStore) CompareAndSwap(key, expected, value string) (string, bool) {
+	var current string
+	var swapped bool
+	s.update(key, func(entry *syncMapEntry) (*syncMapEntry, bool) {
+		if entry == nil || entry.value != expected {
+			current, swapped = s.valueOf(entry), false
+			return nil, false
+		}
+		current, swapped = value, true
+		return &syncMapEntry{
+			value:  value,
+			expiry: entry.expiry,
+		}, true
+	})
+	return current, swapped
+}
+
+func (s *syncMapStore) Increment(key string, delta int64) (int64, error) {
+	var value int64
+	var err error
+	s.update(key, func(entry *syncMapEntry) (*syncMapEntry, bool) {
+		value, err = increment(s.valueOf(entry), entry != nil, delta)
+		if err != nil {
+			return nil, false
+		}
+		next := &syncMapEntry{
+			value: strconv.FormatInt(value, 10),
+		}
+		if entry != nil {
+			next.expiry = entry.expiry
+		}
+		return next, true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// DeleteExpired only removes an entry if it is still the expired one, so a
+// value written after the sweep saw the key is kept
+func (s *syncMapStore) DeleteExpired() []string {
+	var keys []string
+	now := s.clock.Now()
+	s.contents.Range(func(key, value interface{}) bool {
+		cell := value.(*syncMapCell)
+		entry := cell.current()
+		if entry != nil && s.expired(entry, now) && s.remove(key.(string), cell, entry) {
+			keys = append(keys, key.(string))
+		}
+		return true
+	})
+	return keys
+}
+
+func (s *syncMapStore) Entries() map[string]Entry {
+	entries := make(map[string]Entry)
+	now := s.clock.Now()
+	s.contents.Range(func(key, value interface{}) bool {
+		entry := value.(*syncMapCell).current()
+		if entry != nil && !s.expired(entry, now) {
+			entries[key.(string)] = Entry{
+				Value:  entry.value,
+				Expiry: entry.expiry,
+			}
+		}
+		return true
+	})
+	return entries
+}
+
+// Scan doesn't block writers. Range visits every key that isn't stored or
+// deleted during the scan.
+func (s *syncMapStore) Scan(prefix, cursor string, limit int) ([]string, string) {
+	page := newScanPage(limit)
+	now := s.clock.Now()
+	s.contents.Range(func(key, value interface{}) bool {
+		entry := value.(*syncMapCell).current()
+		if scanMatches(key.(string), prefix, cursor) && entry != nil && !s.expired(entry, now) {
+			page.add(key.(string))
+		}
+		return true
+	})
+	return page.keys()
+}
+
+func (s *syncMapStore) Stats() Stats {
+	return Stats{
+		Entries: int(atomic.LoadInt64(&s.entries)),
+		Bytes:   atomic.LoadInt64(&s.bytes),
+	}
+}
+
+// update changes the entry for a key. Change is given the current entry, or
+// nil if the key is missing or expired, and returns the new entry, or nil to
+// delete the key, and whether to write it at all. If another writer changes
+// the key first, change is called again with its entry.
+func (s *syncMapStore) update(key string, change func(*syncMapEntry) (*syncMapEntry, bool)) {
+	for {
+		value, ok := s.contents.Load(key)
+		if !ok {
+			next, write := change(nil)
+			if !write || next == nil {
+				return
+			}
+			cell := &syncMapCell{entry: unsafe.Pointer(next)}
+			if _, loaded := s.contents.LoadOrStore(key, cell); loaded {
+				continue
+			}
+			atomic.AddInt64(&s.entries, 1)
+			atomic.AddInt64(&s.bytes, entrySize(key, next.value))
+			return
+		}
+
+		cell := value.(*syncMapCell)
+		entry := cell.current()
+		if entry == nil {
+			// The key is being removed, and will be gone shortly
+			runtime.Gosched()
+			continue
+		}
+		current := entry
+		if s.expired(entry, s.clock.Now()) {
+			current = nil
+		}
+		next, write := change(current)
+		if !write {
+			return
+		}
+		if next == nil {
+			if s.remove(key, cell, entry) {
+				return
+			}
+			continue
+		}
+		if atomic.CompareAndSwapPointer(&cell.entry, unsafe.Pointer(entry), unsafe.Pointer(next)) {
+			atomic.AddInt64(&s.bytes, entrySize(key, next.value)-entrySize(key, entry.value))
+			return
+		}
+	}
+}
+
+// remove takes the cell out of the map if its entry is still the given one,
+// and updates the stats. While the cell is marked as removed, no other cell
+// can be stored for the key, so deleting the key deletes this cell.
+func (s *syncMapStore) remove(key string, cell *syncMapCell, entry *syncMapEntry) bool {
+	if !atomic.CompareAndSwapPointer(&cell.entry, unsafe.Pointer(entry), removedEntry) {
+		return false
+	}
+	s.contents.Delete(key)
+	atomic.AddInt64(&s.entries, -1)
+	atomic.AddInt64(&s.bytes, -entrySize(key, entry.value))
+	return true
+}
@@ -0,0 +1,226 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Files are the paths of the PEM encoded files used for one side of a TLS
+// connection
+type Files struct {
+	Cert string
+	Key  string
+	// CA is the certificate authority the other side's certificate must be
+	// signed by. Servers only ask for client certificates when it is set, and
+	// clients use the system roots when it isn't.
+	CA string
+}
+
+// fileState identifies a version of a file, so that changes can be noticed
+// without reading it
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Reloader serves a certificate, and the CA for client certificates, from
+// files that are reloaded whenever they change. The files are checked before
+// each handshake, and a version that fails to load is logged while the
+// previous one continues to be served.
+type Reloader struct {
+	mutex       sync.Mutex
+	files       Files
+	logger      *log.Logger
+	states      []fileState
+	certificate tls.Certificate
+	clientCAs   *x509.CertPool // Nil if client certificates aren't verified
+}
+
+// NewReloader loads the files, failing if they aren't valid
+func NewReloader(files Files, logger *log.Logger) (*Reloader, error) {
+	if files.Cert == "" || files.Key == "" {
+		return nil, errors.New("a certificate and key are required")
+	}
+	r := &Reloader{
+		files:  files,
+		logger: logger,
+	}
+	r.states = r.stat()
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ServerConfig returns a TLS config for a gRPC server. Clients must present a
+// certificate signed by the CA if there is one.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return r.serverConfig("h2")
+}
+
+// HTTPServerConfig returns a TLS config like ServerConfig's for an HTTP
+// server, which also accepts HTTP/1.1
+func (r *Reloader) HTTPServerConfig() *tls.Config {
+	return r.serverConfig("h2", "http/1.1")
+}
+
+// StreamServerConfig returns a TLS config like ServerConfig's for a server
+// of a protocol without ALPN negotiation, such as the Redis protocol
+func (r *Reloader) StreamServerConfig() *tls.Config {
+	return r.serverConfig()
+}
+
+func (r *Reloader) serverConfig(protocols ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.reloadIfChanged()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   protocols,
+				Certificates: []tls.Certificate{r.certificate},
+			}
+			if r.clientCAs != nil {
+				config.ClientCAs = r.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// PeerConfig returns a TLS config for connecting to a server that uses the
+// same files, such as another node of a cluster. The server's certificate must
+// be signed by the CA, and the current certificate is presented as the
+// client's. The config is only valid for one connection, as the files may
+// have changed by the next.
+func (r *Reloader) PeerConfig() *tls.Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reloadIfChanged()
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{r.certificate},
+		RootCAs:      r.clientCAs,
+	}
+}
+
+// Reload loads the files again, even if they haven't changed
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.states = r.stat()
+	return r.load()
+}
+
+// reloadIfChanged loads the files again if any of them have changed since
+// they were last loaded. The mutex must be held.
+func (r *Reloader) reloadIfChanged() {
+	states := r.stat()
+	changed := false
+	for i := range states {
+		if states[i] != r.states[i] {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	// The new states are kept even if loading fails, so that a half-written
+	// set of files is only reported once, and is loaded as soon as it is
+	// complete
+	r.states = states
+	if err := r.load(); err != nil {
+		r.logger.Printf("Failed to reload TLS certificate, keeping the previous one: %v", err)
+		return
+	}
+	r.logger.Print("Reloaded TLS certificate")
+}
+
+// stat returns the state of the certificate, key and CA files. Files that
+// can't be read are given a zero state, so that they are retried once they
+// reappear.
+func (r *Reloader) stat() []fileState {
+	paths := []string{r.files.Cert, r.files.Key, r.files.CA}
+	states := make([]fileState, len(paths))
+	for i, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			states[i] = fileState{
+				modTime: info.ModTime(),
+				size:    info.Size(),
+			}
+		}
+	}
+	return states
+}
+
+// load reads the files, only replacing the current certificate and CA if they
+// are all valid. The mutex must be held.
+func (r *Reloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(r.files.Cert, r.files.Key)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if r.files.CA != "" {
+		clientCAs, err = loadCertPool(r.files.CA)
+		if err != nil {
+			return err
+		}
+	}
+	r.certificate = certificate
+	r.clientCAs = clientCAs
+	return nil
+}
+
+// ClientConfig returns a TLS config for a gRPC client. The server's
+// certificate must be signed by the CA, or by a system root if there is no CA,
+// and the client presents its own certificate if there is one.
+func ClientConfig(files Files, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if (files.Cert == "") != (files.Key == "") {
+		return nil, errors.New("a client certificate and key must be given together")
+	}
+	if files.Cert != "" {
+		certificate, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if files.CA != "" {
+		rootCAs, err := loadCertPool(files.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = rootCAs
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %v", path)
+	}
+	return pool, nil
+}
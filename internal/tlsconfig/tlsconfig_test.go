@@ -0,0 +1,282 @@
+package tlsconfig_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/Matt-Kelly-/go-memory-cache/internal/tlsconfig"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type authority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+var serial int64
+
+// issue creates a certificate signed by the authority, or a self-signed CA
+// certificate if the authority is nil. It returns the PEM encoded certificate
+// and key.
+func issue(t *testing.T, ca *authority, name string) (*authority, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = ca.certificate, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.Nil(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return &authority{certificate: certificate, key: key, pem: certPEM}, certPEM, keyPEM
+}
+
+func newAuthority(t *testing.T) *authority {
+	ca, _, _ := issue(t, nil, "Test CA")
+	return ca
+}
+
+// writeFile writes a file with a modification time that is always newer than
+// the last write, so that changes are noticed even with coarse timestamps
+func writeFile(t *testing.T, path string, data []byte) {
+	require.Nil(t, ioutil.WriteFile(path, data, 0600))
+	modTime := time.Now()
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	serial++
+	modTime = modTime.Add(time.Duration(serial) * time.Second)
+	require.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+// writeCertificate issues a certificate for a name and writes it to files in
+// the directory
+func writeCertificate(t *testing.T, dir string, ca *authority, name string) tlsconfig.Files {
+	_, certPEM, keyPEM := issue(t, ca, name)
+	files := tlsconfig.Files{
+		Cert: filepath.Join(dir, name+".pem"),
+		Key:  filepath.Join(dir, name+"-key.pem"),
+	}
+	writeFile(t, files.Cert, certPEM)
+	writeFile(t, files.Key, keyPEM)
+	return files
+}
+
+// writeCA writes a bundle of CA certificates
+func writeCA(t *testing.T, path string, cas ...*authority) string {
+	var bundle []byte
+	for _, ca := range cas {
+		bundle = append(bundle, ca.pem...)
+	}
+	writeFile(t, path, bundle)
+	return path
+}
+
+// serveTLS starts a server with the health service, and returns a function
+// that checks its health with a new connection using the client config
+func serveTLS(t *testing.T, reloader *tlsconfig.Reloader) func(*tls.Config) error {
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(reloader.ServerConfig())))
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	return func(config *tls.Config) error {
+		var creds grpc.DialOption
+		if config == nil {
+			creds = grpc.WithInsecure()
+		} else {
+			creds = grpc.WithTransportCredentials(credentials.NewTLS(config))
+		}
+		conn, err := grpc.Dial("bufnet", creds, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.Dial()
+		}))
+		require.Nil(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		return err
+	}
+}
+
+func clientConfig(t *testing.T, files tlsconfig.Files) *tls.Config {
+	config, err := tlsconfig.ClientConfig(files, "localhost")
+	require.Nil(t, err)
+	return config
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	reloader, err := tlsconfig.NewReloader(writeCertificate(t, dir, ca, "localhost"), log.New(ioutil.Discard, "", 0))
+	require.Nil(t, err)
+	check := serveTLS(t, reloader)
+
+	caPath := writeCA(t, filepath.Join(dir, "ca.pem"), ca)
+	require.Nil(t, check(clientConfig(t, tlsconfig.Files{CA: caPath})))
+
+	// Plaintext and untrusted servers are rejected
+	require.NotNil(t, check(nil))
+	otherCAPath := writeCA(t, filepath.Join(dir, "other-ca.pem"), newAuthority(t))
+	require.NotNil(t, check(clientConfig(t, tlsconfig.Files{CA: otherCAPath})))
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	caPath := writeCA(t, filepath.Join(dir, "ca.pem"), ca)
+	serverFiles := writeCertificate(t, dir, ca, "localhost")
+	serverFiles.CA = caPath
+	reloader, err := tlsconfig.NewReloader(serverFiles, log.New(ioutil.Discard, "", 0))
+	require.Nil(t, err)
+	check := serveTLS(t, reloader)
+
+	clientFiles := writeCertificate(t, dir, ca, "client")
+	clientFiles.CA = caPath
+	require.Nil(t, check(clientConfig(t, clientFiles)))
+
+	// Clients without a certificate, or with one from another CA, are rejected
+	require.NotNil(t, check(clientConfig(t, tlsconfig.Files{CA: caPath})))
+	otherFiles := writeCertificate(t, dir, newAuthority(t), "other")
+	otherFiles.CA = caPath
+	require.NotNil(t, check(clientConfig(t, otherFiles)))
+}
+
+func TestStreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	caPath := writeCA(t, filepath.Join(dir, "ca.pem"), ca)
+	serverFiles := writeCertificate(t, dir, ca, "localhost")
+	serverFiles.CA = caPath
+	reloader, err := tlsconfig.NewReloader(serverFiles, log.New(ioutil.Discard, "", 0))
+	require.Nil(t, err)
+
+	// Text protocol clients don't negotiate a protocol. With TLS 1.3, a
+	// rejected client certificate is only reported on the first read.
+	handshake := func(config *tls.Config) error {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go func() {
+			server := tls.Server(serverConn, reloader.StreamServerConfig())
+			if server.Handshake() == nil {
+				server.Write([]byte("+"))
+			}
+			serverConn.Close()
+		}()
+		config.NextProtos = nil
+		_, err := tls.Client(clientConn, config).Read(make([]byte, 1))
+		return err
+	}
+	clientFiles := writeCertificate(t, dir, ca, "client")
+	clientFiles.CA = caPath
+	require.Nil(t, handshake(clientConfig(t, clientFiles)))
+	require.NotNil(t, handshake(clientConfig(t, tlsconfig.Files{CA: caPath})))
+
+	// Peers present their own certificate, and verify the other's with the CA
+	peerConfig := reloader.PeerConfig()
+	peerConfig.ServerName = "localhost"
+	require.Nil(t, handshake(peerConfig))
+	otherFiles := writeCertificate(t, dir, newAuthority(t), "other")
+	otherFiles.CA = caPath
+	otherReloader, err := tlsconfig.NewReloader(otherFiles, log.New(ioutil.Discard, "", 0))
+	require.Nil(t, err)
+	peerConfig = otherReloader.PeerConfig()
+	peerConfig.ServerName = "localhost"
+	require.NotNil(t, handshake(peerConfig))
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	oldCA, newCA := newAuthority(t), newAuthority(t)
+	oldCAPath := writeCA(t, filepath.Join(dir, "old-ca.pem"), oldCA)
+	newCAPath := writeCA(t, filepath.Join(dir, "new-ca.pem"), newCA)
+
+	serverFiles := writeCertificate(t, dir, oldCA, "localhost")
+	serverFiles.CA = writeCA(t, filepath.Join(dir, "client-ca.pem"), oldCA)
+	var logs bytes.Buffer
+	reloader, err := tlsconfig.NewReloader(serverFiles, log.New(&logs, "", 0))
+	require.Nil(t, err)
+	check := serveTLS(t, reloader)
+
+	oldClient := writeCertificate(t, dir, oldCA, "old-client")
+	oldClient.CA = oldCAPath
+	newClient := writeCertificate(t, dir, newCA, "new-client")
+	newClient.CA = newCAPath
+	require.Nil(t, check(clientConfig(t, oldClient)))
+	require.NotNil(t, check(clientConfig(t, newClient)))
+
+	// Rotate the server certificate and the client CA to the new CA
+	_, certPEM, keyPEM := issue(t, newCA, "localhost")
+	writeFile(t, serverFiles.Cert, certPEM)
+	writeFile(t, serverFiles.Key, keyPEM)
+	writeCA(t, serverFiles.CA, newCA)
+	require.Nil(t, check(clientConfig(t, newClient)))
+	require.NotNil(t, check(clientConfig(t, oldClient)))
+	require.Contains(t, logs.String(), "Reloaded TLS certificate")
+
+	// A certificate that doesn't match its key is reported, and the previous
+	// one is still served
+	_, certPEM, _ = issue(t, newCA, "localhost")
+	writeFile(t, serverFiles.Cert, certPEM)
+	require.Nil(t, check(clientConfig(t, newClient)))
+	require.Contains(t, logs.String(), "Failed to reload TLS certificate")
+	require.NotNil(t, reloader.Reload())
+}
+
+func TestReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := tlsconfig.NewReloader(tlsconfig.Files{}, log.New(ioutil.Discard, "", 0))
+	require.NotNil(t, err)
+
+	files := writeCertificate(t, dir, newAuthority(t), "localhost")
+	files.CA = filepath.Join(dir, "missing.pem")
+	_, err = tlsconfig.NewReloader(files, log.New(ioutil.Discard, "", 0))
+	require.NotNil(t, err)
+
+	files.CA = writeCA(t, filepath.Join(dir, "empty.pem"))
+	_, err = tlsconfig.NewReloader(files, log.New(ioutil.Discard, "", 0))
+	require.EqualError(t, err, "no certificates found in "+files.CA)
+
+	_, err = tlsconfig.ClientConfig(tlsconfig.Files{Cert: files.Cert}, "localhost")
+	require.NotNil(t, err)
+}